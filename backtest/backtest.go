@@ -0,0 +1,348 @@
+/*
+ * 過去のロウソク足でbotの売買ロジックを再生するbacktest。
+ * 判定はbotのframeと同じく、Param.Strategyで選んだstrategyの戦略を使う。
+ * フレームは各足の確定時に1回。現在価格はその足の終値(mid)とし、spread・slippageを乗せて約定させる。
+ * 戦略に渡すbid,askはmidからspreadの半分ずつずらしたもの。足のBid,Askが無ければ同様に求める。
+ * 利確・損切はoanda-simと同じく、次の足以降の高値・安値で約定判定する。同じ足で両方に届いた場合は損切を優先。
+ * 口座通貨はInstrumentのquote通貨と同じと仮定する。
+ */
+
+package backtest
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/sizing"
+	"github.com/zenryokukun/oanda-bot/strategy"
+)
+
+type (
+	Config struct {
+		Param *strategy.Param
+		// 売買判定。nilならParam.Strategyの戦略
+		Strategy strategy.Strategy
+		// 新規取引の量。nilならParam.Unitsの固定量。botと合わせるならparam.jsonのSizingから作る
+		Sizer sizing.Sizer
+		// 価格の桁数とunitsの上下限。nilなら丸めない
+		Instrument *oanda.Instrument
+		Spread     float64 // ask-bid。midの上下に半分ずつ乗せる。Param.Spreadを超えると取引しない
+		Slippage   float64 // 成行き注文が不利な方向にずれる価格幅
+		Balance    float64 // 初期残高
+	}
+
+	// 決済済みの取引
+	Trade struct {
+		Side       string // "BUY","SELL"
+		Units      int
+		OpenTime   time.Time
+		OpenPrice  float64
+		CloseTime  time.Time
+		ClosePrice float64
+		// "SIGNAL":逆向きのブレイクで決済 "TAKE_PROFIT","STOP_LOSS":利確・損切注文 "END":データの終わり
+		Reason string
+		PL     float64
+	}
+
+	// フレーム毎の残高と評価額込みの残高
+	Point struct {
+		Time    time.Time
+		Balance float64
+		Equity  float64
+	}
+
+	Summary struct {
+		Trades       int
+		Wins         int
+		Losses       int
+		WinRate      float64
+		GrossProfit  float64
+		GrossLoss    float64 // 負の値
+		NetPL        float64
+		ProfitFactor float64 // GrossProfit/-GrossLoss。損失が無い場合は0
+		AvgWin       float64
+		AvgLoss      float64
+		// 評価額込みの残高の、最高値からの最大下落幅と率
+		MaxDrawdown     float64
+		MaxDrawdownRate float64
+		FinalBalance    float64
+		Return          float64 // FinalBalance/Balance-1
+	}
+
+	Result struct {
+		Trades  []Trade
+		Equity  []Point
+		Summary Summary
+	}
+
+	// 保有中のtrade
+	position struct {
+		Trade
+		tp float64 // 0なら無し
+		sl float64
+		// 建てた足のindex。利確・損切の判定は次の足から
+		index int
+	}
+
+	engine struct {
+		cfg     Config
+		strat   strategy.Strategy
+		sizer   sizing.Sizer
+		balance float64
+		pos     *position
+		res     *Result
+	}
+)
+
+// csを古い順に再生してbacktestする。戦略のSpan本より前の足では取引しない。
+func Run(cs oanda.CandleSticks, cfg Config) (*Result, error) {
+	if cfg.Param == nil {
+		return nil, errors.New("backtest: Param is nil")
+	}
+	strat := cfg.Strategy
+	if strat == nil {
+		var err error
+		if strat, err = strategy.New(cfg.Param); err != nil {
+			return nil, err
+		}
+	}
+	sizer := cfg.Sizer
+	if sizer == nil {
+		sizer = sizing.Fixed{}
+	}
+	span := strat.Span()
+	if span <= 0 {
+		return nil, errors.New("backtest: Span must be positive")
+	}
+	e := &engine{cfg: cfg, strat: strat, sizer: sizer, balance: cfg.Balance, res: &Result{Trades: []Trade{}, Equity: []Point{}}}
+	for _, c := range cs {
+		if c.Prices == nil {
+			return nil, errors.New("backtest: candle without prices at " + c.Time.String())
+		}
+	}
+	cs = withBidAsk(cs, cfg.Spread/2)
+	for i, c := range cs {
+		e.triggerExits(i, c)
+		if i < span {
+			continue
+		}
+		e.frame(i, cs[i-span:i], c)
+	}
+	if e.pos != nil && len(cs) > 0 {
+		last := cs[len(cs)-1]
+		e.close(last.Time, e.marketPrice(e.pos.Side, last.Prices.C, false), "END")
+	}
+	e.res.Summary = summarize(e.res, cfg.Balance)
+	return e.res, nil
+}
+
+// 1フレーム分。botのframeと同じ順に、損切の移動、決済、新規取引を行う。
+// sticks:判定に使う直近Span本。c:確定したばかりの足。終値を現在価格とする。
+func (e *engine) frame(i int, sticks oanda.CandleSticks, c oanda.CandleStick) {
+	prm := e.cfg.Param
+	current := c.Prices.C
+	half := e.cfg.Spread / 2
+	in := &strategy.Input{Sticks: sticks, Current: current, Bid: current - half, Ask: current + half, Balance: e.balance, UnrealizedPL: e.unrealizedPL(current)}
+	if e.pos != nil {
+		in.Side, in.Units, in.Price = e.pos.Side, e.pos.Units, e.pos.OpenPrice
+		if in.Side == "SELL" {
+			in.Units *= -1
+		}
+	}
+	side := in.Side
+	d := e.strat.Decide(in)
+	// spreadが許容値を超えている場合、botは待っても収まらなければ取引しない
+	tradable := e.cfg.Spread <= prm.Spread
+
+	// 決済判定されていない場合は、含み益に応じて損切を建値に移動
+	if e.pos != nil && !d.Close {
+		if be := strategy.BreakevenPrice(prm, e.pos.OpenPrice, current, side, e.round); be > 0 {
+			if e.pos.sl == 0 || strategy.Tighter(side, be, e.pos.sl) {
+				e.pos.sl = be
+			}
+		}
+	}
+	if d.Close && tradable {
+		e.close(c.Time, e.marketPrice(side, current, false), "SIGNAL")
+	}
+	if len(d.Open) > 0 && e.pos == nil && tradable {
+		e.open(i, c.Time, d.Open, current, sticks)
+	}
+	e.res.Equity = append(e.res.Equity, Point{Time: c.Time, Balance: e.balance, Equity: e.balance + e.unrealizedPL(current)})
+}
+
+// Bid,Askが無い足に、Prices(mid)からhalfずつずらしたBid,Askを付けたcsのコピー。
+// 全ての足にあればcsをそのまま返す。
+func withBidAsk(cs oanda.CandleSticks, half float64) oanda.CandleSticks {
+	missing := false
+	for _, c := range cs {
+		if c.Bid == nil || c.Ask == nil {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return cs
+	}
+	shift := func(p *oanda.Hloc, d float64) *oanda.Hloc {
+		return &oanda.Hloc{O: p.O + d, H: p.H + d, L: p.L + d, C: p.C + d}
+	}
+	out := make(oanda.CandleSticks, len(cs))
+	for i, c := range cs {
+		if c.Bid == nil {
+			c.Bid = shift(c.Prices, -half)
+		}
+		if c.Ask == nil {
+			c.Ask = shift(c.Prices, half)
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// 新規の成行き注文。利確・損切は約定価格から計算する(botはreconcileExitsで約定価格に合わせる)。
+// 量はConfig.Sizerで決める。口座通貨はquote通貨と仮定しているので換算はしない。
+func (e *engine) open(i int, t time.Time, side string, current float64, sticks oanda.CandleSticks) {
+	prm := e.cfg.Param
+	units := e.sizer.Units(&sizing.Input{
+		Units:     prm.Units,
+		LossRate:  prm.LossRate,
+		Price:     current,
+		Sticks:    sticks,
+		NAV:       e.balance, // 保有ポジが無い時に呼ぶので残高=評価額込み残高
+		QuoteHome: 1,
+	})
+	if inst := e.cfg.Instrument; inst != nil {
+		units = inst.ClampUnits(units)
+	}
+	if units <= 0 {
+		return
+	}
+	p := e.marketPrice(side, current, true)
+	tp, sl := e.strat.Exits(p, side)
+	tp, sl = e.round(tp), e.round(sl)
+	e.pos = &position{
+		Trade: Trade{Side: side, Units: units, OpenTime: t, OpenPrice: p},
+		tp:    tp,
+		sl:    sl,
+		index: i,
+	}
+}
+
+func (e *engine) close(t time.Time, price float64, reason string) {
+	tr := e.pos.Trade
+	tr.CloseTime, tr.ClosePrice, tr.Reason = t, price, reason
+	tr.PL = pl(tr.Side, tr.Units, tr.OpenPrice, price)
+	e.balance += tr.PL
+	e.res.Trades = append(e.res.Trades, tr)
+	e.pos = nil
+}
+
+// 足cの値動きで利確・損切注文が約定するか判定する。
+// longはbid、shortはaskで判定し、窓を開けて注文価格を超えた場合は始値で約定する。
+func (e *engine) triggerExits(i int, c oanda.CandleStick) {
+	pos := e.pos
+	if pos == nil || i <= pos.index {
+		return
+	}
+	half := e.cfg.Spread / 2
+	p := c.Prices
+	if pos.Side == "BUY" {
+		o, h, l := p.O-half, p.H-half, p.L-half
+		if pos.sl > 0 && l <= pos.sl {
+			e.close(c.Time, math.Min(o, pos.sl), "STOP_LOSS")
+		} else if pos.tp > 0 && h >= pos.tp {
+			e.close(c.Time, math.Max(o, pos.tp), "TAKE_PROFIT")
+		}
+		return
+	}
+	o, h, l := p.O+half, p.H+half, p.L+half
+	if pos.sl > 0 && h >= pos.sl {
+		e.close(c.Time, math.Max(o, pos.sl), "STOP_LOSS")
+	} else if pos.tp > 0 && l <= pos.tp {
+		e.close(c.Time, math.Min(o, pos.tp), "TAKE_PROFIT")
+	}
+}
+
+// midがcurrentの時の成行きの約定価格。open:新規ならtrue、決済ならfalse。
+// 買い(新規BUY、SELLの決済)はask、売りはbidに、slippageを不利な方向に乗せる。
+func (e *engine) marketPrice(side string, current float64, open bool) float64 {
+	buy := side == "BUY"
+	if !open {
+		buy = !buy
+	}
+	d := e.cfg.Spread/2 + e.cfg.Slippage
+	if buy {
+		return current + d
+	}
+	return current - d
+}
+
+func (e *engine) unrealizedPL(current float64) float64 {
+	if e.pos == nil {
+		return 0
+	}
+	half := e.cfg.Spread / 2
+	price := current - half
+	if e.pos.Side == "SELL" {
+		price = current + half
+	}
+	return pl(e.pos.Side, e.pos.Units, e.pos.OpenPrice, price)
+}
+
+func (e *engine) round(p float64) float64 {
+	if e.cfg.Instrument == nil {
+		return p
+	}
+	return e.cfg.Instrument.RoundPrice(p)
+}
+
+func pl(side string, units int, open, close float64) float64 {
+	if side == "SELL" {
+		return (open - close) * float64(units)
+	}
+	return (close - open) * float64(units)
+}
+
+func summarize(res *Result, balance float64) Summary {
+	s := Summary{Trades: len(res.Trades), FinalBalance: balance}
+	for _, t := range res.Trades {
+		s.NetPL += t.PL
+		if t.PL > 0 {
+			s.Wins++
+			s.GrossProfit += t.PL
+		} else if t.PL < 0 {
+			s.Losses++
+			s.GrossLoss += t.PL
+		}
+	}
+	s.FinalBalance += s.NetPL
+	if s.Trades > 0 {
+		s.WinRate = float64(s.Wins) / float64(s.Trades)
+	}
+	if s.Wins > 0 {
+		s.AvgWin = s.GrossProfit / float64(s.Wins)
+	}
+	if s.Losses > 0 {
+		s.AvgLoss = s.GrossLoss / float64(s.Losses)
+		s.ProfitFactor = s.GrossProfit / -s.GrossLoss
+	}
+	if balance != 0 {
+		s.Return = s.FinalBalance/balance - 1
+	}
+	peak := balance
+	for _, p := range res.Equity {
+		if p.Equity > peak {
+			peak = p.Equity
+		}
+		if dd := peak - p.Equity; dd > s.MaxDrawdown {
+			s.MaxDrawdown = dd
+			if peak != 0 {
+				s.MaxDrawdownRate = dd / peak
+			}
+		}
+	}
+	return s
+}
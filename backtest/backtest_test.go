@@ -0,0 +1,227 @@
+package backtest
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/sizing"
+	"github.com/zenryokukun/oanda-bot/strategy"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// i本目の足
+func candle(i int, o, h, l, c float64) oanda.CandleStick {
+	p := &oanda.Hloc{O: o, H: h, L: l, C: c}
+	return oanda.CandleStick{Complete: true, Time: start.Add(time.Duration(i) * time.Minute), Prices: p, Mid: p}
+}
+
+// 2本のレンジ(99.5-100.5)の後、2本目の終値で上か下にブレイクする足。restは3本目以降
+func series(breakUp bool, rest ...[4]float64) oanda.CandleSticks {
+	cs := oanda.CandleSticks{candle(0, 100, 100.5, 99.5, 100), candle(1, 100, 100.5, 99.5, 100)}
+	if breakUp {
+		cs = append(cs, candle(2, 100, 101, 100, 101))
+	} else {
+		cs = append(cs, candle(2, 100, 100, 99, 99))
+	}
+	for i, r := range rest {
+		cs = append(cs, candle(3+i, r[0], r[1], r[2], r[3]))
+	}
+	return cs
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestRun(t *testing.T) {
+	jpy := &oanda.Instrument{Name: "USD_JPY", DisplayPrecision: 3, MinimumTradeSize: 1, MaximumOrderUnits: 50}
+	type trade struct {
+		side, reason string
+		open, close  float64
+	}
+	tests := []struct {
+		name   string
+		cs     oanda.CandleSticks
+		prm    strategy.Param
+		inst   *oanda.Instrument
+		spread float64
+		trades []trade
+	}{
+		// 買いはmid+spread/2+slippage。利確は101.02*1.01
+		{"take profit", series(true, [4]float64{101, 102.1, 100.9, 101}),
+			strategy.Param{ProfRate: 0.01}, nil, 0.02,
+			[]trade{{"BUY", "TAKE_PROFIT", 101.02, 101.02 * 1.01}}},
+		// 価格は桁数に丸める
+		{"rounded", series(true, [4]float64{101, 102.1, 100.9, 101}),
+			strategy.Param{ProfRate: 0.01}, jpy, 0.02,
+			[]trade{{"BUY", "TAKE_PROFIT", 101.02, 102.03}}},
+		// 同じ足で両方に届いたら損切
+		{"stop loss first", series(true, [4]float64{101, 102.1, 99, 101}),
+			strategy.Param{ProfRate: 0.01, LossRate: -0.01}, nil, 0.02,
+			[]trade{{"BUY", "STOP_LOSS", 101.02, 101.02 * 0.99}}},
+		// 窓を開けたら始値(bid)で約定。その足で下にブレイクして売り、最後に決済
+		{"gap", series(true, [4]float64{98, 98.5, 97.5, 98}),
+			strategy.Param{LossRate: -0.01}, nil, 0.02,
+			[]trade{{"BUY", "STOP_LOSS", 101.02, 97.99}, {"SELL", "END", 97.98, 98.02}}},
+		// 建てた足では判定しない
+		{"next candle", oanda.CandleSticks{candle(0, 100, 100.5, 99.5, 100), candle(1, 100, 100.5, 99.5, 100),
+			candle(2, 100, 103, 100, 101), candle(3, 101, 101, 101, 101)},
+			strategy.Param{ProfRate: 0.01}, nil, 0.02,
+			[]trade{{"BUY", "END", 101.02, 100.98}}},
+		{"short take profit", series(false, [4]float64{99, 99, 97.9, 99}),
+			strategy.Param{ProfRate: 0.01}, nil, 0.02,
+			[]trade{{"SELL", "TAKE_PROFIT", 98.98, 98.98 * 0.99}}},
+		// 逆向きのブレイクで決済してドテン
+		{"signal", series(true, [4]float64{101, 101, 99, 99}),
+			strategy.Param{}, nil, 0.02,
+			[]trade{{"BUY", "SIGNAL", 101.02, 98.98}, {"SELL", "END", 98.98, 99.02}}},
+		{"spread too wide", series(true, [4]float64{101, 102.1, 100.9, 101}),
+			strategy.Param{ProfRate: 0.01, Spread: 0.01}, nil, 0.02,
+			nil},
+	}
+	for _, tt := range tests {
+		prm := tt.prm
+		prm.Span, prm.Units = 2, 100
+		if prm.Spread == 0 {
+			prm.Spread = 1
+		}
+		res, err := Run(tt.cs, Config{Param: &prm, Instrument: tt.inst, Spread: tt.spread, Slippage: 0.01, Balance: 1000})
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if len(res.Trades) != len(tt.trades) {
+			t.Errorf("%v: trades = %+v", tt.name, res.Trades)
+			continue
+		}
+		balance := 1000.0
+		for i, want := range tt.trades {
+			got := res.Trades[i]
+			units := 100
+			if tt.inst != nil {
+				units = 50
+			}
+			if got.Side != want.side || got.Reason != want.reason || got.Units != units ||
+				!near(got.OpenPrice, want.open) || !near(got.ClosePrice, want.close) {
+				t.Errorf("%v: trade[%v] = %+v, want %+v", tt.name, i, got, want)
+			}
+			if !near(got.PL, pl(want.side, units, want.open, want.close)) {
+				t.Errorf("%v: trade[%v] PL = %v", tt.name, i, got.PL)
+			}
+			balance += got.PL
+		}
+		// Span本目から毎フレーム記録する
+		if len(res.Equity) != len(tt.cs)-2 || !near(res.Summary.FinalBalance, balance) {
+			t.Errorf("%v: equity %v points, final %v, want %v", tt.name, len(res.Equity), res.Summary.FinalBalance, balance)
+		}
+	}
+}
+
+func TestRunError(t *testing.T) {
+	cs := series(true)
+	if _, err := Run(cs, Config{}); err == nil {
+		t.Error("nil Param: want error")
+	}
+	if _, err := Run(cs, Config{Param: &strategy.Param{}}); err == nil {
+		t.Error("zero Span: want error")
+	}
+	cs[1].Prices = nil
+	if _, err := Run(cs, Config{Param: &strategy.Param{Span: 2}}); err == nil {
+		t.Error("no prices: want error")
+	}
+}
+
+// Options.Priceが"BA"の戦略には、足と現在価格のbid,askを渡す
+func TestRunBidAsk(t *testing.T) {
+	prm := strategy.Param{Span: 2, Units: 100, Spread: 1, Options: []byte(`{"Price":"BA"}`)}
+	run := func(cs oanda.CandleSticks) []Trade {
+		t.Helper()
+		res, err := Run(cs, Config{Param: &prm, Spread: 0.02, Slippage: 0.01, Balance: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Trades
+	}
+	// bid,askの無い足はspreadから求めるので、midと同じくブレイクする
+	cs := series(true)
+	if trades := run(cs); len(trades) != 1 || trades[0].Side != "BUY" {
+		t.Errorf("no bid ask: trades = %+v", trades)
+	}
+	if cs[0].Bid != nil || cs[0].Ask != nil {
+		t.Errorf("candles modified: %+v", cs[0])
+	}
+	// レンジの足のspreadが広く、askの高値(101.5)を現在のask(101.01)が超えない
+	for i := range cs[:2] {
+		cs[i].Bid = &oanda.Hloc{O: 99, H: 99.5, L: 98.5, C: 99}
+		cs[i].Ask = &oanda.Hloc{O: 101, H: 101.5, L: 100.5, C: 101}
+	}
+	if trades := run(cs); len(trades) != 0 {
+		t.Errorf("wide spread: trades = %+v", trades)
+	}
+	prm.Options = nil
+	if trades := run(cs); len(trades) != 1 || trades[0].Side != "BUY" {
+		t.Errorf("mid: trades = %+v", trades)
+	}
+}
+
+// 損切の建値への移動
+func TestRunBreakeven(t *testing.T) {
+	// 102で+1%に達して損切を101.02に移動し、次の足で約定
+	cs := series(true, [4]float64{101, 102, 101, 102}, [4]float64{102, 102, 100, 100.5})
+	prm := &strategy.Param{Span: 2, Units: 100, Spread: 1, LossRate: -0.02, Breakeven: 0.009}
+	res, err := Run(cs, Config{Param: prm, Spread: 0.02, Slippage: 0.01, Balance: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Trades) != 1 || res.Trades[0].Reason != "STOP_LOSS" || !near(res.Trades[0].ClosePrice, 101.02) || !near(res.Trades[0].PL, 0) {
+		t.Errorf("trades = %+v", res.Trades)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	res := &Result{
+		Trades: []Trade{{PL: 100}, {PL: -50}, {PL: 30}, {PL: 0}},
+		Equity: []Point{{Equity: 1000}, {Equity: 1100}, {Equity: 990}, {Equity: 1200}, {Equity: 1140}},
+	}
+	s := summarize(res, 1000)
+	want := Summary{
+		Trades: 4, Wins: 2, Losses: 1, WinRate: 0.5,
+		GrossProfit: 130, GrossLoss: -50, NetPL: 80, ProfitFactor: 2.6, AvgWin: 65, AvgLoss: -50,
+		MaxDrawdown: 110, MaxDrawdownRate: 0.1, FinalBalance: 1080, Return: 0.08,
+	}
+	if !near(s.ProfitFactor, want.ProfitFactor) || !near(s.Return, want.Return) || !near(s.MaxDrawdownRate, want.MaxDrawdownRate) {
+		t.Errorf("summary = %+v", s)
+	}
+	s.ProfitFactor, s.Return, s.MaxDrawdownRate = want.ProfitFactor, want.Return, want.MaxDrawdownRate
+	if s != want {
+		t.Errorf("summary = %+v, want %+v", s, want)
+	}
+
+	// 損失が無ければProfitFactorは0
+	if s := summarize(&Result{Trades: []Trade{{PL: 10}}}, 1000); s.ProfitFactor != 0 || s.WinRate != 1 || s.MaxDrawdown != 0 {
+		t.Errorf("no loss = %+v", s)
+	}
+}
+
+// 量はConfig.Sizerで決める。nilならUnitsの固定量
+func TestRunSizing(t *testing.T) {
+	cs := series(true, [4]float64{101, 101, 101, 101})
+	prm := &strategy.Param{Span: 2, Units: 100, Spread: 1, LossRate: -0.01}
+	sizer, err := sizing.New(sizing.Config{Method: "risk", Risk: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Run(cs, Config{Param: prm, Sizer: sizer, Balance: 1000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1,000,000 * 0.01 / (101 * 0.01)
+	if len(res.Trades) != 1 || res.Trades[0].Units != 9900 {
+		t.Errorf("trades = %+v", res.Trades)
+	}
+	if res, err := Run(cs, Config{Param: prm, Balance: 1000000}); err != nil || len(res.Trades) != 1 || res.Trades[0].Units != 100 {
+		t.Errorf("fixed: trades = %+v, %v", res.Trades, err)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * backtest結果の出力
+ */
+
+package backtest
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// 取引履歴をcsvで書き出す。
+// header: side,units,open_time,open_price,close_time,close_price,reason,pl
+func (r *Result) WriteTrades(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"side", "units", "open_time", "open_price", "close_time", "close_price", "reason", "pl"})
+	for _, t := range r.Trades {
+		cw.Write([]string{
+			t.Side,
+			strconv.Itoa(t.Units),
+			t.OpenTime.UTC().Format(time.RFC3339),
+			fstr(t.OpenPrice),
+			t.CloseTime.UTC().Format(time.RFC3339),
+			fstr(t.ClosePrice),
+			t.Reason,
+			fstr(t.PL),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// 残高の推移をcsvで書き出す。header: time,balance,equity
+func (r *Result) WriteEquity(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "balance", "equity"})
+	for _, p := range r.Equity {
+		cw.Write([]string{p.Time.UTC().Format(time.RFC3339), fstr(p.Balance), fstr(p.Equity)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf(
+		"trades:%v win:%v loss:%v winrate:%.1f%%\n"+
+			"net:%.2f profit:%.2f loss:%.2f pf:%.2f avgwin:%.2f avgloss:%.2f\n"+
+			"maxdd:%.2f(%.2f%%) balance:%.2f return:%.2f%%",
+		s.Trades, s.Wins, s.Losses, s.WinRate*100,
+		s.NetPL, s.GrossProfit, s.GrossLoss, s.ProfitFactor, s.AvgWin, s.AvgLoss,
+		s.MaxDrawdown, s.MaxDrawdownRate*100, s.FinalBalance, s.Return*100,
+	)
+}
+
+// 浮動小数点の誤差は丸める
+func fstr(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1e8)/1e8, 'f', -1, 64)
+}
@@ -0,0 +1,136 @@
+// 保存済みのロウソク足でbotの売買ロジックをbacktestする。
+//
+//	backtest -param ./param.json -from 2024-01-01 -to 2024-07-01 -spread 0.008
+//
+// param.jsonに複数の通貨ペアがある場合は -inst で選ぶ。省略すると最初の通貨ペア。
+// ロウソク足は -candles で指定。省略するとfetch-candlesの保存先(./candles/{Inst}_{Gran}.csv)。
+// 結果のサマリを表示し、-out のディレクトリにtrades.csvとequity.csvを書き出す。
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zenryokukun/oanda-bot/backtest"
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/history"
+	"github.com/zenryokukun/oanda-bot/sizing"
+	"github.com/zenryokukun/oanda-bot/strategy"
+)
+
+func main() {
+	var (
+		prmFile   = flag.String("param", "./param.json", "param file")
+		inst      = flag.String("inst", "", "instrument in param file. default: the first one")
+		candles   = flag.String("candles", "", "candle csv. default: ./candles/{Inst}_{Gran}.csv")
+		from      = flag.String("from", "", "start date (2006-01-02 or RFC3339)")
+		to        = flag.String("to", "", "end date (2006-01-02 or RFC3339)")
+		spread    = flag.Float64("spread", 0.008, "ask-bid spread")
+		slippage  = flag.Float64("slippage", 0, "slippage of market orders")
+		balance   = flag.Float64("balance", 250000, "initial balance")
+		precision = flag.Int("precision", -1, "price precision. default: 3 for *_JPY, otherwise 5")
+		out       = flag.String("out", "", "directory to write trades.csv and equity.csv")
+	)
+	flag.Parse()
+
+	prms, err := strategy.LoadParamsAs(*prmFile, func(p *param) *strategy.Param { return &p.Param })
+	if err != nil {
+		fail(err)
+	}
+	prm := prms[0]
+	if len(*inst) > 0 {
+		if prm = find(prms, *inst); prm == nil {
+			fail(fmt.Errorf("%v is not in %v", *inst, *prmFile))
+		}
+	}
+	sizer, err := sizing.New(prm.Sizing)
+	if err != nil {
+		fail(err)
+	}
+	start, err := history.ParseDate(*from)
+	if err != nil {
+		fail(err)
+	}
+	end, err := history.ParseDate(*to)
+	if err != nil {
+		fail(err)
+	}
+	fpath := *candles
+	if len(fpath) == 0 {
+		fpath = history.Path("./candles", prm.Inst, prm.Gran)
+	}
+	cs, err := history.LoadRange(fpath, start, end)
+	if err != nil {
+		fail(err)
+	}
+
+	res, err := backtest.Run(cs, backtest.Config{
+		Param:      &prm.Param,
+		Sizer:      sizer,
+		Instrument: instrument(prm.Inst, *precision),
+		Spread:     *spread,
+		Slippage:   *slippage,
+		Balance:    *balance,
+	})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("backtest: %v %v %v candles (%v)\n", prm.Inst, prm.Gran, len(cs), fpath)
+	fmt.Println(res.Summary)
+
+	if len(*out) == 0 {
+		return
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fail(err)
+	}
+	for fname, write := range map[string]func(*os.File) error{
+		"trades.csv": func(f *os.File) error { return res.WriteTrades(f) },
+		"equity.csv": func(f *os.File) error { return res.WriteEquity(f) },
+	} {
+		f, err := os.Create(filepath.Join(*out, fname))
+		if err != nil {
+			fail(err)
+		}
+		err = write(f)
+		f.Close()
+		if err != nil {
+			fail(err)
+		}
+	}
+}
+
+// param.jsonの1通貨ペア分。取引量はbotと同じくSizingで決める。Riskはbotのみで使うので読まない
+type param struct {
+	strategy.Param
+	Sizing sizing.Config
+}
+
+// psからinstのパラメタを返す。無ければnil
+func find(ps []*param, inst string) *param {
+	for _, p := range ps {
+		if p.Inst == inst {
+			return p
+		}
+	}
+	return nil
+}
+
+// 価格の桁数。APIは使わないので、unitsの上限は無し・下限は1とする。
+func instrument(name string, precision int) *oanda.Instrument {
+	if precision < 0 {
+		precision = 5
+		if strings.HasSuffix(name, "_JPY") {
+			precision = 3
+		}
+	}
+	return &oanda.Instrument{Name: name, DisplayPrecision: precision, MinimumTradeSize: 1}
+}
+
+func fail(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
@@ -0,0 +1,82 @@
+// 指定期間のロウソク足をoandaから取得してローカルのCSVに保存する。
+//
+//	fetch-candles -inst USD_JPY -gran M5 -from 2024-01-01 -to 2024-07-01
+//
+// 保存先は -out で指定。省略すると ./candles/USD_JPY_M5.csv。
+// 既にファイルがあれば足りない期間だけ取得する。中断しても再実行すれば続きから取得する。
+// 保存したファイルはoanda-simの -candles にもそのまま渡せる。
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/history"
+)
+
+func main() {
+	var (
+		inst    = flag.String("inst", "USD_JPY", "instrument")
+		gran    = flag.String("gran", "M5", "granularity")
+		from    = flag.String("from", "", "start date (2006-01-02 or RFC3339)")
+		to      = flag.String("to", "", "end date (2006-01-02 or RFC3339). default: now")
+		out     = flag.String("out", "", "output csv. default: ./candles/{inst}_{gran}.csv")
+		key     = flag.String("key", "./key.json", "key file")
+		mode    = flag.String("mode", "live", "live or demo")
+		account = flag.String("account", "", "account name in key.json (overrides -mode)")
+		baseURL = flag.String("url", "", "Oanda API base url (ex. http://localhost:8080/v3)")
+	)
+	flag.Parse()
+
+	g, err := oanda.ParseGranularity(*gran)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	start, err := history.ParseDate(*from)
+	if err != nil || start.IsZero() {
+		fmt.Println("-from is required (2006-01-02 or RFC3339)")
+		os.Exit(2)
+	}
+	end := time.Now().UTC()
+	if len(*to) > 0 {
+		if end, err = history.ParseDate(*to); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	fpath := *out
+	if len(fpath) == 0 {
+		fpath = history.Path("./candles", *inst, g)
+	}
+
+	opts := []oanda.Option{}
+	if *baseURL != "" {
+		opts = append(opts, oanda.WithBaseURL(*baseURL))
+	}
+	var goq *oanda.Goquest
+	if len(*account) > 0 {
+		goq, err = oanda.NewGoquestAccount(*key, *account, opts...)
+	} else {
+		goq, err = oanda.NewGoquest(*key, *mode, opts...)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	n, err := history.Backfill(ctx, goq, fpath, *inst, g, start, end)
+	fmt.Printf("fetch-candles: %v candles added to %v\n", n, fpath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+// ロウソク足ファイルを再生するOanda API simulatorを起動する。
+//
+//	oanda-sim -candles usdjpy_m5.csv -gran M5 -inst USD_JPY
+//
+// botは -url http://localhost:8080/v3 -sim http://localhost:8080 で起動すると、
+// simulatorの時刻で動く（実時間は待たない）。
+// -step を指定すると、その間隔(実時間)ごとに1足ずつ自動で進める。
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda/sim"
+)
+
+func main() {
+	var (
+		addr    = flag.String("addr", ":8080", "listen address")
+		fpath   = flag.String("candles", "", "candle file (.csv or .json)")
+		gran    = flag.String("gran", "M5", "granularity of the candle file")
+		inst    = flag.String("inst", "USD_JPY", "instrument")
+		account = flag.String("account", "001-001-0000001-001", "account id")
+		spread  = flag.Float64("spread", 0.008, "ask-bid spread")
+		balance = flag.Float64("balance", 250000, "initial balance")
+		warmup  = flag.Int("warmup", 100, "number of candles treated as history at start")
+		step    = flag.Duration("step", 0, "advance one candle every step (0: manual via /sim/tick)")
+	)
+	flag.Parse()
+
+	candles, err := sim.LoadCandles(*fpath)
+	if err != nil {
+		panic(err)
+	}
+	srv, err := sim.New(sim.Config{
+		AccountID:   *account,
+		Instrument:  *inst,
+		Granularity: *gran,
+		Spread:      *spread,
+		Balance:     *balance,
+		Warmup:      *warmup,
+		Candles:     candles,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if *step > 0 {
+		go func() {
+			for range time.Tick(*step) {
+				if !srv.Step() {
+					fmt.Println("no more candles.")
+					return
+				}
+			}
+		}()
+	}
+
+	fmt.Printf("oanda-sim: %v candles, account:%v, listening on %v\n", len(candles), *account, *addr)
+	if err := http.ListenAndServe(*addr, srv); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+ * frameが使うデータの取得(data layer)。
+ * 口座・通貨ペア情報・ロウソク足・価格をAPIから取得してSnapshotにまとめる。
+ * 売買判定や注文はここでは行わない。
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/history"
+)
+
+type (
+	// 1フレーム分の判定に使うデータ
+	Snapshot struct {
+		Position   *oanda.PositionData // Param.Instの保有ポジ。取引したことが無ければ空のポジ
+		Account    oanda.AccountData
+		Instrument *oanda.Instrument
+		// 判定に使う確定足。古い順にspan本
+		Sticks oanda.CandleSticks
+		// 現在価格を含む直近の確定足。Timeはframeの基準時刻にする
+		Last  oanda.CandleStick
+		Price *oanda.Price
+	}
+
+	MarketData interface {
+		// 口座を同期し、span本の確定足と現在価格を取得する
+		Snapshot(ctx context.Context, span int) (*Snapshot, error)
+		// 口座を同期しなおす。取引した後に呼ぶ
+		Sync(ctx context.Context) error
+		// 同期済みの口座から取る。リクエストはしない
+		Position() *oanda.PositionData
+		Trades() []*oanda.TradeData
+		Account() oanda.AccountData
+		// idsのclose済みtradeの確定損益
+		RealizedPL(ctx context.Context, ids string) (float64, error)
+		// Param.Instのquote通貨1単位を口座通貨に換算するレート
+		QuoteHome(ctx context.Context) (float64, error)
+	}
+)
+
+// 口座情報のローカルコピー。同じ口座の通貨ペアで共有する。
+// 最初のSyncでNewAccountから作り、以降はchangesの差分で同期する。
+type accountCache struct {
+	goq   *oanda.Goquest
+	mu    sync.Mutex
+	state *oanda.AccountState
+}
+
+func newAccountCache(goq *oanda.Goquest) *accountCache {
+	return &accountCache{goq: goq}
+}
+
+// 複数の通貨ペアから同時に呼んでもよい。
+func (c *accountCache) Sync(ctx context.Context) error {
+	c.mu.Lock()
+	if c.state == nil {
+		defer c.mu.Unlock()
+		a, err := oanda.NewAccountStateContext(ctx, c.goq)
+		if err != nil {
+			return err
+		}
+		c.state = a
+		return nil
+	}
+	st := c.state
+	c.mu.Unlock()
+	return st.SyncContext(ctx)
+}
+
+// Sync済みのAccountState。Syncに成功するまではnil
+func (c *accountCache) State() *oanda.AccountState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// APIから取得するMarketData
+type apiData struct {
+	goq *oanda.Goquest
+	prm *Param
+
+	// 口座情報。同じ口座の通貨ペアで共有する
+	acct *accountCache
+
+	// Param.Instの価格の桁数や取引量の上下限。最初のSnapshotで取得する。
+	inst *oanda.Instrument
+}
+
+func newAPIData(goq *oanda.Goquest, prm *Param, acct *accountCache) *apiData {
+	return &apiData{goq: goq, prm: prm, acct: acct}
+}
+
+// エラーは"account:","candles:"等、どのデータで失敗したか付けて返す
+func (d *apiData) Snapshot(ctx context.Context, span int) (*Snapshot, error) {
+	if err := d.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("account:%w", err)
+	}
+	if err := d.loadInstrument(ctx); err != nil {
+		return nil, fmt.Errorf("instrument:%w", err)
+	}
+	sticks, err := candlesLikeBTest(ctx, d.goq, d.prm, span)
+	if err != nil {
+		return nil, fmt.Errorf("candles:%w", err)
+	}
+	if len(sticks) == 0 {
+		return nil, fmt.Errorf("candles:no complete candles")
+	}
+	price, err := latestPrice(ctx, d.goq, d.prm)
+	if err != nil {
+		return nil, fmt.Errorf("pricing:%w", err)
+	}
+	if price == nil {
+		return nil, fmt.Errorf("pricing:%w for %v", oanda.ErrNoPrice, d.prm.Inst)
+	}
+	// sticksはspan+1になっているはずなので、直近のデータをpop。
+	last := sticks[len(sticks)-1]
+	sticks = sticks[:len(sticks)-1]
+	// pop後に長さがspanと一致しない場合はログ。
+	if len(sticks) != span {
+		fmt.Println("sticks length was:", len(sticks))
+	}
+	return &Snapshot{
+		Position:   d.Position(),
+		Account:    d.Account(),
+		Instrument: d.inst,
+		Sticks:     sticks,
+		Last:       last,
+		Price:      price,
+	}, nil
+}
+
+// 口座情報を最新にする。初回はNewAccountで全て取得し、以降はchangesの差分を適用する。
+func (d *apiData) Sync(ctx context.Context) error {
+	return d.acct.Sync(ctx)
+}
+
+// パラメタをもとに保有ポジションを返す。Sync済みのacctから取るのでリクエストはしない。
+// PositionDataにはLong,Shortそれぞれfieldがあるので留意。
+func (d *apiData) Position() *oanda.PositionData {
+	pos := d.acct.State().Position(d.prm.Inst)
+	if pos == nil {
+		// 一度も取引していない通貨
+		return &oanda.PositionData{Instrument: d.prm.Inst, Long: &oanda.PositionDataSide{}, Short: &oanda.PositionDataSide{}}
+	}
+	return pos
+}
+
+// Param.Instの保有trade。Sync済みのacctから取る。
+func (d *apiData) Trades() []*oanda.TradeData {
+	return d.acct.State().Trades(d.prm.Inst)
+}
+
+// 口座全体の情報。複数の通貨ペアで動かしていても損益は口座の合計になる。
+func (d *apiData) Account() oanda.AccountData {
+	return d.acct.State().Account()
+}
+
+func (d *apiData) RealizedPL(ctx context.Context, ids string) (float64, error) {
+	trades, err := oanda.NewTradesContext(ctx, d.goq, ids, "CLOSED", d.prm.Inst, "", "")
+	if err != nil {
+		return 0, err
+	}
+	realized, _ := trades.PL()
+	return realized, nil
+}
+
+func (d *apiData) QuoteHome(ctx context.Context) (float64, error) {
+	return oanda.QuoteHomeRateContext(ctx, d.goq, d.prm.Inst, d.Account().Currency)
+}
+
+// Param.Instの通貨ペア情報を取得する。取得済みなら何もしない。
+func (d *apiData) loadInstrument(ctx context.Context) error {
+	if d.inst != nil {
+		return nil
+	}
+	res, err := oanda.NewInstrumentsContext(ctx, d.goq, d.prm.Inst)
+	if err != nil {
+		return err
+	}
+	inst := res.Get(d.prm.Inst)
+	if inst == nil {
+		return fmt.Errorf("instrument not found:%v", d.prm.Inst)
+	}
+	d.inst = inst
+	return nil
+}
+
+// パラメタをもとにロウソク足取得。backtestに近づけて、最後の足を現在値として扱う。span:戦略が判定に使う確定足の本数
+func candlesLikeBTest(ctx context.Context, goq *oanda.Goquest, prm *Param, span int) (oanda.CandleSticks, error) {
+	if span+2 > oanda.MaxCandles {
+		return candlesFromHistory(ctx, goq, prm, span)
+	}
+	// ロウソク足が完成していないものが入っている可能性があるので+1
+	// 最後のロウソク足を現在値として扱う。それを除いてspan分データが欲しいので、さらに+1
+	// 戦略がbid,askで判定できるよう"MBA"で取得する。Pricesはmid
+	cd, err := oanda.NewCandlesContext(ctx, goq, span+2, prm.Gran, prm.Inst, "", "", "MBA")
+	if err != nil {
+		return nil, err
+	}
+	sticks := cd.ExtractMid()
+	if sticks != nil {
+		// 完成したロウソク足のみ抽出
+		sticks = sticks.Complete()
+		// 長さを超えている場合はslice。
+		// sticksが全てComplete状態ならspan+2の長さになり得るが、想定はしていない。
+		st := len(sticks) - 1 - span
+		if st < 0 {
+			st = 0
+		}
+		sticks = sticks[st:]
+		// span + 1 と長さが一致しない場合は想定外。ログを吐く。
+		if len(sticks) != span+1 {
+			fmt.Printf("Stick length does not match Param. Stick.length:%v\n", len(sticks))
+		}
+	}
+	return sticks, nil
+}
+
+// 1リクエストで取得できないspanの戦略のwarmup。CANDLE_DIRのキャッシュを現在まで埋めて、直近span+1本の確定足を読み込む。
+// キャッシュはmidのみなので、bid,askでの判定はmidになる。
+func candlesFromHistory(ctx context.Context, goq *oanda.Goquest, prm *Param, span int) (oanda.CandleSticks, error) {
+	fpath := history.Path(CANDLE_DIR, prm.Inst, prm.Gran)
+	now := clock.Now()
+	// 週末等で足が無い期間があるので、span+1本分の2倍の期間を揃える
+	from := now.Add(-2 * time.Duration(span+1) * prm.Gran.Duration())
+	if _, err := history.Backfill(ctx, goq, fpath, prm.Inst, prm.Gran, from, now); err != nil {
+		return nil, err
+	}
+	sticks, err := history.LoadRange(fpath, from, now)
+	if err != nil {
+		return nil, err
+	}
+	if st := len(sticks) - 1 - span; st > 0 {
+		sticks = sticks[st:]
+	}
+	if len(sticks) != span+1 {
+		fmt.Printf("Stick length does not match Param. Stick.length:%v\n", len(sticks))
+	}
+	return sticks, nil
+}
+
+// 現在のPrice取得
+func latestPrice(ctx context.Context, goq *oanda.Goquest, prm *Param) (*oanda.Price, error) {
+	pricing, err := oanda.NewPricingContext(ctx, goq, prm.Inst)
+	if err != nil {
+		return nil, err
+	}
+	return pricing.Latest(prm.Inst), nil
+}
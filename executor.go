@@ -0,0 +1,369 @@
+/*
+ * 注文の執行(execution layer)。
+ * frameの判定結果(OrderPlan)を受け取り、spreadが収まるのを待って発注し、約定を確認する。
+ * 保有ポジを閉じてから新規取引する順序もここで守る。
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/strategy"
+)
+
+// spreadが許容値に収まるまで待つ秒数
+const spreadWaitSecs = 15
+
+type (
+	// 1フレーム分の注文内容
+	OrderPlan struct {
+		Close bool   // 保有ポジを閉じる
+		Open  string // 新規取引の向き。"BUY","SELL",""。Closeする場合は閉じた後に注文する
+		Units int    // 新規取引の量(正)。最小取引量・最大注文量の範囲に収めて注文する
+		// 現在の保有ポジ。Closeする場合に使う
+		Position   *oanda.PositionData
+		Instrument *oanda.Instrument
+		// 判定に使った価格。spreadが許容値を超えていれば収まるまで待つ
+		Price *oanda.Price
+		// spreadを待たずにCloseする。kill switch用
+		Force bool
+	}
+
+	// 注文結果
+	Execution struct {
+		Closed bool // close注文が約定した
+		Opened bool // open注文が約定した
+		// 約定したopen注文のID。約定しなかった場合は空
+		OpenOrderID string
+	}
+
+	Executor interface {
+		// planの通りに注文する。spreadが収まらない場合や、新規注文がリスクの制限に掛かる場合は注文しない
+		Execute(ctx context.Context, plan *OrderPlan) *Execution
+		// 保有tradeの利確・損切注文を合わせる。current:現在価格
+		ReconcileExits(ctx context.Context, inst *oanda.Instrument, trades []*oanda.TradeData, current float64) error
+	}
+)
+
+// APIで注文するExecutor
+type apiExecutor struct {
+	goq   *oanda.Goquest
+	prm   *Param
+	strat strategy.Strategy
+
+	// 約定通知(transaction stream)の購読用。
+	// nilもしくは未接続の場合はpollingで約定を確認する。
+	txDispatcher *oanda.TransactionDispatcher
+
+	// 新規注文前のリスク確認。nilなら確認しない
+	risk RiskChecker
+}
+
+func newAPIExecutor(goq *oanda.Goquest, prm *Param, strat strategy.Strategy, tx *oanda.TransactionDispatcher, risk RiskChecker) *apiExecutor {
+	return &apiExecutor{goq: goq, prm: prm, strat: strat, txDispatcher: tx, risk: risk}
+}
+
+func (e *apiExecutor) Execute(ctx context.Context, plan *OrderPlan) *Execution {
+	res := &Execution{}
+	chOrder := make(chan string, 1)
+	price := plan.Price
+
+	// ****************************************************
+	// 保有ポジを閉じる処理
+	// ****************************************************
+	if plan.Close {
+		// spreadが許容値になるまで待つ。待っても収まらない場合は取引しない。
+		if !plan.Force {
+			price = waitSpread(ctx, e.goq, price, e.prm, spreadWaitSecs)
+		}
+		if price == nil {
+			// 閉じられなかった場合は新規取引もしない
+			return res
+		}
+		go e.closeOrder(ctx, plan.Position, chOrder)
+		// 結局待つwww
+		if id := <-chOrder; id == "" {
+			// 約定しなかった場合も新規取引はしない
+			return res
+		}
+		res.Closed = true
+	}
+
+	// ****************************************************
+	// 新規購入処理。closeした場合はその後に注文する
+	// ****************************************************
+	if len(plan.Open) > 0 {
+		units := e.orderUnits(plan.Instrument, plan.Open, plan.Units)
+		if units == 0 {
+			return res
+		}
+		// 閉じた後の保有量で判定する
+		if e.risk != nil {
+			if err := e.risk.Allow(e.prm.Inst, units, res.Closed); err != nil {
+				fmt.Printf("openOrder:%v\n", err)
+				return res
+			}
+		}
+		price = waitSpread(ctx, e.goq, price, e.prm, spreadWaitSecs)
+		if price != nil {
+			go e.openOrder(ctx, plan.Instrument, units, price, chOrder)
+			res.OpenOrderID = <-chOrder
+			res.Opened = res.OpenOrderID != ""
+		}
+	}
+	return res
+}
+
+// 新規注文の量。売りは負。最小取引量に満たない場合は0
+func (e *apiExecutor) orderUnits(inst *oanda.Instrument, side string, size int) int {
+	// Sizingで取引しないと判断された場合
+	if size <= 0 {
+		fmt.Printf("openOrder:units is %v\n", size)
+		return 0
+	}
+	units := inst.ClampUnits(size)
+	if units == 0 {
+		fmt.Printf("openOrder:units %v is less than minimum trade size %v\n", size, inst.MinimumTradeSize)
+		return 0
+	}
+	if side == "SELL" {
+		units *= -1
+	}
+	return units
+}
+
+// 保有tradeの利確・損切注文を、取得価格とParamから計算した価格に合わせる。
+// 注文が無い（bot導入前のtrade、手動で外した等）場合や、価格がずれている場合のみ設定しなおす。
+// current:現在価格。含み益がprm.Breakevenに達していたら損切を建値に移動する。
+// 損切は不利な方向には動かさない（建値に移動済みのものを戻さない）。
+func (e *apiExecutor) ReconcileExits(ctx context.Context, inst *oanda.Instrument, trades []*oanda.TradeData, current float64) error {
+	for _, t := range trades {
+		side := "BUY"
+		if t.CurrentUnits < 0 {
+			side = "SELL"
+		}
+		tp, sl := e.exitPrices(inst, t.Price, side)
+		if be := strategy.BreakevenPrice(e.prm, t.Price, current, side, inst.RoundPrice); be > 0 {
+			sl = be
+		}
+		p := &oanda.TradeOrdersParam{}
+		if tp > 0 && !samePrice(t.TakeProfitOrder, tp) {
+			p.TakeProfit = &oanda.TakeProfitParam{Price: tp}
+		}
+		if sl > 0 && (t.StopLossOrder == nil || strategy.Tighter(side, sl, t.StopLossOrder.Price)) {
+			p.StopLoss = &oanda.StopLossParam{Price: sl}
+		}
+		if p.TakeProfit == nil && p.StopLoss == nil {
+			continue
+		}
+		if _, err := oanda.SetTradeOrdersContext(ctx, e.goq, t.ID, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// p:取得価格 side:"BUY"or"SELL"のtradeの、利確価格と損切価格を返す。
+// LossRateは負の値。ProfRate,LossRateが0の場合は0を返す（注文を付けない）。
+func (e *apiExecutor) exitPrices(inst *oanda.Instrument, p float64, side string) (float64, float64) {
+	tp, sl := e.strat.Exits(p, side)
+	return inst.RoundPrice(tp), inst.RoundPrice(sl)
+}
+
+// 注文oの価格がpriceと一致するか。oがnilならfalse
+func samePrice(o *oanda.OrderData, price float64) bool {
+	return o != nil && math.Abs(o.Price-price) < 1e-9
+}
+
+// spreadが許容値になるまで待つ。価格はstreamで受け取り、tick毎に判定する。
+// streamに接続できない場合は1秒ごとのpollingに切り替える。
+// secs秒待っても収まらない、もしくはctxがキャンセルされた場合はnilを返す
+func waitSpread(ctx context.Context, goq *oanda.Goquest, price *oanda.Price, prm *Param, secs int) *oanda.Price {
+	if price.Spread() <= prm.Spread {
+		return price
+	}
+	wctx, cancel := context.WithTimeout(ctx, time.Duration(secs)*time.Second)
+	defer cancel()
+	sctx, stop := context.WithCancel(wctx)
+	defer stop()
+
+	stream := oanda.NewPricingStream(sctx, goq, prm.Inst)
+	for {
+		select {
+		case p, ok := <-stream.C:
+			if !ok {
+				return nil
+			}
+			if p.Instrument == prm.Inst && p.Spread() <= prm.Spread {
+				return &p
+			}
+		case err := <-stream.Errors:
+			fmt.Printf("waitSpread:%v\n", err)
+			stop()
+			return pollSpread(wctx, goq, prm)
+		}
+	}
+}
+
+// 1秒ごとにpricingを取得し、spreadが許容値になるまで待つ。waitSpreadのfallback。
+// ctxがキャンセル(timeout)されたらnilを返す
+func pollSpread(ctx context.Context, goq *oanda.Goquest, prm *Param) *oanda.Price {
+	for {
+		if !sleep(ctx, time.Second*1) {
+			return nil
+		}
+		p, err := latestPrice(ctx, goq, prm)
+		if err != nil {
+			fmt.Printf("pollSpread:%v\n", err)
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		if p.Spread() <= prm.Spread {
+			return p
+		}
+	}
+}
+
+// orderIDの注文がFILLEDになるまで待つ。sec秒待ってもFILLしない場合、falseを返す
+// fillsにtransactionの購読channelを渡すと、streamで約定を待つ。nilならpollingで確認する。
+// ctxがキャンセルされた場合もfalseを返す
+func waitOrderFill(ctx context.Context, goq *oanda.Goquest, fills <-chan oanda.Transaction, orderID string, sec int) bool {
+	if fills != nil {
+		wctx, cancel := context.WithTimeout(ctx, time.Duration(sec)*time.Second)
+		defer cancel()
+		for {
+			select {
+			case t := <-fills:
+				switch tx := t.(type) {
+				case *oanda.OrderFillTransaction:
+					if tx.OrderID == orderID {
+						return true
+					}
+				case *oanda.OrderCancelTransaction:
+					if tx.OrderID == orderID {
+						fmt.Printf("order cancelled:%v %v\n", orderID, tx.Reason)
+						return false
+					}
+				}
+			case <-wctx.Done():
+				if ctx.Err() != nil {
+					return false
+				}
+				// streamで受け取れなかった場合は念のため1回だけ確認
+				order, err := oanda.NewOrderDataContext(ctx, goq, orderID)
+				return err == nil && order != nil && order.OrderStatus() == "FILLED"
+			}
+		}
+	}
+
+	// 300ミリ秒ごとに実行
+	for i := 0.3; i < float64(sec); i += 0.3 {
+		order, err := oanda.NewOrderDataContext(ctx, goq, orderID)
+		if err != nil || order == nil {
+			fmt.Printf("Could not get orderID:%v %v\n", orderID, err)
+		} else if order.OrderStatus() == "FILLED" {
+			return true
+		}
+		if !sleep(ctx, 300*time.Millisecond) {
+			return false
+		}
+	}
+	return false
+}
+
+// 新規の成行き注文。units:売りは負。
+// 利確・損切注文をoanda側に付けて発注し、botが止まっていても決済されるようにする。
+// 約定見込み価格（buyならask、sellならbid）で計算しておき、約定価格とのずれはReconcileExitsで直す。
+// go で呼ぶこと。
+func (e *apiExecutor) openOrder(ctx context.Context, inst *oanda.Instrument, units int, price *oanda.Price, ch chan string) {
+	ask, bid := price.Latest()
+	side, expect := "BUY", ask
+	if units < 0 {
+		side, expect = "SELL", bid
+	}
+	p := &oanda.OrderParam{Instrument: e.prm.Inst, Units: units}
+	tp, sl := e.exitPrices(inst, expect, side)
+	if tp > 0 {
+		p.TakeProfit = &oanda.TakeProfitParam{Price: tp}
+	}
+	if sl > 0 {
+		p.StopLoss = &oanda.StopLossParam{Price: sl}
+	}
+	e.placeOrder(ctx, p, ch)
+}
+
+// 成行き注文を出し、FILLEDになるまで待つ。約定したらorderIDを、しなければ空文字をchに送る。
+func (e *apiExecutor) placeOrder(ctx context.Context, p *oanda.OrderParam, ch chan string) {
+	// 約定をstreamで受け取る場合は、取りこぼさないよう注文前に購読しておく
+	fills, unsubscribe := e.subscribeFills()
+	defer unsubscribe()
+	// 注文してorder IDを抽出
+	order, err := oanda.NewMarketOrderParamContext(ctx, e.goq, p)
+	if err != nil {
+		fmt.Printf("marketOrder:%v\n", err)
+		ch <- ""
+		return
+	}
+	id := order.Id()
+	// IDが取得できない場合はリターン
+	if id == "" {
+		fmt.Printf("marketOrder: id was empty:%v", id)
+		ch <- ""
+		return
+	}
+	// orderが完了するまで待つ
+	isFilled := waitOrderFill(ctx, e.goq, fills, id, 6)
+
+	if isFilled {
+		ch <- id
+		return
+	}
+	ch <- ""
+}
+
+// 保有ポジションをcloseする処理。ヘルパー。orderがFILLEDになるまで待つ。
+// 両建て不可アカウントなので、保有している側を全てクローズする。
+func (e *apiExecutor) closeOrder(ctx context.Context, pos *oanda.PositionData, ch chan string) {
+	long, short := 0, 0
+	if tradeSide(pos) == "BUY" {
+		long = oanda.CLOSE_ALL
+	} else {
+		short = oanda.CLOSE_ALL
+	}
+	fills, unsubscribe := e.subscribeFills()
+	defer unsubscribe()
+	res, err := oanda.NewMarketCloseContext(ctx, e.goq, e.prm.Inst, long, short)
+	if err != nil {
+		fmt.Printf("closeOrder:%v\n", err)
+		ch <- ""
+		return
+	}
+	id := res.Id()
+	if id == "" {
+		fmt.Printf("closeOrder: id was empty:%v", id)
+		ch <- ""
+		return
+	}
+	// 通常はレスポンスの時点で約定している
+	if res.Filled() || waitOrderFill(ctx, e.goq, fills, id, 6) {
+		ch <- id
+		return
+	}
+	ch <- ""
+}
+
+// 約定をstreamで受け取るための購読。streamに未接続の場合はnilを返すので、waitOrderFillはpollingになる。
+// 取りこぼさないよう注文前に呼ぶこと。戻り値のfuncで購読を解除する。
+func (e *apiExecutor) subscribeFills() (<-chan oanda.Transaction, func()) {
+	if e.txDispatcher == nil || !e.txDispatcher.Connected() {
+		return nil, func() {}
+	}
+	return e.txDispatcher.Subscribe("ORDER_FILL", "ORDER_CANCEL")
+}
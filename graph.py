@@ -1,6 +1,7 @@
 import datetime
 import matplotlib.pyplot as plt
 import json
+import os
 import sys
 
 BALANCE_F = "./balance.json"
@@ -39,10 +40,10 @@ def slice_trade(start_time, tobj):
     return tobj
 
 
-def graph(img_path: str):
+def graph(img_path: str, data_dir: str = ".", inst: str = "USD_JPY"):
     # ファイルから読み取る
-    bl = load(BALANCE_F)
-    tr = load(TRADE_F)
+    bl = load(os.path.join(data_dir, BALANCE_F))
+    tr = load(os.path.join(data_dir, TRADE_F))
     # unix時間を文字列に変換した値をセット
     time_str(bl)
     time_str(tr)
@@ -73,8 +74,8 @@ def graph(img_path: str):
     fig = plt.figure()
     # 左グラフ 実際の価格
     ax = fig.add_subplot(111)
-    ax.set_ylabel("USD_JPY")
-    ax.plot(bl["time"], bl["Y"], label="USD/JPY", color="orange")
+    ax.set_ylabel(inst)
+    ax.plot(bl["time"], bl["Y"], label=inst.replace("_", "/"), color="orange")
     # 取引箇所
     ax.scatter(openbuy_x, openbuy_y, label="@openBuy", color="red")
     ax.scatter(opensell_x, opensell_y,
@@ -105,4 +106,8 @@ if __name__ == "__main__":
     except IndexError as err:
         print(err)
         sys.exit()
-    graph(tpath)
+    # 口座毎のディレクトリ。省略時はカレントディレクトリ
+    data_dir = sys.argv[2] if len(sys.argv) > 2 else "."
+    # 通貨ペア。省略時はUSD_JPY
+    inst = sys.argv[3] if len(sys.argv) > 3 else "USD_JPY"
+    graph(tpath, data_dir, inst)
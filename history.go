@@ -21,6 +21,12 @@ type (
 		TotalPL []float64 // 残高
 	}
 
+	// 口座全体の評価額込み残高
+	EquityData struct {
+		X      []int64 // unixTime
+		Equity []float64
+	}
+
 	// 取引履歴
 	TradeData struct {
 		XY              // unixTime,価格
@@ -122,6 +128,36 @@ func (b *BalanceData) Add(x int64, y, balance float64) {
 	b.TotalPL = append(b.TotalPL, balance)
 }
 
+// ***************************************************
+// Equity
+// ***************************************************
+func NewEquityHistory() *EquityData {
+	return &EquityData{}
+}
+
+func (e *EquityData) Slice(mlen int) {
+	lx := len(e.X)
+	if lx != len(e.Equity) {
+		panic("equityData:mismatched length.")
+	}
+	if lx <= mlen {
+		return
+	}
+	st := lx - mlen
+	e.X = e.X[st:]
+	e.Equity = e.Equity[st:]
+}
+
+// 同じ時刻の記録は上書きする。複数のbotが同じ足の時刻で記録するため
+func (e *EquityData) Add(x int64, equity float64) {
+	if n := len(e.X); n > 0 && e.X[n-1] == x {
+		e.Equity[n-1] = equity
+		return
+	}
+	e.X = append(e.X, x)
+	e.Equity = append(e.Equity, equity)
+}
+
 // ***************************************************
 // Trade
 // ***************************************************
@@ -1,16 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
-	"math"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/zenryokukun/gotweet"
 	"github.com/zenryokukun/oanda-bot/oanda"
-	"github.com/zenryokukun/surfergopher/minmax"
+	"github.com/zenryokukun/oanda-bot/oanda/sim"
+	"github.com/zenryokukun/oanda-bot/risk"
+	"github.com/zenryokukun/oanda-bot/sizing"
+	"github.com/zenryokukun/oanda-bot/strategy"
 )
 
 // 稼働時の総利益。現在総歴-稼働時の総利益 = BOTの総利益　とするため。
@@ -22,308 +28,129 @@ var TOTAL_PROF_FILE = "./balance.json"
 // 取引履歴を出力するファイル
 var TRADE_FILE = "./trade.json"
 
+// 口座全体の評価額込み残高の推移を出力するファイル。口座のディレクトリに1つ。リスク管理が使う
+var EQUITY_FILE = "./equity.json"
+
 // 画像生成するpythonファイルのパス
 var IMG_PYSCRIPT = "./graph.py"
 
 // tweet用画像のパス
 var IMG_PATH = "./tweet.png"
 
-// ロジックに使うパラメタ。コンパイル面倒だからファイルから読み取る。
-type Param struct {
-	Inst     string  // Instrument: "USD_JPY","EUR_USD"等
-	Gran     string  // granularity："M5","H4",等。
-	Seconds  int     // granularityを秒数で表したもの。"M5" -> 300
-	Span     int     // Gran何個分で予測するか
-	Thresh   float64 // レンジ判定の閾値
-	ProfRate float64 // 利確ライン
-	LossRate float64 // 損切ライン
-	Spread   float64 // 許容スプレッド
-	Units    int     // 取引量
-}
-
-// ファイルからパラメタを読みってParam structを返す
-func loadParam(fpath string) *Param {
-	b, err := os.ReadFile(fpath)
-	if err != nil {
-		panic(err)
-	}
-	p := &Param{}
-	json.Unmarshal(b, p)
-	return p
-}
-
-// パラメタをもとに保有ポジションを取得して返す。
-// PositionDataにはLong,Shortそれぞれfieldがあるので留意。
-func position(goq *oanda.Goquest, prm *Param) *oanda.PositionData {
-	pos := oanda.NewPosition(goq, prm.Inst)
-	data := pos.Extract()
-	if data == nil {
-		return nil
-	}
-	return data
-}
-
-// マーケットが空いているかチェック。パラメタは最後のロウソク足を想定
-// 現在時刻と最後のロウソク足を比較し、prm.Granの3倍以上開いていたら閉じていると判断させる。
-func isMarketOpen(cs oanda.CandleStick, prm *Param) bool {
-	ct, err := time.Parse(layout(), cs.Time)
-	if err != nil {
-		fmt.Printf("marketopen:Could not parse time:%v\n", cs.Time)
-		return false
-	}
-	now := time.Now().Unix()
-	diff := now - ct.Unix()
-	// 3倍を超えていたらマーケットが閉じていると判断
-	if diff >= int64(prm.Seconds)*3 {
-		// fmt.Printf("Market might be closed...Last:%v,Now:%v,diff:%v\n", ct.Unix(), time.Now().UTC(), diff)
-		return false
-	}
-	return true
-}
-
-// パラメタをもとにロウソク足取得
-func candles(goq *oanda.Goquest, prm *Param) oanda.CandleSticks {
-	span := prm.Span + 1 // ロウソク足が完成していないものが入っている可能性があるので＋1
-	cd := oanda.NewCandles(goq, span, prm.Gran, prm.Inst, "", "", "")
-	sticks := cd.ExtractMid()
-	if sticks != nil {
-		// 完成したロウソク足のみ抽出
-		sticks = sticks.Complete()
-		// 長さを超えている場合はslice
-		st := len(sticks) - prm.Span
-		sticks = sticks[st:]
-		// 所定の長さに達していなかったらログ
-		if len(sticks) != prm.Span {
-			fmt.Printf("Stick length does not match Param. Stick.length:%v\n", len(sticks))
-		}
-	}
-	return sticks
-}
+// 取引時にツイートするか。simulatorで動かすときはfalse。
+var TWEET = true
 
-// candlesをよりbacktestに近づけた版
-func candlesLikeBTest(goq *oanda.Goquest, prm *Param) oanda.CandleSticks {
-	// ロウソク足が完成していないものが入っている可能性があるので+1
-	// 最後のロウソク足を現在値として扱う。それを除いてprm.Span分データが欲しいので、さらに+1
-	span := prm.Span + 2
-	cd := oanda.NewCandles(goq, span, prm.Gran, prm.Inst, "", "", "")
-	sticks := cd.ExtractMid()
-	if sticks != nil {
-		// 完成したロウソク足のみ抽出
-		sticks = sticks.Complete()
-		// 長さを超えている場合はslice。
-		// sticksが全てComplete状態ならprm.Span+2の長さになり得るが、想定はしていない。
-		st := len(sticks) - 1 - prm.Span
-		sticks = sticks[st:]
-		// prm.Span + 1 と長さが一致しない場合は想定外。ログを吐く。
-		if len(sticks) != prm.Span+1 {
-			fmt.Printf("Stick length does not match Param. Stick.length:%v\n", len(sticks))
-		}
-	}
-	return sticks
-}
+// APIキーのファイル
+var KEY_FILE = "./key.json"
 
-// 現在のPrice取得
-func latestPrice(goq *oanda.Goquest, prm *Param) *oanda.Price {
-	pr := oanda.NewPricing(goq, prm.Inst).Latest(prm.Inst)
-	return pr
-}
+// ロウソク足のローカルキャッシュのディレクトリ。fetch-candlesの保存先と同じ。
+// 1リクエストの上限を超えるSpanの戦略はここから読み込む。
+var CANDLE_DIR = "./candles"
 
-// botの総利益
-func totalPL(goq *oanda.Goquest) float64 {
-	acc := oanda.NewAccount(goq)
-	data := acc.Extract()
-	if data == nil {
-		return 0.0
-	}
-	return data.Balance - INITIAL_BALANCE
-}
+// APIのリクエスト数の上限(1秒あたり)。全口座・全通貨ペアで共有する。oandaの制限は100。
+var RATE_LIMIT = 50.0
 
-// Longポジを持っていいれば"BUY"、Shortなら"SELL"を返す
-// 両建て不可アカウントを想定しているため、両方は存在することは想定しない。
-// ポジ無しの時は空文字を返す
-func tradeSide(p *oanda.PositionData) string {
-	if !p.Has() {
-		return ""
-	}
-	if p.Long.Units > 0 {
-		return "BUY"
-	}
-	if p.Short.Units < 0 {
-		return "SELL"
-	}
-	return ""
-}
+// 1口座分。口座毎にディレクトリを分けてファイルを書き出す。
+// param.jsonの通貨ペア毎にbotを作り、並行して取引する。
+type account struct {
+	name string // key.jsonのaccountsの名前。単一口座の場合は空
+	dir  string // param.json,tweet用画像等を置くディレクトリ
+	goq  *oanda.Goquest
 
-// 保有ポジと逆サイドを返す。決済の向きを指定するために使う
-func closingSide(side string) string {
-	if side == "BUY" {
-		return "SELL"
-	}
-	if side == "SELL" {
-		return "BUY"
-	}
-	return ""
-}
+	// 約定通知(transaction stream)の購読用。runで起動し、各botのexecが約定確認に使う。
+	txDispatcher *oanda.TransactionDispatcher
+	// 口座全体の評価額込み残高の推移。各botが記録し、リスク管理が読む
+	equity *equityLog
 
-// 売買判定ロジック
-func breakThrough(v float64, inf *minmax.Inf) string {
-	if v > inf.Maxv {
-		return "BUY"
-	}
-	if v < inf.Minv {
-		return "SELL"
-	}
-	return ""
+	bots []*bot
 }
 
-// v: 現在価格。p:取得価格 side:"BUY"or"SELL",prm: Param
-func isProfFilled(v float64, p float64, side string, prm *Param) bool {
-	if side == "BUY" {
-		return (v-p)/p >= prm.ProfRate
-	} else {
-		return (p-v)/p >= prm.ProfRate
-	}
+// 1口座・1通貨ペア分のbot。
+type bot struct {
+	acct *account
+	dir  string // trade.json,balance.json等を出力するディレクトリ
+	prm  *Param
+
+	// 前フレーム終了時点で保有していたtradeのIDとside。
+	// oanda側の利確・損切注文で決済されたことを検知するために使う。
+	heldIDs, heldSide string
+
+	// 口座・ロウソク足・価格の取得。口座情報は同じ口座のbotで共有する
+	data MarketData
+	// 売買判定。param.jsonのStrategyで選ぶ
+	strat strategy.Strategy
+	// 新規取引の量。param.jsonのSizingで選ぶ
+	sizer sizing.Sizer
+	// 注文の執行
+	exec Executor
+	// 新規注文前のリスク確認とkill switch。execと共有する
+	risk RiskChecker
+	// trade.json,balance.jsonへの記録
+	report Reporter
+
+	// kill switchで保有ポジを閉じ終えたらtrue。runを終了する
+	halted bool
 }
 
-// v: 現在価格。p:取得価格 side:"BUY"or"SELL",prm: Param
-func isLossFilled(v float64, p float64, side string, prm *Param) bool {
-	if side == "BUY" {
-		return (v-p)/p <= prm.LossRate
-	} else {
-		return (p-v)/p <= prm.LossRate
-	}
-}
+// ロジックに使うパラメタ。backtestと共通なのでstrategyに置いている。
+type Param = strategy.Param
 
-// spreadが許容値になるまで待つ
-func waitSpread(goq *oanda.Goquest, price *oanda.Price, prm *Param, secs int) *oanda.Price {
-	if price.Spread() <= prm.Spread {
-		return price
-	}
-	for i := 0; i < secs; i++ {
-		time.Sleep(time.Second * 1)
-		p := latestPrice(goq, prm)
-		if p == nil {
-			continue
-		}
-		if p.Spread() <= prm.Spread {
-			return p
-		}
-	}
-	return nil
+// param.jsonの1通貨ペア分。戦略のParamに、botだけで使う設定を加えたもの。
+type botParam struct {
+	Param
+	// 取引量の決め方。省略するとUnitsの固定量
+	Sizing sizing.Config
+	// 新規注文前のリスク管理。口座全体の制限はトップレベルに書く
+	Risk risk.Limits
 }
 
-// orderIDの注文がFILLEDになるまで待つ。sec秒待ってもFILLしない場合、falseを返す
-func waitOrderFill(goq *oanda.Goquest, orderID string, sec int) bool {
-	// 300ミリ秒ごとに実行
-	for i := 0.3; i < float64(sec); i += 0.3 {
-		order := oanda.NewOrderData(goq, orderID)
-		if order == nil {
-			fmt.Printf("Could not get orderID:%v \n", orderID)
-			continue
-		}
-		status := order.OrderStatus()
-		if status == "FILLED" {
-			return true
-		}
-		time.Sleep(300 * time.Millisecond)
+// ファイルから通貨ペア毎のパラメタを読み取る
+func loadParams(fpath string) []*botParam {
+	ps, err := strategy.LoadParamsAs(fpath, func(p *botParam) *Param { return &p.Param })
+	if err != nil {
+		panic(err)
 	}
-	return false
+	return ps
 }
 
-// 成行き注文。両建て不可アカウントなので、openもcloseもこれで完結
-// go で呼ぶこと。
-func marketOrder(goq *oanda.Goquest, inst, side string, units int, ch chan string) {
-	// 売りの場合はunitをマイナスで指定する仕様
-
-	if side == "SELL" {
-		units *= -1
-	}
-	// 注文してorder IDを抽出
-	order := oanda.NewMarketOrder(goq, inst, units)
-	id := order.Id()
-	// IDが取得できない場合はリターン
-	if id == "" {
-		fmt.Printf("marketOrder: id was empty:%v", id)
-		ch <- ""
-		return
-	}
-	// orderが完了するまで待つ
-	isFilled := waitOrderFill(goq, id, 6)
-
-	if isFilled {
-		ch <- id
-		return
+// マーケットが空いているかチェック。パラメタは最後のロウソク足を想定
+// 現在時刻と最後のロウソク足を比較し、prm.Granの3倍以上開いていたら閉じていると判断させる。
+func isMarketOpen(cs oanda.CandleStick, prm *Param) bool {
+	ct := cs.Time
+	if ct.IsZero() {
+		fmt.Println("marketopen:Could not parse time")
+		return false
 	}
-	ch <- ""
-}
-
-// 保有ポジションをcloseする処理。ヘルパー。orderがFILLEDになるまで待つ。
-func closeOrder(goq *oanda.Goquest, pos *oanda.PositionData, prm *Param, ch chan string) {
-	posSide := tradeSide(pos)
-	closeSide := closingSide(posSide)
-	units := pos.Units()
-	// marketOrderでSELL時はunit *= -1にする処理があるので、ここでは絶対値にしておく
-	units = int(math.Abs(float64(units)))
-	marketOrder(goq, prm.Inst, closeSide, units, ch)
-}
-
-// 実現損益をtweetメッセージに設定
-func addClosingMsg(goq *oanda.Goquest, prm *Param, ids string, m *Message) {
-	trades := oanda.NewTrades(goq, ids, "CLOSED", prm.Inst, "", "")
-	realized, _ := trades.PL()
-	m.realizedProf = realized
-}
-
-// 保有中ポジションの情報をメッセージにセット。
-func addPositionMsg(goq *oanda.Goquest, prm *Param, ids string, m *Message) {
-	trades := oanda.NewTrades(goq, ids, "OPEN", prm.Inst, "", "")
-	_, unrealized := trades.PL() // 評価額
-	units := trades.Units()
-	if units > 0 {
-		m.side = "LONG"
-	} else {
-		m.side = "SHORT"
+	now := clock.Now().Unix()
+	diff := now - ct.Unix()
+	// 3倍を超えていたらマーケットが閉じていると判断
+	if diff >= int64(prm.Gran.Duration()/time.Second)*3 {
+		// fmt.Printf("Market might be closed...Last:%v,Now:%v,diff:%v\n", ct.Unix(), time.Now().UTC(), diff)
+		return false
 	}
-	m.unrealizedProf = unrealized
-	m.units = units
-}
-
-func addTotalPLMsg(pl float64, m *Message) {
-	m.totalProf = pl
+	return true
 }
 
-// ロジック部分
-func frame(goq *oanda.Goquest, prm *Param) *Message {
-	pos := position(goq, prm)
-	sticks := candlesLikeBTest(goq, prm)
-	price := latestPrice(goq, prm)
-
-	// graph用データの最大個数
-	mlen := 5000
-
-	// このフレームでの新規取引フラグ
-	willClose := false
-	chOrder := make(chan string, 1)
-
-	// chOrderの受け皿。open取引のorderID
-	// close時には設定しないで。
-	openOrderId := ""
-
-	msg := NewMessage() // tweet用
+// ロジック部分。データ取得はMarketData、判定はstrategy、注文はExecutor、記録はReporterに任せる。
+// ctxがキャンセルされると実行中のリクエストや待機も中断される。
+func (b *bot) frame(ctx context.Context) *Message {
+	prm := b.prm
+	msg := NewMessage(prm.Inst) // tweet用
 
-	// apiで取得できないデータがあれば処理なし
-	if pos == nil || sticks == nil || price == nil {
-		fmt.Println("pos,sticks,or price is nil.")
+	// apiの呼び出しに失敗した場合は処理なし。次のフレームで再実行される。
+	snap, err := b.data.Snapshot(ctx, b.strat.Span())
+	if err != nil {
+		fmt.Printf("%vframe:%v\n", b.logPrefix(), err)
 		return msg
 	}
 
 	// マーケットが閉じているっぽければ処理なし
-	if !isMarketOpen(sticks[len(sticks)-1], prm) {
+	if !isMarketOpen(snap.Last, prm) {
 		return msg
 	}
 
 	// 現在価格
-	current := price.Mid()
+	current := snap.Price.Mid()
 
 	// 現在価格が取得できない場合は処理なし
 	if current == oanda.EmptyError {
@@ -332,122 +159,237 @@ func frame(goq *oanda.Goquest, prm *Param) *Message {
 	}
 
 	// 最後のロウソク足のopentime。現在時刻とはprm.Gran分前の時間になるので留意。
-	openTime := toUnix(sticks[len(sticks)-1].Time)
-
-	// sticksはprm.Span+1になっているはずなので、直近のデータをpop。
-	sticks = sticks[:len(sticks)-1]
-	// pop後に長さがprm.Spanと一致しない場合はログ。
-	if len(sticks) != prm.Span {
-		fmt.Println("sticks length was:", len(sticks))
-	}
+	openTime := snap.Last.Time.Unix()
 
-	// 最大値と最小値をセット。AddWrapしてるが今のところ使う予定なし
-	highs, lows := sticks.Extract("H"), sticks.Extract("L")
-	inf := minmax.NewInf(highs, lows).AddWrap(current)
-
-	// 値幅
-	vel := 1 - (inf.Minv / inf.Maxv)
-	// 新規取引判定 "BUY","SELL",""
-	dec := breakThrough(current, inf)
 	// 保有ポジ。long->"BUY", short->"SELL", なし->""
+	pos := snap.Position
 	side := tradeSide(pos)
+	// 新規取引判定 "BUY","SELL",""と決済判定
+	d := decide(b.strat, snap, current)
+	// kill switchが入っていたら新規取引はせず、保有ポジをspreadを待たずに閉じる
+	killed := b.risk.Killed()
+	if killed {
+		fmt.Printf("%vframe:kill switch is on\n", b.logPrefix())
+		d = strategy.Decision{Close: len(side) > 0, Reason: "kill switch"}
+	}
 
-	// 逆向きポジを持っていて、かつ値幅が閾値を超えていれば決済。
-	if len(dec) > 0 {
-		if len(side) > 0 && side != dec && vel > prm.Thresh {
-			willClose = true
-		}
+	// 前フレームで保有していたポジションが無くなっていたら、oanda側の利確・損切で決済されている
+	closedByExit := len(b.heldIDs) > 0 && len(side) == 0
+	closedIDs := b.heldIDs
+	if closedByExit {
+		b.report.Trade(openTime, current, strategy.ClosingSide(b.heldSide), "CLOSE")
+		msg.close()
 	}
 
-	// ポジションがあり、上でcloseしていない場合、利確・損切処理を実施
-	if len(side) > 0 && !willClose {
-		// 平均取得価格
-		posData := pos.Side()
-		avg := posData.Average
+	// 取引する場合は判定理由をログ
+	if d.Close || len(d.Open) > 0 && len(side) == 0 {
+		fmt.Printf("%vframe:%v\n", b.logPrefix(), d.Reason)
+	}
 
-		if isLossFilled(current, avg, side, prm) {
-			willClose = true
-		}
-		if isProfFilled(current, avg, side, prm) {
-			willClose = true
+	// ポジションがあり、closeしない場合、利確・損切注文がoanda側にあるか確認
+	if len(side) > 0 && !d.Close {
+		if err := b.exec.ReconcileExits(ctx, snap.Instrument, b.data.Trades(), current); err != nil {
+			fmt.Printf("%vframe:reconcileExits:%v\n", b.logPrefix(), err)
 		}
 	}
 
 	// ****************************************************
-	// 保有ポジを閉じる処理
+	// 注文処理。逆向きポジを閉じる判定なら閉じる。
+	// 新規取引判定されている場合で、保有ポジションが無い場合、
+	// もしくは本フレームでクローズする場合、新規取引
 	// ****************************************************
-	if willClose {
-		// spreadが許容値になるまで待つ。待っても収まらない場合は取引しない。
-		price = waitSpread(goq, price, prm, 15)
-		if price != nil {
-			go closeOrder(goq, pos, prm, chOrder)
-			// 結局待つwww
-			<-chOrder
-			// tradeグラフ用データをファイルに出力
-			writeTrade(TRADE_FILE, mlen, openTime, current, closingSide(side), "CLOSE")
-			// Messageにcloseフラグをつける
-			msg.close()
+	plan := &OrderPlan{Close: d.Close, Position: pos, Instrument: snap.Instrument, Price: snap.Price, Force: killed}
+	if len(side) == 0 || d.Close {
+		plan.Open = d.Open
+	}
+	if len(plan.Open) > 0 {
+		plan.Units = b.orderUnits(ctx, snap, current)
+	}
+	ex := b.exec.Execute(ctx, plan)
+	if ex.Closed {
+		// tradeグラフ用データをファイルに出力し、Messageにcloseフラグをつける
+		b.report.Trade(openTime, current, strategy.ClosingSide(side), "CLOSE")
+		msg.close()
+	}
+	if ex.Opened {
+		b.report.Trade(openTime, current, plan.Open, "OPEN")
+		msg.open()
+	}
+
+	// 取引した場合は口座情報を同期しなおす
+	synced := true
+	if ex.Closed || len(ex.OpenOrderID) > 0 {
+		if err := b.data.Sync(ctx); err != nil {
+			fmt.Printf("%vframe:account:%v\n", b.logPrefix(), err)
+			synced = false
+		}
+	}
+
+	// 約定価格で利確・損切を合わせる
+	if len(ex.OpenOrderID) > 0 && synced {
+		if err := b.exec.ReconcileExits(ctx, snap.Instrument, b.data.Trades(), current); err != nil {
+			fmt.Printf("%vframe:reconcileExits:%v\n", b.logPrefix(), err)
 		}
 	}
 
 	// ****************************************************
-	// 新規購入処理。
-	// 新規取引判定されている場合で、保有ポジションが無い場合、
-	// もしくは本フレームでクローズしている場合、新規取引
+	// フレーム終了時点の保有tradeを記録。次のフレームでoanda側の決済を検知するため。
+	// 新規取引した場合はポジションをとりなおす。
 	// ****************************************************
-	if len(dec) > 0 {
-		if len(side) == 0 || willClose {
-			price = waitSpread(goq, price, prm, 15)
-			if price != nil {
-				go marketOrder(goq, prm.Inst, dec, prm.Units, chOrder)
-				<-chOrder
-				// tradeグラフ用データをファイルに出力
-				// writeTrade(TRADE_FILE, mlen, openTime, current, closingSide(side), "OPEN")
-				writeTrade(TRADE_FILE, mlen, openTime, current, dec, "OPEN")
-				// Messageにopenフラグをつける
-				msg.open()
-			}
+	var newPos *oanda.PositionData
+	if len(ex.OpenOrderID) > 0 {
+		if synced {
+			newPos = b.data.Position()
+			b.heldIDs, b.heldSide = newPos.Ids(), tradeSide(newPos)
 		}
+	} else if ex.Closed {
+		b.heldIDs, b.heldSide = "", ""
+	} else {
+		b.heldIDs, b.heldSide = pos.Ids(), side
+	}
+	// kill switchで保有ポジが無くなったら停止。閉じられなかった場合は次のフレームで再度閉じる
+	if killed && synced && len(tradeSide(b.data.Position())) == 0 {
+		b.halted = true
 	}
 
 	// ****************************************************
 	// tweet処理
 	// ****************************************************
 	tradeIDs := pos.Ids()
-	if willClose {
+	if closedByExit {
+		// oanda側で決済されたtradeの確定損益を設定する
+		tradeIDs = closedIDs
+	}
+	if ex.Closed || closedByExit {
 		// closeした場合は確定損益を設定
-		addClosingMsg(goq, prm, tradeIDs, msg)
-		if len(openOrderId) > 0 {
+		if err := addClosingMsg(ctx, b.data, tradeIDs, msg); err != nil {
+			fmt.Printf("%vframe:closingMsg:%v\n", b.logPrefix(), err)
+		}
+		if newPos != nil {
 			// 同じフレームで新規open取引をしていたら、その情報を設定
-			// 新規取引なので新たにポジションをとりなおす。
-			newPos := position(goq, prm)
-			newTradeIds := newPos.Ids()
-			addPositionMsg(goq, prm, newTradeIds, msg)
+			addPositionMsg(b.data.Trades(), newPos.Ids(), msg)
 		}
 	} else {
 		// 決済されていない場合、保有ポジションの情報を設定。無い場合は全てzero-valueになる（はず）。
-		addPositionMsg(goq, prm, tradeIDs, msg)
+		addPositionMsg(b.data.Trades(), tradeIDs, msg)
 	}
 
-	acc := oanda.NewAccount(goq)
-	accData := acc.Extract()
-	var tpl, upl float64 // 総利益,評価額込みの総利益
-	if accData != nil {
-		tpl = accData.Balance - INITIAL_BALANCE
-		upl = tpl + accData.UnrealizedPL
-	}
-	// tpl := totalPL(goq)
+	accData := b.data.Account()
+	tpl := accData.Balance - b.initialBalance() // 総利益
+	upl := tpl + accData.UnrealizedPL           // 評価額込みの総利益
 	addTotalPLMsg(tpl, msg)
 
 	// balance用データをファイルに出力
-	writeBalance(TOTAL_PROF_FILE, mlen, openTime, current, upl)
+	b.report.Balance(openTime, current, upl)
+	b.report.Equity(openTime, risk.Equity(&accData))
 
 	return msg
 }
 
-func trade() {
-	goq := oanda.NewGoquest("./key.json", "live")
-	prm := loadParam("./param.json")
+// name:key.jsonのaccountsの名前。空ならliveの口座で、カレントディレクトリにファイルを書き出す。
+// 名前付きの口座は./{name}/にファイルを書き出す。param.jsonは./{name}/param.jsonがあればそれを、無ければ./param.jsonを使う。
+// param.jsonに複数の通貨ペアがある場合、trade.json,balance.jsonは{口座のディレクトリ}/{Inst}/に書き出す。
+// optsはGoquestに渡す。mock serverに向けるときなどに使う。
+func newAccount(name string, opts ...oanda.Option) (*account, error) {
+	a := &account{name: name, dir: "."}
+	var err error
+	if len(name) == 0 {
+		a.goq, err = oanda.NewGoquest(KEY_FILE, "live", opts...)
+	} else {
+		a.dir = filepath.Join(".", name)
+		a.goq, err = oanda.NewGoquestAccount(KEY_FILE, name, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prmFile := filepath.Join(a.dir, "param.json")
+	if _, err := os.Stat(prmFile); err != nil {
+		prmFile = "./param.json"
+	}
+	prms := loadParams(prmFile)
+	a.txDispatcher = oanda.NewTransactionDispatcher()
+	a.equity = newEquityLog(filepath.Join(a.dir, EQUITY_FILE))
+	cache := newAccountCache(a.goq)
+	for _, bp := range prms {
+		prm := &bp.Param
+		b := &bot{acct: a, dir: a.dir, prm: prm}
+		if len(prms) > 1 {
+			b.dir = filepath.Join(a.dir, prm.Inst)
+		}
+		if err := os.MkdirAll(b.dir, 0755); err != nil {
+			return nil, err
+		}
+		if b.strat, err = strategy.New(prm); err != nil {
+			return nil, err
+		}
+		if b.sizer, err = sizing.New(bp.Sizing); err != nil {
+			return nil, err
+		}
+		b.data = newAPIData(a.goq, prm, cache)
+		b.risk = newLimitRisk(bp.Risk, b.data, a.equity)
+		b.exec = newAPIExecutor(a.goq, prm, b.strat, a.txDispatcher, b.risk)
+		b.report = newFileReporter(b.path(TRADE_FILE), b.path(TOTAL_PROF_FILE), a.equity)
+		a.bots = append(a.bots, b)
+	}
+	return a, nil
+}
+
+// 複数口座で動かす場合、ログにどの口座か付ける
+func (a *account) logPrefix() string {
+	if len(a.name) == 0 {
+		return ""
+	}
+	return "[" + a.name + "]"
+}
+
+// ctxがキャンセルされるまで、通貨ペア毎のbotを並行して動かす
+func (a *account) run(ctx context.Context) {
+	// 約定をstreamで受け取る
+	go a.txDispatcher.Run(ctx, a.goq, func(err error) {
+		fmt.Printf("%vtransactions:%v\n", a.logPrefix(), err)
+	})
+	var wg sync.WaitGroup
+	for _, b := range a.bots {
+		wg.Add(1)
+		go func(b *bot) {
+			defer wg.Done()
+			b.run(ctx)
+		}(b)
+	}
+	wg.Wait()
+}
+
+// botのディレクトリ内のファイルのパス
+func (b *bot) path(fname string) string {
+	return filepath.Join(b.dir, fname)
+}
+
+// 総利益の基準にする稼働時の残高
+func (b *bot) initialBalance() float64 {
+	if b.prm.InitialBalance != 0 {
+		return b.prm.InitialBalance
+	}
+	return INITIAL_BALANCE
+}
+
+// 複数口座・複数通貨ペアで動かす場合、ログにどの口座・通貨ペアか付ける
+func (b *bot) logPrefix() string {
+	tags := []string{}
+	if len(b.acct.name) > 0 {
+		tags = append(tags, b.acct.name)
+	}
+	if len(b.acct.bots) > 1 {
+		tags = append(tags, b.prm.Inst)
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(tags, ":") + "]"
+}
+
+// ctxがキャンセルされるまで取引処理を繰り返す
+func (b *bot) run(ctx context.Context) {
+	prm := b.prm
 
 	// trackerは廃止。取引したフレームでツイートするように変更
 	// ***********************************************
@@ -456,27 +398,122 @@ func trade() {
 	// ***********************************************
 
 	for {
-		// 所定の時刻まで待つ
-		tick(int64(prm.Seconds))
+		// 所定の時刻まで待つ。待機中にキャンセルされたら終了
+		if !clock.Tick(ctx, prm.Gran) {
+			return
+		}
 		// 取引処理を実行し、結果のメッセージを取得
-		msg := frame(goq, prm)
+		// 1フレームがGran分を超えないようにdeadlineを設定
+		fctx, cancel := context.WithTimeout(ctx, prm.Gran.Duration())
+		msg := b.frame(fctx)
+		cancel()
 		// openかclose処理がされていたらツイート
-		if msg.didClose || msg.didOpen {
-			cmd := exec.Command(genPyCommand(), IMG_PYSCRIPT, IMG_PATH)
-			b, err := cmd.CombinedOutput()
-			if err != nil {
-				//err時は表示
-				fmt.Println(err)
-				fmt.Println(string(b))
-			}
-			twitter := gotweet.NewTwitter("./twitter.json")
-			twitter.Tweet(msg.String(), IMG_PATH)
+		if TWEET && (msg.didClose || msg.didOpen) {
+			b.tweet(msg)
+		}
+		if b.halted {
+			fmt.Printf("%vhalted by kill switch\n", b.logPrefix())
+			return
+		}
+	}
+}
+
+// namesの口座毎にaccountを作り、ctxがキャンセルされるまで並行して取引する。
+// namesが空ならliveの口座で1つだけ動かす。
+// optsはGoquestに渡す。mock serverに向けるときなどに使う。
+func trade(ctx context.Context, names []string, opts ...oanda.Option) {
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	accounts := []*account{}
+	for _, name := range names {
+		a, err := newAccount(name, opts...)
+		if err != nil {
+			panic(err)
 		}
+		accounts = append(accounts, a)
+	}
+	if err := checkSimBots(accounts); err != nil {
+		panic(err)
+	}
+	var wg sync.WaitGroup
+	for _, a := range accounts {
+		wg.Add(1)
+		go func(a *account) {
+			defer wg.Done()
+			a.run(ctx)
+		}(a)
+	}
+	wg.Wait()
+}
+
+// simulatorの時刻はbotがTickする度に進むので、botが複数あると1フレームで複数足進んでしまう。
+// simulatorは1口座・1通貨ペアしか再生できないこともあり、-simではbotを1つに限る。
+func checkSimBots(accounts []*account) error {
+	if _, ok := clock.(*sim.RemoteClock); !ok {
+		return nil
+	}
+	n := 0
+	for _, a := range accounts {
+		n += len(a.bots)
+	}
+	if n > 1 {
+		return fmt.Errorf("-sim supports only one account and one instrument, got %v bots", n)
+	}
+	return nil
+}
+
+// tokenで操作できる口座(サブアカウント含む)の一覧を表示する。key.jsonのaccountsを書く時に使う。
+func listAccounts(ctx context.Context, opts ...oanda.Option) {
+	goq, err := oanda.NewGoquest(KEY_FILE, "live", opts...)
+	if err != nil {
+		panic(err)
+	}
+	res, err := oanda.NewAccountListContext(ctx, goq)
+	if err != nil {
+		fmt.Printf("listAccounts:%v\n", err)
+		return
+	}
+	for _, a := range res.Extract() {
+		fmt.Println(a.ID, strings.Join(a.Tags, ","))
 	}
 }
 
 func main() {
-	trade()
+	// -url でAPIの向き先を上書きできる。ローカルのsimulator等で動かす用。
+	baseURL := flag.String("url", "", "Oanda API base url (ex. http://localhost:8080/v3)")
+	// -sim でsimulatorの時刻で動かす。実時間は待たずに次の足に進む。
+	simURL := flag.String("sim", "", "oanda-sim url (ex. http://localhost:8080)")
+	// -accounts でkey.jsonのaccountsに定義した口座を並行して動かす。
+	accounts := flag.String("accounts", "", "comma separated account names in key.json (ex. main,sub1)")
+	// -list-accounts でtokenで操作できる口座の一覧を表示して終了する。
+	list := flag.Bool("list-accounts", false, "list accounts available for the token and exit")
+	flag.Parse()
+
+	// リクエスト数の制限は全口座・全通貨ペアで共有する
+	opts := []oanda.Option{oanda.WithRateLimiter(oanda.NewRateLimiter(RATE_LIMIT, 10))}
+	if *baseURL != "" {
+		opts = append(opts, oanda.WithBaseURL(*baseURL))
+	}
+	if *simURL != "" {
+		clock = sim.NewRemoteClock(*simURL)
+		TWEET = false
+	}
+
+	// SIGINT,SIGTERMで実行中のリクエストをキャンセルして終了
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *list {
+		listAccounts(ctx, opts...)
+		return
+	}
+	names := []string{}
+	for _, name := range strings.Split(*accounts, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	trade(ctx, names, opts...)
 }
 
 // Test Codes
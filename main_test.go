@@ -0,0 +1,820 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/history"
+	"github.com/zenryokukun/oanda-bot/oanda/sim"
+	"github.com/zenryokukun/oanda-bot/sizing"
+	"github.com/zenryokukun/oanda-bot/strategy"
+)
+
+// 1日周期で上下するH1足。ブレイクアウトと決済が数日で何度か起きる。
+func simCandles(days int) []sim.Candle {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cs := []sim.Candle{}
+	for i := 0; i < days*24; i++ {
+		o := 150 + 3*math.Sin(2*math.Pi*float64(i)/24)
+		c := 150 + 3*math.Sin(2*math.Pi*float64(i+1)/24)
+		cs = append(cs, sim.Candle{
+			Time: start.Add(time.Duration(i) * time.Hour),
+			O:    o,
+			H:    math.Max(o, c) + 0.05,
+			L:    math.Min(o, c) - 0.05,
+			C:    c,
+		})
+	}
+	return cs
+}
+
+// liveの口座だけのkey.json
+func liveKey(accountID string) string {
+	return fmt.Sprintf(`{"live":{"id":%q,"token":"token"}}`, accountID)
+}
+
+// テスト用のkey.json,param.jsonを置いたディレクトリに移動する
+func chdirTemp(t *testing.T, key string, prm *Param) {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.json"), []byte(key), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(prm)
+	if err := os.WriteFile(filepath.Join(dir, "param.json"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// APIを呼ばないapiExecutorと、instの表示桁数を設定したInstrument。JPYの通貨ペアは小数3桁、それ以外は5桁。
+func newTestExecutor(prm *Param) (*apiExecutor, *oanda.Instrument) {
+	inst := &oanda.Instrument{Name: prm.Inst, DisplayPrecision: 5, MinimumTradeSize: 1}
+	if strings.HasSuffix(prm.Inst, "_JPY") {
+		inst.DisplayPrecision = 3
+	}
+	if prm.Span == 0 {
+		prm.Span = 1
+	}
+	strat, _ := strategy.New(prm)
+	return newAPIExecutor(nil, prm, strat, nil, nil), inst
+}
+
+// simulator上で数日分trade()を回し、約定・残高・trade.jsonが一致することを確認する
+func TestTradeWithSim(t *testing.T) {
+	cfg := sim.Config{
+		AccountID:   "001-001-0000001-001",
+		Instrument:  "USD_JPY",
+		Granularity: "H1",
+		Spread:      0.008,
+		Balance:     250000,
+		Warmup:      12,
+		Candles:     simCandles(5),
+	}
+	srv, err := sim.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	prm := &Param{
+		Inst: "USD_JPY", Gran: "H1", Span: 6,
+		Thresh: 0.005, ProfRate: 0.01, LossRate: -0.01, Spread: 0.01, Units: 1000,
+	}
+	chdirTemp(t, liveKey(cfg.AccountID), prm)
+
+	oldClock, oldTweet, oldBalance := clock, TWEET, INITIAL_BALANCE
+	clock, TWEET, INITIAL_BALANCE = sim.NewRemoteClock(ts.URL), false, cfg.Balance
+	defer func() { clock, TWEET, INITIAL_BALANCE = oldClock, oldTweet, oldBalance }()
+
+	// trade()が起動したstreamを止めてからserverを閉じる
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// データが尽きるとclock.Tickがfalseになり終了する
+	trade(ctx, nil, oanda.WithBaseURL(ts.URL+"/v3"))
+
+	if want := cfg.Candles[len(cfg.Candles)-1].Time.Add(time.Hour); !srv.Now().Equal(want) {
+		t.Errorf("sim stopped at %v, want %v", srv.Now(), want)
+	}
+
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey(cfg.AccountID, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trades, err := oanda.NewTradesContext(ctx, goq, "", "ALL", prm.Inst, "500", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := NewTradeHistory()
+	load(TRADE_FILE, td)
+
+	// trade.jsonのOPENはsimのtradeと1対1。約定価格はmid±spread/2
+	opens := []float64{}
+	closes := 0
+	for i, a := range td.Action {
+		switch a {
+		case "OPEN":
+			opens = append(opens, td.Y[i])
+		case "CLOSE":
+			closes++
+		}
+	}
+	if len(opens) < 2 || closes < 1 {
+		t.Fatalf("too few trades: open=%v close=%v", len(opens), closes)
+	}
+	sims := trades.Extract()
+	if len(sims) != len(opens) {
+		t.Fatalf("sim trades = %v, trade.json opens = %v", len(sims), len(opens))
+	}
+	// CLOSEはbotの決済とoanda側の利確・損切の両方を記録している
+	closed := 0
+	for _, tr := range sims {
+		if tr.State == "CLOSED" {
+			closed++
+		}
+	}
+	if closed != closes {
+		t.Errorf("sim closed trades = %v, trade.json closes = %v", closed, closes)
+	}
+	realized := 0.0
+	for i, tr := range sims {
+		// simは新しい順
+		mid := opens[len(opens)-1-i]
+		if d := math.Abs(tr.Price - mid); math.Abs(d-cfg.Spread/2) > 1e-6 {
+			t.Errorf("trade %v: price %v, mid %v", tr.ID, tr.Price, mid)
+		}
+		if abs := int(math.Abs(float64(tr.InitialUnits))); abs != prm.Units {
+			t.Errorf("trade %v: units %v", tr.ID, tr.InitialUnits)
+		}
+		realized += tr.RealizedPL
+	}
+	if math.Abs(srv.Balance()-cfg.Balance-realized) > 1e-6 {
+		t.Errorf("balance %v, want %v", srv.Balance(), cfg.Balance+realized)
+	}
+
+	// balance.jsonの最後はsimの評価額込みの総利益
+	acc, err := oanda.NewAccountContext(ctx, goq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := acc.Extract()
+	bl := NewBalanceHistory()
+	load(TOTAL_PROF_FILE, bl)
+	if len(bl.TotalPL) == 0 {
+		t.Fatal("balance.json is empty")
+	}
+	last := bl.TotalPL[len(bl.TotalPL)-1]
+	if want := data.Balance + data.UnrealizedPL - cfg.Balance; math.Abs(last-want) > 1e-6 {
+		t.Errorf("balance.json last = %v, want %v", last, want)
+	}
+}
+
+func TestExitPrices(t *testing.T) {
+	tests := []struct {
+		inst   string
+		p      float64
+		side   string
+		tp, sl float64
+	}{
+		{"USD_JPY", 150, "BUY", 151.5, 148.5},
+		{"USD_JPY", 150, "SELL", 148.5, 151.5},
+		{"USD_JPY", 150.1234, "BUY", 151.625, 148.622},
+		{"EUR_USD", 1.1, "BUY", 1.111, 1.089},
+	}
+	for _, tt := range tests {
+		e, inst := newTestExecutor(&Param{Inst: tt.inst, ProfRate: 0.01, LossRate: -0.01})
+		tp, sl := e.exitPrices(inst, tt.p, tt.side)
+		if tp != tt.tp || sl != tt.sl {
+			t.Errorf("%v %v %v: tp,sl = %v,%v, want %v,%v", tt.inst, tt.p, tt.side, tp, sl, tt.tp, tt.sl)
+		}
+	}
+	// 0なら注文を付けない
+	e, inst := newTestExecutor(&Param{Inst: "USD_JPY"})
+	if tp, sl := e.exitPrices(inst, 150, "BUY"); tp != 0 || sl != 0 {
+		t.Errorf("zero rates: %v,%v", tp, sl)
+	}
+}
+
+// 最小取引量に満たない、もしくはリスクの制限に掛かる場合は注文しない
+func TestExecuteOpenRejected(t *testing.T) {
+	e, inst := newTestExecutor(&Param{Inst: "USD_JPY", Units: 99})
+	inst.MinimumTradeSize = 100
+	// goqは使われない
+	plan := &OrderPlan{Open: "BUY", Units: 99, Position: flat(), Instrument: inst}
+	if res := e.Execute(context.Background(), plan); res.Opened || len(res.OpenOrderID) > 0 {
+		t.Errorf("below minimum = %+v", res)
+	}
+
+	inst.MinimumTradeSize = 1
+	r := &fakeRisk{err: errors.New("max units")}
+	e.risk = r
+	plan.Open = "SELL"
+	if res := e.Execute(context.Background(), plan); res.Opened {
+		t.Errorf("rejected = %+v", res)
+	}
+	if len(r.allowed) != 1 || r.allowed[0] != "USD_JPY -99 false" {
+		t.Errorf("Allow called with %v", r.allowed)
+	}
+}
+
+// accountの唯一のbot
+func newSingleBot(t *testing.T, name string) *bot {
+	t.Helper()
+	a, err := newAccount(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.bots) != 1 {
+		t.Fatalf("%v bots", len(a.bots))
+	}
+	return a.bots[0]
+}
+
+func TestNewAccount(t *testing.T) {
+	key := `{"live":{"id":"live-id","token":"token"},"accounts":{"sub":{"mode":"live","id":"sub-id"}}}`
+	chdirTemp(t, key, &Param{Inst: "USD_JPY", Gran: "H1", Span: 10, Units: 1000})
+
+	b := newSingleBot(t, "")
+	if b.acct.goq.Auth.Id != "live-id" || b.path(TRADE_FILE) != "trade.json" || b.prm.Units != 1000 {
+		t.Errorf("live bot = %+v %v", b.acct.goq.Auth, b.path(TRADE_FILE))
+	}
+
+	// 名前付きの口座は./{name}/に書き出す。param.jsonが無ければ./param.jsonを使う
+	b = newSingleBot(t, "sub")
+	if b.acct.goq.Auth.Id != "sub-id" || b.path(TRADE_FILE) != filepath.Join("sub", "trade.json") || b.prm.Units != 1000 {
+		t.Errorf("sub bot = %+v %v %+v", b.acct.goq.Auth, b.path(TRADE_FILE), b.prm)
+	}
+	if fi, err := os.Stat("sub"); err != nil || !fi.IsDir() {
+		t.Errorf("sub dir: %v", err)
+	}
+	if b.logPrefix() != "[sub]" {
+		t.Errorf("logPrefix = %v", b.logPrefix())
+	}
+	if err := os.WriteFile(filepath.Join("sub", "param.json"), []byte(`{"Inst":"EUR_USD","Gran":"M5","Span":5,"Units":10,"InitialBalance":5000}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b = newSingleBot(t, "sub")
+	if b.prm.Inst != "EUR_USD" || b.initialBalance() != 5000 || b.strat.Span() != 5 {
+		t.Errorf("sub param = %+v", b.prm)
+	}
+
+	// 複数の通貨ペアは./{name}/{Inst}/に書き出し、口座情報を共有する
+	// Sizing,Riskはbotの設定として読み込む
+	multi := `{"Gran":"M5","Span":5,"Units":10,"Risk":{"MaxUnits":100},
+		"Instruments":[{"Inst":"EUR_USD"},{"Inst":"USD_JPY","Span":8,"Sizing":{"Method":"risk","Risk":0.01},"Risk":{"MaxTotalUnits":300}}]}`
+	if err := os.WriteFile(filepath.Join("sub", "param.json"), []byte(multi), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAccount("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.bots) != 2 {
+		t.Fatalf("%v bots", len(a.bots))
+	}
+	jpy := a.bots[1]
+	if jpy.prm.Inst != "USD_JPY" || jpy.strat.Span() != 8 || jpy.path(TRADE_FILE) != filepath.Join("sub", "USD_JPY", "trade.json") {
+		t.Errorf("USD_JPY bot = %+v %v", jpy.prm, jpy.path(TRADE_FILE))
+	}
+	if jpy.logPrefix() != "[sub:USD_JPY]" || a.logPrefix() != "[sub]" {
+		t.Errorf("logPrefix = %v %v", jpy.logPrefix(), a.logPrefix())
+	}
+	if a.bots[0].data.(*apiData).acct != jpy.data.(*apiData).acct {
+		t.Error("account cache is not shared")
+	}
+	if _, ok := a.bots[0].sizer.(sizing.Fixed); !ok {
+		t.Errorf("EUR_USD sizer = %T", a.bots[0].sizer)
+	}
+	if _, ok := jpy.sizer.(*sizing.RiskPerTrade); !ok {
+		t.Errorf("USD_JPY sizer = %T", jpy.sizer)
+	}
+	if l := jpy.risk.(*limitRisk).limits; l.MaxUnits != 100 || l.MaxTotalUnits != 300 {
+		t.Errorf("USD_JPY risk = %+v", l)
+	}
+
+	// 未登録の戦略
+	if err := os.WriteFile(filepath.Join("sub", "param.json"), []byte(`{"Strategy":"nope","Inst":"EUR_USD","Gran":"M5","Span":5}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAccount("sub"); err == nil || !strings.Contains(err.Error(), "unknown strategy") {
+		t.Errorf("unknown strategy: %v", err)
+	}
+
+	if _, err := newAccount("missing"); err == nil {
+		t.Error("missing account: want error")
+	}
+	if err := os.WriteFile("key.json", []byte(`{"demo":{"id":"demo-id","token":"token"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAccount(""); err == nil {
+		t.Error("no live key: want error")
+	}
+}
+
+// 名前付きの口座で動かすと、ファイルは口座のディレクトリに出力される
+func TestTradeNamedAccount(t *testing.T) {
+	cfg := sim.Config{
+		AccountID:   "001-001-0000001-002",
+		Instrument:  "USD_JPY",
+		Granularity: "H1",
+		Spread:      0.008,
+		Balance:     100000,
+		Warmup:      12,
+		Candles:     simCandles(2),
+	}
+	srv, err := sim.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	prm := &Param{
+		Inst: "USD_JPY", Gran: "H1", Span: 6,
+		Thresh: 0.005, ProfRate: 0.01, LossRate: -0.01, Spread: 0.01, Units: 1000,
+		InitialBalance: cfg.Balance,
+	}
+	key := fmt.Sprintf(`{"live":{"id":"live-id","token":"token"},"accounts":{"sub":{"mode":"live","id":%q}}}`, cfg.AccountID)
+	chdirTemp(t, key, prm)
+
+	oldClock, oldTweet := clock, TWEET
+	clock, TWEET = sim.NewRemoteClock(ts.URL), false
+	defer func() { clock, TWEET = oldClock, oldTweet }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trade(ctx, []string{"sub"}, oanda.WithBaseURL(ts.URL+"/v3"))
+
+	if _, err := os.Stat(TRADE_FILE); !os.IsNotExist(err) {
+		t.Errorf("./%v: %v", TRADE_FILE, err)
+	}
+	bl := NewBalanceHistory()
+	load(filepath.Join("sub", TOTAL_PROF_FILE), bl)
+	if len(bl.TotalPL) == 0 {
+		t.Fatal("sub/balance.json is empty")
+	}
+	// 評価額込み残高は口座のディレクトリに記録する
+	ed := NewEquityHistory()
+	load(filepath.Join("sub", EQUITY_FILE), ed)
+	if len(ed.Equity) != len(bl.TotalPL) || math.Abs(ed.Equity[len(ed.Equity)-1]-(cfg.Balance+bl.TotalPL[len(bl.TotalPL)-1])) > 1e-6 {
+		t.Errorf("sub/equity.json = %v records, last %v", len(ed.Equity), ed.Equity)
+	}
+	// InitialBalanceが総利益の基準
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey(cfg.AccountID, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc, err := oanda.NewAccountContext(ctx, goq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := acc.Extract()
+	last := bl.TotalPL[len(bl.TotalPL)-1]
+	if want := data.Balance + data.UnrealizedPL - cfg.Balance; math.Abs(last-want) > 1e-6 {
+		t.Errorf("sub/balance.json last = %v, want %v", last, want)
+	}
+}
+
+// 固定時刻のClock。Tickはすぐfalseを返す
+type fakeClock struct {
+	now time.Time
+}
+
+func (c fakeClock) Now() time.Time                               { return c.now }
+func (c fakeClock) Tick(context.Context, oanda.Granularity) bool { return false }
+
+func setClock(t *testing.T, now time.Time) {
+	t.Helper()
+	old := clock
+	clock = fakeClock{now: now}
+	t.Cleanup(func() { clock = old })
+}
+
+// Syncするとpositionがnextに変わるMarketData
+type fakeData struct {
+	snap     *Snapshot
+	position *oanda.PositionData
+	next     *oanda.PositionData
+	syncs    int
+	realized []string // RealizedPLに渡されたids
+	quoteErr error    // QuoteHomeのerror
+}
+
+func (d *fakeData) Snapshot(ctx context.Context, span int) (*Snapshot, error) {
+	d.snap.Position = d.position
+	return d.snap, nil
+}
+
+func (d *fakeData) Sync(ctx context.Context) error {
+	d.syncs++
+	if d.next != nil {
+		d.position = d.next
+	}
+	return nil
+}
+
+func (d *fakeData) Position() *oanda.PositionData { return d.position }
+func (d *fakeData) Trades() []*oanda.TradeData    { return nil }
+func (d *fakeData) Account() oanda.AccountData    { return d.snap.Account }
+
+func (d *fakeData) RealizedPL(ctx context.Context, ids string) (float64, error) {
+	d.realized = append(d.realized, ids)
+	return 0, nil
+}
+
+func (d *fakeData) QuoteHome(ctx context.Context) (float64, error) {
+	if d.quoteErr != nil {
+		return 0, d.quoteErr
+	}
+	return 150, nil
+}
+
+// 渡されたOrderPlanを記録し、resを返すExecutor
+type fakeExec struct {
+	res   Execution
+	plans []*OrderPlan
+}
+
+func (e *fakeExec) Execute(ctx context.Context, plan *OrderPlan) *Execution {
+	e.plans = append(e.plans, plan)
+	res := e.res
+	return &res
+}
+
+func (e *fakeExec) ReconcileExits(ctx context.Context, inst *oanda.Instrument, trades []*oanda.TradeData, current float64) error {
+	return nil
+}
+
+// Allowの引数を"inst units flat"で記録し、errを返すRiskChecker
+type fakeRisk struct {
+	err     error
+	killed  bool
+	allowed []string
+}
+
+func (r *fakeRisk) Allow(inst string, units int, flat bool) error {
+	r.allowed = append(r.allowed, fmt.Sprint(inst, " ", units, " ", flat))
+	return r.err
+}
+
+func (r *fakeRisk) Killed() bool { return r.killed }
+
+// 記録した取引を"action side"で持つ
+type fakeReport struct {
+	trades   []string
+	balances int
+	equity   []float64
+}
+
+func (r *fakeReport) Trade(x int64, price float64, side, action string) {
+	r.trades = append(r.trades, action+" "+side)
+}
+
+func (r *fakeReport) Balance(x int64, price, upl float64) { r.balances++ }
+func (r *fakeReport) Equity(x int64, equity float64)      { r.equity = append(r.equity, equity) }
+
+// 常にdを返す戦略
+type fakeStrategy struct {
+	d  strategy.Decision
+	in *strategy.Input // Decideに渡されたInput
+}
+
+func (s *fakeStrategy) Span() int { return 2 }
+func (s *fakeStrategy) Decide(in *strategy.Input) strategy.Decision {
+	s.in = in
+	return s.d
+}
+func (s *fakeStrategy) Exits(p float64, side string) (float64, float64) { return 0, 0 }
+
+func flat() *oanda.PositionData {
+	return &oanda.PositionData{Instrument: "USD_JPY", Long: &oanda.PositionDataSide{}, Short: &oanda.PositionDataSide{}}
+}
+
+func long(units int, ids ...string) *oanda.PositionData {
+	p := flat()
+	p.Long = &oanda.PositionDataSide{Units: units, Average: 115, TradeIDs: ids}
+	return p
+}
+
+func short(units int, ids ...string) *oanda.PositionData {
+	p := flat()
+	p.Short = &oanda.PositionDataSide{Units: -units, Average: 115, TradeIDs: ids}
+	return p
+}
+
+type frameTest struct {
+	bot    *bot
+	data   *fakeData
+	exec   *fakeExec
+	risk   *fakeRisk
+	report *fakeReport
+}
+
+// posを保有していて、戦略がdを返すbot
+func newFrameTest(t *testing.T, pos *oanda.PositionData, d strategy.Decision) *frameTest {
+	t.Helper()
+	now := time.Date(2022, 1, 4, 12, 0, 0, 0, time.UTC)
+	setClock(t, now)
+	price := &oanda.Price{Asks: []oanda.Ticker{{Price: 115.01}}, Bids: []oanda.Ticker{{Price: 114.99}}}
+	ft := &frameTest{
+		data: &fakeData{
+			position: pos,
+			snap: &Snapshot{
+				Account: oanda.AccountData{Balance: INITIAL_BALANCE},
+				Last:    oanda.CandleStick{Time: now.Add(-5 * time.Minute)},
+				Price:   price,
+			},
+		},
+		exec:   &fakeExec{},
+		risk:   &fakeRisk{},
+		report: &fakeReport{},
+	}
+	ft.bot = &bot{
+		acct:   &account{},
+		prm:    &Param{Inst: "USD_JPY", Gran: "M5", Units: 1000},
+		data:   ft.data,
+		strat:  &fakeStrategy{d: d},
+		sizer:  sizing.Fixed{},
+		exec:   ft.exec,
+		risk:   ft.risk,
+		report: ft.report,
+	}
+	ft.bot.heldIDs, ft.bot.heldSide = pos.Ids(), tradeSide(pos)
+	return ft
+}
+
+func (ft *frameTest) plan(t *testing.T) *OrderPlan {
+	t.Helper()
+	if len(ft.exec.plans) != 1 {
+		t.Fatalf("Execute called %v times, want 1", len(ft.exec.plans))
+	}
+	return ft.exec.plans[0]
+}
+
+func TestFrameCloseThenOpen(t *testing.T) {
+	ft := newFrameTest(t, short(1000, "1"), strategy.Decision{Open: "BUY", Close: true})
+	ft.exec.res = Execution{Closed: true, Opened: true, OpenOrderID: "3"}
+	ft.data.next = long(1000, "4")
+
+	msg := ft.bot.frame(context.Background())
+
+	plan := ft.plan(t)
+	if !plan.Close || plan.Open != "BUY" || plan.Units != 1000 || tradeSide(plan.Position) != "SELL" || plan.Force {
+		t.Errorf("plan = %+v, want close and open BUY 1000", plan)
+	}
+	if got := strings.Join(ft.report.trades, ","); got != "CLOSE BUY,OPEN BUY" {
+		t.Errorf("reported %v, want close then open", got)
+	}
+	if !msg.didClose || !msg.didOpen {
+		t.Errorf("msg close:%v open:%v", msg.didClose, msg.didOpen)
+	}
+	if ft.data.syncs != 1 || ft.report.balances != 1 || len(ft.report.equity) != 1 {
+		t.Errorf("synced %v times, balance reported %v times, equity %v, want 1", ft.data.syncs, ft.report.balances, ft.report.equity)
+	}
+	if ft.bot.heldIDs != "4" || ft.bot.heldSide != "BUY" {
+		t.Errorf("held %v %v, want new position", ft.bot.heldIDs, ft.bot.heldSide)
+	}
+	if len(ft.data.realized) != 1 || ft.data.realized[0] != "1" {
+		t.Errorf("realized PL of %v, want closed trade 1", ft.data.realized)
+	}
+	if in := ft.bot.strat.(*fakeStrategy).in; in.Side != "SELL" || in.Ask != 115.01 || in.Bid != 114.99 {
+		t.Errorf("input side %v ask %v bid %v, want SELL 115.01 114.99", in.Side, in.Ask, in.Bid)
+	}
+}
+
+func TestFrameOpenOnlyWhenFlat(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  *oanda.PositionData
+		d    strategy.Decision
+		open string
+	}{
+		{"flat", flat(), strategy.Decision{Open: "SELL"}, "SELL"},
+		{"holding", long(1000, "1"), strategy.Decision{Open: "SELL"}, ""},
+		{"holding and close", long(1000, "1"), strategy.Decision{Open: "SELL", Close: true}, "SELL"},
+		{"no signal", flat(), strategy.Decision{}, ""},
+	}
+	for _, tt := range tests {
+		ft := newFrameTest(t, tt.pos, tt.d)
+		ft.bot.frame(context.Background())
+		plan := ft.plan(t)
+		if plan.Open != tt.open || plan.Close != tt.d.Close {
+			t.Errorf("%v: plan open:%q close:%v, want open:%q close:%v", tt.name, plan.Open, plan.Close, tt.open, tt.d.Close)
+		}
+		if len(plan.Open) > 0 && plan.Units != 1000 || len(plan.Open) == 0 && plan.Units != 0 {
+			t.Errorf("%v: units = %v", tt.name, plan.Units)
+		}
+		// 取引しなければ同期しなおさない
+		if ft.data.syncs != 0 || len(ft.report.trades) != 0 {
+			t.Errorf("%v: synced %v, reported %v", tt.name, ft.data.syncs, ft.report.trades)
+		}
+	}
+}
+
+func TestFrameClosedByBroker(t *testing.T) {
+	// 前フレームではtrade 7を保有していたが、利確・損切で決済されている
+	ft := newFrameTest(t, flat(), strategy.Decision{})
+	ft.bot.heldIDs, ft.bot.heldSide = "7", "BUY"
+
+	msg := ft.bot.frame(context.Background())
+
+	if got := strings.Join(ft.report.trades, ","); got != "CLOSE SELL" {
+		t.Errorf("reported %v, want CLOSE SELL", got)
+	}
+	if !msg.didClose || msg.didOpen {
+		t.Errorf("msg close:%v open:%v", msg.didClose, msg.didOpen)
+	}
+	if len(ft.data.realized) != 1 || ft.data.realized[0] != "7" {
+		t.Errorf("realized PL of %v, want trade 7", ft.data.realized)
+	}
+	if ft.bot.heldIDs != "" || ft.bot.heldSide != "" {
+		t.Errorf("held %v %v, want none", ft.bot.heldIDs, ft.bot.heldSide)
+	}
+
+	// 次のフレームでは検知しない
+	ft.report.trades = nil
+	ft.exec.plans = nil
+	ft.bot.frame(context.Background())
+	if len(ft.report.trades) != 0 {
+		t.Errorf("reported %v again", ft.report.trades)
+	}
+}
+
+// マーケットが閉じていれば注文しない
+func TestFrameMarketClosed(t *testing.T) {
+	ft := newFrameTest(t, flat(), strategy.Decision{Open: "BUY"})
+	ft.data.snap.Last.Time = clock.Now().Add(-time.Hour)
+	ft.bot.frame(context.Background())
+	if len(ft.exec.plans) != 0 || ft.report.balances != 0 {
+		t.Errorf("plans %v, balances %v", ft.exec.plans, ft.report.balances)
+	}
+}
+
+func TestCheckSimBots(t *testing.T) {
+	one := &account{bots: []*bot{{}}}
+	two := &account{bots: []*bot{{}, {}}}
+	tests := []struct {
+		name     string
+		sim      bool
+		accounts []*account
+		ok       bool
+	}{
+		{"wall clock", false, []*account{two, one}, true},
+		{"sim one bot", true, []*account{one}, true},
+		{"sim two instruments", true, []*account{two}, false},
+		{"sim two accounts", true, []*account{one, one}, false},
+	}
+	old := clock
+	t.Cleanup(func() { clock = old })
+	for _, tt := range tests {
+		clock = wallClock{}
+		if tt.sim {
+			clock = sim.NewRemoteClock("http://localhost")
+		}
+		if err := checkSimBots(tt.accounts); (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestFrameKillSwitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		pos    *oanda.PositionData
+		res    Execution
+		next   *oanda.PositionData
+		halted bool
+	}{
+		{"flatten", long(1000, "1"), Execution{Closed: true}, flat(), true},
+		{"close failed", long(1000, "1"), Execution{}, nil, false},
+		{"already flat", flat(), Execution{}, nil, true},
+	}
+	for _, tt := range tests {
+		// 戦略は新規取引と判定しているが、kill switchで取引しない
+		ft := newFrameTest(t, tt.pos, strategy.Decision{Open: "SELL", Close: true})
+		ft.risk.killed = true
+		ft.exec.res = tt.res
+		ft.data.next = tt.next
+
+		ft.bot.frame(context.Background())
+
+		plan := ft.plan(t)
+		hold := len(tradeSide(tt.pos)) > 0
+		if plan.Close != hold || plan.Open != "" || !plan.Force {
+			t.Errorf("%v: plan = %+v, want force close only", tt.name, plan)
+		}
+		if ft.bot.halted != tt.halted {
+			t.Errorf("%v: halted = %v, want %v", tt.name, ft.bot.halted, tt.halted)
+		}
+	}
+}
+
+// closeが約定しなければClosedにせず、新規取引もしない。openが約定しなければOpenedにしない
+func TestExecuteNotFilled(t *testing.T) {
+	tests := []struct {
+		name           string
+		close          string // PUT positions/closeのレスポンス。空なら500
+		closed, opened bool
+		orders         int // 新規注文のリクエスト数
+	}{
+		{"close failed", "", false, false, 0},
+		// 注文IDが返ってこない
+		{"close rejected", `{"longOrderRejectTransaction":{"id":"5"}}`, false, false, 0},
+		// closeは約定したがopenが失敗
+		{"open failed", `{"longOrderCreateTransaction":{"id":"5"},"longOrderFillTransaction":{"id":"6","orderID":"5"}}`, true, false, 1},
+	}
+	for _, tt := range tests {
+		orders := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/close") && tt.close != "":
+				w.Write([]byte(tt.close))
+				return
+			case strings.HasSuffix(r.URL.Path, "/orders"):
+				orders++
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errorMessage":"down"}`))
+		}))
+		goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey("acc", "token"), oanda.WithRetry(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		prm := &Param{Inst: "USD_JPY", Span: 1, Spread: 1}
+		strat, _ := strategy.New(prm)
+		e := newAPIExecutor(goq, prm, strat, nil, nil)
+		price := &oanda.Price{Asks: []oanda.Ticker{{Price: 115.01}}, Bids: []oanda.Ticker{{Price: 114.99}}}
+		inst := &oanda.Instrument{Name: "USD_JPY", DisplayPrecision: 3, MinimumTradeSize: 1}
+		plan := &OrderPlan{Close: true, Open: "SELL", Units: 1000, Position: long(1000, "1"), Instrument: inst, Price: price}
+
+		res := e.Execute(context.Background(), plan)
+		ts.Close()
+		if res.Closed != tt.closed || res.Opened != tt.opened || res.OpenOrderID != "" || orders != tt.orders {
+			t.Errorf("%v: %+v, orders %v", tt.name, res, orders)
+		}
+	}
+}
+
+// 1リクエストの上限を超えるspanは、ローカルキャッシュを埋めてから読み込む
+func TestCandlesFromHistory(t *testing.T) {
+	cfg := sim.Config{
+		AccountID:   "001-001-0000001-001",
+		Instrument:  "USD_JPY",
+		Granularity: "H1",
+		Spread:      0.008,
+		Balance:     250000,
+		Warmup:      5050,
+		Candles:     simCandles(213),
+	}
+	srv, err := sim.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey(cfg.AccountID, "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setClock(t, srv.Now())
+	old := CANDLE_DIR
+	CANDLE_DIR = t.TempDir()
+	defer func() { CANDLE_DIR = old }()
+
+	prm := &Param{Inst: "USD_JPY", Gran: "H1"}
+	span := oanda.MaxCandles
+	for i := 0; i < 2; i++ {
+		sticks, err := candlesLikeBTest(context.Background(), goq, prm, span)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 最後の足は確定したばかりの足
+		if len(sticks) != span+1 || !sticks[span].Time.Equal(cfg.Candles[cfg.Warmup-1].Time) ||
+			!sticks[0].Time.Equal(cfg.Candles[cfg.Warmup-1-span].Time) {
+			t.Fatalf("%v: %v sticks %v - %v", i, len(sticks), sticks[0].Time, sticks[len(sticks)-1].Time)
+		}
+	}
+	cs, err := history.Load(history.Path(CANDLE_DIR, prm.Inst, prm.Gran))
+	if err != nil || len(cs) != cfg.Warmup {
+		t.Errorf("cache: %v candles, %v", len(cs), err)
+	}
+}
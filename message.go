@@ -24,8 +24,9 @@ type Message struct {
 
 }
 
-func NewMessage() *Message {
-	m := &Message{tags: "#FX #USD_JPY"}
+// inst:取引している通貨ペア。ハッシュタグに付ける
+func NewMessage(inst string) *Message {
+	m := &Message{tags: "#FX #" + inst}
 	return m
 }
 
@@ -0,0 +1,482 @@
+/*
+ * 口座一覧(v3/accounts)、口座の差分取得(v3/accounts/{accountID}/changes)と、
+ * それで同期するローカルの口座情報
+ */
+
+package oanda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// 前回以降に変化した注文・trade・ポジションとtransaction
+	AccountChangesData struct {
+		OrdersCreated   []*OrderData    `json:"ordersCreated"`
+		OrdersCancelled []*OrderData    `json:"ordersCancelled"`
+		OrdersFilled    []*OrderData    `json:"ordersFilled"`
+		OrdersTriggered []*OrderData    `json:"ordersTriggered"`
+		TradesOpened    []*TradeData    `json:"tradesOpened"`
+		TradesReduced   []*TradeData    `json:"tradesReduced"`
+		TradesClosed    []*TradeData    `json:"tradesClosed"`
+		Positions       []*PositionData `json:"positions"`
+		Transactions    TransactionList `json:"transactions"`
+	}
+
+	// 価格で変わる注文の状態
+	DynamicOrderState struct {
+		ID                string  `json:"id"`
+		TrailingStopValue float64 `json:"trailingStopValue,string"`
+		TriggerDistance   float64 `json:"triggerDistance,string"`
+	}
+
+	// 価格で変わるtradeの状態
+	CalculatedTradeState struct {
+		ID           string  `json:"id"`
+		UnrealizedPL float64 `json:"unrealizedPL,string"`
+		MarginUsed   float64 `json:"marginUsed,string"`
+	}
+
+	// 価格で変わるポジションの状態
+	CalculatedPositionState struct {
+		Instrument        string  `json:"instrument"`
+		NetUnrealizedPL   float64 `json:"netUnrealizedPL,string"`
+		LongUnrealizedPL  float64 `json:"longUnrealizedPL,string"`
+		ShortUnrealizedPL float64 `json:"shortUnrealizedPL,string"`
+		MarginUsed        float64 `json:"marginUsed,string"`
+	}
+
+	// 現在の口座の状態。レスポンスに無い項目はnil
+	AccountChangesState struct {
+		UnrealizedPL          *float64                  `json:"unrealizedPL,string"`
+		NAV                   *float64                  `json:"NAV,string"`
+		MarginUsed            *float64                  `json:"marginUsed,string"`
+		MarginAvailable       *float64                  `json:"marginAvailable,string"`
+		PositionValue         *float64                  `json:"positionValue,string"`
+		MarginCloseoutPercent *float64                  `json:"marginCloseoutPercent,string"`
+		WithdrawalLimit       *float64                  `json:"withdrawalLimit,string"`
+		Balance               *float64                  `json:"balance,string"`
+		PL                    *float64                  `json:"pl,string"`
+		Financing             *float64                  `json:"financing,string"`
+		Commission            *float64                  `json:"commission,string"`
+		Orders                []DynamicOrderState       `json:"orders"`
+		Trades                []CalculatedTradeState    `json:"trades"`
+		Positions             []CalculatedPositionState `json:"positions"`
+	}
+
+	// GET: v3/accounts/{accountID}/changes
+	AccountChanges struct {
+		base
+		Changes *AccountChangesData  `json:"changes"`
+		State   *AccountChangesState `json:"state"`
+		LastID  string               `json:"lastTransactionID"`
+	}
+
+	// tokenで操作できる口座
+	AccountProperties struct {
+		ID           string   `json:"id"`
+		Mt4AccountID int      `json:"mt4AccountID"`
+		Tags         []string `json:"tags"`
+	}
+
+	// GET: v3/accounts
+	AccountList struct {
+		base
+		Accounts []*AccountProperties `json:"accounts"`
+	}
+
+	// NewAccountで取得した口座情報に、changesの差分を適用して最新に保つ。
+	// 毎回NewAccount,NewPosition,NewTradesを呼ぶ代わりにSyncを1回呼べばよい。
+	// 各メソッドはコピーを返すので、呼び出し側で変更しても影響はない。
+	AccountState struct {
+		mu        sync.RWMutex
+		goq       *Goquest
+		account   AccountData // Positions,Orders,Tradesは下のmapで持つ
+		orders    map[string]*OrderData
+		trades    map[string]*TradeData
+		positions map[string]*PositionData
+		lastID    string
+	}
+)
+
+// tokenで操作できる口座(サブアカウント含む)の一覧を取得する。
+// 各口座はgoq.ForAccount(id)で操作できる。
+func NewAccountList(goq *Goquest) (*AccountList, error) {
+	return NewAccountListContext(context.Background(), goq)
+}
+
+// NewAccountListのcontext版。
+func NewAccountListContext(ctx context.Context, goq *Goquest) (*AccountList, error) {
+	res := &AccountList{}
+	err := goq.Get(ctx, "/accounts", nil, res)
+	return res, err
+}
+
+func (a *AccountList) Extract() []*AccountProperties {
+	if !a.Check() {
+		return nil
+	}
+	return a.Accounts
+}
+
+// sinceIDより後の口座の変化を取得する。sinceIDは前回のLastID。
+func NewAccountChanges(goq *Goquest, sinceID string) (*AccountChanges, error) {
+	return NewAccountChangesContext(context.Background(), goq, sinceID)
+}
+
+// NewAccountChangesのcontext版。
+func NewAccountChangesContext(ctx context.Context, goq *Goquest, sinceID string) (*AccountChanges, error) {
+	if len(sinceID) == 0 {
+		return nil, &ParamError{Field: "sinceTransactionID", Msg: "required"}
+	}
+	res := &AccountChanges{}
+	ep := "/accounts/" + goq.Auth.Id + "/changes"
+	err := goq.Get(ctx, ep, strMap{"sinceTransactionID": sinceID}, res)
+	return res, err
+}
+
+// NewAccountで口座情報を取得し、AccountStateを作る。
+func NewAccountState(goq *Goquest) (*AccountState, error) {
+	return NewAccountStateContext(context.Background(), goq)
+}
+
+// NewAccountStateのcontext版。
+func NewAccountStateContext(ctx context.Context, goq *Goquest) (*AccountState, error) {
+	a := &AccountState{goq: goq}
+	if err := a.ReloadContext(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// NewAccountで全て取得しなおす。
+func (a *AccountState) Reload() error {
+	return a.ReloadContext(context.Background())
+}
+
+// Reloadのcontext版。
+func (a *AccountState) ReloadContext(ctx context.Context) error {
+	acc, err := NewAccountContext(ctx, a.goq)
+	if err != nil {
+		return err
+	}
+	if acc.Data == nil {
+		return fmt.Errorf("%w: %v", ErrEmptyAccount, a.goq.Auth.Id)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.account = *acc.Data
+	a.orders = map[string]*OrderData{}
+	for i := range acc.Data.Orders {
+		o := acc.Data.Orders[i]
+		a.orders[o.Id] = &o
+	}
+	a.trades = map[string]*TradeData{}
+	for i := range acc.Data.Trades {
+		t := acc.Data.Trades[i]
+		a.trades[t.ID] = &t
+	}
+	a.positions = map[string]*PositionData{}
+	for i := range acc.Data.Positions {
+		p := acc.Data.Positions[i]
+		a.positions[p.Instrument] = &p
+	}
+	a.account.Positions, a.account.Orders, a.account.Trades = nil, nil, nil
+	a.lastID = acc.LastID
+	return nil
+}
+
+// 前回以降の差分を取得して適用する。
+// sinceTransactionIDが不正・古すぎる場合のみReloadする。それ以外のエラー(429,401等)はそのまま返す。
+func (a *AccountState) Sync() error {
+	return a.SyncContext(context.Background())
+}
+
+// Syncのcontext版。
+func (a *AccountState) SyncContext(ctx context.Context) error {
+	a.mu.RLock()
+	since := a.lastID
+	a.mu.RUnlock()
+
+	res, err := NewAccountChangesContext(ctx, a.goq, since)
+	if err != nil {
+		// sinceTransactionIDが使えない場合のみ取得しなおす。429や401等はそのまま返す
+		if badSinceID(err) {
+			return a.ReloadContext(ctx)
+		}
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// 他のSyncが先に適用していたら何もしない
+	if a.lastID != since {
+		return nil
+	}
+	a.applyChanges(res.Changes)
+	a.applyState(res.State)
+	a.lastID = res.LastID
+	a.account.LastTransactionID = res.LastID
+	return nil
+}
+
+// sinceTransactionIDが不正もしくは古すぎてchangesを取得できないエラーか。
+// Oandaは不正な値には400とerrorMessage、古すぎる値には416を返す。
+func badSinceID(err error) bool {
+	switch statusCode(err) {
+	case http.StatusRequestedRangeNotSatisfiable:
+		return true
+	case http.StatusBadRequest:
+		var ae *APIError
+		return errors.As(err, &ae) && strings.Contains(ae.Message, "sinceTransactionID")
+	}
+	return false
+}
+
+func (a *AccountState) applyChanges(c *AccountChangesData) {
+	if c == nil {
+		return
+	}
+	for _, o := range c.OrdersCreated {
+		a.orders[o.Id] = o
+	}
+	for _, l := range [][]*OrderData{c.OrdersCancelled, c.OrdersFilled, c.OrdersTriggered} {
+		for _, o := range l {
+			delete(a.orders, o.Id)
+		}
+	}
+	for _, l := range [][]*TradeData{c.TradesOpened, c.TradesReduced} {
+		for _, t := range l {
+			a.trades[t.ID] = t
+		}
+	}
+	for _, t := range c.TradesClosed {
+		delete(a.trades, t.ID)
+	}
+	for _, p := range c.Positions {
+		a.positions[p.Instrument] = p
+	}
+	// PENDING以外の注文、OPEN以外のtradeは持たない
+	for id, o := range a.orders {
+		if o.State != "" && o.State != "PENDING" {
+			delete(a.orders, id)
+		}
+	}
+	for id, t := range a.trades {
+		if t.State != "" && t.State != "OPEN" {
+			delete(a.trades, id)
+		}
+	}
+
+	// stateに残高が無い場合に備えて、transactionから残高と損益を追う
+	for _, t := range c.Transactions {
+		switch v := t.(type) {
+		case *OrderFillTransaction:
+			a.account.Balance = v.AccountBalance
+			a.account.PL += v.PL
+			a.account.Financing += v.Financing
+			a.account.Commission += v.Commission
+		case *DailyFinancingTransaction:
+			a.account.Balance = v.AccountBalance
+			a.account.Financing += v.Financing
+		case *TransferFundsTransaction:
+			if v.Type == "TRANSFER_FUNDS" {
+				a.account.Balance = v.AccountBalance
+			}
+		case *DividendAdjustmentTransaction:
+			a.account.Balance = v.AccountBalance
+		}
+	}
+
+	a.account.OpenTradeCount = len(a.trades)
+	a.account.PendingOrderCount = len(a.orders)
+	a.account.OpenPositionCount = 0
+	for _, p := range a.positions {
+		// Hasはshortがnilでないと常にtrueなので使わない
+		if (p.Long != nil && p.Long.Units != 0) || (p.Short != nil && p.Short.Units != 0) {
+			a.account.OpenPositionCount++
+		}
+	}
+}
+
+func (a *AccountState) applyState(st *AccountChangesState) {
+	if st == nil {
+		return
+	}
+	set := func(dst *float64, v *float64) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&a.account.UnrealizedPL, st.UnrealizedPL)
+	set(&a.account.NAV, st.NAV)
+	set(&a.account.MarginUsed, st.MarginUsed)
+	set(&a.account.MarginAvailable, st.MarginAvailable)
+	set(&a.account.PositionValue, st.PositionValue)
+	set(&a.account.MarginCloseoutPercent, st.MarginCloseoutPercent)
+	set(&a.account.WithdrawalLimit, st.WithdrawalLimit)
+	set(&a.account.Balance, st.Balance)
+	set(&a.account.PL, st.PL)
+	set(&a.account.Financing, st.Financing)
+	set(&a.account.Commission, st.Commission)
+
+	for _, o := range st.Orders {
+		if d, ok := a.orders[o.ID]; ok {
+			d.TrailingStopValue = o.TrailingStopValue
+		}
+	}
+	for _, t := range st.Trades {
+		if d, ok := a.trades[t.ID]; ok {
+			d.UnrealizedPL = t.UnrealizedPL
+			d.MarginUsed = t.MarginUsed
+		}
+	}
+	for _, p := range st.Positions {
+		d, ok := a.positions[p.Instrument]
+		if !ok {
+			continue
+		}
+		d.UnrealizedPL = p.NetUnrealizedPL
+		d.Margin = p.MarginUsed
+		if d.Long != nil {
+			d.Long.UnrealizedPL = p.LongUnrealizedPL
+		}
+		if d.Short != nil {
+			d.Short.UnrealizedPL = p.ShortUnrealizedPL
+		}
+	}
+}
+
+// 口座情報。Positions,Orders,Tradesも入る。
+func (a *AccountState) Account() AccountData {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	acc := a.account
+	for _, p := range a.sortedPositions() {
+		acc.Positions = append(acc.Positions, *copyPosition(p))
+	}
+	for _, o := range a.pendingOrders("") {
+		acc.Orders = append(acc.Orders, *o)
+	}
+	for _, t := range a.openTrades("") {
+		acc.Trades = append(acc.Trades, *t)
+	}
+	return acc
+}
+
+// instrumentのポジション。取引したことが無ければnil
+func (a *AccountState) Position(instrument string) *PositionData {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	p, ok := a.positions[instrument]
+	if !ok {
+		return nil
+	}
+	return copyPosition(p)
+}
+
+// 保有中のtradeをID順に返す。instrumentが空なら全て。
+// TakeProfitOrder,StopLossOrder,TrailingStopLossOrderには保持している注文が入る。
+func (a *AccountState) Trades(instrument string) []*TradeData {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.openTrades(instrument)
+}
+
+// 未約定の注文をID順に返す。instrumentが空なら全て。
+func (a *AccountState) Orders(instrument string) []*OrderData {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.pendingOrders(instrument)
+}
+
+// 最後に適用したtransactionのID
+func (a *AccountState) LastID() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lastID
+}
+
+func (a *AccountState) openTrades(instrument string) []*TradeData {
+	res := []*TradeData{}
+	for _, t := range a.trades {
+		if len(instrument) > 0 && t.Instrument != instrument {
+			continue
+		}
+		c := *t
+		c.TakeProfitOrder = a.linkedOrder(t.ID, "TAKE_PROFIT")
+		c.StopLossOrder = a.linkedOrder(t.ID, "STOP_LOSS")
+		c.TrailingStopLossOrder = a.linkedOrder(t.ID, "TRAILING_STOP_LOSS")
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool { return idLess(res[i].ID, res[j].ID) })
+	return res
+}
+
+// tradeに紐づくtypの注文。
+// 注文を置き換えてもtradeは差分に入らず*OrderIDが古いままなので、注文側のtradeIDから探す
+func (a *AccountState) linkedOrder(tradeID, typ string) *OrderData {
+	for _, o := range a.orders {
+		if o.TradeID == tradeID && o.Type == typ {
+			c := *o
+			return &c
+		}
+	}
+	return nil
+}
+
+func (a *AccountState) pendingOrders(instrument string) []*OrderData {
+	res := []*OrderData{}
+	for _, o := range a.orders {
+		// 利確・損切注文はinstrumentを持たないので紐づくtradeで判定
+		inst := o.Instrument
+		if t, ok := a.trades[o.TradeID]; ok && len(inst) == 0 {
+			inst = t.Instrument
+		}
+		if len(instrument) > 0 && inst != instrument {
+			continue
+		}
+		c := *o
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool { return idLess(res[i].Id, res[j].Id) })
+	return res
+}
+
+func (a *AccountState) sortedPositions() []*PositionData {
+	res := []*PositionData{}
+	for _, p := range a.positions {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Instrument < res[j].Instrument })
+	return res
+}
+
+func copyPosition(p *PositionData) *PositionData {
+	c := *p
+	if p.Long != nil {
+		l := *p.Long
+		c.Long = &l
+	}
+	if p.Short != nil {
+		s := *p.Short
+		c.Short = &s
+	}
+	return &c
+}
+
+// transaction IDの比較。数値として比べる
+func idLess(a, b string) bool {
+	x, errx := strconv.Atoi(a)
+	y, erry := strconv.Atoi(b)
+	if errx != nil || erry != nil {
+		return a < b
+	}
+	return x < y
+}
@@ -0,0 +1,210 @@
+package oanda_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/sim"
+)
+
+// simの手前でリクエストを記録する。badSinceがtrueならchangesのsinceTransactionIDを壊す。
+// failが0以外ならchangesにそのステータスを返す
+type recorder struct {
+	h        http.Handler
+	mu       sync.Mutex
+	badSince bool
+	fail     int
+	paths    []string
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	changes := strings.HasSuffix(req.URL.Path, "/changes")
+	if r.badSince && changes {
+		q := req.URL.Query()
+		q.Set("sinceTransactionID", "999999")
+		req.URL.RawQuery = q.Encode()
+	}
+	r.paths = append(r.paths, req.URL.Path)
+	fail := r.fail
+	r.mu.Unlock()
+	if fail != 0 && changes {
+		w.WriteHeader(fail)
+		w.Write([]byte(`{"errorMessage":"` + http.StatusText(fail) + `"}`))
+		return
+	}
+	r.h.ServeHTTP(w, req)
+}
+
+func (r *recorder) reset(badSince bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.badSince = badSince
+	r.fail = 0
+	r.paths = nil
+}
+
+func newRecordedClient(t *testing.T) (*oanda.Goquest, *recorder) {
+	t.Helper()
+	start := time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC)
+	cs := []sim.Candle{}
+	for i := 0; i < 10; i++ {
+		p := 115.0 + float64(i)*0.01
+		cs = append(cs, sim.Candle{Time: start.Add(time.Duration(i) * 5 * time.Minute), O: p, H: p + 0.02, L: p - 0.02, C: p + 0.01, Volume: 1})
+	}
+	srv, err := sim.New(sim.Config{Instrument: "USD_JPY", Granularity: "M5", Spread: 0.004, Balance: 100000, Warmup: 5, Candles: cs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{h: srv}
+	ts := httptest.NewServer(rec)
+	t.Cleanup(ts.Close)
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey("001-001-0000001-001", "token"), oanda.WithRetry(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goq, rec
+}
+
+func TestAccountStateSyncReloadsOnBadSinceID(t *testing.T) {
+	goq, rec := newRecordedClient(t)
+	a, err := oanda.NewAccountState(goq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 正常時はchangesだけで同期する
+	rec.reset(false)
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if len(rec.paths) != 1 || !strings.HasSuffix(rec.paths[0], "/changes") {
+		t.Fatalf("expected only changes request, got %v", rec.paths)
+	}
+
+	// simは不正なsinceTransactionIDに400とerrorMessageを返す。APIErrorでもReloadする
+	rec.reset(true)
+	if err := a.Sync(); err != nil {
+		t.Fatalf("Sync with bad sinceTransactionID: %v", err)
+	}
+	want := []string{"/v3/accounts/001-001-0000001-001/changes", "/v3/accounts/001-001-0000001-001"}
+	if strings.Join(rec.paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected changes then reload, got %v", rec.paths)
+	}
+}
+
+// sinceTransactionIDが古すぎる(416)場合は取得しなおし、それ以外のエラーは返す
+func TestAccountStateSyncErrors(t *testing.T) {
+	goq, rec := newRecordedClient(t)
+	a, err := oanda.NewAccountState(goq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := "/v3/accounts/001-001-0000001-001/changes"
+	tests := []struct {
+		status int
+		reload bool
+	}{
+		{http.StatusRequestedRangeNotSatisfiable, true},
+		// sinceTransactionIDに関係ない400
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		rec.reset(false)
+		rec.fail = tt.status
+		err := a.Sync()
+		var ae *oanda.APIError
+		if tt.reload {
+			if err != nil || len(rec.paths) != 2 || rec.paths[1] != "/v3/accounts/001-001-0000001-001" {
+				t.Errorf("%v: err %v, requests %v, want reload", tt.status, err, rec.paths)
+			}
+			continue
+		}
+		if !errors.As(err, &ae) || ae.StatusCode != tt.status || strings.Join(rec.paths, ",") != changes {
+			t.Errorf("%v: err %v, requests %v, want error without reload", tt.status, err, rec.paths)
+		}
+	}
+}
+
+// accountの無いレスポンスはErrEmptyAccount
+func TestAccountStateEmpty(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"lastTransactionID":"1"}`))
+	}))
+	defer ts.Close()
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey("001-001-0000001-001", "token"), oanda.WithRetry(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oanda.NewAccountState(goq)
+	var de *oanda.DecodeError
+	if !errors.Is(err, oanda.ErrEmptyAccount) || errors.As(err, &de) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// Syncで差分を適用した結果が、取得し直した口座と一致する
+func TestAccountStateSync(t *testing.T) {
+	goq, _ := newRecordedClient(t)
+	ctx := context.Background()
+	a, err := oanda.NewAccountStateContext(ctx, goq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := func(step string) {
+		t.Helper()
+		if err := a.SyncContext(ctx); err != nil {
+			t.Fatalf("%v: %v", step, err)
+		}
+		fresh, err := oanda.NewAccountStateContext(ctx, goq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, want := a.Account(), fresh.Account()
+		if a.LastID() != fresh.LastID() || math.Abs(got.Balance-want.Balance) > 1e-9 ||
+			len(got.Trades) != len(want.Trades) || len(got.Orders) != len(want.Orders) ||
+			got.OpenPositionCount != want.OpenPositionCount {
+			t.Errorf("%v: synced %v %+v, reloaded %v %+v", step, a.LastID(), got, fresh.LastID(), want)
+		}
+	}
+
+	_, err = oanda.NewMarketOrderParamContext(ctx, goq, &oanda.OrderParam{
+		Instrument: "USD_JPY", Units: 100,
+		TakeProfit: &oanda.TakeProfitParam{Price: 116},
+		StopLoss:   &oanda.StopLossParam{Price: 114},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same("open")
+	trades := a.Trades("USD_JPY")
+	if len(trades) != 1 || trades[0].TakeProfitOrder == nil || trades[0].StopLossOrder == nil {
+		t.Fatalf("trades = %+v", trades)
+	}
+	if p := a.Position("USD_JPY"); p == nil || p.Long.Units != 100 {
+		t.Errorf("position = %+v", p)
+	}
+	if len(a.Trades("EUR_USD")) != 0 || a.Position("EUR_USD") != nil {
+		t.Error("other instrument has state")
+	}
+
+	if _, err := oanda.CloseTradeContext(ctx, goq, trades[0].ID, oanda.CLOSE_ALL); err != nil {
+		t.Fatal(err)
+	}
+	same("close")
+	if acc := a.Account(); len(acc.Trades) != 0 || len(acc.Orders) != 0 || acc.OpenPositionCount != 0 {
+		t.Errorf("after close: %+v", a.Account())
+	}
+}
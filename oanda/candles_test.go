@@ -0,0 +1,84 @@
+package oanda
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const testBACandles = `{"instrument":"USD_JPY","granularity":"H1","candles":[` +
+	`{"complete":true,"volume":10,"time":"2024-01-01T00:00:00.000000000Z",` +
+	`"bid":{"o":"149.990","h":"150.990","l":"148.990","c":"150.490"},"ask":{"o":"150.010","h":"151.010","l":"149.010","c":"150.510"}},` +
+	`{"complete":false,"volume":3,"time":"2024-01-01T01:00:00.000000000Z",` +
+	`"bid":{"o":"150.490","h":"150.490","l":"150.490","c":"150.490"},"ask":{"o":"150.510","h":"150.510","l":"150.510","c":"150.510"}}]}`
+
+func TestCandlesBidAsk(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, testBACandles)
+	res, err := NewCandles(goq, 2, "H1", "USD_JPY", "", "", "BA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.query.Get("price") != "BA" {
+		t.Errorf("price = %v", rec.query.Get("price"))
+	}
+
+	// midを取得していないのでExtractMidは空
+	if mid := res.ExtractMid(); len(mid) != 0 {
+		t.Errorf("mid = %+v", mid)
+	}
+	bid, ask := res.ExtractBid(), res.ExtractAsk()
+	if len(bid) != 2 || len(ask) != 2 {
+		t.Fatalf("bid,ask = %v,%v", len(bid), len(ask))
+	}
+	if fmt.Sprint(bid.Extract("H")) != "[150.99 150.49]" || fmt.Sprint(ask.Extract("L")) != "[149.01 150.51]" {
+		t.Errorf("bid H = %v, ask L = %v", bid.Extract("H"), ask.Extract("L"))
+	}
+	// 選んでいない側も保持している
+	if bid[0].Ask == nil || bid[0].Ask.H != 151.01 || bid[0].Mid != nil {
+		t.Errorf("bid[0] = %+v", bid[0])
+	}
+	if !bid[1].Time.Equal(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)) || bid[1].Complete {
+		t.Errorf("bid[1] = %+v", bid[1])
+	}
+	if fmt.Sprint(bid.Volumes()) != "[10 3]" || len(bid.Complete()) != 1 {
+		t.Errorf("volumes = %v, complete = %v", bid.Volumes(), len(bid.Complete()))
+	}
+
+	// Sticksは全て持ち、Sideで切り替える
+	all := res.Sticks()
+	if len(all) != 2 || all[0].Prices != nil {
+		t.Errorf("sticks = %+v", all)
+	}
+	if a := all.Side("A"); len(a) != 2 || a[0].Prices.O != 150.01 {
+		t.Errorf("Side(A) = %+v", a)
+	}
+	if m := all.Side("M"); len(m) != 0 {
+		t.Errorf("Side(M) = %+v", m)
+	}
+}
+
+func TestPriceComponent(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"candles":[]}`)
+	tests := []struct {
+		pc, want string
+	}{
+		{"", "M"},
+		{"M", "M"},
+		{"B", "B"},
+		{"BA", "BA"},
+		{"MBA", "MBA"},
+	}
+	for _, tt := range tests {
+		if _, err := NewCandles(goq, 1, "H1", "USD_JPY", "", "", tt.pc); err != nil || rec.query.Get("price") != tt.want {
+			t.Errorf("%q: price = %v, err = %v", tt.pc, rec.query.Get("price"), err)
+		}
+	}
+	var pe *ParamError
+	for _, pc := range []string{"X", "MM", "m", "BAB"} {
+		rec.query = nil
+		if _, err := NewCandles(goq, 1, "H1", "USD_JPY", "", "", pc); !errors.As(err, &pe) || rec.query != nil {
+			t.Errorf("%q: err = %v", pc, err)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 )
 
 type (
@@ -16,9 +17,40 @@ type (
 		Token string `json:"token"`
 	}
 
+	// 名前付きの口座。サブアカウント等。
+	// Tokenを省略した場合はModeの("live"or"demo")のtokenを使う。
+	accountKey struct {
+		Mode  string `json:"mode"`
+		Id    string `json:"id"`
+		Token string `json:"token"`
+	}
+
 	apiKeys struct {
-		Live *apiKey `json:"live"`
-		Demo *apiKey `json:"demo"`
+		Live     *apiKey                `json:"live"`
+		Demo     *apiKey                `json:"demo"`
+		Accounts map[string]*accountKey `json:"accounts"`
+	}
+
+	// 認証情報(口座idとtoken)の取得元。
+	KeySource interface {
+		Key() (id string, token string, err error)
+	}
+
+	// ファイルから認証情報を読む。
+	// Path:{"live":{"id":string,"token":string},"demo":{"id":string,"token":string}}形式のファイル。
+	// 名前付きの口座は"accounts":{"name":{"mode":"live","id":string,"token":string}}に書く。
+	// Mode:"live" or "demo"
+	// Name:accountsの名前。空ならModeの口座
+	FileKeySource struct {
+		Path string
+		Mode string
+		Name string
+	}
+
+	// 固定の認証情報。mock server向け。
+	StaticKey struct {
+		Id    string
+		Token string
 	}
 )
 
@@ -28,20 +60,86 @@ func readConf(fpath string) (*apiKeys, error) {
 		return nil, err
 	}
 	keys := &apiKeys{}
-	json.Unmarshal(b, keys)
+	if err := json.Unmarshal(b, keys); err != nil {
+		return nil, err
+	}
 	return keys, nil
 }
 
-func newApiKey(fpath string, mode string) *apiKey {
+func newApiKey(fpath string, mode string) (*apiKey, error) {
 	conf, err := readConf(fpath)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+	var key *apiKey
 	if mode == "live" {
-		return conf.Live
+		key = conf.Live
 	}
 	if mode == "demo" {
-		return conf.Demo
+		key = conf.Demo
 	}
-	return nil
+	if key == nil {
+		return nil, fmt.Errorf("oanda: no %q key in %v", mode, fpath)
+	}
+	return key, nil
+}
+
+// 名前付きの口座の認証情報を返す。
+func newAccountKey(fpath string, name string) (*accountKey, error) {
+	conf, err := readConf(fpath)
+	if err != nil {
+		return nil, err
+	}
+	acc, ok := conf.Accounts[name]
+	if !ok || acc == nil {
+		return nil, fmt.Errorf("oanda: no account %q in %v", name, fpath)
+	}
+	if acc.Mode != "live" && acc.Mode != "demo" {
+		return nil, fmt.Errorf("oanda: invalid mode %q for account %q", acc.Mode, name)
+	}
+	key := *acc
+	if len(key.Token) == 0 {
+		base := conf.Live
+		if key.Mode == "demo" {
+			base = conf.Demo
+		}
+		if base == nil {
+			return nil, fmt.Errorf("oanda: no token for account %q in %v", name, fpath)
+		}
+		key.Token = base.Token
+	}
+	return &key, nil
+}
+
+// ファイルに定義されている名前付きの口座の名前を昇順で返す。
+func AccountNames(fpath string) ([]string, error) {
+	conf, err := readConf(fpath)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range conf.Accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *FileKeySource) Key() (string, string, error) {
+	if len(f.Name) > 0 {
+		key, err := newAccountKey(f.Path, f.Name)
+		if err != nil {
+			return "", "", err
+		}
+		return key.Id, key.Token, nil
+	}
+	key, err := newApiKey(f.Path, f.Mode)
+	if err != nil {
+		return "", "", err
+	}
+	return key.Id, key.Token, nil
+}
+
+func (s *StaticKey) Key() (string, string, error) {
+	return s.Id, s.Token, nil
 }
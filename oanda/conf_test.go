@@ -0,0 +1,116 @@
+package oanda
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKeys = `{
+	"live":{"id":"live-id","token":"live-token"},
+	"demo":{"id":"demo-id","token":"demo-token"},
+	"accounts":{
+		"sub1":{"mode":"live","id":"sub1-id"},
+		"practice":{"mode":"demo","id":"practice-id"},
+		"own":{"mode":"live","id":"own-id","token":"own-token"},
+		"nomode":{"id":"nomode-id"}
+	}
+}`
+
+func writeKeys(t *testing.T, body string) string {
+	t.Helper()
+	fpath := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(fpath, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fpath
+}
+
+func TestFileKeySource(t *testing.T) {
+	fpath := writeKeys(t, testKeys)
+	tests := []struct {
+		mode, name string
+		id, token  string
+		err        string
+	}{
+		{"live", "", "live-id", "live-token", ""},
+		{"demo", "", "demo-id", "demo-token", ""},
+		{"", "", "", "", `no "" key`},
+		// tokenを省略した口座はmodeのtokenを使う
+		{"", "sub1", "sub1-id", "live-token", ""},
+		{"", "practice", "practice-id", "demo-token", ""},
+		{"", "own", "own-id", "own-token", ""},
+		{"", "missing", "", "", `no account "missing"`},
+		{"", "nomode", "", "", `invalid mode ""`},
+	}
+	for _, tt := range tests {
+		id, token, err := (&FileKeySource{Path: fpath, Mode: tt.mode, Name: tt.name}).Key()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v/%v: err = %v, want %v", tt.mode, tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || id != tt.id || token != tt.token {
+			t.Errorf("%v/%v: %v,%v,%v", tt.mode, tt.name, id, token, err)
+		}
+	}
+
+	// modeのtokenが無い
+	fpath = writeKeys(t, `{"live":{"id":"live-id","token":"live-token"},"accounts":{"practice":{"mode":"demo","id":"practice-id"}}}`)
+	if _, _, err := (&FileKeySource{Path: fpath, Name: "practice"}).Key(); err == nil || !strings.Contains(err.Error(), "no token") {
+		t.Errorf("no demo token: %v", err)
+	}
+	// ファイルが無い、壊れている
+	if _, _, err := (&FileKeySource{Path: filepath.Join(t.TempDir(), "none.json"), Mode: "live"}).Key(); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+	if _, _, err := (&FileKeySource{Path: writeKeys(t, `{"live":`), Mode: "live"}).Key(); err == nil {
+		t.Error("broken file: want error")
+	}
+}
+
+func TestAccountNames(t *testing.T) {
+	names, err := AccountNames(writeKeys(t, testKeys))
+	if err != nil || strings.Join(names, ",") != "nomode,own,practice,sub1" {
+		t.Errorf("names = %v, %v", names, err)
+	}
+	names, err = AccountNames(writeKeys(t, `{"live":{"id":"live-id","token":"live-token"}}`))
+	if err != nil || len(names) != 0 {
+		t.Errorf("no accounts: %v, %v", names, err)
+	}
+}
+
+func TestNewGoquestAccount(t *testing.T) {
+	fpath := writeKeys(t, testKeys)
+	goq, err := NewGoquestAccount(fpath, "practice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// demoの口座はpracticeのurl
+	if goq.Auth.Id != "practice-id" || goq.Auth.Token != "demo-token" || goq.url != DEMO_URL {
+		t.Errorf("practice = %+v %v", goq.Auth, goq.url)
+	}
+	if _, err := NewGoquestAccount(fpath, "missing"); err == nil {
+		t.Error("missing: want error")
+	}
+
+	sub := goq.ForAccount("other-id")
+	if sub.Auth.Id != "other-id" || sub.Auth.Token != "demo-token" || goq.Auth.Id != "practice-id" {
+		t.Errorf("ForAccount = %+v, original %+v", sub.Auth, goq.Auth)
+	}
+}
+
+func TestNewAccountList(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"accounts":[{"id":"001-1","tags":[]},{"id":"001-2","tags":["sub"]}]}`)
+	res, err := NewAccountListContext(context.Background(), goq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := res.Extract()
+	if rec.path != "/accounts" || len(l) != 2 || l[1].ID != "001-2" || l[1].Tags[0] != "sub" {
+		t.Errorf("%v: %+v", rec.path, l)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * 通貨の換算。取引量や損益を口座通貨で計算するのに使う。
+ */
+
+package oanda
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// "EUR_USD"なら"EUR","USD"。"_"が無ければ両方instrument
+func SplitInstrument(instrument string) (string, string) {
+	if i := strings.Index(instrument, "_"); i >= 0 {
+		return instrument[:i], instrument[i+1:]
+	}
+	return instrument, instrument
+}
+
+// instrumentのquote通貨1単位をhome通貨に換算するレート(mid)。
+// quote通貨がhomeなら1を返し、リクエストはしない。
+// "{quote}_{home}"の価格、無ければ"{home}_{quote}"の価格の逆数。どちらも取れなければerror
+func QuoteHomeRate(goq *Goquest, instrument, home string) (float64, error) {
+	return QuoteHomeRateContext(context.Background(), goq, instrument, home)
+}
+
+// QuoteHomeRateのcontext版。
+func QuoteHomeRateContext(ctx context.Context, goq *Goquest, instrument, home string) (float64, error) {
+	_, quote := SplitInstrument(instrument)
+	if len(home) == 0 || quote == home {
+		return 1, nil
+	}
+	mid, err := pricingMid(ctx, goq, quote+"_"+home)
+	if err == nil {
+		return mid, nil
+	}
+	// 存在しない通貨ペアは400が返る。逆向きを試す
+	if inv, ierr := pricingMid(ctx, goq, home+"_"+quote); ierr == nil {
+		return 1 / inv, nil
+	}
+	return 0, err
+}
+
+// instrumentの現在価格(mid)
+func pricingMid(ctx context.Context, goq *Goquest, instrument string) (float64, error) {
+	pricing, err := NewPricingContext(ctx, goq, instrument)
+	if err != nil {
+		return 0, err
+	}
+	p := pricing.Latest(instrument)
+	if p == nil || p.Mid() == EmptyError || p.Mid() <= 0 {
+		return 0, fmt.Errorf("%w for %v", ErrNoPrice, instrument)
+	}
+	return p.Mid(), nil
+}
@@ -0,0 +1,67 @@
+package oanda
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplitInstrument(t *testing.T) {
+	if b, q := SplitInstrument("EUR_USD"); b != "EUR" || q != "USD" {
+		t.Errorf("EUR_USD = %v,%v", b, q)
+	}
+	if b, q := SplitInstrument("XAU"); b != "XAU" || q != "XAU" {
+		t.Errorf("XAU = %v,%v", b, q)
+	}
+}
+
+func TestQuoteHomeRate(t *testing.T) {
+	// instrument毎のpricingのレスポンス。無ければ400
+	prices := map[string]string{
+		"USD_JPY": `{"prices":[{"instrument":"USD_JPY","bids":[{"price":"149.99"}],"asks":[{"price":"150.01"}]}]}`,
+		"GBP_USD": `{"prices":[{"instrument":"GBP_USD","bids":[{"price":"1.2499"}],"asks":[{"price":"1.2501"}]}]}`,
+		// 価格が入っていない
+		"CHF_JPY": `{"prices":[]}`,
+	}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, ok := prices[r.URL.Query().Get("instruments")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			body = `{"errorMessage":"Invalid Instrument"}`
+		}
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	goq, err := NewClient(WithBaseURL(ts.URL), WithKey("acc", "token"), WithRetry(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// quote通貨がhomeならリクエストしない
+	if r, err := QuoteHomeRateContext(ctx, goq, "USD_JPY", "JPY"); err != nil || r != 1 || requests != 0 {
+		t.Errorf("same = %v,%v requests %v", r, err, requests)
+	}
+	// {quote}_{home}
+	if r, err := QuoteHomeRateContext(ctx, goq, "EUR_USD", "JPY"); err != nil || r != 150 {
+		t.Errorf("direct = %v,%v", r, err)
+	}
+	// {home}_{quote}の逆数
+	if r, err := QuoteHomeRateContext(ctx, goq, "EUR_USD", "GBP"); err != nil || r != 1/1.25 {
+		t.Errorf("inverse = %v,%v", r, err)
+	}
+	// どちらも無い場合は{quote}_{home}のエラー
+	var ae *APIError
+	if _, err := QuoteHomeRateContext(ctx, goq, "EUR_AUD", "NZD"); !errors.As(err, &ae) || ae.StatusCode != 400 {
+		t.Errorf("missing = %v", err)
+	}
+	// レスポンスに価格が無い
+	var de *DecodeError
+	if _, err := QuoteHomeRateContext(ctx, goq, "EUR_CHF", "JPY"); !errors.Is(err, ErrNoPrice) || errors.As(err, &de) {
+		t.Errorf("no price = %v", err)
+	}
+}
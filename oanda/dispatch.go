@@ -0,0 +1,167 @@
+/*
+ * transactions/streamのclientと、受信したtransactionを購読者に配るdispatcher
+ */
+
+package oanda
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type (
+	// transactionのstream。
+	// GET: v3/accounts/{accountID}/transactions/stream
+	TransactionStream struct {
+		// transaction。HEARTBEATも流れてくる。ctxがキャンセルされるとcloseされる。
+		C <-chan Transaction
+		// 接続エラー。再接続は自動で行うので、ログ用。読まなくても詰まらない。
+		Errors <-chan error
+	}
+
+	// TransactionStreamで受信したtransactionを、typeごとに購読者に配る。
+	TransactionDispatcher struct {
+		mu   sync.Mutex
+		subs map[int]*subscription
+		next int
+		// HEARTBEATかtransactionを受信済みか
+		connected bool
+		// バッファが一杯で配れなかった数(購読者毎に数える)
+		dropped int
+	}
+
+	subscription struct {
+		ch    chan Transaction
+		types map[string]bool
+	}
+)
+
+// 購読者1人あたりのバッファ。溢れた分は捨てる。
+var SUBSCRIPTION_BUFFER = 256
+
+// transactionのstreamを開始する。
+// 切断された場合はgoq.Retryのbackoffで再接続し続ける。ctxをキャンセルすると終了する。
+func NewTransactionStream(ctx context.Context, goq *Goquest) *TransactionStream {
+	txs := make(chan Transaction, 64)
+	errs := make(chan error, 8)
+	ep := "/accounts/" + goq.Auth.Id + "/transactions/stream"
+
+	go func() {
+		defer close(txs)
+		goq.streamLoop(ctx, ep, nil, errs, func(b []byte) error {
+			t, err := DecodeTransaction(b)
+			if err != nil {
+				return err
+			}
+			select {
+			case txs <- t:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+	return &TransactionStream{C: txs, Errors: errs}
+}
+
+func NewTransactionDispatcher() *TransactionDispatcher {
+	return &TransactionDispatcher{subs: map[int]*subscription{}}
+}
+
+// transactionのstreamに接続し、ctxがキャンセルされるまで購読者に配る。goで呼ぶこと。
+// errsに接続エラーと、購読者のバッファが一杯で配れなかったtransactionを渡す。nilなら捨てる。
+func (d *TransactionDispatcher) Run(ctx context.Context, goq *Goquest, errs func(error)) {
+	stream := NewTransactionStream(ctx, goq)
+	for {
+		select {
+		case t, ok := <-stream.C:
+			if !ok {
+				d.setConnected(false)
+				return
+			}
+			d.setConnected(true)
+			if n := d.Dispatch(t); n > 0 && errs != nil {
+				h := t.Header()
+				errs(fmt.Errorf("oanda: transaction %v %v dropped for %v subscribers: buffer full", h.Type, h.ID, n))
+			}
+		case err := <-stream.Errors:
+			d.setConnected(false)
+			if errs != nil {
+				errs(err)
+			}
+		}
+	}
+}
+
+// streamに接続できているか。falseの場合、fillの待ちはpollingにする等で対応すること。
+func (d *TransactionDispatcher) Connected() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.connected
+}
+
+func (d *TransactionDispatcher) setConnected(b bool) {
+	d.mu.Lock()
+	d.connected = b
+	d.mu.Unlock()
+}
+
+// typesのtransactionを購読する。typesが空なら全て(HEARTBEATを除く)。
+// 戻り値のfuncで購読を解除する(channelもcloseされる)。
+func (d *TransactionDispatcher) Subscribe(types ...string) (<-chan Transaction, func()) {
+	sub := &subscription{
+		ch:    make(chan Transaction, SUBSCRIPTION_BUFFER),
+		types: map[string]bool{},
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	d.mu.Lock()
+	id := d.next
+	d.next++
+	d.subs[id] = sub
+	d.mu.Unlock()
+
+	once := sync.Once{}
+	cancel := func() {
+		once.Do(func() {
+			d.mu.Lock()
+			delete(d.subs, id)
+			d.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+// transactionを購読者に配る。購読者のバッファが一杯なら、その購読者には配らない。
+// 配れなかった購読者の数を返す。
+func (d *TransactionDispatcher) Dispatch(t Transaction) int {
+	typ := t.Header().Type
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dropped := 0
+	for _, sub := range d.subs {
+		if len(sub.types) == 0 && typ == "HEARTBEAT" {
+			continue
+		}
+		if len(sub.types) > 0 && !sub.types[typ] {
+			continue
+		}
+		select {
+		case sub.ch <- t:
+		default:
+			dropped++
+		}
+	}
+	d.dropped += dropped
+	return dropped
+}
+
+// これまでにバッファが一杯で配れなかった数。購読者毎に数える。
+func (d *TransactionDispatcher) Dropped() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dropped
+}
@@ -0,0 +1,147 @@
+package oanda
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testTx(typ, id string) Transaction {
+	if typ == "HEARTBEAT" {
+		return &TransactionHeartbeat{TransactionHeader: TransactionHeader{Type: typ}}
+	}
+	return &OtherTransaction{TransactionHeader: TransactionHeader{ID: id, Type: typ}}
+}
+
+// chに溜まっているtransactionのidを返す
+func drain(ch <-chan Transaction) []string {
+	ids := []string{}
+	for {
+		select {
+		case t, ok := <-ch:
+			if !ok {
+				return ids
+			}
+			ids = append(ids, t.Header().ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	d := NewTransactionDispatcher()
+	fills, unsubFills := d.Subscribe("ORDER_FILL", "ORDER_CANCEL")
+	all, unsubAll := d.Subscribe()
+	defer unsubAll()
+
+	d.Dispatch(testTx("ORDER_FILL", "1"))
+	d.Dispatch(testTx("HEARTBEAT", ""))
+	d.Dispatch(testTx("MARKET_ORDER", "2"))
+	d.Dispatch(testTx("ORDER_CANCEL", "3"))
+
+	if got := drain(fills); len(got) != 2 || got[0] != "1" || got[1] != "3" {
+		t.Errorf("fills = %v, want [1 3]", got)
+	}
+	// 全購読でもHEARTBEATは配らない
+	if got := drain(all); len(got) != 3 {
+		t.Errorf("all = %v, want [1 2 3]", got)
+	}
+
+	// 解除後は配られず、channelはcloseされる
+	unsubFills()
+	unsubFills()
+	d.Dispatch(testTx("ORDER_FILL", "4"))
+	if _, ok := <-fills; ok {
+		t.Error("fills should be closed")
+	}
+	if got := drain(all); len(got) != 1 || got[0] != "4" {
+		t.Errorf("all after unsubscribe = %v", got)
+	}
+}
+
+// 読まない購読者がいてもDispatchは詰まらない
+func TestDispatchFullBuffer(t *testing.T) {
+	old := SUBSCRIPTION_BUFFER
+	SUBSCRIPTION_BUFFER = 2
+	defer func() { SUBSCRIPTION_BUFFER = old }()
+
+	d := NewTransactionDispatcher()
+	slow, unsub := d.Subscribe()
+	defer unsub()
+
+	done := make(chan struct{})
+	dropped := []int{}
+	go func() {
+		for _, id := range []string{"1", "2", "3"} {
+			dropped = append(dropped, d.Dispatch(testTx("ORDER_FILL", id)))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch blocked on a full subscriber")
+	}
+	// 溢れた分は捨てられ、数える
+	if got := drain(slow); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("slow = %v, want [1 2]", got)
+	}
+	if len(dropped) != 3 || dropped[2] != 1 || d.Dropped() != 1 {
+		t.Errorf("dropped = %v, total %v, want 3rd only", dropped, d.Dropped())
+	}
+}
+
+func TestTransactionDispatcherRun(t *testing.T) {
+	s := &streamServer{handlers: []func(http.ResponseWriter, *http.Request){
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/accounts/acc/transactions/stream" {
+				t.Errorf("path = %v", r.URL.Path)
+			}
+			sendLines(`{"type":"HEARTBEAT","lastTransactionID":"1"}`)(w, r)
+		},
+		sendLines(`{"type":"HEARTBEAT","lastTransactionID":"1"}`, `{"id":"2","type":"ORDER_FILL","orderID":"1"}`),
+	}}
+	goq := newStreamClient(t, s)
+	setStreamTimeout(t, 100*time.Millisecond)
+
+	d := NewTransactionDispatcher()
+	fills, unsub := d.Subscribe("ORDER_FILL")
+	defer unsub()
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 8)
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, goq, func(err error) { errs <- err })
+		close(done)
+	}()
+
+	// 1回目の接続はtimeoutで切れて再接続し、そこで約定が流れてくる
+	select {
+	case tr := <-fills:
+		if f, ok := tr.(*OrderFillTransaction); !ok || f.OrderID != "1" {
+			t.Errorf("fill = %+v", tr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no fill")
+	}
+	if !d.Connected() {
+		t.Error("Connected = false after receiving")
+	}
+	select {
+	case <-errs:
+	default:
+		t.Error("timeout error was not reported")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if d.Connected() {
+		t.Error("Connected = true after Run returned")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Goquestのリクエストで返すエラーの型を定める
+ */
+
+package oanda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type (
+	// 通信エラー。DNSエラーやタイムアウト等、レスポンスが得られなかった場合。
+	TransportError struct {
+		Method string
+		Url    string
+		Err    error
+	}
+
+	// ステータスコードが2xx以外で、bodyがOandaのエラー形式でない場合。
+	StatusError struct {
+		Method     string
+		Url        string
+		StatusCode int
+		Body       []byte
+		// Retry-Afterヘッダの値。無ければ0。
+		RetryAfter time.Duration
+	}
+
+	// ステータスコードが2xx以外で、bodyにerrorMessage(,errorCode)が入っている場合。
+	// 注文系のAPIだとorderRejectTransaction等もbodyに入ってくるのでBodyも保持しておく。
+	APIError struct {
+		Method     string `json:"-"`
+		Url        string `json:"-"`
+		StatusCode int    `json:"-"`
+		Code       string `json:"errorCode"`
+		Message    string `json:"errorMessage"`
+		Body       []byte `json:"-"`
+		// Retry-Afterヘッダの値。無ければ0。
+		RetryAfter time.Duration `json:"-"`
+	}
+
+	// レスポンスのbodyをjsonとして読めなかった場合。
+	DecodeError struct {
+		Url  string
+		Body []byte
+		Err  error
+	}
+
+	// リクエスト前のパラメタチェックで弾いた場合。リクエストは送信されていない。
+	ParamError struct {
+		Field string
+		Msg   string
+	}
+)
+
+// レスポンスは読めたが、必要なデータが入っていなかった場合のエラー。errors.Isで判定する。
+var (
+	// 口座情報(account)が入っていない
+	ErrEmptyAccount = errors.New("oanda: account is empty")
+	// pricingに指定した通貨ペアの価格が入っていない
+	ErrNoPrice = errors.New("oanda: no price")
+)
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("oanda: %v %v: %v", e.Method, e.Url, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("oanda: %v %v: status %v", e.Method, e.Url, e.StatusCode)
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("oanda: %v %v: status %v: %v (%v)", e.Method, e.Url, e.StatusCode, e.Message, e.Code)
+	}
+	return fmt.Sprintf("oanda: %v %v: status %v: %v", e.Method, e.Url, e.StatusCode, e.Message)
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("oanda: %v: could not decode response: %v", e.Url, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("oanda: invalid param %v: %v", e.Field, e.Msg)
+}
+
+// ステータスコードが2xx以外の時のエラーを生成する。
+// bodyにerrorMessageがあればAPIError、なければStatusErrorを返す。
+func newStatusError(method, url string, code int, header http.Header, body []byte) error {
+	ae := &APIError{}
+	if err := json.Unmarshal(body, ae); err == nil && ae.Message != "" {
+		ae.Method = method
+		ae.Url = url
+		ae.StatusCode = code
+		ae.Body = body
+		ae.RetryAfter = retryAfter(header)
+		return ae
+	}
+	return &StatusError{
+		Method:     method,
+		Url:        url,
+		StatusCode: code,
+		Body:       body,
+		RetryAfter: retryAfter(header),
+	}
+}
+
+// errがStatusErrorかAPIErrorならそのステータスコード。それ以外は0。
+func statusCode(err error) int {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.StatusCode
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+/*
+ * 長期間のロウソク足の取得。1リクエスト5000本の上限を超える期間をfrom,toで分割して取得する。
+ */
+
+package oanda
+
+import (
+	"context"
+	"time"
+)
+
+// 1リクエストで取得できるロウソク足の上限
+const MaxCandles = 5000
+
+// fromからtoまでの確定したロウソク足を、MaxCandles本分の期間ずつ取得してfnに渡す。
+// fnには古い順に、重複を除いて渡す。fnがエラーを返すとそこで中断する。
+// toが未来の場合oandaはエラーを返すので、現在時刻以前にしておくこと。
+func FetchCandles(
+	goq *Goquest,
+	instrument string,
+	granularity Granularity,
+	from, to time.Time,
+	priceComponent string,
+	fn func(CandleSticks) error,
+) error {
+	return FetchCandlesContext(context.Background(), goq, instrument, granularity, from, to, priceComponent, fn)
+}
+
+// FetchCandlesのcontext版。
+func FetchCandlesContext(
+	ctx context.Context,
+	goq *Goquest,
+	instrument string,
+	granularity Granularity,
+	from, to time.Time,
+	priceComponent string,
+	fn func(CandleSticks) error,
+) error {
+	if err := granularity.Validate(); err != nil {
+		return err
+	}
+	if !from.Before(to) {
+		return &ParamError{Field: "from,to", Msg: "from must be before to"}
+	}
+	// from,toの両端の足が含まれても上限を超えないように1本分減らす
+	step := granularity.Duration() * (MaxCandles - 1)
+	last := time.Time{}
+	for start := from; start.Before(to); {
+		end := start.Add(step)
+		if end.After(to) {
+			end = to
+		}
+		res, err := NewCandlesContext(ctx, goq, 0, granularity, instrument, FormatTime(start), FormatTime(end), priceComponent)
+		if err != nil {
+			return err
+		}
+		sticks := CandleSticks{}
+		for _, s := range res.Sticks() {
+			// 境界の足は前後のリクエストで重複し得る
+			if !s.Complete || s.Time.Before(from) || !s.Time.After(last) && !last.IsZero() {
+				continue
+			}
+			sticks = append(sticks, s)
+			last = s.Time
+		}
+		if len(sticks) > 0 {
+			if err := fn(sticks); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
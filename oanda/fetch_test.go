@@ -0,0 +1,44 @@
+package oanda_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+func TestFetchCandlesParam(t *testing.T) {
+	_, goq := newSimClient(t)
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fn := func(oanda.CandleSticks) error { return nil }
+	var pe *oanda.ParamError
+	if err := oanda.FetchCandlesContext(ctx, goq, "USD_JPY", "H1", from, from, "M", fn); !errors.As(err, &pe) {
+		t.Errorf("from == to: %v", err)
+	}
+	if err := oanda.FetchCandlesContext(ctx, goq, "USD_JPY", "H5", from, from.Add(time.Hour), "M", fn); !errors.As(err, &pe) {
+		t.Errorf("bad granularity: %v", err)
+	}
+}
+
+// fnのエラーで中断する
+func TestFetchCandlesStop(t *testing.T) {
+	srv, goq := newSimClient(t)
+	for srv.Step() {
+	}
+	stop := errors.New("stop")
+	calls := 0
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := oanda.FetchCandlesContext(context.Background(), goq, "USD_JPY", "H1", from, from.Add(9*time.Hour), "M", func(s oanda.CandleSticks) error {
+		calls++
+		if len(s) != 10 || !s[0].Time.Equal(from) {
+			t.Errorf("sticks = %v", len(s))
+		}
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("err = %v, calls = %v", err, calls)
+	}
+}
@@ -5,24 +5,41 @@
 package oanda
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
-	"strings"
+	"time"
 )
 
 var (
 	LIVE_URL = "https://api-fxtrade.oanda.com/v3"
 	DEMO_URL = "https://api-fxpractice.oanda.com/v3"
+	// streaming用のurl
+	LIVE_STREAM_URL = "https://stream-fxtrade.oanda.com/v3"
+	DEMO_STREAM_URL = "https://stream-fxpractice.oanda.com/v3"
 )
 
 type (
 	Goquest struct {
 		Auth   *apiKey
 		Client *http.Client
-		url    string
+		// リトライ方針。nilならリトライしない。
+		Retry *RetryPolicy
+		// 1回のリクエスト(試行)あたりのタイムアウト。0なら無制限。
+		Timeout time.Duration
+		// リクエスト数の制限。nilなら制限しない。ForAccountで作ったGoquestとは共有する。
+		Limiter *RateLimiter
+		url     string
+		// streaming endpoint用のurl
+		streamUrl string
+		// User-Agentヘッダ。空ならGoのデフォルト。
+		userAgent string
+		// 認証情報の取得元。NewClientで読み取ってAuthに設定する。
+		keys KeySource
 	}
 )
 
@@ -32,18 +49,64 @@ type iMap map[string]interface{}
 // Oanda-API実行用のハンドラを返す。
 // fpath:APIキー等が入ったファイル({"live":{"id":string,"token":string},"demo":{"id":string,"token":string}})。
 // mode: "live" ->本番 "demo" ->　デモ。
-func NewGoquest(fpath string, mode string) *Goquest {
-	host := ""
+// optsでurlや認証情報を上書きできる（mock server向けなど）。
+func NewGoquest(fpath string, mode string, opts ...Option) (*Goquest, error) {
+	host, stream := "", ""
 	if mode == "live" {
-		host = LIVE_URL
+		host, stream = LIVE_URL, LIVE_STREAM_URL
 	} else if mode == "demo" {
-		host = DEMO_URL
+		host, stream = DEMO_URL, DEMO_STREAM_URL
 	}
-	return &Goquest{
-		Auth:   newApiKey(fpath, mode),
-		Client: &http.Client{},
-		url:    host,
+	defaults := []Option{
+		WithBaseURL(host),
+		WithStreamURL(stream),
+		WithKeySource(&FileKeySource{Path: fpath, Mode: mode}),
 	}
+	return NewClient(append(defaults, opts...)...)
+}
+
+// fpathの"accounts"に定義した名前付きの口座用のハンドラを返す。
+// live,demoは口座のmodeで決まる。
+func NewGoquestAccount(fpath string, name string, opts ...Option) (*Goquest, error) {
+	key, err := newAccountKey(fpath, name)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithKeySource(&FileKeySource{Path: fpath, Name: name})}, opts...)
+	return NewGoquest(fpath, key.Mode, opts...)
+}
+
+// 同じtokenで別の口座(サブアカウント等)を操作するハンドラを返す。
+// http.Client等の設定は共有する。
+func (goq *Goquest) ForAccount(id string) *Goquest {
+	g := *goq
+	g.Auth = &apiKey{Id: id, Token: goq.Auth.Token}
+	return &g
+}
+
+// optsからOanda-API実行用のハンドラを返す。
+// WithBaseURLとWithKeySource(もしくはWithKey)は必須。
+func NewClient(opts ...Option) (*Goquest, error) {
+	goq := &Goquest{
+		Client:  &http.Client{},
+		Retry:   DefaultRetryPolicy(),
+		Timeout: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(goq)
+	}
+	if goq.url == "" {
+		return nil, errors.New("oanda: base url is not set")
+	}
+	if goq.keys == nil {
+		return nil, errors.New("oanda: key source is not set")
+	}
+	id, token, err := goq.keys.Key()
+	if err != nil {
+		return nil, err
+	}
+	goq.Auth = &apiKey{Id: id, Token: token}
+	return goq, nil
 }
 
 // paramをuriにエンコードし、フルurlを返す。
@@ -57,9 +120,12 @@ func (g *Goquest) genUrl(ep string, param strMap) string {
 	return url
 }
 
-// 認証authをヘッダにセット
+// 認証authをヘッダにセット。User-Agentの指定があればそれもセット。
 func (g *Goquest) auth(req *http.Request) {
 	req.Header.Set("Authorization", "Bearer "+g.Auth.Token)
+	if g.userAgent != "" {
+		req.Header.Set("User-Agent", g.userAgent)
+	}
 }
 
 // Content-Typeをヘッダにセット
@@ -68,77 +134,124 @@ func (g *Goquest) contenType(req *http.Request, mime string) {
 }
 
 // GET 実行。Responseはjsonを想定。responseのbodyをinterfaceにpopulateする。
-func (goq *Goquest) Get(ep string, param strMap, i Checker) {
+// 通信・ステータス・decodeのいずれかで失敗した場合はerrorを返す。
+// GETは冪等なので、goq.Retryに従ってリトライする。
+// ctxがキャンセルされた場合はリトライの待ちも含めて中断する。
+func (goq *Goquest) Get(ctx context.Context, ep string, param strMap, i Checker) error {
 	uri := goq.genUrl(ep, param)
-	req, err := http.NewRequest("GET", uri, nil)
-
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	goq.auth(req)
-
-	res, err := goq.Client.Do(req)
-	if err != nil {
-		fmt.Println(err)
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		goq.auth(req)
+		return req, nil
 	}
-
-	defer res.Body.Close()
-
-	b, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	err = json.Unmarshal(b, i)
-	if err != nil {
-		fmt.Println(err)
-	}
-	// Check interfaceにステータスコードを設定
-	i.Status(res.StatusCode)
-
+	return goq.send(newReq, true, i)
 }
 
-func (goq *Goquest) Post(ep string, param iMap, i Checker) {
-	goq.exec("POST", ep, param, i)
+func (goq *Goquest) Post(ctx context.Context, ep string, param iMap, i Checker) error {
+	return goq.exec(ctx, "POST", ep, param, i)
 }
 
-func (goq *Goquest) Put(ep string, param iMap, i Checker) {
-	goq.exec("PUT", ep, param, i)
+func (goq *Goquest) Put(ctx context.Context, ep string, param iMap, i Checker) error {
+	return goq.exec(ctx, "PUT", ep, param, i)
 }
 
-func (goq *Goquest) exec(method string, ep string, param iMap, i Checker) {
+// POST,PUTは冪等とは限らない（成行き注文の二重発注など）ので、
+// リクエストが届いていないことが確実な場合のみリトライする。
+// ctxがキャンセルされた場合はGetと同じくリトライの待ちも含めて中断する。
+// New*Context関数はGet,Post,Putにctxを渡すので、どれもこれに従う。
+func (goq *Goquest) exec(ctx context.Context, method string, ep string, param iMap, i Checker) error {
 	uri := goq.genUrl(ep, nil)
 	body, err := json.Marshal(param)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	// fmt.Println(uri)
-	req, err := http.NewRequest(method, uri, strings.NewReader(string(body)))
-	if err != nil {
-		fmt.Println(err)
+	newReq := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		goq.auth(req)
+		// add content-type
+		goq.contenType(req, "application/json")
+		return req, nil
+	}
+	return goq.send(newReq, false, i)
+}
+
+// newReqで生成したリクエストを、goq.Retryに従ってリトライしながら実行する。
+// リトライの度にリクエストを生成しなおす（bodyを読み直すため）。
+func (goq *Goquest) send(newReq func() (*http.Request, error), idempotent bool, i Checker) error {
+	policy := goq.Retry
+	if policy == nil {
+		policy = NoRetry()
 	}
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return err
+		}
+		parent := req.Context()
+		// リトライも1リクエストとして数える
+		if err := goq.Limiter.Wait(parent); err != nil {
+			return err
+		}
+		err = goq.do(req, i)
+		if err == nil {
+			return nil
+		}
+		// 呼び出し元がキャンセルしている場合はリトライしない
+		if parent.Err() != nil {
+			return err
+		}
+		if attempt >= policy.MaxAttempts || !policy.retryable(err, idempotent) {
+			return err
+		}
+		wait := policy.backoff(attempt)
+		if ra := errRetryAfter(err); ra > 0 {
+			wait = ra
+		}
+		if serr := sleepContext(parent, wait); serr != nil {
+			return err
+		}
+	}
+}
+
+// リクエストを1回実行し、responseのbodyをinterfaceにpopulateする。
+// ステータスコードが2xx以外の場合もbodyはpopulateするが、errorを返す。
+func (goq *Goquest) do(req *http.Request, i Checker) error {
+	method, uri := req.Method, req.URL.String()
 
-	goq.auth(req)
-	// add content-type
-	goq.contenType(req, "application/json")
+	if goq.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), goq.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
 
 	res, err := goq.Client.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		return &TransportError{Method: method, Url: uri, Err: err}
 	}
-
 	defer res.Body.Close()
 
-	resBody, err := ioutil.ReadAll(res.Body)
+	b, err := io.ReadAll(res.Body)
 	if err != nil {
-		fmt.Println(err)
+		return &TransportError{Method: method, Url: uri, Err: err}
 	}
 
-	err = json.Unmarshal(resBody, i)
-	if err != nil {
-		fmt.Println(err)
-	}
-	// fmt.Println(res.Status)
+	// Check interfaceにステータスコードを設定
 	i.Status(res.StatusCode)
+
+	if !i.Check() {
+		// 注文系はエラー時もrejectTransaction等が入っているのでpopulateしておく
+		json.Unmarshal(b, i)
+		return newStatusError(method, uri, res.StatusCode, res.Header, b)
+	}
+
+	if err := json.Unmarshal(b, i); err != nil {
+		return &DecodeError{Url: uri, Body: b, Err: err}
+	}
+	return nil
 }
@@ -0,0 +1,161 @@
+/*
+ * ロウソク足の足(granularity)。足の長さと、足の開始時刻の計算。
+ */
+
+package oanda
+
+import (
+	"strconv"
+	"time"
+)
+
+// ロウソク足の足。"S5","M5","H4","D","W","M"等
+type Granularity string
+
+var granularities = map[Granularity]time.Duration{
+	"S5":  5 * time.Second,
+	"S10": 10 * time.Second,
+	"S15": 15 * time.Second,
+	"S30": 30 * time.Second,
+	"M1":  time.Minute,
+	"M2":  2 * time.Minute,
+	"M4":  4 * time.Minute,
+	"M5":  5 * time.Minute,
+	"M10": 10 * time.Minute,
+	"M15": 15 * time.Minute,
+	"M30": 30 * time.Minute,
+	"H1":  time.Hour,
+	"H2":  2 * time.Hour,
+	"H3":  3 * time.Hour,
+	"H4":  4 * time.Hour,
+	"H6":  6 * time.Hour,
+	"H8":  8 * time.Hour,
+	"H12": 12 * time.Hour,
+	"D":   24 * time.Hour,
+	"W":   7 * 24 * time.Hour,
+	// 月の長さは一定でないので31日としておく。足の境界はNextで求めること
+	"M": 31 * 24 * time.Hour,
+}
+
+// 文字列をGranularityにする。oandaに無い足ならParamError
+func ParseGranularity(s string) (Granularity, error) {
+	g := Granularity(s)
+	if err := g.Validate(); err != nil {
+		return "", err
+	}
+	return g, nil
+}
+
+// oandaで使える足ならnil
+func (g Granularity) Validate() error {
+	if _, ok := granularities[g]; !ok {
+		return &ParamError{Field: "granularity", Msg: "unsupported granularity:" + strconv.Quote(string(g))}
+	}
+	return nil
+}
+
+// 足の長さ。"M5"なら5分。不正な足なら0
+func (g Granularity) Duration() time.Duration {
+	return granularities[g]
+}
+
+func (g Granularity) String() string {
+	return string(g)
+}
+
+// 日足以上の足の区切り。oandaのcandlesのdailyAlignment,alignmentTimezone,weeklyAlignmentに対応する。
+// ゼロ値はUTCの0時、日曜始まり。
+type Alignment struct {
+	// 日足の始まりの時刻(0-23)。oandaのdefaultは17
+	DailyAlignment int
+	// DailyAlignmentのtimezone。nilならUTC。oandaのdefaultはAmerica/New_York
+	Timezone *time.Location
+	// 週足の始まりの曜日。oandaのdefaultはFriday
+	WeeklyAlignment time.Weekday
+}
+
+// oandaのdefaultの区切り(America/New_Yorkの17時、金曜始まり)。
+// tzdataが無い環境ではEST(UTC-5)固定になるので、夏時間中は1時間ずれる。
+func DefaultAlignment() Alignment {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		loc = time.FixedZone("EST", -5*60*60)
+	}
+	return Alignment{DailyAlignment: 17, Timezone: loc, WeeklyAlignment: time.Friday}
+}
+
+func (a Alignment) location() *time.Location {
+	if a.Timezone == nil {
+		return time.UTC
+	}
+	return a.Timezone
+}
+
+// tを含む日足の開始時刻
+func (a Alignment) dayStart(t time.Time) time.Time {
+	loc := a.location()
+	lt := t.In(loc)
+	d := time.Date(lt.Year(), lt.Month(), lt.Day(), a.DailyAlignment, 0, 0, 0, loc)
+	if d.After(t) {
+		d = time.Date(lt.Year(), lt.Month(), lt.Day()-1, a.DailyAlignment, 0, 0, 0, loc)
+	}
+	return d
+}
+
+// candlesのパラメタに区切りを設定する
+func (a Alignment) param(p strMap) {
+	p["dailyAlignment"] = strconv.Itoa(a.DailyAlignment)
+	p["alignmentTimezone"] = a.location().String()
+	p["weeklyAlignment"] = a.WeeklyAlignment.String()
+}
+
+// tを含む足の開始時刻。日足未満の足は日足の開始時刻から足の長さ毎に区切る。
+// 分足以下はtimezoneが1時間単位のずれであればunix時間を足の長さで割った余りを切り捨てたものと同じ。
+func (g Granularity) Align(t time.Time, a Alignment) time.Time {
+	loc := a.location()
+	switch g {
+	case "D":
+		return a.dayStart(t)
+	case "W":
+		d := a.dayStart(t).In(loc)
+		back := (int(d.Weekday()) - int(a.WeeklyAlignment) + 7) % 7
+		return time.Date(d.Year(), d.Month(), d.Day()-back, a.DailyAlignment, 0, 0, 0, loc)
+	case "M":
+		lt := t.In(loc)
+		m := time.Date(lt.Year(), lt.Month(), 1, a.DailyAlignment, 0, 0, 0, loc)
+		if m.After(t) {
+			m = time.Date(lt.Year(), lt.Month()-1, 1, a.DailyAlignment, 0, 0, 0, loc)
+		}
+		return m
+	}
+	d := g.Duration()
+	if d == 0 {
+		return t
+	}
+	day := a.dayStart(t)
+	return day.Add(t.Sub(day).Truncate(d))
+}
+
+// tより後で最初の足の開始時刻。つまりtを含む足の確定時刻。
+// 夏時間の切替日は、日足の境界を超えないように最後の足が短くなる。
+func (g Granularity) Next(t time.Time, a Alignment) time.Time {
+	start := g.Align(t, a).In(a.location())
+	switch g {
+	case "D":
+		return start.AddDate(0, 0, 1)
+	case "W":
+		return start.AddDate(0, 0, 7)
+	case "M":
+		return start.AddDate(0, 1, 0)
+	}
+	d := g.Duration()
+	if d == 0 {
+		return t
+	}
+	next := start.Add(d)
+	day := a.dayStart(start)
+	if end := time.Date(day.Year(), day.Month(), day.Day()+1, a.DailyAlignment, 0, 0, 0, a.location()); next.After(end) {
+		return end
+	}
+	return next
+}
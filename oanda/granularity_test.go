@@ -0,0 +1,109 @@
+package oanda
+
+import (
+	"errors"
+	"testing"
+	"time"
+	// America/New_Yorkの夏時間をテストするため、tzdataの無い環境でも読めるようにする
+	_ "time/tzdata"
+)
+
+func utc(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestGranularityAlign(t *testing.T) {
+	ny := DefaultAlignment()
+	tests := []struct {
+		name  string
+		g     Granularity
+		a     Alignment
+		t     string
+		align string
+		next  string
+	}{
+		{"M5", "M5", Alignment{}, "2024-01-10 12:07", "2024-01-10 12:05", "2024-01-10 12:10"},
+		{"M5 on boundary", "M5", Alignment{}, "2024-01-10 12:05", "2024-01-10 12:05", "2024-01-10 12:10"},
+		{"H1 ny", "H1", ny, "2024-01-10 12:59", "2024-01-10 12:00", "2024-01-10 13:00"},
+		// H4はNY17時(冬はUTC22時、夏は21時)から数える
+		{"H4 winter", "H4", ny, "2024-01-10 00:30", "2024-01-09 22:00", "2024-01-10 02:00"},
+		{"H4 summer", "H4", ny, "2024-07-10 00:30", "2024-07-09 21:00", "2024-07-10 01:00"},
+		{"H4 utc", "H4", Alignment{}, "2024-01-10 00:30", "2024-01-10 00:00", "2024-01-10 04:00"},
+		// 夏時間開始日(2024-03-10)は23時間。最後のH4は3時間になる
+		{"H4 dst start", "H4", ny, "2024-03-10 19:30", "2024-03-10 18:00", "2024-03-10 21:00"},
+		// 夏時間終了日(2024-11-03)は25時間。最後のH4は1時間になる
+		{"H4 dst end", "H4", ny, "2024-11-03 21:30", "2024-11-03 21:00", "2024-11-03 22:00"},
+		{"D before", "D", ny, "2024-01-10 21:59", "2024-01-09 22:00", "2024-01-10 22:00"},
+		{"D on boundary", "D", ny, "2024-01-10 22:00", "2024-01-10 22:00", "2024-01-11 22:00"},
+		{"D dst start", "D", ny, "2024-03-10 12:00", "2024-03-09 22:00", "2024-03-10 21:00"},
+		{"D tokyo", "D", Alignment{DailyAlignment: 7, Timezone: time.FixedZone("JST", 9*60*60)}, "2024-01-10 21:59", "2024-01-09 22:00", "2024-01-10 22:00"},
+		// 週足は金曜17時(NY)始まり。2024-01-10は水曜
+		{"W ny", "W", ny, "2024-01-10 12:00", "2024-01-05 22:00", "2024-01-12 22:00"},
+		{"W ny friday before", "W", ny, "2024-01-12 21:59", "2024-01-05 22:00", "2024-01-12 22:00"},
+		{"W ny friday after", "W", ny, "2024-01-12 22:00", "2024-01-12 22:00", "2024-01-19 22:00"},
+		// ゼロ値は日曜0時(UTC)始まり
+		{"W utc", "W", Alignment{}, "2024-01-10 12:00", "2024-01-07 00:00", "2024-01-14 00:00"},
+		{"W dst start", "W", ny, "2024-03-10 12:00", "2024-03-08 22:00", "2024-03-15 21:00"},
+		// 月足は1日17時(NY)始まり。1日の17時前は前月の足
+		{"M ny", "M", ny, "2024-02-15 00:00", "2024-02-01 22:00", "2024-03-01 22:00"},
+		{"M ny first day", "M", ny, "2024-03-01 21:00", "2024-02-01 22:00", "2024-03-01 22:00"},
+		{"M dst", "M", ny, "2024-03-15 00:00", "2024-03-01 22:00", "2024-04-01 21:00"},
+		{"M year end", "M", Alignment{}, "2024-12-31 23:59", "2024-12-01 00:00", "2025-01-01 00:00"},
+	}
+	for _, tt := range tests {
+		at := utc(tt.t)
+		if got := tt.g.Align(at, tt.a); !got.Equal(utc(tt.align)) {
+			t.Errorf("%v: Align = %v, want %v", tt.name, got.UTC(), tt.align)
+		}
+		if got := tt.g.Next(at, tt.a); !got.Equal(utc(tt.next)) {
+			t.Errorf("%v: Next = %v, want %v", tt.name, got.UTC(), tt.next)
+		}
+	}
+}
+
+func TestParseGranularity(t *testing.T) {
+	for _, s := range []string{"S5", "M5", "H4", "D", "W", "M"} {
+		g, err := ParseGranularity(s)
+		if err != nil || g.Duration() == 0 {
+			t.Errorf("%v: %v,%v", s, g.Duration(), err)
+		}
+	}
+	var pe *ParamError
+	for _, s := range []string{"", "M3", "h1", "H24"} {
+		if _, err := ParseGranularity(s); !errors.As(err, &pe) || pe.Field != "granularity" {
+			t.Errorf("%q: err = %v", s, err)
+		}
+	}
+	// 不正な足はAlign,Nextともにtのまま
+	at := utc("2024-01-10 12:07")
+	if g := Granularity("X"); !g.Align(at, Alignment{}).Equal(at) || !g.Next(at, Alignment{}).Equal(at) {
+		t.Error("invalid granularity moved t")
+	}
+}
+
+func TestNewCandlesAligned(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"instrument":"USD_JPY","granularity":"H4","candles":[]}`)
+	align := DefaultAlignment()
+	if _, err := NewCandlesAligned(goq, 10, "H4", "USD_JPY", "", "", "M", &align); err != nil {
+		t.Fatal(err)
+	}
+	q := rec.query
+	if rec.path != "/instruments/USD_JPY/candles" || q.Get("granularity") != "H4" || q.Get("dailyAlignment") != "17" ||
+		q.Get("alignmentTimezone") != "America/New_York" || q.Get("weeklyAlignment") != "Friday" {
+		t.Errorf("request = %v %v", rec.path, q)
+	}
+	// alignがnilならoandaのdefaultに任せる
+	if _, err := NewCandles(goq, 10, "H4", "USD_JPY", "", "", "M"); err != nil || rec.query.Has("dailyAlignment") {
+		t.Errorf("default: %v %v", rec.query, err)
+	}
+
+	rec.path = ""
+	var pe *ParamError
+	if _, err := NewCandles(goq, 10, "H5", "USD_JPY", "", "", "M"); !errors.As(err, &pe) || rec.path != "" {
+		t.Errorf("invalid granularity: %v, requested %v", err, rec.path)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * ロウソク足のローカルキャッシュ。
+ * 形式はoanda-simと同じCSV(time,o,h,l,c,volume)で、価格はmid。timeはRFC3339。
+ * Backfillで不足分だけoandaから取得して追記し、backtestや戦略のwarmupはLoadで読み込む。
+ */
+
+package history
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+var header = []string{"time", "o", "h", "l", "c", "volume"}
+
+// dir以下のキャッシュファイルのパス。dir/USD_JPY_M5.csv
+func Path(dir, instrument string, gran oanda.Granularity) string {
+	return filepath.Join(dir, fmt.Sprintf("%v_%v.csv", instrument, gran))
+}
+
+// キャッシュを全て読み込む。古い順で、PricesとMidにmidが入る。
+func Load(fpath string) (oanda.CandleSticks, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return read(f)
+}
+
+// キャッシュのうちfrom以上to未満の足を読み込む。ゼロ値なら制限なし。
+func LoadRange(fpath string, from, to time.Time) (oanda.CandleSticks, error) {
+	cs, err := Load(fpath)
+	if err != nil {
+		return nil, err
+	}
+	sticks := oanda.CandleSticks{}
+	for _, s := range cs {
+		if s.Time.Before(from) || !to.IsZero() && !s.Time.Before(to) {
+			continue
+		}
+		sticks = append(sticks, s)
+	}
+	return sticks, nil
+}
+
+// コマンドの-from,-to等の日付。"2006-01-02"(UTC)かRFC3339。空ならゼロ値。
+func ParseDate(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// fromからtoまでのロウソク足をfpathのキャッシュに揃える。追加した本数を返す。
+// キャッシュより前の期間は取得して書き直し、キャッシュより後の期間は1リクエスト毎に追記する。
+// 途中で中断しても、次回は最後に書いた足の続きから取得する。キャッシュの途中の欠けは埋めない。
+func Backfill(ctx context.Context, goq *oanda.Goquest, fpath, instrument string, gran oanda.Granularity, from, to time.Time) (int, error) {
+	cs, err := Load(fpath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	added := 0
+
+	// キャッシュより前
+	if len(cs) > 0 && from.Before(cs[0].Time) {
+		head := oanda.CandleSticks{}
+		err := oanda.FetchCandlesContext(ctx, goq, instrument, gran, from, cs[0].Time, "M", func(sticks oanda.CandleSticks) error {
+			// toの足はキャッシュの先頭と重複する
+			for _, s := range sticks {
+				if s.Time.Before(cs[0].Time) {
+					head = append(head, s)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return added, err
+		}
+		if len(head) > 0 {
+			cs = merge(head, cs)
+			if err := save(fpath, cs); err != nil {
+				return added, err
+			}
+			added += len(head)
+		}
+	}
+
+	// キャッシュより後。最後の足から取得し、重複分は書かない。
+	start := from
+	last := time.Time{}
+	if len(cs) > 0 {
+		last = cs[len(cs)-1].Time
+		if last.After(start) {
+			start = last
+		}
+	}
+	if !start.Before(to) {
+		return added, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return added, err
+	}
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return added, err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	if len(cs) == 0 {
+		if err := writeHeader(f, w); err != nil {
+			return added, err
+		}
+	}
+	err = oanda.FetchCandlesContext(ctx, goq, instrument, gran, start, to, "M", func(sticks oanda.CandleSticks) error {
+		for _, s := range sticks {
+			if !s.Time.After(last) && !last.IsZero() {
+				continue
+			}
+			if err := w.Write(record(s)); err != nil {
+				return err
+			}
+			added++
+		}
+		w.Flush()
+		return w.Error()
+	})
+	return added, err
+}
+
+// 空ファイルの場合のみheaderを書く
+func writeHeader(f *os.File, w *csv.Writer) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() > 0 {
+		return err
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// 古い順に並べ、同じ時刻の足はbの方を残す
+func merge(a, b oanda.CandleSticks) oanda.CandleSticks {
+	m := map[int64]oanda.CandleStick{}
+	for _, s := range append(append(oanda.CandleSticks{}, a...), b...) {
+		m[s.Time.UnixNano()] = s
+	}
+	cs := oanda.CandleSticks{}
+	for _, s := range m {
+		cs = append(cs, s)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Time.Before(cs[j].Time) })
+	return cs
+}
+
+// 一時ファイルに書いてから置き換える
+func save(fpath string, cs oanda.CandleSticks) error {
+	tmp := fpath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write(header)
+	for _, s := range cs {
+		w.Write(record(s))
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
+
+func record(s oanda.CandleStick) []string {
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	p := s.Prices
+	return []string{s.Time.UTC().Format(time.RFC3339), f(p.O), f(p.H), f(p.L), f(p.C), strconv.Itoa(s.Volume)}
+}
+
+func read(r io.Reader) (oanda.CandleSticks, error) {
+	rd := csv.NewReader(r)
+	rd.FieldsPerRecord = -1
+	rows, err := rd.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	cs := oanda.CandleSticks{}
+	for i, row := range rows {
+		// header行
+		if i == 0 && len(row) > 0 && row[0] == header[0] {
+			continue
+		}
+		if len(row) < 5 {
+			return nil, fmt.Errorf("history: line %v: too few columns", i+1)
+		}
+		t, err := time.Parse(time.RFC3339Nano, row[0])
+		if err != nil {
+			return nil, fmt.Errorf("history: line %v: %v", i+1, err)
+		}
+		p := &oanda.Hloc{}
+		for j, v := range []*float64{&p.O, &p.H, &p.L, &p.C} {
+			if *v, err = strconv.ParseFloat(row[j+1], 64); err != nil {
+				return nil, fmt.Errorf("history: line %v: %v", i+1, err)
+			}
+		}
+		s := oanda.CandleStick{Complete: true, Time: t.UTC(), Prices: p, Mid: p}
+		if len(row) > 5 {
+			s.Volume, _ = strconv.Atoi(row[5])
+		}
+		cs = append(cs, s)
+	}
+	return cs, nil
+}
@@ -0,0 +1,216 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/sim"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simの手前でcandlesのリクエストを数える。failAtの回目(1始まり)は500を返す
+type counter struct {
+	h      http.Handler
+	mu     sync.Mutex
+	n      int
+	failAt int
+}
+
+func (c *counter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.n++
+	fail := c.n == c.failAt
+	c.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"errorMessage":"down"}`))
+		return
+	}
+	c.h.ServeHTTP(w, r)
+}
+
+func (c *counter) reset(failAt int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n, c.failAt = 0, failAt
+}
+
+// n本のM1足が全て確定しているsimulatorと、それに向けたclient
+func newSimClient(t *testing.T, n int) (*oanda.Goquest, *counter) {
+	t.Helper()
+	cs := make([]sim.Candle, n)
+	for i := range cs {
+		p := 150 + float64(i%100)*0.01
+		cs[i] = sim.Candle{Time: start.Add(time.Duration(i) * time.Minute), O: p, H: p + 0.02, L: p - 0.02, C: p + 0.01, Volume: i}
+	}
+	srv, err := sim.New(sim.Config{AccountID: "acc", Instrument: "USD_JPY", Granularity: "M1", Warmup: n, Candles: cs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &counter{h: srv}
+	ts := httptest.NewServer(c)
+	t.Cleanup(ts.Close)
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey("acc", "token"), oanda.WithRetry(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goq, c
+}
+
+func minute(i int) time.Time {
+	return start.Add(time.Duration(i) * time.Minute)
+}
+
+// fpathのキャッシュがfromからtoまでの足を重複なく古い順に持っているか
+func checkCache(t *testing.T, fpath string, from, to int) {
+	t.Helper()
+	cs, err := Load(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != to-from+1 {
+		t.Fatalf("cache has %v candles, want %v", len(cs), to-from+1)
+	}
+	for i, s := range cs {
+		if !s.Time.Equal(minute(from+i)) || s.Volume != from+i {
+			t.Fatalf("cache[%v] = %v vol %v, want %v", i, s.Time, s.Volume, minute(from+i))
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	goq, c := newSimClient(t, 300)
+	ctx := context.Background()
+	fpath := Path(filepath.Join(t.TempDir(), "candles"), "USD_JPY", "M1")
+
+	// from,toの足を両方含む
+	n, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(100), minute(200))
+	if err != nil || n != 101 {
+		t.Fatalf("first: %v,%v", n, err)
+	}
+	checkCache(t, fpath, 100, 200)
+
+	// 取得済みの期間はリクエストしない
+	c.reset(0)
+	if n, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(120), minute(180)); err != nil || n != 0 || c.n != 0 {
+		t.Errorf("cached: %v,%v requests %v", n, err, c.n)
+	}
+
+	// 後ろは追記。最後の足は重複しない
+	if n, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(100), minute(250)); err != nil || n != 50 {
+		t.Fatalf("append: %v,%v", n, err)
+	}
+	checkCache(t, fpath, 100, 250)
+
+	// 前は取得して書き直す。境界の足(100)は重複しない
+	if n, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(50), minute(250)); err != nil || n != 50 {
+		t.Fatalf("prepend: %v,%v", n, err)
+	}
+	checkCache(t, fpath, 50, 250)
+	if _, err := os.Stat(fpath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("tmp file left: %v", err)
+	}
+
+	// 前後同時
+	if n, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(0), minute(299)); err != nil || n != 99 {
+		t.Fatalf("both: %v,%v", n, err)
+	}
+	checkCache(t, fpath, 0, 299)
+	if n, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(0), minute(299)); err != nil || n != 0 {
+		t.Errorf("again: %v,%v", n, err)
+	}
+
+	rs, err := LoadRange(fpath, minute(10), minute(20))
+	if err != nil || len(rs) != 10 || !rs[0].Time.Equal(minute(10)) {
+		t.Errorf("LoadRange = %v,%v", len(rs), err)
+	}
+	if rs, _ := LoadRange(fpath, time.Time{}, time.Time{}); len(rs) != 300 {
+		t.Errorf("LoadRange unbounded = %v", len(rs))
+	}
+}
+
+// 1リクエスト5000本の上限を超える期間は分割して取得し、中断しても続きから取得する
+func TestBackfillChunks(t *testing.T) {
+	n := 2*(oanda.MaxCandles-1) + 100
+	goq, c := newSimClient(t, n+1)
+	ctx := context.Background()
+	fpath := filepath.Join(t.TempDir(), "USD_JPY_M1.csv")
+
+	// 2回目のリクエストで失敗。1回目の分は書かれている
+	c.reset(2)
+	added, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(0), minute(n))
+	var ae *oanda.APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 500 {
+		t.Fatalf("err = %v", err)
+	}
+	if added != oanda.MaxCandles {
+		t.Errorf("added before error = %v", added)
+	}
+	checkCache(t, fpath, 0, added-1)
+
+	// 再実行は最後に書いた足から。残りは5000本以内に分けて2回
+	c.reset(0)
+	rest, err := Backfill(ctx, goq, fpath, "USD_JPY", "M1", minute(0), minute(n))
+	if err != nil || added+rest != n+1 {
+		t.Fatalf("resume: %v,%v", rest, err)
+	}
+	if c.n != 2 {
+		t.Errorf("resume requests = %v, want 2", c.n)
+	}
+	checkCache(t, fpath, 0, n)
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name, csv string
+		n         int
+		err       string
+	}{
+		{"header", "time,o,h,l,c,volume\n2024-01-01T00:00:00Z,1,2,0.5,1.5,10\n", 1, ""},
+		{"no header", "2024-01-01T00:00:00Z,1,2,0.5,1.5,10\n2024-01-01T00:01:00Z,1,2,0.5,1.5\n", 2, ""},
+		{"few columns", "2024-01-01T00:00:00Z,1,2,0.5\n", 0, "line 1: too few columns"},
+		{"bad time", "time,o,h,l,c\n2024-01-01,1,2,0.5,1.5\n", 0, "line 2"},
+		{"bad price", "2024-01-01T00:00:00Z,1,x,0.5,1.5\n", 0, "line 1"},
+	}
+	for _, tt := range tests {
+		cs, err := read(strings.NewReader(tt.csv))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: err = %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || len(cs) != tt.n || cs[0].Prices.H != 2 || cs[0].Mid != cs[0].Prices {
+			t.Errorf("%v: %+v,%v", tt.name, cs, err)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		err  bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-01-02", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"2024-01-02T09:00:00+09:00", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"2024/01/02", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDate(tt.s)
+		if (err != nil) != tt.err || !got.Equal(tt.want) {
+			t.Errorf("%q: %v, %v", tt.s, got, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * 取引可能な通貨ペアの情報(v3/accounts/{accountID}/instruments)と、
+ * それを使った価格・unitsの丸め。
+ */
+
+package oanda
+
+import (
+	"context"
+	"math"
+	"strconv"
+)
+
+type (
+	// 通貨ペアの情報。価格の桁数や取引量の上下限など。
+	Instrument struct {
+		// "USD_JPY"等
+		Name        string `json:"name"`
+		Type        string `json:"type"`
+		DisplayName string `json:"displayName"`
+		// 1pipの桁。USD_JPYなら-2(0.01)、EUR_USDなら-4(0.0001)
+		PipLocation int `json:"pipLocation"`
+		// 価格の小数桁数。USD_JPYなら3、EUR_USDなら5
+		DisplayPrecision int `json:"displayPrecision"`
+		// unitsの小数桁数。通常0
+		TradeUnitsPrecision         int     `json:"tradeUnitsPrecision"`
+		MinimumTradeSize            float64 `json:"minimumTradeSize,string"`
+		MaximumTrailingStopDistance float64 `json:"maximumTrailingStopDistance,string"`
+		MinimumTrailingStopDistance float64 `json:"minimumTrailingStopDistance,string"`
+		MaximumPositionSize         float64 `json:"maximumPositionSize,string"`
+		MaximumOrderUnits           float64 `json:"maximumOrderUnits,string"`
+		// 必要証拠金率。0.04なら25倍
+		MarginRate float64 `json:"marginRate,string"`
+	}
+
+	// GET: v3/accounts/{accountID}/instruments
+	Instruments struct {
+		base
+		Instruments []*Instrument `json:"instruments"`
+		LastID      string        `json:"lastTransactionID"`
+	}
+)
+
+// 口座で取引可能な通貨ペアの情報を取得する。
+// instruments:"USD_JPY,EUR_USD"のようにカンマ区切り。空なら全て。
+func NewInstruments(goq *Goquest, instruments string) (*Instruments, error) {
+	return NewInstrumentsContext(context.Background(), goq, instruments)
+}
+
+// NewInstrumentsのcontext版。
+func NewInstrumentsContext(ctx context.Context, goq *Goquest, instruments string) (*Instruments, error) {
+	res := &Instruments{}
+	ep := "/accounts/" + goq.Auth.Id + "/instruments"
+	p := strMap{}
+	if len(instruments) > 0 {
+		p["instruments"] = instruments
+	}
+	err := goq.Get(ctx, ep, p, res)
+	return res, err
+}
+
+func (i *Instruments) Extract() []*Instrument {
+	if !i.Check() {
+		return nil
+	}
+	return i.Instruments
+}
+
+// nameの通貨ペア。無ければnil
+func (i *Instruments) Get(name string) *Instrument {
+	for _, inst := range i.Extract() {
+		if inst.Name == name {
+			return inst
+		}
+	}
+	return nil
+}
+
+// 1pipの価格幅。USD_JPYなら0.01
+func (i *Instrument) Pip() float64 {
+	return math.Pow10(i.PipLocation)
+}
+
+// 価格差をpipsに変換する
+func (i *Instrument) ToPips(diff float64) float64 {
+	return diff / i.Pip()
+}
+
+// pipsを価格差に変換する
+func (i *Instrument) FromPips(pips float64) float64 {
+	return pips * i.Pip()
+}
+
+// 価格をoandaが受け付ける桁数(DisplayPrecision)に丸める
+func (i *Instrument) RoundPrice(p float64) float64 {
+	d := math.Pow10(i.DisplayPrecision)
+	return math.Round(p*d) / d
+}
+
+// 価格をDisplayPrecisionの桁数の文字列にする
+func (i *Instrument) FormatPrice(p float64) string {
+	return strconv.FormatFloat(p, 'f', i.DisplayPrecision, 64)
+}
+
+// unitsをMinimumTradeSizeからMaximumOrderUnitsの範囲に収め、TradeUnitsPrecisionの桁に切り捨てる。符号は保つ。
+// MinimumTradeSizeに満たない場合は取引できないので0を返す。
+func (i *Instrument) ClampUnits(units int) int {
+	sign := 1
+	if units < 0 {
+		sign = -1
+	}
+	abs := float64(units * sign)
+	if i.MaximumOrderUnits > 0 && abs > i.MaximumOrderUnits {
+		abs = i.MaximumOrderUnits
+	}
+	// unitsはintなので、MaximumOrderUnitsの端数は切り捨て。
+	// TradeUnitsPrecisionが負なら10^-precisionの倍数にする(-1なら10単位)
+	step := 1.0
+	if i.TradeUnitsPrecision < 0 {
+		step = math.Pow10(-i.TradeUnitsPrecision)
+	}
+	abs = math.Floor(abs/step) * step
+	if abs < i.MinimumTradeSize || abs == 0 {
+		return 0
+	}
+	return sign * int(abs)
+}
@@ -0,0 +1,120 @@
+package oanda
+
+import (
+	"testing"
+)
+
+var (
+	usdJpy = &Instrument{Name: "USD_JPY", PipLocation: -2, DisplayPrecision: 3, MinimumTradeSize: 1, MaximumOrderUnits: 100000000}
+	eurUsd = &Instrument{Name: "EUR_USD", PipLocation: -4, DisplayPrecision: 5, MinimumTradeSize: 1, MaximumOrderUnits: 100000000}
+)
+
+func TestRoundPrice(t *testing.T) {
+	tests := []struct {
+		inst *Instrument
+		p    float64
+		want float64
+		str  string
+	}{
+		{usdJpy, 150.1234, 150.123, "150.123"},
+		{usdJpy, 150.1235, 150.124, "150.124"},
+		{usdJpy, 150, 150, "150.000"},
+		{usdJpy, 149.9995, 150, "150.000"},
+		{eurUsd, 1.123456, 1.12346, "1.12346"},
+		{eurUsd, 1.123454, 1.12345, "1.12345"},
+		{eurUsd, 1.1, 1.1, "1.10000"},
+	}
+	for _, tt := range tests {
+		if got := tt.inst.RoundPrice(tt.p); got != tt.want {
+			t.Errorf("%v RoundPrice(%v) = %v, want %v", tt.inst.Name, tt.p, got, tt.want)
+		}
+		if got := tt.inst.FormatPrice(tt.inst.RoundPrice(tt.p)); got != tt.str {
+			t.Errorf("%v FormatPrice(%v) = %v, want %v", tt.inst.Name, tt.p, got, tt.str)
+		}
+	}
+}
+
+func TestPips(t *testing.T) {
+	if usdJpy.Pip() != 0.01 || eurUsd.Pip() != 0.0001 {
+		t.Errorf("pip = %v,%v", usdJpy.Pip(), eurUsd.Pip())
+	}
+	if got := usdJpy.ToPips(0.25); got < 24.999 || got > 25.001 {
+		t.Errorf("ToPips = %v", got)
+	}
+	if got := eurUsd.FromPips(15); got < 0.00149 || got > 0.00151 {
+		t.Errorf("FromPips = %v", got)
+	}
+}
+
+func TestClampUnits(t *testing.T) {
+	inst := &Instrument{MinimumTradeSize: 100, MaximumOrderUnits: 10000.5}
+	tests := []struct {
+		units, want int
+	}{
+		{1000, 1000},
+		{-1000, -1000},
+		{100, 100},
+		{-100, -100},
+		// 最小取引量未満は0
+		{99, 0},
+		{-99, 0},
+		{0, 0},
+		// 最大注文量で頭打ち。端数は切り捨て
+		{10000, 10000},
+		{20000, 10000},
+		{-20000, -10000},
+	}
+	for _, tt := range tests {
+		if got := inst.ClampUnits(tt.units); got != tt.want {
+			t.Errorf("ClampUnits(%v) = %v, want %v", tt.units, got, tt.want)
+		}
+	}
+	// MaximumOrderUnitsが0なら上限なし
+	if got := (&Instrument{MinimumTradeSize: 1}).ClampUnits(1e9); got != 1e9 {
+		t.Errorf("no maximum: %v", got)
+	}
+
+	// TradeUnitsPrecisionが負なら10^-precisionの倍数に切り捨て
+	inst = &Instrument{TradeUnitsPrecision: -2, MinimumTradeSize: 100, MaximumOrderUnits: 10050}
+	for _, tt := range []struct{ units, want int }{
+		{1234, 1200},
+		{-1299, -1200},
+		{150, 100},
+		// 切り捨てて最小取引量未満になれば0
+		{99, 0},
+		{20000, 10000},
+	} {
+		if got := inst.ClampUnits(tt.units); got != tt.want {
+			t.Errorf("precision -2: ClampUnits(%v) = %v, want %v", tt.units, got, tt.want)
+		}
+	}
+	// 正なら小数の桁数なので、intのunitsはそのまま
+	if got := (&Instrument{TradeUnitsPrecision: 1, MinimumTradeSize: 0.1}).ClampUnits(123); got != 123 {
+		t.Errorf("precision 1: %v", got)
+	}
+}
+
+func TestNewInstruments(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"instruments":[`+
+		`{"name":"USD_JPY","type":"CURRENCY","pipLocation":-2,"displayPrecision":3,"tradeUnitsPrecision":0,`+
+		`"minimumTradeSize":"1","maximumOrderUnits":"100000000","marginRate":"0.04"}],"lastTransactionID":"5"}`)
+	res, err := NewInstruments(goq, "USD_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.path != "/accounts/acc/instruments" || rec.query.Get("instruments") != "USD_JPY" {
+		t.Errorf("request = %v %v", rec.path, rec.query)
+	}
+	inst := res.Get("USD_JPY")
+	if inst == nil || inst.DisplayPrecision != 3 || inst.MinimumTradeSize != 1 || inst.MaximumOrderUnits != 1e8 || inst.MarginRate != 0.04 {
+		t.Errorf("USD_JPY = %+v", inst)
+	}
+	if res.Get("EUR_USD") != nil {
+		t.Error("EUR_USD found")
+	}
+
+	// 空なら全件
+	if _, err := NewInstruments(goq, ""); err != nil || rec.query.Has("instruments") {
+		t.Errorf("all: %v %v", rec.query, err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * NewGoquest,NewClientに渡すオプションを定める
+ */
+
+package oanda
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Goquestの設定を上書きする関数。NewGoquest,NewClientに渡す。
+type Option func(*Goquest)
+
+// APIのbase url。"https://api-fxtrade.oanda.com/v3"のように/v3まで含める。
+// httptest.Serverのurlに向けるときなどに使う。
+// streaming用のurlも同じurlにする。別にしたい場合は後ろにWithStreamURLを指定すること。
+func WithBaseURL(u string) Option {
+	return func(g *Goquest) {
+		g.url = strings.TrimRight(u, "/")
+		g.streamUrl = g.url
+	}
+}
+
+// streaming endpoint用のbase url。"https://stream-fxtrade.oanda.com/v3"のように/v3まで含める。
+func WithStreamURL(u string) Option {
+	return func(g *Goquest) {
+		g.streamUrl = strings.TrimRight(u, "/")
+	}
+}
+
+// http.Clientを差し替える。
+func WithHTTPClient(c *http.Client) Option {
+	return func(g *Goquest) {
+		g.Client = c
+	}
+}
+
+// http.ClientのTransportを差し替える。記録したレスポンスを返すRoundTripper等。
+func WithTransport(rt http.RoundTripper) Option {
+	return func(g *Goquest) {
+		c := *g.Client
+		c.Transport = rt
+		g.Client = &c
+	}
+}
+
+// User-Agentヘッダを設定する。
+func WithUserAgent(ua string) Option {
+	return func(g *Goquest) {
+		g.userAgent = ua
+	}
+}
+
+// 認証情報の取得元を設定する。
+func WithKeySource(src KeySource) Option {
+	return func(g *Goquest) {
+		g.keys = src
+	}
+}
+
+// 認証情報を直接設定する。
+func WithKey(id, token string) Option {
+	return WithKeySource(&StaticKey{Id: id, Token: token})
+}
+
+// リトライ方針を設定する。nilならリトライしない。
+func WithRetry(p *RetryPolicy) Option {
+	return func(g *Goquest) {
+		g.Retry = p
+	}
+}
+
+// 1回のリクエストあたりのタイムアウトを設定する。0なら無制限。
+func WithTimeout(d time.Duration) Option {
+	return func(g *Goquest) {
+		g.Timeout = d
+	}
+}
+
+// リクエスト数の制限を設定する。複数のGoquestに同じRateLimiterを渡すと合計で制限する。
+func WithRateLimiter(l *RateLimiter) Option {
+	return func(g *Goquest) {
+		g.Limiter = l
+	}
+}
@@ -0,0 +1,44 @@
+package oanda
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewClientRequired(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"ok", []Option{WithBaseURL("http://localhost/v3"), WithKey("id", "token")}, true},
+		{"no url", []Option{WithKey("id", "token")}, false},
+		{"no key", []Option{WithBaseURL("http://localhost/v3")}, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewClient(tt.opts...); (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+	}
+}
+
+func TestClientHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	goq, err := NewClient(WithBaseURL(ts.URL), WithKey("id", "token"), WithUserAgent("oanda-bot-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goq.Get(context.Background(), "/x", nil, &base{}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Authorization") != "Bearer token" || got.Get("User-Agent") != "oanda-bot-test" {
+		t.Errorf("headers = %v", got)
+	}
+}
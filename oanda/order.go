@@ -0,0 +1,546 @@
+/*
+ * 注文(POST v3/accounts/{accountID}/orders)のパラメタ、validation、実行関数
+ */
+
+package oanda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type (
+	// 約定時に付ける利確注文
+	TakeProfitParam struct {
+		Price            float64           `json:"price,string"`
+		Tif              string            `json:"timeInForce,omitempty"`
+		Gtd              string            `json:"gtdTime,omitempty"`
+		ClientExtensions *ClientExtensions `json:"clientExtensions,omitempty"`
+	}
+
+	// 約定時に付ける損切注文。PriceかDistanceのどちらか一方を指定する。
+	StopLossParam struct {
+		Price            float64           `json:"price,string,omitempty"`
+		Distance         float64           `json:"distance,string,omitempty"`
+		Tif              string            `json:"timeInForce,omitempty"`
+		Gtd              string            `json:"gtdTime,omitempty"`
+		ClientExtensions *ClientExtensions `json:"clientExtensions,omitempty"`
+	}
+
+	// 約定時に付けるトレーリングストップ
+	TrailingStopLossParam struct {
+		Distance         float64           `json:"distance,string"`
+		Tif              string            `json:"timeInForce,omitempty"`
+		Gtd              string            `json:"gtdTime,omitempty"`
+		ClientExtensions *ClientExtensions `json:"clientExtensions,omitempty"`
+	}
+
+	// 新規注文(MARKET,LIMIT,STOP,MARKET_IF_TOUCHED)のパラメタ
+	OrderParam struct {
+		// "MARKET","LIMIT","STOP","MARKET_IF_TOUCHED"。New*Order関数で設定されるので指定不要。
+		Type       string `json:"type"`
+		Instrument string `json:"instrument"`
+		// 買いは正、売りは負
+		Units int `json:"units,string"`
+		// 指値・逆指値の価格。MARKETでは指定しない。
+		Price float64 `json:"price,string,omitempty"`
+		// 約定価格の許容範囲。LIMITでは指定しない。
+		PriceBound float64 `json:"priceBound,string,omitempty"`
+		// MARKET:"FOK"(default),"IOC"。それ以外:"GTC"(default),"GTD","GFD"等
+		Tif string `json:"timeInForce,omitempty"`
+		// Tif:"GTD"の時の期限
+		Gtd string `json:"gtdTime,omitempty"`
+		// "DEFAULT","REDUCE_FIRST","REDUCE_ONLY","OPEN_ONLY"
+		PositionFill string `json:"positionFill,omitempty"`
+		// "DEFAULT","INVERSE","BID","ASK","MID"。MARKETでは指定しない。
+		TriggerCondition      string                 `json:"triggerCondition,omitempty"`
+		ClientExtensions      *ClientExtensions      `json:"clientExtensions,omitempty"`
+		TakeProfit            *TakeProfitParam       `json:"takeProfitOnFill,omitempty"`
+		StopLoss              *StopLossParam         `json:"stopLossOnFill,omitempty"`
+		Trailing              *TrailingStopLossParam `json:"trailingStopLossOnFill,omitempty"`
+		TradeClientExtensions *ClientExtensions      `json:"tradeClientExtensions,omitempty"`
+	}
+
+	// 保有tradeに紐づく決済注文(TAKE_PROFIT,STOP_LOSS,TRAILING_STOP_LOSS)のパラメタ
+	DependentOrderParam struct {
+		// New*Order関数で設定されるので指定不要。
+		Type          string `json:"type"`
+		TradeID       string `json:"tradeID"`
+		ClientTradeID string `json:"clientTradeID,omitempty"`
+		// TAKE_PROFIT,STOP_LOSSの価格
+		Price float64 `json:"price,string,omitempty"`
+		// STOP_LOSS,TRAILING_STOP_LOSSの値幅
+		Distance float64 `json:"distance,string,omitempty"`
+		// "GTC"(default),"GTD","GFD"
+		Tif              string            `json:"timeInForce,omitempty"`
+		Gtd              string            `json:"gtdTime,omitempty"`
+		TriggerCondition string            `json:"triggerCondition,omitempty"`
+		ClientExtensions *ClientExtensions `json:"clientExtensions,omitempty"`
+	}
+)
+
+// 注文typeごとに指定可能なtimeInForce
+var tifs = map[string][]string{
+	"MARKET":             {"FOK", "IOC"},
+	"LIMIT":              {"GTC", "GTD", "GFD", "FOK", "IOC"},
+	"STOP":               {"GTC", "GTD", "GFD", "FOK", "IOC"},
+	"MARKET_IF_TOUCHED":  {"GTC", "GTD", "GFD"},
+	"TAKE_PROFIT":        {"GTC", "GTD", "GFD"},
+	"STOP_LOSS":          {"GTC", "GTD", "GFD"},
+	"TRAILING_STOP_LOSS": {"GTC", "GTD", "GFD"},
+}
+
+var triggerConditions = []string{"DEFAULT", "INVERSE", "BID", "ASK", "MID"}
+
+var positionFills = []string{"DEFAULT", "REDUCE_FIRST", "REDUCE_ONLY", "OPEN_ONLY"}
+
+// パラメタをチェックし、timeInForceが空ならdefaultを設定する。
+func (p *OrderParam) Validate() error {
+	allowed, ok := tifs[p.Type]
+	if !ok || p.Type == "TAKE_PROFIT" || p.Type == "STOP_LOSS" || p.Type == "TRAILING_STOP_LOSS" {
+		return &ParamError{Field: "type", Msg: "invalid order type:" + p.Type}
+	}
+	if p.Instrument == "" {
+		return &ParamError{Field: "instrument", Msg: "required"}
+	}
+	if p.Units == 0 {
+		return &ParamError{Field: "units", Msg: "must not be 0"}
+	}
+	if p.Type == "MARKET" {
+		if p.Price != 0 {
+			return &ParamError{Field: "price", Msg: "not allowed for MARKET"}
+		}
+		if p.TriggerCondition != "" {
+			return &ParamError{Field: "triggerCondition", Msg: "not allowed for MARKET"}
+		}
+		if p.Tif == "" {
+			p.Tif = "FOK"
+		}
+	} else {
+		if p.Price <= 0 {
+			return &ParamError{Field: "price", Msg: "required for " + p.Type}
+		}
+		if p.Tif == "" {
+			p.Tif = "GTC"
+		}
+	}
+	if p.Type == "LIMIT" && p.PriceBound != 0 {
+		return &ParamError{Field: "priceBound", Msg: "not allowed for LIMIT"}
+	}
+	if p.PriceBound < 0 {
+		return &ParamError{Field: "priceBound", Msg: "must be positive"}
+	}
+	if err := validateTif(p.Tif, p.Gtd, allowed); err != nil {
+		return err
+	}
+	if p.TriggerCondition != "" && !contains(triggerConditions, p.TriggerCondition) {
+		return &ParamError{Field: "triggerCondition", Msg: "invalid:" + p.TriggerCondition}
+	}
+	if p.PositionFill != "" && !contains(positionFills, p.PositionFill) {
+		return &ParamError{Field: "positionFill", Msg: "invalid:" + p.PositionFill}
+	}
+	return validateOnFill(p.TakeProfit, p.StopLoss, p.Trailing, "OnFill")
+}
+
+// takeProfitOnFill等のチェック。suffixはエラーのField名用。
+func validateOnFill(tp *TakeProfitParam, sl *StopLossParam, ts *TrailingStopLossParam, suffix string) error {
+	dependent := tifs["TAKE_PROFIT"]
+	if tp != nil {
+		if tp.Price <= 0 {
+			return &ParamError{Field: "takeProfit" + suffix + ".price", Msg: "required"}
+		}
+		if tp.Tif == "" {
+			tp.Tif = "GTC"
+		}
+		if err := validateTif(tp.Tif, tp.Gtd, dependent); err != nil {
+			return prefixed("takeProfit"+suffix+".", err)
+		}
+	}
+	if sl != nil {
+		if (sl.Price > 0) == (sl.Distance > 0) {
+			return &ParamError{Field: "stopLoss" + suffix, Msg: "specify either price or distance"}
+		}
+		if sl.Tif == "" {
+			sl.Tif = "GTC"
+		}
+		if err := validateTif(sl.Tif, sl.Gtd, dependent); err != nil {
+			return prefixed("stopLoss"+suffix+".", err)
+		}
+	}
+	if ts != nil {
+		if ts.Distance <= 0 {
+			return &ParamError{Field: "trailingStopLoss" + suffix + ".distance", Msg: "required"}
+		}
+		if ts.Tif == "" {
+			ts.Tif = "GTC"
+		}
+		if err := validateTif(ts.Tif, ts.Gtd, dependent); err != nil {
+			return prefixed("trailingStopLoss"+suffix+".", err)
+		}
+	}
+	return nil
+}
+
+// パラメタをチェックし、timeInForceが空ならdefaultを設定する。
+func (p *DependentOrderParam) Validate() error {
+	if p.Type != "TAKE_PROFIT" && p.Type != "STOP_LOSS" && p.Type != "TRAILING_STOP_LOSS" {
+		return &ParamError{Field: "type", Msg: "invalid dependent order type:" + p.Type}
+	}
+	if p.TradeID == "" && p.ClientTradeID == "" {
+		return &ParamError{Field: "tradeID", Msg: "required"}
+	}
+	switch p.Type {
+	case "TAKE_PROFIT":
+		if p.Price <= 0 || p.Distance != 0 {
+			return &ParamError{Field: "price", Msg: "TAKE_PROFIT requires price only"}
+		}
+	case "STOP_LOSS":
+		if (p.Price > 0) == (p.Distance > 0) {
+			return &ParamError{Field: "price", Msg: "STOP_LOSS requires either price or distance"}
+		}
+	case "TRAILING_STOP_LOSS":
+		if p.Distance <= 0 || p.Price != 0 {
+			return &ParamError{Field: "distance", Msg: "TRAILING_STOP_LOSS requires distance only"}
+		}
+	}
+	if p.Tif == "" {
+		p.Tif = "GTC"
+	}
+	if err := validateTif(p.Tif, p.Gtd, tifs[p.Type]); err != nil {
+		return err
+	}
+	if p.TriggerCondition != "" && !contains(triggerConditions, p.TriggerCondition) {
+		return &ParamError{Field: "triggerCondition", Msg: "invalid:" + p.TriggerCondition}
+	}
+	return nil
+}
+
+// timeInForceとgtdTimeの組み合わせをチェック
+// gtdは"YYYY-mm-ddTHH:MM:SS.000000000Z"(RFC3339) か unix時間の文字列
+func validateTif(tif, gtd string, allowed []string) error {
+	if !contains(allowed, tif) {
+		return &ParamError{Field: "timeInForce", Msg: fmt.Sprintf("%v is not allowed. use one of %v", tif, allowed)}
+	}
+	if tif != "GTD" {
+		if gtd != "" {
+			return &ParamError{Field: "gtdTime", Msg: "only allowed with GTD"}
+		}
+		return nil
+	}
+	if gtd == "" {
+		return &ParamError{Field: "gtdTime", Msg: "required with GTD"}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, gtd); err == nil {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(gtd, 64); err == nil {
+		return nil
+	}
+	return &ParamError{Field: "gtdTime", Msg: "invalid time:" + gtd}
+}
+
+func contains(list []string, v string) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+func prefixed(prefix string, err error) error {
+	if pe, ok := err.(*ParamError); ok {
+		return &ParamError{Field: prefix + pe.Field, Msg: pe.Msg}
+	}
+	return err
+}
+
+// 注文を実行する。pはValidateしてから送信する。
+// 約定・キャンセル等の結果はOrdersの各Transactionに入る。
+func NewOrder(goq *Goquest, p *OrderParam) (*Orders, error) {
+	return NewOrderContext(context.Background(), goq, p)
+}
+
+// NewOrderのcontext版。
+func NewOrderContext(ctx context.Context, goq *Goquest, p *OrderParam) (*Orders, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return postOrder(ctx, goq, p)
+}
+
+// 決済注文を実行する。pはValidateしてから送信する。
+func NewDependentOrder(goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	return NewDependentOrderContext(context.Background(), goq, p)
+}
+
+// NewDependentOrderのcontext版。
+func NewDependentOrderContext(ctx context.Context, goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return postOrder(ctx, goq, p)
+}
+
+func postOrder(ctx context.Context, goq *Goquest, order interface{}) (*Orders, error) {
+	res := &Orders{}
+	ep := fmt.Sprintf("/accounts/%v/orders", goq.Auth.Id)
+	err := goq.Post(ctx, ep, iMap{"order": order}, res)
+	return res, err
+}
+
+// 成行き新規
+func NewMarketOrder(goq *Goquest, instrument string, units int) (*Orders, error) {
+	return NewMarketOrderContext(context.Background(), goq, instrument, units)
+}
+
+// NewMarketOrderのcontext版。
+func NewMarketOrderContext(ctx context.Context, goq *Goquest, instrument string, units int) (*Orders, error) {
+	p := &OrderParam{Instrument: instrument, Units: units}
+	return NewMarketOrderParamContext(ctx, goq, p)
+}
+
+// 成行き新規。利確・損切等を付ける場合はこちら。
+func NewMarketOrderParam(goq *Goquest, p *OrderParam) (*Orders, error) {
+	return NewMarketOrderParamContext(context.Background(), goq, p)
+}
+
+// NewMarketOrderParamのcontext版。
+func NewMarketOrderParamContext(ctx context.Context, goq *Goquest, p *OrderParam) (*Orders, error) {
+	p.Type = "MARKET"
+	return NewOrderContext(ctx, goq, p)
+}
+
+// 指値注文
+func NewLimitOrder(goq *Goquest, p *OrderParam) (*Orders, error) {
+	return NewLimitOrderContext(context.Background(), goq, p)
+}
+
+// NewLimitOrderのcontext版。
+func NewLimitOrderContext(ctx context.Context, goq *Goquest, p *OrderParam) (*Orders, error) {
+	p.Type = "LIMIT"
+	return NewOrderContext(ctx, goq, p)
+}
+
+// 逆指値注文
+func NewStopOrder(goq *Goquest, p *OrderParam) (*Orders, error) {
+	return NewStopOrderContext(context.Background(), goq, p)
+}
+
+// NewStopOrderのcontext版。
+func NewStopOrderContext(ctx context.Context, goq *Goquest, p *OrderParam) (*Orders, error) {
+	p.Type = "STOP"
+	return NewOrderContext(ctx, goq, p)
+}
+
+// MIT注文。価格に触れたら成行きで約定。
+func NewMarketIfTouchedOrder(goq *Goquest, p *OrderParam) (*Orders, error) {
+	return NewMarketIfTouchedOrderContext(context.Background(), goq, p)
+}
+
+// NewMarketIfTouchedOrderのcontext版。
+func NewMarketIfTouchedOrderContext(ctx context.Context, goq *Goquest, p *OrderParam) (*Orders, error) {
+	p.Type = "MARKET_IF_TOUCHED"
+	return NewOrderContext(ctx, goq, p)
+}
+
+// 保有tradeへの利確注文
+func NewTakeProfitOrder(goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	return NewTakeProfitOrderContext(context.Background(), goq, p)
+}
+
+// NewTakeProfitOrderのcontext版。
+func NewTakeProfitOrderContext(ctx context.Context, goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	p.Type = "TAKE_PROFIT"
+	return NewDependentOrderContext(ctx, goq, p)
+}
+
+// 保有tradeへの損切注文
+func NewStopLossOrder(goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	return NewStopLossOrderContext(context.Background(), goq, p)
+}
+
+// NewStopLossOrderのcontext版。
+func NewStopLossOrderContext(ctx context.Context, goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	p.Type = "STOP_LOSS"
+	return NewDependentOrderContext(ctx, goq, p)
+}
+
+// 保有tradeへのトレーリングストップ
+func NewTrailingStopLossOrder(goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	return NewTrailingStopLossOrderContext(context.Background(), goq, p)
+}
+
+// NewTrailingStopLossOrderのcontext版。
+func NewTrailingStopLossOrderContext(ctx context.Context, goq *Goquest, p *DependentOrderParam) (*Orders, error) {
+	p.Type = "TRAILING_STOP_LOSS"
+	return NewDependentOrderContext(ctx, goq, p)
+}
+
+// 注文レスポンスの各transactionを、typeに応じた型にdecodeする。
+// 注文typeや結果によって入るtransactionが違うのでcustomにしている。
+func (o *Orders) UnmarshalJSON(b []byte) error {
+	raw := struct {
+		Create        json.RawMessage `json:"orderCreateTransaction"`
+		Fill          json.RawMessage `json:"orderFillTransaction"`
+		Cancel        json.RawMessage `json:"orderCancelTransaction"`
+		Replacing     json.RawMessage `json:"replacingOrderCancelTransaction"`
+		Reject        json.RawMessage `json:"orderRejectTransaction"`
+		Reissue       json.RawMessage `json:"orderReissueTransaction"`
+		ReissueReject json.RawMessage `json:"orderReissueRejectTransaction"`
+		RelatedIDs    []string        `json:"relatedTransactionIDs"`
+		LastID        string          `json:"lastTransactionID"`
+	}{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	o.RelatedIDs = raw.RelatedIDs
+	o.LastID = raw.LastID
+
+	var err error
+	decode := func(r json.RawMessage) Transaction {
+		if len(r) == 0 || string(r) == "null" || err != nil {
+			return nil
+		}
+		var t Transaction
+		t, err = DecodeTransaction(r)
+		return t
+	}
+	o.CreateTransaction = decode(raw.Create)
+	o.RejectTransaction = decode(raw.Reject)
+	o.ReissueTransaction = decode(raw.Reissue)
+	o.ReissueRejectTransaction = decode(raw.ReissueReject)
+	if t, ok := decode(raw.Fill).(*OrderFillTransaction); ok {
+		o.FillTransaction = t
+	}
+	if t, ok := decode(raw.Cancel).(*OrderCancelTransaction); ok {
+		o.CancelTransaction = t
+	}
+	if t, ok := decode(raw.Replacing).(*OrderCancelTransaction); ok {
+		o.ReplacingCancelTransaction = t
+	}
+	return err
+}
+
+// 注文の一覧を取得する。
+// ids : "657,655"のように指定。
+// state : "PENDING","FILLED","TRIGGERED","CANCELLED","ALL"。空ならPENDING
+// instrument: "USD_JPY"
+// count : 何個抽出するか
+// befID : IDの最大値
+func ListOrders(goq *Goquest, ids, state, instrument, count, befID string) (*OrderList, error) {
+	return ListOrdersContext(context.Background(), goq, ids, state, instrument, count, befID)
+}
+
+// ListOrdersのcontext版。
+func ListOrdersContext(ctx context.Context, goq *Goquest, ids, state, instrument, count, befID string) (*OrderList, error) {
+	res := &OrderList{}
+	ep := "/accounts/" + goq.Auth.Id + "/orders"
+	p := map[string]string{}
+	if len(ids) > 0 {
+		p["ids"] = ids
+	}
+	if len(state) > 0 {
+		p["state"] = state
+	}
+	if len(instrument) > 0 {
+		p["instrument"] = instrument
+	}
+	if len(count) > 0 {
+		p["count"] = count
+	}
+	if len(befID) > 0 {
+		p["beforeID"] = befID
+	}
+	err := goq.Get(ctx, ep, p, res)
+	return res, err
+}
+
+// 未約定(PENDING)の注文を全て取得する。
+func ListPendingOrders(goq *Goquest) (*OrderList, error) {
+	return ListPendingOrdersContext(context.Background(), goq)
+}
+
+// ListPendingOrdersのcontext版。
+func ListPendingOrdersContext(ctx context.Context, goq *Goquest) (*OrderList, error) {
+	res := &OrderList{}
+	ep := "/accounts/" + goq.Auth.Id + "/pendingOrders"
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
+}
+
+// 未約定の注文orderIDをpの内容に置き換える。p.Typeは指定すること。
+// 元の注文はキャンセルされ、新しい注文が作られる（IDも変わる）。
+// id:order idか、"@"+client order id
+func ReplaceOrder(goq *Goquest, id string, p *OrderParam) (*Orders, error) {
+	return ReplaceOrderContext(context.Background(), goq, id, p)
+}
+
+// ReplaceOrderのcontext版。
+func ReplaceOrderContext(ctx context.Context, goq *Goquest, id string, p *OrderParam) (*Orders, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return putOrder(ctx, goq, id, p)
+}
+
+// 決済注文(TAKE_PROFIT等)をpの内容に置き換える。p.Typeは指定すること。
+func ReplaceDependentOrder(goq *Goquest, id string, p *DependentOrderParam) (*Orders, error) {
+	return ReplaceDependentOrderContext(context.Background(), goq, id, p)
+}
+
+// ReplaceDependentOrderのcontext版。
+func ReplaceDependentOrderContext(ctx context.Context, goq *Goquest, id string, p *DependentOrderParam) (*Orders, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return putOrder(ctx, goq, id, p)
+}
+
+func putOrder(ctx context.Context, goq *Goquest, id string, order interface{}) (*Orders, error) {
+	res := &Orders{}
+	ep := fmt.Sprintf("/accounts/%v/orders/%v", goq.Auth.Id, id)
+	err := goq.Put(ctx, ep, iMap{"order": order}, res)
+	return res, err
+}
+
+// 未約定の注文をキャンセルする。結果はCancelTransactionに入る。
+// id:order idか、"@"+client order id
+func CancelOrder(goq *Goquest, id string) (*Orders, error) {
+	return CancelOrderContext(context.Background(), goq, id)
+}
+
+// CancelOrderのcontext版。
+func CancelOrderContext(ctx context.Context, goq *Goquest, id string) (*Orders, error) {
+	res := &Orders{}
+	ep := fmt.Sprintf("/accounts/%v/orders/%v/cancel", goq.Auth.Id, id)
+	err := goq.Put(ctx, ep, iMap{}, res)
+	return res, err
+}
+
+// 注文のclientExtensionsを変更する。tradeは約定時に建つtradeのclientExtensions。
+// 変更しない方はnilにする。
+func SetOrderClientExtensions(goq *Goquest, id string, order, trade *ClientExtensions) (*OrderClientExtensions, error) {
+	return SetOrderClientExtensionsContext(context.Background(), goq, id, order, trade)
+}
+
+// SetOrderClientExtensionsのcontext版。
+func SetOrderClientExtensionsContext(ctx context.Context, goq *Goquest, id string, order, trade *ClientExtensions) (*OrderClientExtensions, error) {
+	if order == nil && trade == nil {
+		return nil, &ParamError{Field: "clientExtensions", Msg: "nothing to set"}
+	}
+	param := iMap{}
+	if order != nil {
+		param["clientExtensions"] = order
+	}
+	if trade != nil {
+		param["tradeClientExtensions"] = trade
+	}
+	res := &OrderClientExtensions{}
+	ep := fmt.Sprintf("/accounts/%v/orders/%v/clientExtensions", goq.Auth.Id, id)
+	err := goq.Put(ctx, ep, param, res)
+	return res, err
+}
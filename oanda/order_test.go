@@ -0,0 +1,312 @@
+package oanda
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestOrderParamValidate(t *testing.T) {
+	market := func(f func(p *OrderParam)) *OrderParam {
+		p := &OrderParam{Type: "MARKET", Instrument: "USD_JPY", Units: 100}
+		f(p)
+		return p
+	}
+	limit := func(f func(p *OrderParam)) *OrderParam {
+		p := &OrderParam{Type: "LIMIT", Instrument: "USD_JPY", Units: 100, Price: 150}
+		f(p)
+		return p
+	}
+	none := func(p *OrderParam) {}
+	tests := []struct {
+		name  string
+		param *OrderParam
+		field string // ParamErrorのField。空ならエラー無し
+	}{
+		{"market", market(none), ""},
+		{"limit", limit(none), ""},
+		{"type", market(func(p *OrderParam) { p.Type = "TAKE_PROFIT" }), "type"},
+		{"instrument", market(func(p *OrderParam) { p.Instrument = "" }), "instrument"},
+		{"units", market(func(p *OrderParam) { p.Units = 0 }), "units"},
+		{"market price", market(func(p *OrderParam) { p.Price = 150 }), "price"},
+		{"market trigger", market(func(p *OrderParam) { p.TriggerCondition = "MID" }), "triggerCondition"},
+		{"limit price", limit(func(p *OrderParam) { p.Price = 0 }), "price"},
+		{"limit priceBound", limit(func(p *OrderParam) { p.PriceBound = 151 }), "priceBound"},
+		{"negative priceBound", market(func(p *OrderParam) { p.PriceBound = -1 }), "priceBound"},
+		{"trigger", limit(func(p *OrderParam) { p.TriggerCondition = "LAST" }), "triggerCondition"},
+		{"positionFill", market(func(p *OrderParam) { p.PositionFill = "CLOSE" }), "positionFill"},
+
+		// timeInForce,gtdTime
+		{"market GTC", market(func(p *OrderParam) { p.Tif = "GTC" }), "timeInForce"},
+		{"market IOC", market(func(p *OrderParam) { p.Tif = "IOC" }), ""},
+		{"mit FOK", &OrderParam{Type: "MARKET_IF_TOUCHED", Instrument: "USD_JPY", Units: 1, Price: 150, Tif: "FOK"}, "timeInForce"},
+		{"GTD without time", limit(func(p *OrderParam) { p.Tif = "GTD" }), "gtdTime"},
+		{"GTD rfc3339", limit(func(p *OrderParam) { p.Tif, p.Gtd = "GTD", "2024-01-01T00:00:00.000000000Z" }), ""},
+		{"GTD unix", limit(func(p *OrderParam) { p.Tif, p.Gtd = "GTD", "1704067200.000000000" }), ""},
+		{"GTD invalid", limit(func(p *OrderParam) { p.Tif, p.Gtd = "GTD", "tomorrow" }), "gtdTime"},
+		{"gtd without GTD", limit(func(p *OrderParam) { p.Gtd = "1704067200" }), "gtdTime"},
+
+		// on fill
+		{"tp", market(func(p *OrderParam) { p.TakeProfit = &TakeProfitParam{Price: 151} }), ""},
+		{"tp price", market(func(p *OrderParam) { p.TakeProfit = &TakeProfitParam{} }), "takeProfitOnFill.price"},
+		{"tp tif", market(func(p *OrderParam) { p.TakeProfit = &TakeProfitParam{Price: 151, Tif: "FOK"} }), "takeProfitOnFill.timeInForce"},
+		{"tp gtd", market(func(p *OrderParam) { p.TakeProfit = &TakeProfitParam{Price: 151, Tif: "GTD"} }), "takeProfitOnFill.gtdTime"},
+		{"sl price", market(func(p *OrderParam) { p.StopLoss = &StopLossParam{Price: 149} }), ""},
+		{"sl distance", market(func(p *OrderParam) { p.StopLoss = &StopLossParam{Distance: 0.5} }), ""},
+		{"sl both", market(func(p *OrderParam) { p.StopLoss = &StopLossParam{Price: 149, Distance: 0.5} }), "stopLossOnFill"},
+		{"sl neither", market(func(p *OrderParam) { p.StopLoss = &StopLossParam{} }), "stopLossOnFill"},
+		{"sl gtd", market(func(p *OrderParam) { p.StopLoss = &StopLossParam{Price: 149, Gtd: "1704067200"} }), "stopLossOnFill.gtdTime"},
+		{"trailing", market(func(p *OrderParam) { p.Trailing = &TrailingStopLossParam{Distance: 0.3} }), ""},
+		{"trailing distance", market(func(p *OrderParam) { p.Trailing = &TrailingStopLossParam{} }), "trailingStopLossOnFill.distance"},
+		{"trailing tif", market(func(p *OrderParam) { p.Trailing = &TrailingStopLossParam{Distance: 0.3, Tif: "IOC"} }), "trailingStopLossOnFill.timeInForce"},
+	}
+	for _, tt := range tests {
+		err := tt.param.Validate()
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+			continue
+		}
+		var pe *ParamError
+		if !errors.As(err, &pe) || pe.Field != tt.field {
+			t.Errorf("%v: err = %v, want ParamError on %v", tt.name, err, tt.field)
+		}
+	}
+}
+
+// 空のtimeInForceにはdefaultが入る
+func TestOrderParamDefaultTif(t *testing.T) {
+	p := &OrderParam{Type: "MARKET", Instrument: "USD_JPY", Units: 1,
+		TakeProfit: &TakeProfitParam{Price: 151}, StopLoss: &StopLossParam{Distance: 1}, Trailing: &TrailingStopLossParam{Distance: 1}}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Tif != "FOK" || p.TakeProfit.Tif != "GTC" || p.StopLoss.Tif != "GTC" || p.Trailing.Tif != "GTC" {
+		t.Errorf("tif = %v,%v,%v,%v", p.Tif, p.TakeProfit.Tif, p.StopLoss.Tif, p.Trailing.Tif)
+	}
+	l := &OrderParam{Type: "STOP", Instrument: "USD_JPY", Units: 1, Price: 150}
+	if err := l.Validate(); err != nil || l.Tif != "GTC" {
+		t.Errorf("STOP tif = %v, err = %v", l.Tif, err)
+	}
+}
+
+func TestDependentOrderParamValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		param DependentOrderParam
+		field string
+	}{
+		{"tp", DependentOrderParam{Type: "TAKE_PROFIT", TradeID: "1", Price: 151}, ""},
+		{"tp client id", DependentOrderParam{Type: "TAKE_PROFIT", ClientTradeID: "my", Price: 151}, ""},
+		{"type", DependentOrderParam{Type: "MARKET", TradeID: "1", Price: 151}, "type"},
+		{"trade id", DependentOrderParam{Type: "TAKE_PROFIT", Price: 151}, "tradeID"},
+		{"tp distance", DependentOrderParam{Type: "TAKE_PROFIT", TradeID: "1", Price: 151, Distance: 1}, "price"},
+		{"sl price", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Price: 149}, ""},
+		{"sl distance", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Distance: 1}, ""},
+		{"sl both", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Price: 149, Distance: 1}, "price"},
+		{"trailing", DependentOrderParam{Type: "TRAILING_STOP_LOSS", TradeID: "1", Distance: 1}, ""},
+		{"trailing price", DependentOrderParam{Type: "TRAILING_STOP_LOSS", TradeID: "1", Distance: 1, Price: 149}, "distance"},
+		{"tif", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Price: 149, Tif: "FOK"}, "timeInForce"},
+		{"gtd", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Price: 149, Tif: "GTD", Gtd: "2024-01-01T00:00:00Z"}, ""},
+		{"gtd missing", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Price: 149, Tif: "GTD"}, "gtdTime"},
+		{"trigger", DependentOrderParam{Type: "STOP_LOSS", TradeID: "1", Price: 149, TriggerCondition: "X"}, "triggerCondition"},
+	}
+	for _, tt := range tests {
+		err := tt.param.Validate()
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+			continue
+		}
+		var pe *ParamError
+		if !errors.As(err, &pe) || pe.Field != tt.field {
+			t.Errorf("%v: err = %v, want ParamError on %v", tt.name, err, tt.field)
+		}
+	}
+}
+
+// Validateで弾いた注文は送信しない
+func TestNewOrderInvalid(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request sent: %v", r.URL)
+	}))
+	defer ts.Close()
+	goq, err := NewClient(WithBaseURL(ts.URL), WithKey("acc", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLimitOrderContext(context.Background(), goq, &OrderParam{Instrument: "USD_JPY", Units: 1})
+	var pe *ParamError
+	if !errors.As(err, &pe) || pe.Field != "price" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewOrder(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/accounts/acc/orders" {
+			t.Errorf("%v %v", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"orderCreateTransaction":{"id":"2","type":"MARKET_ORDER","units":"100"},` +
+			`"orderFillTransaction":{"id":"3","type":"ORDER_FILL","orderID":"2","units":"100","price":"150.01",` +
+			`"tradeOpened":{"tradeID":"3","units":"100","price":"150.01"}},"relatedTransactionIDs":["2","3"],"lastTransactionID":"3"}`))
+	}))
+	defer ts.Close()
+	goq, err := NewClient(WithBaseURL(ts.URL), WithKey("acc", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := NewMarketOrderContext(context.Background(), goq, "USD_JPY", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res.CreateTransaction.(*MarketOrderTransaction); !ok {
+		t.Errorf("create = %+v", res.CreateTransaction)
+	}
+	f := res.FillTransaction
+	if f == nil || f.OrderID != "2" || f.TradeOpened == nil || f.TradeOpened.TradeID != "3" {
+		t.Errorf("fill = %+v", f)
+	}
+	if res.CancelTransaction != nil || res.LastID != "3" || len(res.RelatedIDs) != 2 {
+		t.Errorf("res = %+v", res)
+	}
+}
+
+// 受け取ったリクエスト
+type recorded struct {
+	method, path string
+	query        url.Values
+	body         map[string]interface{}
+}
+
+// 1回のリクエストにstatus,bodyを返すserverと、それに向けたclient
+func newAPIServer(t *testing.T, status int, body string) (*Goquest, *recorded) {
+	t.Helper()
+	rec := &recorded{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec.method, rec.path, rec.query = r.Method, r.URL.Path, r.URL.Query()
+		json.NewDecoder(r.Body).Decode(&rec.body)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	goq, err := NewClient(WithBaseURL(ts.URL), WithKey("acc", "token"), WithRetry(&RetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goq, rec
+}
+
+func TestListOrders(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"orders":[`+
+		`{"id":"7","type":"STOP_LOSS","state":"PENDING","tradeID":"5","price":"149.500","timeInForce":"GTC","createTime":"2024-01-01T00:00:00.000000000Z"},`+
+		`{"id":"6","type":"LIMIT","state":"PENDING","instrument":"USD_JPY","units":"-100","price":"151.000",`+
+		`"clientExtensions":{"id":"my"},"takeProfitOnFill":{"price":"150.000","timeInForce":"GTC"}}],"lastTransactionID":"7"}`)
+	res, err := ListOrdersContext(context.Background(), goq, "", "ALL", "USD_JPY", "2", "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := rec.query
+	if rec.method != "GET" || rec.path != "/accounts/acc/orders" || q.Get("state") != "ALL" ||
+		q.Get("instrument") != "USD_JPY" || q.Get("count") != "2" || q.Get("beforeID") != "10" || q.Has("ids") {
+		t.Errorf("request = %v %v?%v", rec.method, rec.path, q.Encode())
+	}
+	orders := res.Extract()
+	if len(orders) != 2 || res.LastID != "7" {
+		t.Fatalf("orders = %+v", res)
+	}
+	if sl := orders[0]; sl.Type != "STOP_LOSS" || sl.TradeID != "5" || sl.Price != 149.5 || sl.CreatedTime == "" {
+		t.Errorf("stop loss = %+v", sl)
+	}
+	if l := orders[1]; l.Units != -100 || l.ClientExtensions.ID != "my" || l.TakeProfitOnFill.Price != 150 {
+		t.Errorf("limit = %+v", l)
+	}
+
+	goq, rec = newAPIServer(t, 200, `{"orders":[],"lastTransactionID":"7"}`)
+	if _, err := ListPendingOrdersContext(context.Background(), goq); err != nil || rec.path != "/accounts/acc/pendingOrders" {
+		t.Errorf("pending: %v %v", rec.path, err)
+	}
+}
+
+func TestReplaceOrder(t *testing.T) {
+	goq, rec := newAPIServer(t, 201, `{`+
+		`"orderCancelTransaction":{"id":"8","type":"ORDER_CANCEL","orderID":"6","reason":"CLIENT_REQUEST_REPLACED","replacedByOrderID":"9"},`+
+		`"orderCreateTransaction":{"id":"9","type":"LIMIT_ORDER","instrument":"USD_JPY","units":"-100","price":"151.500","replacesOrderID":"6"},`+
+		`"relatedTransactionIDs":["8","9"],"lastTransactionID":"9"}`)
+	p := &OrderParam{Type: "LIMIT", Instrument: "USD_JPY", Units: -100, Price: 151.5}
+	res, err := ReplaceOrderContext(context.Background(), goq, "@my", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.method != "PUT" || rec.path != "/accounts/acc/orders/@my" {
+		t.Errorf("request = %v %v", rec.method, rec.path)
+	}
+	if o, ok := rec.body["order"].(map[string]interface{}); !ok || o["type"] != "LIMIT" || o["price"] != "151.5" || o["timeInForce"] != "GTC" {
+		t.Errorf("body = %v", rec.body)
+	}
+	if c := res.CancelTransaction; c == nil || c.OrderID != "6" || c.ReplacedByOrderID != "9" {
+		t.Errorf("cancel = %+v", c)
+	}
+	if res.CreateTransaction == nil || res.CreateTransaction.Header().Type != "LIMIT_ORDER" || res.ReplacingCancelTransaction != nil {
+		t.Errorf("res = %+v", res)
+	}
+
+	// 不正なパラメタは送信しない
+	goq, rec = newAPIServer(t, 201, `{}`)
+	_, err = ReplaceDependentOrderContext(context.Background(), goq, "7", &DependentOrderParam{Type: "STOP_LOSS", TradeID: "5"})
+	var pe *ParamError
+	if !errors.As(err, &pe) || rec.method != "" {
+		t.Errorf("invalid replace: err = %v, request = %v", err, rec.method)
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"orderCancelTransaction":{"id":"8","type":"ORDER_CANCEL","orderID":"6","reason":"CLIENT_REQUEST"},"lastTransactionID":"8"}`)
+	res, err := CancelOrderContext(context.Background(), goq, "6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.method != "PUT" || rec.path != "/accounts/acc/orders/6/cancel" {
+		t.Errorf("request = %v %v", rec.method, rec.path)
+	}
+	if c := res.CancelTransaction; c == nil || c.Reason != "CLIENT_REQUEST" || res.FillTransaction != nil {
+		t.Errorf("res = %+v", res)
+	}
+
+	// 既にキャンセル済み等
+	goq, _ = newAPIServer(t, 404, `{"errorCode":"ORDER_DOESNT_EXIST","errorMessage":"The order does not exist"}`)
+	_, err = CancelOrderContext(context.Background(), goq, "6")
+	var ae *APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 404 {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSetOrderClientExtensions(t *testing.T) {
+	goq, rec := newAPIServer(t, 200, `{"orderClientExtensionsModifyTransaction":{"id":"9","type":"ORDER_CLIENT_EXTENSIONS_MODIFY","orderID":"6",`+
+		`"tradeClientExtensionsModify":{"tag":"bot"}},"lastTransactionID":"9"}`)
+	var pe *ParamError
+	if _, err := SetOrderClientExtensionsContext(context.Background(), goq, "6", nil, nil); !errors.As(err, &pe) || rec.method != "" {
+		t.Errorf("nothing to set: %v", err)
+	}
+	res, err := SetOrderClientExtensionsContext(context.Background(), goq, "6", nil, &ClientExtensions{Tag: "bot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.path != "/accounts/acc/orders/6/clientExtensions" {
+		t.Errorf("path = %v", rec.path)
+	}
+	if _, ok := rec.body["clientExtensions"]; ok {
+		t.Errorf("body = %v, want tradeClientExtensions only", rec.body)
+	}
+	if tx := res.Transaction; tx == nil || tx.OrderID != "6" || tx.TradeClientExtensionsModify.Tag != "bot" {
+		t.Errorf("res = %+v", res)
+	}
+}
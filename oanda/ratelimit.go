@@ -0,0 +1,61 @@
+/*
+ * リクエスト数の制限。oandaの制限は1秒あたり100リクエスト。
+ * 複数のGoquestで1つのRateLimiterを共有すると、合計で制限できる。
+ */
+
+package oanda
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// token bucket方式のリクエスト数の制限。goroutine safe。
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 1秒あたりに補充するトークン数
+	burst  float64 // トークンの上限。連続して送れるリクエスト数
+	tokens float64
+	last   time.Time
+}
+
+// 1秒あたりrps回、連続burst回までリクエストを許可するRateLimiterを返す。
+// burstが1未満なら1にする。
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rps, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// リクエストを送ってよくなるまで待つ。ctxがキャンセルされたらctx.Err()を返す。
+// lがnilもしくはrateが0以下なら待たない。
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil || l.rate <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// 先にトークンを予約し、足りない分だけ待つ
+	l.tokens--
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if err := sleepContext(ctx, wait); err != nil {
+		// 送らなかったので予約を戻す
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
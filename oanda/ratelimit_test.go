@@ -0,0 +1,77 @@
+package oanda
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+	// burstの分はすぐ、それ以降は1/rps秒ずつ
+	l := NewRateLimiter(100, 3)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 5*time.Millisecond {
+		t.Errorf("burst took %v", d)
+	}
+	for i := 0; i < 5; i++ {
+		l.Wait(ctx)
+	}
+	if d := time.Since(start); d < 45*time.Millisecond {
+		t.Errorf("8 requests took %v, want >= 50ms", d)
+	}
+
+	// キャンセルしたら予約を戻す
+	l = NewRateLimiter(1, 1)
+	l.Wait(ctx)
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(cctx); err != context.DeadlineExceeded {
+		t.Errorf("err = %v", err)
+	}
+	if l.tokens < -0.1 {
+		t.Errorf("tokens = %v, reservation not returned", l.tokens)
+	}
+
+	// nilや0は制限しない
+	var nl *RateLimiter
+	if err := nl.Wait(ctx); err != nil {
+		t.Errorf("nil: %v", err)
+	}
+	if err := NewRateLimiter(0, 0).Wait(ctx); err != nil {
+		t.Errorf("zero: %v", err)
+	}
+}
+
+// 複数のGoquestで共有すると合計で制限する
+func TestSharedRateLimiter(t *testing.T) {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	l := NewRateLimiter(50, 1)
+	a, _ := NewClient(WithBaseURL(ts.URL), WithKey("a", "token"), WithRateLimiter(l))
+	b := a.ForAccount("b")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		for _, goq := range []*Goquest{a, b} {
+			if err := goq.Get(context.Background(), "/x", nil, &base{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// 1本目以降は20msずつ
+	if d := time.Since(start); d < 90*time.Millisecond || n != 6 {
+		t.Errorf("6 requests took %v, served %v", d, n)
+	}
+}
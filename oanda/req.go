@@ -4,56 +4,27 @@
 package oanda
 
 import (
+	"context"
 	"fmt"
 	"strconv"
-)
-
-type (
-	TakeProfitParam struct {
-		Price float64 `json:"price,string"`
-		Tif   string  `json:"timeInForce"`
-		Gtd   string  `json:"gtdTime"`
-	}
-
-	StopLossParam struct {
-		Price    float64 `json:"price,string"`
-		Distance float64 `json:"distance,string"`
-		Tif      string  `json:"timeInForce"`
-		Gtd      string  `json:"gtdTime"`
-	}
-
-	TrailingStopLossParam struct {
-		Distance float64 `json:"distance,string"`
-		Tif      string  `json:"timeInForce"`
-		Gtd      string  `json:"gtdTime"`
-	}
-
-	OrderParam struct {
-		Type       string `json:"type"`
-		Instrument string `json:"instrument"`
-		Units      int    `json:"units,string"`
-		Tif        string `json:"timeInForce"`
-		// PriceBound float64                `json:"priceBound,string"`
-		TakeProfit TakeProfitParam       `json:"takeProfitOnFill"`
-		StopLoss   StopLossParam         `json:"stopLossOnFill"`
-		Trailing   TrailingStopLossParam `json:"trailingStopLossOnFill"`
-	}
+	"strings"
 )
 
 // from,to両方指定した場合、countの指定は出来ないので、0以下の数値を渡すこと。
 // from,to は　"YYYY-mm-ddTHH:MM:SS.000000000Z" もしくは unix時間を文字列にしたもの(fmt.Sprintf("%v",time.Now().Unix())とか)
-// priceComponent -> "M"(default):中央値？ "A":ask "B":bid
+// priceComponent -> "M"(default):中央値？ "A":ask "B":bid。"BA","MBA"等の組み合わせも可
 func candlesParam(
 	p strMap,
 	count int,
-	granularity, instruments, from, to string,
+	granularity Granularity,
+	instruments, from, to string,
 	priceComponent string,
 ) {
 	if count > 0 {
 		cntStr := strconv.Itoa(count)
 		p["count"] = cntStr
 	}
-	p["granularity"] = granularity
+	p["granularity"] = string(granularity)
 	p["instruments"] = instruments
 
 	if from != "" {
@@ -64,34 +35,39 @@ func candlesParam(
 		p["to"] = to
 	}
 
-	if priceComponent == "A" || priceComponent == "B" {
-		p["price"] = priceComponent
-	} else {
+	if priceComponent == "" {
 		p["price"] = "M"
+	} else {
+		p["price"] = priceComponent
 	}
 }
 
-// 成行注文のbaseパラメタ
-func marketOrderParam(p iMap, instrument string, units int, tif string) {
-	if tif == "" {
-		tif = "FOK" // DEFAULT Fill or Kill.
-	}
-	p["order"] = iMap{
-		"type":        "MARKET",
-		"instrument":  instrument,
-		"units":       units,
-		"timeInForce": tif,
+// priceComponentは"M","B","A"の組み合わせ。空ならdefaultの"M"。
+func validPriceComponent(priceComponent string) bool {
+	seen := map[rune]bool{}
+	for _, c := range priceComponent {
+		if !strings.ContainsRune("MBA", c) || seen[c] {
+			return false
+		}
+		seen[c] = true
 	}
+	return true
 }
 
-// 成行きのcloseパラメタ
+// 成行きのcloseパラメタ。0は"NONE"、CLOSE_ALLは"ALL"。
+// oandaは省略すると"ALL"扱いになり、ポジションが無い側を"ALL"にするとエラーになるので必ず指定する。
 func marketCloseParam(p iMap, longUnits, shortUnits int) {
-	if longUnits > 0 {
-		p["longUnits"] = strconv.Itoa(longUnits)
-	}
-	if shortUnits > 0 {
-		p["shortUnits"] = strconv.Itoa(shortUnits)
+	units := func(u int) string {
+		if u == CLOSE_ALL {
+			return "ALL"
+		}
+		if u <= 0 {
+			return "NONE"
+		}
+		return strconv.Itoa(u)
 	}
+	p["longUnits"] = units(longUnits)
+	p["shortUnits"] = units(shortUnits)
 }
 
 // dtime は　"YYYY-mm-ddTHH:MM:SS.000000000Z" もしくは unix時間を文字列にしたもの(fmt.Sprintf("%v",time.Now().Unix())とか)
@@ -112,109 +88,191 @@ func instrumentParam(p strMap, instrument string) {
 // count -> ロウソク足何個とるか
 // from,to両方指定した場合、countの指定は出来ないので、0以下の数値を渡すこと。
 // from,to は　"YYYY-mm-ddTHH:MM:SS.000000000Z" もしくは unix時間を文字列にしたもの(fmt.Sprintf("%v",time.Now().Unix())とか)
-// priceComponent -> "M"(default):中央値？ "A":ask "B":bid
+// priceComponent -> "M"(default):中央値？ "A":ask "B":bid。"BA","MBA"のように組み合わせると全て取得する。
+// granularityがoandaに無い足、priceComponentが不正ならParamError
 func NewCandles(
 	goq *Goquest,
 	count int,
-	granularity, instruments, from, to string,
+	granularity Granularity,
+	instruments, from, to string,
 	priceComponent string,
-) *Candles {
+) (*Candles, error) {
+	return NewCandlesContext(context.Background(), goq, count, granularity, instruments, from, to, priceComponent)
+}
+
+// NewCandlesのcontext版。
+func NewCandlesContext(
+	ctx context.Context,
+	goq *Goquest,
+	count int,
+	granularity Granularity,
+	instruments, from, to string,
+	priceComponent string,
+) (*Candles, error) {
+	return NewCandlesAlignedContext(ctx, goq, count, granularity, instruments, from, to, priceComponent, nil)
+}
+
+// 日足・週足・月足の区切りを指定してロウソク足を取得する。alignがnilならoandaのdefault。
+// 日足未満でも、H4等は日足の区切りから数えるので影響する。
+func NewCandlesAligned(
+	goq *Goquest,
+	count int,
+	granularity Granularity,
+	instruments, from, to string,
+	priceComponent string,
+	align *Alignment,
+) (*Candles, error) {
+	return NewCandlesAlignedContext(context.Background(), goq, count, granularity, instruments, from, to, priceComponent, align)
+}
+
+// NewCandlesAlignedのcontext版。
+func NewCandlesAlignedContext(
+	ctx context.Context,
+	goq *Goquest,
+	count int,
+	granularity Granularity,
+	instruments, from, to string,
+	priceComponent string,
+	align *Alignment,
+) (*Candles, error) {
+	if err := granularity.Validate(); err != nil {
+		return nil, err
+	}
+	if !validPriceComponent(priceComponent) {
+		return nil, &ParamError{Field: "priceComponent", Msg: "must be a combination of M,B,A"}
+	}
 	res := &Candles{}
 	ep := fmt.Sprintf("/instruments/%v/candles", instruments)
 	param := strMap{}
 	candlesParam(param, count, granularity, instruments, from, to, priceComponent)
-	goq.Get(ep, param, res)
-	return res
+	if align != nil {
+		align.param(param)
+	}
+	err := goq.Get(ctx, ep, param, res)
+	return res, err
 }
 
-func populateBook(goq *Goquest, ep string, dtime string, i Checker) {
+func populateBook(ctx context.Context, goq *Goquest, ep string, dtime string, i Checker) error {
 	param := strMap{}
 	timeParam(param, dtime)
-	goq.Get(ep, param, i)
+	return goq.Get(ctx, ep, param, i)
 }
 
 // dtimeはうまく効かない。どういうデータが返ってきているかよく分からない
-func NewPositionBook(goq *Goquest, instruments string, dtime string) *PositionBook {
+func NewPositionBook(goq *Goquest, instruments string, dtime string) (*PositionBook, error) {
+	return NewPositionBookContext(context.Background(), goq, instruments, dtime)
+}
+
+// NewPositionBookのcontext版。
+func NewPositionBookContext(ctx context.Context, goq *Goquest, instruments string, dtime string) (*PositionBook, error) {
 	res := &PositionBook{}
 	ep := fmt.Sprintf("/instruments/%v/positionBook", instruments)
-	populateBook(goq, ep, dtime, res)
-	return res
+	err := populateBook(ctx, goq, ep, dtime, res)
+	return res, err
 }
 
 // dtimeはうまく効かない。どういうデータが返ってきているかよく分からない
-func NewOrderBook(goq *Goquest, instruments string, dtime string) *OrderBook {
+func NewOrderBook(goq *Goquest, instruments string, dtime string) (*OrderBook, error) {
+	return NewOrderBookContext(context.Background(), goq, instruments, dtime)
+}
+
+// NewOrderBookのcontext版。
+func NewOrderBookContext(ctx context.Context, goq *Goquest, instruments string, dtime string) (*OrderBook, error) {
 	res := &OrderBook{}
 	ep := fmt.Sprintf("/instruments/%v/orderBook", instruments)
-	populateBook(goq, ep, dtime, res)
-	return res
+	err := populateBook(ctx, goq, ep, dtime, res)
+	return res, err
 }
 
 // 通貨単位のPositionを取得
-func NewPosition(goq *Goquest, instrument string) *Position {
+func NewPosition(goq *Goquest, instrument string) (*Position, error) {
+	return NewPositionContext(context.Background(), goq, instrument)
+}
+
+// NewPositionのcontext版。
+func NewPositionContext(ctx context.Context, goq *Goquest, instrument string) (*Position, error) {
 	res := &Position{}
 	ep := fmt.Sprintf("/accounts/%v/positions/%v", goq.Auth.Id, instrument)
-	goq.Get(ep, nil, res)
-	return res
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
 }
 
 // 取引したことのあるポジション情報を取得
 // Responseは全期間利益とか癖のあるデータがあるのでstructのコメント見ておくこと
-func NewPositions(goq *Goquest) *Positions {
+func NewPositions(goq *Goquest) (*Positions, error) {
+	return NewPositionsContext(context.Background(), goq)
+}
+
+// NewPositionsのcontext版。
+func NewPositionsContext(ctx context.Context, goq *Goquest) (*Positions, error) {
 	res := &Positions{}
 	ep := fmt.Sprintf("/accounts/%v/positions", goq.Auth.Id)
-	goq.Get(ep, nil, res)
-	return res
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
 }
 
 // ポジションを持っている通貨の情報を取得。
 // Responseのデータは癖があるのでstructのコメント見ておくこと
-func NewOpenPositions(goq *Goquest) *Positions {
+func NewOpenPositions(goq *Goquest) (*Positions, error) {
+	return NewOpenPositionsContext(context.Background(), goq)
+}
+
+// NewOpenPositionsのcontext版。
+func NewOpenPositionsContext(ctx context.Context, goq *Goquest) (*Positions, error) {
 	res := &Positions{}
 	ep := fmt.Sprintf("/accounts/%v/openPositions", goq.Auth.Id)
-	goq.Get(ep, nil, res)
-	return res
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
 }
 
-// 成行き新規
-func NewMarketOrder(goq *Goquest, instrument string, units int) *Orders {
-	res := &Orders{}
-	ep := fmt.Sprintf("/accounts/%v/orders", goq.Auth.Id)
-	param := iMap{}
-	marketOrderParam(param, instrument, units, "")
-	goq.Post(ep, param, res)
-	return res
+// 成行きクローズ
+// long:クローズするlongポジションunit、short:クローズするshortポジション。いずれも正の値。
+// 全てクローズする場合はCLOSE_ALL、決済しないほうのポジションには 0 を指定
+func NewMarketClose(goq *Goquest, instrument string, longUnits, shortUnits int) (*CloseOrders, error) {
+	return NewMarketCloseContext(context.Background(), goq, instrument, longUnits, shortUnits)
 }
 
-// 成行きクローズ
-// long:クローズするlongポジションunit、short:クローズするshortポジション
-// 決済しないほうのポジションには 0 を指定
-// func NewMarketClose(goq *Goquest, instrument string, longUnits, shortUnits int) *CloseOrders {
-// 	res := &CloseOrders{}
-// 	param := iMap{}
-// 	marketCloseParam(param, longUnits, shortUnits)
-// 	ep := fmt.Sprintf("/accounts/%v/positions/%v/close", goq.Auth.Id, instrument)
-// 	goq.Put(ep, param, res)
-// 	return res
-// }
+// NewMarketCloseのcontext版。
+func NewMarketCloseContext(ctx context.Context, goq *Goquest, instrument string, longUnits, shortUnits int) (*CloseOrders, error) {
+	if longUnits == 0 && shortUnits == 0 {
+		return nil, &ParamError{Field: "units", Msg: "longUnits or shortUnits is required"}
+	}
+	res := &CloseOrders{}
+	param := iMap{}
+	marketCloseParam(param, longUnits, shortUnits)
+	ep := fmt.Sprintf("/accounts/%v/positions/%v/close", goq.Auth.Id, instrument)
+	err := goq.Put(ctx, ep, param, res)
+	return res, err
+}
 
 // 口座情報
-func NewAccount(goq *Goquest) *Account {
+func NewAccount(goq *Goquest) (*Account, error) {
+	return NewAccountContext(context.Background(), goq)
+}
+
+// NewAccountのcontext版。
+func NewAccountContext(ctx context.Context, goq *Goquest) (*Account, error) {
 	res := &Account{}
 	ep := "/accounts/" + goq.Auth.Id
-	goq.Get(ep, nil, res)
-	return res
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
 }
 
 // 現在の価格情報。
 // instruments:"USD_JPY,EUR_USD"のように複数指定可能
-func NewPricing(goq *Goquest, instruments string) *Pricing {
+func NewPricing(goq *Goquest, instruments string) (*Pricing, error) {
+	return NewPricingContext(context.Background(), goq, instruments)
+}
+
+// NewPricingのcontext版。
+func NewPricingContext(ctx context.Context, goq *Goquest, instruments string) (*Pricing, error) {
 	res := &Pricing{}
 	ep := "/accounts/" + goq.Auth.Id + "/pricing"
 	p := map[string]string{
 		"instruments": instruments,
 	}
-	goq.Get(ep, p, res)
-	return res
+	err := goq.Get(ctx, ep, p, res)
+	return res, err
 }
 
 // 指定した取引を抽出
@@ -223,7 +281,12 @@ func NewPricing(goq *Goquest, instruments string) *Pricing {
 // instrument: "USD_JPY"
 // count : 何個抽出するか
 // befID : IDの最大値
-func NewTrades(goq *Goquest, ids, state, instrument, count, befID string) *Trades {
+func NewTrades(goq *Goquest, ids, state, instrument, count, befID string) (*Trades, error) {
+	return NewTradesContext(context.Background(), goq, ids, state, instrument, count, befID)
+}
+
+// NewTradesのcontext版。
+func NewTradesContext(ctx context.Context, goq *Goquest, ids, state, instrument, count, befID string) (*Trades, error) {
 	res := &Trades{}
 	ep := "/accounts/" + goq.Auth.Id + "/trades"
 	p := map[string]string{}
@@ -242,34 +305,47 @@ func NewTrades(goq *Goquest, ids, state, instrument, count, befID string) *Trade
 	if len(befID) > 0 {
 		p["beforeID"] = befID
 	}
-	goq.Get(ep, p, res)
-	return res
+	err := goq.Get(ctx, ep, p, res)
+	return res, err
 }
 
 // tradeIDのTradeを抽出
-func NewTrade(goq *Goquest, tradeID string) *Trade {
+func NewTrade(goq *Goquest, tradeID string) (*Trade, error) {
+	return NewTradeContext(context.Background(), goq, tradeID)
+}
+
+// NewTradeのcontext版。
+func NewTradeContext(ctx context.Context, goq *Goquest, tradeID string) (*Trade, error) {
 	res := &Trade{}
 	ep := "/accounts/" + goq.Auth.Id + "/trades/" + tradeID
-	goq.Get(ep, nil, res)
-	return res
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
 }
 
 // openポジションのTradeを抽出
-func NewOpenTrades(goq *Goquest) *Trades {
+func NewOpenTrades(goq *Goquest) (*Trades, error) {
+	return NewOpenTradesContext(context.Background(), goq)
+}
+
+// NewOpenTradesのcontext版。
+func NewOpenTradesContext(ctx context.Context, goq *Goquest) (*Trades, error) {
 	res := &Trades{}
 	ep := "/accounts/" + goq.Auth.Id + "/openTrades"
-	goq.Get(ep, nil, res)
-	return res
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
 }
 
 // order idからorderデータを取得
-func NewOrderData(goq *Goquest, id string) *OrderData {
+func NewOrderData(goq *Goquest, id string) (*OrderData, error) {
+	return NewOrderDataContext(context.Background(), goq, id)
+}
+
+// NewOrderDataのcontext版。
+func NewOrderDataContext(ctx context.Context, goq *Goquest, id string) (*OrderData, error) {
 	res := &GetOrder{}
 	ep := "/accounts/" + goq.Auth.Id + "/orders/" + id
-	goq.Get(ep, nil, res)
-	if res == nil {
-		fmt.Println(res.statusCode)
-		return nil
+	if err := goq.Get(ctx, ep, nil, res); err != nil {
+		return nil, err
 	}
-	return res.Data
+	return res.Data, nil
 }
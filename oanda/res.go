@@ -3,6 +3,10 @@
  */
 package oanda
 
+import (
+	"time"
+)
+
 const (
 	// 想定外の計算値
 	CalcError = -1
@@ -30,8 +34,15 @@ type (
 	// CandleDataの MId or Ask or BidとTimeをマージしたもの。
 	CandleStick struct {
 		Complete bool
-		Time     string
-		Prices   *Hloc
+		// 足の開始時刻
+		Time time.Time
+		// ExtractMid,ExtractBid,ExtractAsk,Sideで選んだ側の価格。Extract("H")等はこれを使う
+		Prices *Hloc
+		// リクエストのpriceComponentに含めた側のみ埋まる。他はnil
+		Mid    *Hloc
+		Bid    *Hloc
+		Ask    *Hloc
+		Volume int
 	}
 
 	CandleSticks []CandleStick
@@ -43,6 +54,7 @@ type (
 		// price:"B" -> Bidが埋まる
 		// price:"A" -> Askが埋まる
 		// price:"M" -> Midが埋まる(default)
+		// price:"BA","MBA"等、組み合わせるとそれぞれ埋まる
 		Mid *Hloc `json:"mid"`
 		Ask *Hloc `json:"ask"`
 		Bid *Hloc `json:"bid"`
@@ -124,67 +136,41 @@ type (
 		LastID       string        `json:"lastTransactionID"`
 	}
 
-	transaction struct {
-		ID        string `json:"id"`
-		Time      string `json:"time"`
-		BatchID   string `json:"batchID"`
-		RequestID string `json:"requestID"`
-	}
-
-	marketCreateTransaction struct {
-		transaction
-		Instrument string `json:"instrument"`
-		Units      int    `json:"units,string"`
-		Reason     string `json:"reason"`
-	}
-
-	fillTransaction struct {
-		transaction
-		Type           string     `json:"type"`
-		OrderID        string     `json:"orderID"`
-		Instrument     string     `json:"instrument"`
-		Units          int        `json:"units,string"`
-		Reason         string     `json:"reason"`
-		PL             float64    `json:"pl,string"`
-		Commission     float64    `json:"commission,string"`
-		Opened         tradeOpen  `json:"tradeOpened"`
-		Closed         tradeClose `json:"tradeClosed"`
-		AccountBalance float64    `json:"accountBalance,string"`
-	}
-
-	cancelTransaction struct {
-		transaction
-		Type    string `json:"type"`
-		OrderID string `json:"orderID"`
-		Reason  string `json:"reason"`
-	}
-
-	tradeOpen struct {
-	}
-	tradeClose struct {
-	}
-
 	// 取引注文時のレスポンス
 	// POST: v3/accounts/{accountID}/orders
+	// 各Transactionはレスポンスに無ければnil。
+	// CreateTransactionは注文typeに応じてMarketOrderTransaction,EntryOrderTransaction等が入る。
+	// ReplaceOrderの場合、CancelTransactionは置き換えられた注文のキャンセル。
+	// CancelOrderの場合はCancelTransactionのみ入る。
 	Orders struct {
 		base
-		Transaction       transaction       `json:"orderCreateTransaction"`
-		FillTransaction   fillTransaction   `json:"orderFillTransaction"`
-		CancelTransaction cancelTransaction `json:"orderCancelTransaction"`
-		LastID            string            `json:"lastTransactionID"`
-	}
-
-	// クローズ処理時のレスポンス
-	// CloseOrders struct {
-	// 	base
-	// 	LongCreateTransaction  marketCreateTransaction `json:"longOrderCreateTransaction"`
-	// 	ShortCreateTransaction marketCreateTransaction `json:"shortOrderCreateTransaction"`
-	// 	LongFillTransaction    fillTransaction         `json:"longOrderFillTransaction"`
-	// 	ShortFillTransaction   fillTransaction         `json:"shortOrderFillTransaction"`
-	// 	LongCancelTransaction  cancelTransaction       `json:"longOrderCancelTransaction "`
-	// 	ShortCancelTransaction cancelTransaction       `json:"shortOrderCancelTransaction"`
-	// 	LastID                 string                  `json:"lastTransactionID"`
-	// }
+		CreateTransaction        Transaction
+		FillTransaction          *OrderFillTransaction
+		CancelTransaction        *OrderCancelTransaction
+		RejectTransaction        Transaction
+		ReissueTransaction       Transaction
+		ReissueRejectTransaction Transaction
+		RelatedIDs               []string
+		LastID                   string
+		// ReplaceOrderで、新しい注文が即キャンセルされた場合
+		ReplacingCancelTransaction *OrderCancelTransaction
+	}
+
+	// クローズ処理時のレスポンス。クローズしなかった側のTransactionはnil
+	// PUT: v3/accounts/{accountID}/positions/{instrument}/close
+	CloseOrders struct {
+		base
+		LongCreateTransaction  *MarketOrderTransaction `json:"longOrderCreateTransaction"`
+		ShortCreateTransaction *MarketOrderTransaction `json:"shortOrderCreateTransaction"`
+		LongFillTransaction    *OrderFillTransaction   `json:"longOrderFillTransaction"`
+		ShortFillTransaction   *OrderFillTransaction   `json:"shortOrderFillTransaction"`
+		LongCancelTransaction  *OrderCancelTransaction `json:"longOrderCancelTransaction"`
+		ShortCancelTransaction *OrderCancelTransaction `json:"shortOrderCancelTransaction"`
+		LongRejectTransaction  *OrderRejectTransaction `json:"longOrderRejectTransaction"`
+		ShortRejectTransaction *OrderRejectTransaction `json:"shortOrderRejectTransaction"`
+		RelatedIDs             []string                `json:"relatedTransactionIDs"`
+		LastID                 string                  `json:"lastTransactionID"`
+	}
 
 	// Get: v3/accounts/{accountID}/order/{orderSpecifier}
 	GetOrder struct {
@@ -196,12 +182,68 @@ type (
 
 	OrderData struct {
 		Id          string `json:"id"`
-		CreatedTime string `json:"createdTime"`
+		CreatedTime string `json:"createTime"`
 		// PENDING,FILLED,TRIGGERED,CANCELLED
 		State string `json:"state"`
+		// "MARKET","LIMIT","STOP","MARKET_IF_TOUCHED","TAKE_PROFIT","STOP_LOSS","TRAILING_STOP_LOSS"等
+		Type       string `json:"type"`
+		Instrument string `json:"instrument"`
+		// TAKE_PROFIT等の決済注文は0
+		Units int `json:"units,string"`
+		// 指値等の価格。MARKETは0
+		Price            float64 `json:"price,string"`
+		PriceBound       float64 `json:"priceBound,string"`
+		TimeInForce      string  `json:"timeInForce"`
+		GtdTime          string  `json:"gtdTime"`
+		PositionFill     string  `json:"positionFill"`
+		TriggerCondition string  `json:"triggerCondition"`
+		// 決済注文(TAKE_PROFIT,STOP_LOSS,TRAILING_STOP_LOSS)の紐づくtrade
+		TradeID       string `json:"tradeID"`
+		ClientTradeID string `json:"clientTradeID"`
+		// STOP_LOSS,TRAILING_STOP_LOSSの値幅
+		Distance float64 `json:"distance,string"`
+		// TRAILING_STOP_LOSSの現在の発動価格
+		TrailingStopValue      float64                `json:"trailingStopValue,string"`
+		TakeProfitOnFill       *TakeProfitParam       `json:"takeProfitOnFill"`
+		StopLossOnFill         *StopLossParam         `json:"stopLossOnFill"`
+		TrailingStopLossOnFill *TrailingStopLossParam `json:"trailingStopLossOnFill"`
+		ClientExtensions       *ClientExtensions      `json:"clientExtensions"`
+		TradeClientExtensions  *ClientExtensions      `json:"tradeClientExtensions"`
+		// 約定・キャンセル時の情報
+		FillingTransactionID    string   `json:"fillingTransactionID"`
+		FilledTime              string   `json:"filledTime"`
+		TradeOpenedID           string   `json:"tradeOpenedID"`
+		TradeReducedID          string   `json:"tradeReducedID"`
+		TradeClosedIDs          []string `json:"tradeClosedIDs"`
+		CancellingTransactionID string   `json:"cancellingTransactionID"`
+		CancelledTime           string   `json:"cancelledTime"`
+		// ReplaceOrderで置き換えた・置き換えられた注文
+		ReplacesOrderID   string `json:"replacesOrderID"`
+		ReplacedByOrderID string `json:"replacedByOrderID"`
+	}
+
+	// 注文の一覧
+	// GET: v3/accounts/{accountID}/orders
+	// GET: v3/accounts/{accountID}/pendingOrders
+	OrderList struct {
+		base
+		Orders []*OrderData `json:"orders"`
+		LastID string       `json:"lastTransactionID"`
+	}
+
+	// 注文のclientExtensions変更時のレスポンス
+	// PUT: v3/accounts/{accountID}/orders/{orderSpecifier}/clientExtensions
+	OrderClientExtensions struct {
+		base
+		Transaction       *OrderClientExtensionsModifyTransaction `json:"orderClientExtensionsModifyTransaction"`
+		RejectTransaction *OrderRejectTransaction                 `json:"orderClientExtensionsModifyRejectTransaction"`
+		RelatedIDs        []string                                `json:"relatedTransactionIDs"`
+		LastID            string                                  `json:"lastTransactionID"`
 	}
 
 	AccountData struct {
+		ID       string `json:"id"`
+		Currency string `json:"currency"`
 		// 証拠金維持率と思われる
 		MarginRate        float64 `json:"marginRate,string"`
 		MarginUsed        float64 `json:"marginUsed,string"`
@@ -213,10 +255,21 @@ type (
 		// 総利益
 		PL float64 `json:"pl,string"`
 		// 残高
-		Balance    float64        `json:"balance,string"`
-		Commission float64        `json:"commission,string"`
-		Positions  []PositionData `json:"positions"`
-		Orders     []OrderData    `json:"orders"`
+		Balance    float64 `json:"balance,string"`
+		Commission float64 `json:"commission,string"`
+		Financing  float64 `json:"financing,string"`
+		// 評価額込みの残高
+		NAV             float64 `json:"NAV,string"`
+		MarginAvailable float64 `json:"marginAvailable,string"`
+		PositionValue   float64 `json:"positionValue,string"`
+		// 1以上でロスカット
+		MarginCloseoutPercent float64        `json:"marginCloseoutPercent,string"`
+		WithdrawalLimit       float64        `json:"withdrawalLimit,string"`
+		LastTransactionID     string         `json:"lastTransactionID"`
+		Positions             []PositionData `json:"positions"`
+		Orders                []OrderData    `json:"orders"`
+		// 保有中のtrade。TakeProfitOrder等は入らず、*OrderIDのみ
+		Trades []TradeData `json:"trades"`
 	}
 
 	Account struct {
@@ -231,8 +284,11 @@ type (
 	}
 
 	Price struct {
+		// "PRICE"。streamの場合に設定される
+		Type       string   `json:"type"`
 		Time       string   `json:"time"`
 		Instrument string   `json:"instrument"`
+		Tradeable  bool     `json:"tradeable"`
 		Bids       []Ticker `json:"bids"`
 		Asks       []Ticker `json:"asks"`
 	}
@@ -256,6 +312,23 @@ type (
 		CurrentUnits int     `json:"currentUnits,string"`
 		UnrealizedPL float64 `json:"unrealizedPL,string"`
 		RealizedPL   float64 `json:"realizedPL,string"`
+		// 累計のスワップ
+		Financing float64 `json:"financing,string"`
+		// 決済済みunitsの平均決済価格
+		AverageClosePrice     float64 `json:"averageClosePrice,string"`
+		MarginUsed            float64 `json:"marginUsed,string"`
+		InitialMarginRequired float64 `json:"initialMarginRequired,string"`
+		// 決済(一部決済含む)したtransactionのID
+		ClosingTransactionIDs []string          `json:"closingTransactionIDs"`
+		ClientExtensions      *ClientExtensions `json:"clientExtensions"`
+		// 紐づいている利確・損切注文。無ければnil
+		TakeProfitOrder       *OrderData `json:"takeProfitOrder"`
+		StopLossOrder         *OrderData `json:"stopLossOrder"`
+		TrailingStopLossOrder *OrderData `json:"trailingStopLossOrder"`
+		// 口座情報・changesのtradeは注文の代わりにIDのみ入る
+		TakeProfitOrderID       string `json:"takeProfitOrderID"`
+		StopLossOrderID         string `json:"stopLossOrderID"`
+		TrailingStopLossOrderID string `json:"trailingStopLossOrderID"`
 	}
 
 	Trade struct {
@@ -298,26 +371,91 @@ func (c *Candles) Extract() []CandleData {
 	return c.CandleData
 }
 
+// mid,bid,askを全て持つCandleSticks。PricesはMid。
+func (c *Candles) Sticks() CandleSticks {
+	return c.sticks("")
+}
+
+// midのCandleSticks。midが無い足は除く。
 func (c *Candles) ExtractMid() CandleSticks {
+	return c.sticks("M")
+}
+
+// bidのCandleSticks。priceComponentに"B"を含めて取得したもの。
+func (c *Candles) ExtractBid() CandleSticks {
+	return c.sticks("B")
+}
+
+// askのCandleSticks。priceComponentに"A"を含めて取得したもの。
+func (c *Candles) ExtractAsk() CandleSticks {
+	return c.sticks("A")
+}
+
+// sideの価格をPricesにしたCandleSticks。sideの価格が無い足は除く。sideが空なら全て。
+func (c *Candles) sticks(side string) CandleSticks {
 	data := c.Extract()
 	if data == nil || len(data) == 0 {
 		return nil
 	}
 	sticks := []CandleStick{}
 	for _, d := range data {
-		if d.Mid == nil {
-			continue
-		}
+		// パースできない場合はゼロ値
+		t, _ := ParseTime(d.Time)
 		stick := CandleStick{
 			Complete: d.Complete,
+			Time:     t,
 			Prices:   d.Mid,
-			Time:     d.Time,
+			Mid:      d.Mid,
+			Bid:      d.Bid,
+			Ask:      d.Ask,
+			Volume:   int(d.Volume),
+		}
+		if len(side) > 0 {
+			stick.Prices = stick.side(side)
+			if stick.Prices == nil {
+				continue
+			}
 		}
 		sticks = append(sticks, stick)
 	}
 	return sticks
 }
 
+// "M","B","A"の価格。
+func (s CandleStick) side(side string) *Hloc {
+	switch side {
+	case "M":
+		return s.Mid
+	case "B":
+		return s.Bid
+	case "A":
+		return s.Ask
+	}
+	return nil
+}
+
+// PricesをsideにしたCandleSticks。side:"M","B","A"。
+// 買いのブレイクはask、売りのブレイクはbidで判定したい場合等に使う。sideの価格が無い足は除く。
+func (c CandleSticks) Side(side string) CandleSticks {
+	newSticks := CandleSticks{}
+	for _, s := range c {
+		if p := s.side(side); p != nil {
+			s.Prices = p
+			newSticks = append(newSticks, s)
+		}
+	}
+	return newSticks
+}
+
+// 各足の出来高(tick数)
+func (c CandleSticks) Volumes() []int {
+	vols := []int{}
+	for _, s := range c {
+		vols = append(vols, s.Volume)
+	}
+	return vols
+}
+
 func (c CandleSticks) Complete() CandleSticks {
 	newSticks := CandleSticks{}
 	for _, s := range c {
@@ -485,14 +623,62 @@ func (o *Orders) Id() string {
 	if !o.Check() {
 		return ""
 	}
-	// o.Transactionはvalueなのでnilにはならない。なのでチェックしない
-	return o.Transaction.ID
+	if o.CreateTransaction == nil {
+		return ""
+	}
+	return o.CreateTransaction.Header().ID
+}
+
+// クローズ注文のorder ID。longとshortの両方をクローズした場合はlong側。
+func (c *CloseOrders) Id() string {
+	if !c.Check() {
+		return ""
+	}
+	if c.LongCreateTransaction != nil {
+		return c.LongCreateTransaction.ID
+	}
+	if c.ShortCreateTransaction != nil {
+		return c.ShortCreateTransaction.ID
+	}
+	return ""
+}
+
+// クローズ注文が全て約定したか
+func (c *CloseOrders) Filled() bool {
+	if !c.Check() {
+		return false
+	}
+	if c.LongCreateTransaction != nil && c.LongFillTransaction == nil {
+		return false
+	}
+	if c.ShortCreateTransaction != nil && c.ShortFillTransaction == nil {
+		return false
+	}
+	return c.LongFillTransaction != nil || c.ShortFillTransaction != nil
+}
+
+// 実現損益。long,shortの合計
+func (c *CloseOrders) PL() float64 {
+	pl := 0.0
+	for _, f := range []*OrderFillTransaction{c.LongFillTransaction, c.ShortFillTransaction} {
+		if f != nil {
+			pl += f.PL
+		}
+	}
+	return pl
 }
 
 func (o *OrderData) OrderStatus() string {
 	return o.State
 }
 
+func (o *OrderList) Extract() []*OrderData {
+	if !o.Check() {
+		return nil
+	}
+	return o.Orders
+}
+
 func (g *GetOrder) OrderStatus() string {
 	if !g.Check() || g.Data == nil {
 		return ""
@@ -0,0 +1,156 @@
+/*
+ * Goquestのリトライ方針を定める
+ */
+
+package oanda
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type (
+	// リトライ方針。
+	// GETは5xx,429,接続リセット等でリトライする。
+	// POST,PUTは成行き注文の二重発注を防ぐため、サーバに届いていないことが確実な場合
+	// (接続確立前の失敗、429)のみリトライする。
+	RetryPolicy struct {
+		// 1回目を含む最大試行回数。1以下ならリトライしない。
+		MaxAttempts int
+		// 初回リトライまでの待ち時間。以降2倍ずつ伸びる。
+		BaseDelay time.Duration
+		// 待ち時間の上限。Retry-Afterヘッダの値には適用しない。
+		MaxDelay time.Duration
+		// 待ち時間のゆらぎ。0~1。0.2なら±20%。
+		Jitter float64
+	}
+)
+
+// デフォルトのリトライ方針。最大3回、0.5秒,1秒,...と待つ。
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.2,
+	}
+}
+
+// リトライしない方針。
+func NoRetry() *RetryPolicy {
+	return &RetryPolicy{MaxAttempts: 1}
+}
+
+// attempt回目(1~)の失敗後に待つ時間。exponential backoff + jitter。
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// errがリトライ対象か判定する。
+// idempotent:同じリクエストを複数回送っても問題ないか。GETのみtrueを想定。
+func (p *RetryPolicy) retryable(err error, idempotent bool) bool {
+	if code := statusCode(err); code > 0 {
+		return retryableStatus(code, idempotent)
+	}
+	var te *TransportError
+	if !errors.As(err, &te) {
+		// DecodeError等はリトライしても結果は変わらない
+		return false
+	}
+	if isDialError(te.Err) {
+		// 接続確立前の失敗はリクエストが届いていないのでPOSTでもリトライ可
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	if errors.Is(te.Err, syscall.ECONNRESET) ||
+		errors.Is(te.Err, io.ErrUnexpectedEOF) ||
+		errors.Is(te.Err, io.EOF) ||
+		errors.Is(te.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(te.Err, &ne) && ne.Timeout()
+}
+
+// 429はリクエストが処理されていないのでPOSTでもリトライ可。5xxはGETのみ。
+func retryableStatus(code int, idempotent bool) bool {
+	if code == http.StatusTooManyRequests {
+		return true
+	}
+	return idempotent && code >= 500 && code <= 599
+}
+
+// 接続確立(DNS解決含む)前のエラーか
+func isDialError(err error) bool {
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return true
+	}
+	var de *net.DNSError
+	return errors.As(err, &de)
+}
+
+// Retry-Afterヘッダを解釈する。秒数かHTTP日付。無い・読めない場合は0。
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// エラーに付いているRetry-Afterを返す。
+func errRetryAfter(err error) time.Duration {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.RetryAfter
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.RetryAfter
+	}
+	return 0
+}
+
+// d時間待つ。ctxがキャンセルされたらその時点でctx.Err()を返す。
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,252 @@
+package oanda
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%v) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	// jitterは±Jitterの範囲に収まる
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(1); got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("backoff with jitter = %v, want 80ms~120ms", got)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name       string
+		err        error
+		get, other bool // GET,POSTでリトライするか
+	}{
+		{"api 500", &APIError{StatusCode: 500, Message: "x"}, true, false},
+		{"status 503", &StatusError{StatusCode: 503}, true, false},
+		{"api 429", &APIError{StatusCode: 429, Message: "x"}, true, true},
+		{"status 429", &StatusError{StatusCode: 429}, true, true},
+		{"api 400", &APIError{StatusCode: 400, Message: "x"}, false, false},
+		{"status 404", &StatusError{StatusCode: 404}, false, false},
+		{"dial", &TransportError{Err: dial}, true, true},
+		{"dns", &TransportError{Err: &net.DNSError{Err: "no such host"}}, true, true},
+		{"reset", &TransportError{Err: syscall.ECONNRESET}, true, false},
+		{"timeout", &TransportError{Err: context.DeadlineExceeded}, true, false},
+		{"decode", &DecodeError{Err: errors.New("x")}, false, false},
+		{"param", &ParamError{Field: "x"}, false, false},
+	}
+	p := DefaultRetryPolicy()
+	for _, tt := range tests {
+		if got := p.retryable(tt.err, true); got != tt.get {
+			t.Errorf("%v: retryable(GET) = %v, want %v", tt.name, got, tt.get)
+		}
+		if got := p.retryable(tt.err, false); got != tt.other {
+			t.Errorf("%v: retryable(POST) = %v, want %v", tt.name, got, tt.other)
+		}
+	}
+}
+
+// 試行回数を数えるRoundTripper
+type countTransport struct {
+	rt http.RoundTripper
+	n  int32
+}
+
+func (c *countTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.n, 1)
+	return c.rt.RoundTrip(req)
+}
+
+func newTestClient(t *testing.T, url string, p *RetryPolicy, opts ...Option) (*Goquest, *countTransport) {
+	t.Helper()
+	ct := &countTransport{rt: http.DefaultTransport}
+	opts = append([]Option{WithBaseURL(url), WithKey("id", "token"), WithRetry(p), WithTransport(ct)}, opts...)
+	goq, err := NewClient(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goq, ct
+}
+
+func quickRetry() *RetryPolicy {
+	return &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+}
+
+// codeを返すサーバ。okAfter回目以降は200。0なら常にcode
+func statusServer(t *testing.T, code int, okAfter int32, header http.Header) *httptest.Server {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i := atomic.AddInt32(&n, 1); okAfter > 0 && i >= okAfter {
+			w.Write([]byte(`{}`))
+			return
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(`{"errorMessage":"error"}`))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestSendStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		code   int
+		want   int32 // 試行回数
+		ok     bool
+	}{
+		{"GET 500", "GET", 500, 2, true},
+		{"GET 429", "GET", 429, 2, true},
+		{"POST 500", "POST", 500, 1, false},
+		{"PUT 503", "PUT", 503, 1, false},
+		{"POST 429", "POST", 429, 2, true},
+		{"GET 400", "GET", 400, 1, false},
+	}
+	for _, tt := range tests {
+		ts := statusServer(t, tt.code, 2, nil)
+		goq, ct := newTestClient(t, ts.URL, quickRetry())
+		err := request(goq, context.Background(), tt.method)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+		if ct.n != tt.want {
+			t.Errorf("%v: attempts = %v, want %v", tt.name, ct.n, tt.want)
+		}
+	}
+}
+
+func request(goq *Goquest, ctx context.Context, method string) error {
+	switch method {
+	case "GET":
+		return goq.Get(ctx, "/x", nil, &base{})
+	case "PUT":
+		return goq.Put(ctx, "/x", iMap{}, &base{})
+	}
+	return goq.Post(ctx, "/x", iMap{}, &base{})
+}
+
+// レスポンスを返さずに接続を切るサーバ
+func resetServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestSendReset(t *testing.T) {
+	ts := resetServer(t)
+	for _, tt := range []struct {
+		method string
+		want   int32
+	}{{"GET", 3}, {"POST", 1}} {
+		goq, ct := newTestClient(t, ts.URL, quickRetry())
+		if err := request(goq, context.Background(), tt.method); err == nil {
+			t.Errorf("%v: expected error", tt.method)
+		}
+		if ct.n != tt.want {
+			t.Errorf("%v: attempts = %v, want %v", tt.method, ct.n, tt.want)
+		}
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(done) })
+	for _, tt := range []struct {
+		method string
+		want   int32
+	}{{"GET", 3}, {"POST", 1}} {
+		goq, ct := newTestClient(t, ts.URL, quickRetry(), WithTimeout(20*time.Millisecond))
+		if err := request(goq, context.Background(), tt.method); err == nil {
+			t.Errorf("%v: expected error", tt.method)
+		}
+		if ct.n != tt.want {
+			t.Errorf("%v: attempts = %v, want %v", tt.method, ct.n, tt.want)
+		}
+	}
+}
+
+func TestSendDialError(t *testing.T) {
+	// 閉じたサーバのurlに接続するとconnection refusedになる
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+	for _, method := range []string{"GET", "POST"} {
+		goq, ct := newTestClient(t, url, quickRetry())
+		if err := request(goq, context.Background(), method); err == nil {
+			t.Errorf("%v: expected error", method)
+		}
+		if ct.n != 3 {
+			t.Errorf("%v: attempts = %v, want 3", method, ct.n)
+		}
+	}
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	h := http.Header{}
+	h.Set("Retry-After", "1")
+	ts := statusServer(t, 429, 2, h)
+	// backoffだけなら1ms程度で再試行する
+	goq, ct := newTestClient(t, ts.URL, quickRetry())
+	st := time.Now()
+	if err := request(goq, context.Background(), "POST"); err != nil {
+		t.Fatal(err)
+	}
+	if el := time.Since(st); el < time.Second {
+		t.Errorf("retried after %v, want >= 1s (Retry-After)", el)
+	}
+	if ct.n != 2 {
+		t.Errorf("attempts = %v, want 2", ct.n)
+	}
+}
+
+func TestSendCancel(t *testing.T) {
+	ts := statusServer(t, 500, 0, nil)
+	p := &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	goq, ct := newTestClient(t, ts.URL, p)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	st := time.Now()
+	err := request(goq, ctx, "GET")
+	if code := statusCode(err); code != 500 {
+		t.Errorf("err = %v, want last status error", err)
+	}
+	if el := time.Since(st); el > 5*time.Second {
+		t.Errorf("took %v after cancel", el)
+	}
+	if ct.n != 1 {
+		t.Errorf("attempts = %v, want 1", ct.n)
+	}
+}
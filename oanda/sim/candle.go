@@ -0,0 +1,121 @@
+/*
+ * simulatorで再生するロウソク足の読み込み
+ */
+
+package sim
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// 再生するロウソク足。価格はmid。
+type Candle struct {
+	Time   time.Time
+	O      float64
+	H      float64
+	L      float64
+	C      float64
+	Volume int
+}
+
+// ファイルからロウソク足を読み込む。拡張子で形式を判定する。
+// .json: NewCandlesのレスポンスをそのまま保存したもの({"candles":[{"time":..,"mid":{..}}]})
+// .csv : time,o,h,l,c,volume。timeはRFC3339かunix秒。1行目がheaderなら読み飛ばす。
+func LoadCandles(fpath string) ([]Candle, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cs []Candle
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".json":
+		cs, err = readJSON(f)
+	case ".csv":
+		cs, err = readCSV(f)
+	default:
+		return nil, fmt.Errorf("sim: unsupported candle file:%v", fpath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Time.Before(cs[j].Time) })
+	return cs, nil
+}
+
+func readJSON(r io.Reader) ([]Candle, error) {
+	data := struct {
+		Candles []struct {
+			Time   string `json:"time"`
+			Volume int    `json:"volume"`
+			Mid    *struct {
+				O float64 `json:"o,string"`
+				H float64 `json:"h,string"`
+				L float64 `json:"l,string"`
+				C float64 `json:"c,string"`
+			} `json:"mid"`
+		} `json:"candles"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+	cs := []Candle{}
+	for _, d := range data.Candles {
+		if d.Mid == nil {
+			continue
+		}
+		t, err := oanda.ParseTime(d.Time)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, Candle{Time: t, O: d.Mid.O, H: d.Mid.H, L: d.Mid.L, C: d.Mid.C, Volume: d.Volume})
+	}
+	return cs, nil
+}
+
+func readCSV(r io.Reader) ([]Candle, error) {
+	rd := csv.NewReader(r)
+	rd.FieldsPerRecord = -1
+	rows, err := rd.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	cs := []Candle{}
+	for i, row := range rows {
+		if len(row) < 5 {
+			return nil, fmt.Errorf("sim: line %v: too few columns", i+1)
+		}
+		t, err := oanda.ParseTime(row[0])
+		if err != nil {
+			// header行
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("sim: line %v: %v", i+1, err)
+		}
+		c := Candle{Time: t}
+		vals := []*float64{&c.O, &c.H, &c.L, &c.C}
+		for j, v := range vals {
+			if *v, err = strconv.ParseFloat(row[j+1], 64); err != nil {
+				return nil, fmt.Errorf("sim: line %v: %v", i+1, err)
+			}
+		}
+		if len(row) > 5 {
+			c.Volume, _ = strconv.Atoi(row[5])
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
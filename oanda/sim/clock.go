@@ -0,0 +1,80 @@
+/*
+ * bot側からsimulatorの時刻を参照・操作するためのclient
+ */
+
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// simulatorの/sim endpointを叩いて時刻を進めるclock。
+// botのtick()の代わりに使うと、実時間を待たずにロウソク足を再生できる。
+type RemoteClock struct {
+	// simulatorのurl。"http://localhost:8080"のように/simの手前まで。
+	Url    string
+	Client *http.Client
+	// H4以上の足の区切り。NewRemoteClockではoandaのdefault(botと同じ17時NY基準)
+	Align oanda.Alignment
+}
+
+func NewRemoteClock(url string) *RemoteClock {
+	return &RemoteClock{Url: strings.TrimRight(url, "/"), Client: &http.Client{}, Align: oanda.DefaultAlignment()}
+}
+
+// simulator上の現在時刻。取得できない場合はゼロ値。
+func (c *RemoteClock) Now() time.Time {
+	t, err := c.call(context.Background(), "GET", "/sim/clock")
+	if err != nil {
+		fmt.Println(err)
+	}
+	return t
+}
+
+// 次のgの足が確定する時刻までsimulatorを進める。データが尽きた、もしくはctxがキャンセルされた場合はfalse。
+// botのtick()と同じく、H4以上の足もAlignの区切りに合わせる。
+func (c *RemoteClock) Tick(ctx context.Context, g oanda.Granularity) bool {
+	now, err := c.call(ctx, "GET", "/sim/clock")
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	next := g.Next(now, c.Align)
+	_, err = c.call(ctx, "POST", "/sim/tick?to="+url.QueryEscape(oanda.FormatTime(next)))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+func (c *RemoteClock) call(ctx context.Context, method, ep string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.Url+ep, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	res, err := c.Client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer res.Body.Close()
+	body := struct {
+		Time    string `json:"time"`
+		Message string `json:"errorMessage"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return time.Time{}, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("sim: %v %v: %v", method, ep, body.Message)
+	}
+	return time.Parse(oanda.TimeLayout, body.Time)
+}
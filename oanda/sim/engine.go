@@ -0,0 +1,505 @@
+/*
+ * simulatorの約定処理。両建て不可(netting)口座として振る舞う。
+ */
+
+package sim
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+type (
+	simTrade struct {
+		ID           string
+		Instrument   string
+		Price        float64
+		OpenTime     time.Time
+		CloseTime    time.Time
+		InitialUnits int
+		CurrentUnits int
+		RealizedPL   float64
+		// 決済済みunitsの平均決済価格
+		AverageClose float64
+		closedUnits  int
+		// 決済(一部決済含む)したfill transactionのID
+		ClosingIDs []string
+		// 紐づく利確・損切注文のID。無ければ空
+		TakeProfitID string
+		StopLossID   string
+	}
+
+	simOrder struct {
+		ID          string
+		Type        string
+		Instrument  string
+		Units       int
+		Tif         string
+		State       string // PENDING,FILLED,CANCELLED
+		CreateTime  time.Time
+		FillTxID    string
+		CancelTxID  string
+		TradeOpened string
+		TradeClosed []string
+		// TAKE_PROFIT,STOP_LOSSの場合の紐づくtradeと価格
+		TradeID string
+		Price   float64
+		// ReplaceOrderで置き換えた・置き換えられた注文
+		ReplacesID   string
+		ReplacedByID string
+		Ext          tx
+		TradeExt     tx
+	}
+
+	// 約定時に付ける利確・損切。0なら付けない。
+	onFill struct {
+		TakeProfit       float64
+		StopLoss         float64
+		StopLossDistance float64
+	}
+
+	// transaction。そのままjsonにする。
+	tx map[string]interface{}
+)
+
+func (t *simTrade) open() bool {
+	return t.CurrentUnits != 0
+}
+
+func (t *simTrade) state() string {
+	if t.open() {
+		return "OPEN"
+	}
+	return "CLOSED"
+}
+
+// 決済する側の価格。longならbid、shortならask。
+func (t *simTrade) closePrice(ask, bid float64) float64 {
+	if t.CurrentUnits > 0 {
+		return bid
+	}
+	return ask
+}
+
+func (t *simTrade) unrealizedPL(ask, bid float64) float64 {
+	if !t.open() {
+		return 0
+	}
+	return (t.closePrice(ask, bid) - t.Price) * float64(t.CurrentUnits)
+}
+
+// unitsだけpriceで決済し、実現損益を返す。unitsは正の値。
+func (t *simTrade) reduce(units int, price float64, now time.Time) float64 {
+	sign := 1
+	if t.CurrentUnits < 0 {
+		sign = -1
+	}
+	pl := (price - t.Price) * float64(units*sign)
+	t.AverageClose = (t.AverageClose*float64(t.closedUnits) + price*float64(units)) / float64(t.closedUnits+units)
+	t.closedUnits += units
+	t.CurrentUnits -= units * sign
+	t.RealizedPL += pl
+	if !t.open() {
+		t.CloseTime = now
+	}
+	return pl
+}
+
+func (s *Server) openTrades() []*simTrade {
+	ts := []*simTrade{}
+	for _, t := range s.trades {
+		if t.open() {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+func (s *Server) nextID() string {
+	s.lastTxID++
+	return strconv.Itoa(s.lastTxID)
+}
+
+// transactionに共通項目を設定して記録する
+func (s *Server) record(t tx) tx {
+	if _, ok := t["id"]; !ok {
+		t["id"] = s.nextID()
+	}
+	t["time"] = oanda.FormatTime(s.now)
+	t["accountID"] = s.cfg.AccountID
+	t["userID"] = 1
+	s.transactions = append(s.transactions, t)
+	return t
+}
+
+// 成行き注文を処理し、create,fill(もしくはcancel)transactionを返す。
+// units:正ならbuy、負ならsell。反対側のtradeから先入れ先出しで決済し、残りで新規tradeを作る。
+// 新規tradeにはofの利確・損切注文を付ける。extraはcreate transactionに追加する項目。
+func (s *Server) marketOrder(instrument string, units int, tif string, reason string, of onFill, extra tx) (tx, tx, tx) {
+	if tif == "" {
+		tif = "FOK"
+	}
+	order := &simOrder{
+		ID:         s.nextID(),
+		Type:       "MARKET",
+		Instrument: instrument,
+		Units:      units,
+		Tif:        tif,
+		CreateTime: s.now,
+	}
+	s.orders[order.ID] = order
+	create := tx{
+		"id":           order.ID,
+		"type":         "MARKET_ORDER",
+		"instrument":   instrument,
+		"units":        strconv.Itoa(units),
+		"timeInForce":  tif,
+		"positionFill": "DEFAULT",
+		"reason":       reason,
+	}
+	if of.TakeProfit != 0 {
+		create["takeProfitOnFill"] = tx{"price": fstr(of.TakeProfit), "timeInForce": "GTC"}
+	}
+	if of.StopLoss != 0 {
+		create["stopLossOnFill"] = tx{"price": fstr(of.StopLoss), "timeInForce": "GTC"}
+	}
+	if of.StopLossDistance != 0 {
+		create["stopLossOnFill"] = tx{"distance": fstr(of.StopLossDistance), "timeInForce": "GTC"}
+	}
+	for k, v := range extra {
+		create[k] = v
+	}
+	s.record(create)
+
+	if instrument != s.cfg.Instrument || units == 0 {
+		return create, nil, s.cancelOrder(order, "MARKET_HALTED")
+	}
+
+	ask, bid := s.quote()
+	price := bid
+	if units > 0 {
+		price = ask
+	}
+	// 利確・損切が約定価格に対して損益が逆の場合、oanda同様に注文ごとキャンセル
+	sign := 1.0
+	if units < 0 {
+		sign = -1
+	}
+	if of.TakeProfit != 0 && (of.TakeProfit-price)*sign <= 0 {
+		return create, nil, s.cancelOrder(order, "TAKE_PROFIT_ON_FILL_LOSS")
+	}
+	if of.StopLoss != 0 && (price-of.StopLoss)*sign <= 0 {
+		return create, nil, s.cancelOrder(order, "STOP_LOSS_ON_FILL_LOSS")
+	}
+
+	fillID := s.nextID()
+	fill := tx{
+		"id":             fillID,
+		"type":           "ORDER_FILL",
+		"orderID":        order.ID,
+		"instrument":     instrument,
+		"units":          strconv.Itoa(units),
+		"price":          fstr(price),
+		"fullPrice":      tx{"asks": []tx{{"price": fstr(ask), "liquidity": 10000000}}, "bids": []tx{{"price": fstr(bid), "liquidity": 10000000}}},
+		"reason":         "MARKET_ORDER",
+		"commission":     "0",
+		"financing":      "0",
+		"halfSpreadCost": fstr(math.Abs(float64(units)) * s.cfg.Spread / 2),
+	}
+
+	// 反対側のtradeを決済
+	remain := units
+	pl := 0.0
+	closed := []tx{}
+	closedTrades := []*simTrade{}
+	for _, t := range s.openTrades() {
+		if remain == 0 || (t.CurrentUnits > 0) == (remain > 0) {
+			continue
+		}
+		n := int(math.Min(math.Abs(float64(remain)), math.Abs(float64(t.CurrentUnits))))
+		tpl := t.reduce(n, price, s.now)
+		pl += tpl
+		closedUnits := -n
+		if remain < 0 {
+			remain += n
+		} else {
+			remain -= n
+			closedUnits = n
+		}
+		closed = append(closed, tx{"tradeID": t.ID, "units": strconv.Itoa(closedUnits), "price": fstr(price), "realizedPL": fstr(tpl)})
+		order.TradeClosed = append(order.TradeClosed, t.ID)
+		t.ClosingIDs = append(t.ClosingIDs, fillID)
+		if !t.open() {
+			closedTrades = append(closedTrades, t)
+		}
+	}
+	if len(closed) > 0 {
+		fill["tradesClosed"] = closed
+	}
+
+	// 残りで新規trade。trade idはfill transactionのid
+	var opened *simTrade
+	if remain != 0 {
+		opened = &simTrade{
+			ID:           fillID,
+			Instrument:   instrument,
+			Price:        price,
+			OpenTime:     s.now,
+			InitialUnits: remain,
+			CurrentUnits: remain,
+		}
+		s.trades = append(s.trades, opened)
+		order.TradeOpened = opened.ID
+		fill["tradeOpened"] = tx{"tradeID": opened.ID, "units": strconv.Itoa(remain), "price": fstr(price)}
+	}
+
+	s.balance += pl
+	s.pl += pl
+	fill["pl"] = fstr(pl)
+	fill["accountBalance"] = fstr(s.balance)
+	s.record(fill)
+
+	order.State = "FILLED"
+	order.FillTxID = fillID
+
+	for _, t := range closedTrades {
+		s.cancelDependents(t)
+	}
+	if opened != nil {
+		if of.TakeProfit != 0 {
+			s.createDependent("TAKE_PROFIT", opened, of.TakeProfit, "ON_FILL", fillID)
+		}
+		sl := of.StopLoss
+		if of.StopLossDistance != 0 {
+			sl = price - of.StopLossDistance*sign
+		}
+		if sl != 0 {
+			s.createDependent("STOP_LOSS", opened, sl, "ON_FILL", fillID)
+		}
+	}
+	return create, fill, nil
+}
+
+// 注文をキャンセルし、cancel transactionを返す。
+func (s *Server) cancelOrder(o *simOrder, reason string) tx {
+	o.State = "CANCELLED"
+	cancel := s.record(tx{
+		"type":    "ORDER_CANCEL",
+		"orderID": o.ID,
+		"reason":  reason,
+	})
+	o.CancelTxID = cancel["id"].(string)
+	return cancel
+}
+
+// tradeに利確・損切注文(typ:"TAKE_PROFIT","STOP_LOSS")を作り、create transactionを返す。
+// 既にある場合は置き換える。fillIDはON_FILLの場合の約定transaction。
+func (s *Server) createDependent(typ string, t *simTrade, price float64, reason string, fillID string) (tx, tx) {
+	var cancel tx
+	prev := t.dependent(typ)
+	o := &simOrder{
+		ID:         s.nextID(),
+		Type:       typ,
+		Instrument: t.Instrument,
+		Units:      -t.CurrentUnits,
+		Tif:        "GTC",
+		State:      "PENDING",
+		CreateTime: s.now,
+		TradeID:    t.ID,
+		Price:      price,
+	}
+	create := tx{
+		"id":               o.ID,
+		"type":             typ + "_ORDER",
+		"tradeID":          t.ID,
+		"price":            fstr(price),
+		"timeInForce":      "GTC",
+		"triggerCondition": "DEFAULT",
+		"reason":           reason,
+	}
+	if fillID != "" {
+		create["orderFillTransactionID"] = fillID
+	}
+	if prev != "" {
+		create["replacesOrderID"] = prev
+	}
+	s.record(create)
+	if prev != "" {
+		old := s.orders[prev]
+		cancel = s.cancelOrder(old, "CLIENT_REQUEST_REPLACED")
+		cancel["replacedByOrderID"] = o.ID
+		old.ReplacedByID = o.ID
+		o.ReplacesID = prev
+	}
+	s.orders[o.ID] = o
+	if typ == "TAKE_PROFIT" {
+		t.TakeProfitID = o.ID
+	} else {
+		t.StopLossID = o.ID
+	}
+	return create, cancel
+}
+
+// idの注文。"@"で始まる場合はclient order id
+func (s *Server) findOrder(id string) *simOrder {
+	if strings.HasPrefix(id, "@") {
+		for _, o := range s.orders {
+			if o.Ext != nil && o.Ext["id"] == id[1:] {
+				return o
+			}
+		}
+		return nil
+	}
+	return s.orders[id]
+}
+
+// idのtrade
+func (s *Server) findTrade(id string) *simTrade {
+	for _, t := range s.trades {
+		if t.ID == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// 注文をキャンセルし、tradeとの紐づけも外す。
+func (s *Server) cancelPending(o *simOrder, reason string) tx {
+	if t := s.findTrade(o.TradeID); t != nil {
+		if t.TakeProfitID == o.ID {
+			t.TakeProfitID = ""
+		}
+		if t.StopLossID == o.ID {
+			t.StopLossID = ""
+		}
+	}
+	return s.cancelOrder(o, reason)
+}
+
+// typの紐づく注文のID
+func (t *simTrade) dependent(typ string) string {
+	if typ == "TAKE_PROFIT" {
+		return t.TakeProfitID
+	}
+	return t.StopLossID
+}
+
+// 決済済みtradeに紐づく利確・損切注文をキャンセルする
+func (s *Server) cancelDependents(t *simTrade) {
+	for _, id := range []string{t.TakeProfitID, t.StopLossID} {
+		if o, ok := s.orders[id]; ok && o.State == "PENDING" {
+			s.cancelOrder(o, "LINKED_TRADE_CLOSED")
+		}
+	}
+	t.TakeProfitID = ""
+	t.StopLossID = ""
+}
+
+// tradeをunits(正の値)だけpriceで決済し、fill transactionを記録して返す。
+// 全決済した場合は紐づく利確・損切注文をキャンセルする。
+func (s *Server) closeTrade(t *simTrade, units int, price float64, orderID, reason string) tx {
+	full := units == t.CurrentUnits || units == -t.CurrentUnits
+	closedUnits := units
+	if t.CurrentUnits > 0 {
+		closedUnits = -units
+	}
+	pl := t.reduce(units, price, s.now)
+	s.balance += pl
+	s.pl += pl
+	reduced := tx{"tradeID": t.ID, "units": strconv.Itoa(closedUnits), "price": fstr(price), "realizedPL": fstr(pl)}
+	fill := tx{
+		"type":           "ORDER_FILL",
+		"orderID":        orderID,
+		"instrument":     t.Instrument,
+		"units":          strconv.Itoa(closedUnits),
+		"price":          fstr(price),
+		"reason":         reason,
+		"pl":             fstr(pl),
+		"commission":     "0",
+		"financing":      "0",
+		"halfSpreadCost": fstr(float64(units) * s.cfg.Spread / 2),
+		"accountBalance": fstr(s.balance),
+	}
+	if full {
+		fill["tradesClosed"] = []tx{reduced}
+	} else {
+		fill["tradeReduced"] = reduced
+	}
+	s.record(fill)
+	t.ClosingIDs = append(t.ClosingIDs, fill["id"].(string))
+	if o, ok := s.orders[orderID]; ok {
+		o.State = "FILLED"
+		o.FillTxID = fill["id"].(string)
+		o.TradeClosed = append(o.TradeClosed, t.ID)
+	}
+	if full {
+		s.cancelDependents(t)
+	}
+	return fill
+}
+
+// tradeをunits(正の値)だけ成行きで決済し、create,fill transactionを返す。
+// unitsStrはリクエストで指定された値("ALL"か数値)。
+func (s *Server) tradeCloseOrder(t *simTrade, units int, unitsStr string) (tx, tx) {
+	order := &simOrder{
+		ID:         s.nextID(),
+		Type:       "MARKET",
+		Instrument: t.Instrument,
+		Units:      -units,
+		Tif:        "FOK",
+		CreateTime: s.now,
+	}
+	if t.CurrentUnits < 0 {
+		order.Units = units
+	}
+	s.orders[order.ID] = order
+	create := s.record(tx{
+		"id":           order.ID,
+		"type":         "MARKET_ORDER",
+		"instrument":   t.Instrument,
+		"units":        strconv.Itoa(order.Units),
+		"timeInForce":  "FOK",
+		"positionFill": "REDUCE_ONLY",
+		"reason":       "TRADE_CLOSE",
+		"tradeClose":   tx{"tradeID": t.ID, "units": unitsStr},
+	})
+	ask, bid := s.quote()
+	fill := s.closeTrade(t, units, t.closePrice(ask, bid), order.ID, "MARKET_ORDER_TRADE_CLOSE")
+	return create, fill
+}
+
+// ロウソク足cの値動きで利確・損切注文が約定するか判定し、約定させる。
+// 同じ足で両方に届いた場合は、保守的に損切を優先する。
+// 窓を開けて注文価格を超えた場合は始値で約定する。
+func (s *Server) triggerOrders(c Candle) {
+	half := s.cfg.Spread / 2
+	for _, t := range s.openTrades() {
+		sl, tp := s.orders[t.StopLossID], s.orders[t.TakeProfitID]
+		if t.CurrentUnits > 0 {
+			// longはbidで決済
+			o, h, l := c.O-half, c.H-half, c.L-half
+			if sl != nil && l <= sl.Price {
+				s.closeTrade(t, t.CurrentUnits, math.Min(o, sl.Price), sl.ID, "STOP_LOSS_ORDER")
+			} else if tp != nil && h >= tp.Price {
+				s.closeTrade(t, t.CurrentUnits, math.Max(o, tp.Price), tp.ID, "TAKE_PROFIT_ORDER")
+			}
+		} else {
+			// shortはaskで決済
+			o, h, l := c.O+half, c.H+half, c.L+half
+			if sl != nil && h >= sl.Price {
+				s.closeTrade(t, -t.CurrentUnits, math.Max(o, sl.Price), sl.ID, "STOP_LOSS_ORDER")
+			} else if tp != nil && l <= tp.Price {
+				s.closeTrade(t, -t.CurrentUnits, math.Min(o, tp.Price), tp.ID, "TAKE_PROFIT_ORDER")
+			}
+		}
+	}
+}
+
+// 数値をoandaと同じく文字列にする。浮動小数点の誤差は丸める。
+func fstr(f float64) string {
+	return strconv.FormatFloat(math.Round(f*1e8)/1e8, 'f', -1, 64)
+}
@@ -0,0 +1,1187 @@
+/*
+ * simulatorのhttp endpoint。/v3以下のOanda APIと、/sim以下の操作用APIを提供する。
+ */
+
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	seg := strings.Split(path, "/")
+
+	// streamは接続し続けるのでlockの外で処理する
+	if len(seg) == 5 && seg[0] == "v3" && seg[1] == "accounts" && seg[4] == "stream" && r.Method == "GET" {
+		s.serveStream(w, r, seg[2], seg[3])
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seg[0] == "sim" {
+		s.serveControl(w, r, seg[1:])
+		return
+	}
+	if seg[0] != "v3" || len(seg) < 2 {
+		notFound(w, r)
+		return
+	}
+	seg = seg[1:]
+
+	switch {
+	case seg[0] == "instruments" && len(seg) == 3 && seg[2] == "candles" && r.Method == "GET":
+		s.getCandles(w, r, seg[1])
+	case seg[0] == "accounts" && len(seg) == 1 && r.Method == "GET":
+		// simulatorの口座は1つのみ
+		writeJSON(w, http.StatusOK, tx{"accounts": []tx{{"id": s.cfg.AccountID, "tags": []string{}}}})
+	case seg[0] == "accounts" && len(seg) >= 2:
+		if seg[1] != s.cfg.AccountID {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for 'accountID'")
+			return
+		}
+		s.serveAccount(w, r, seg[2:])
+	default:
+		notFound(w, r)
+	}
+}
+
+// /v3/accounts/{id}/...
+func (s *Server) serveAccount(w http.ResponseWriter, r *http.Request, seg []string) {
+	route := strings.Join(seg, "/")
+	switch {
+	case route == "" && r.Method == "GET":
+		s.getAccount(w, r)
+	case route == "instruments" && r.Method == "GET":
+		s.getInstruments(w, r)
+	case route == "changes" && r.Method == "GET":
+		s.getChanges(w, r)
+	case route == "pricing" && r.Method == "GET":
+		s.getPricing(w, r)
+	case len(seg) == 2 && seg[0] == "positions" && r.Method == "GET":
+		s.getPosition(w, r, seg[1])
+	case len(seg) == 3 && seg[0] == "positions" && seg[2] == "close" && r.Method == "PUT":
+		s.closePosition(w, r, seg[1])
+	case (route == "positions" || route == "openPositions") && r.Method == "GET":
+		s.getPositions(w, r, route == "openPositions")
+	case route == "trades" && r.Method == "GET":
+		s.getTrades(w, r)
+	case route == "openTrades" && r.Method == "GET":
+		s.writeTrades(w, s.openTrades())
+	case len(seg) == 2 && seg[0] == "trades" && r.Method == "GET":
+		s.getTrade(w, r, seg[1])
+	case len(seg) == 3 && seg[0] == "trades" && seg[2] == "close" && r.Method == "PUT":
+		s.putCloseTrade(w, r, seg[1])
+	case len(seg) == 3 && seg[0] == "trades" && seg[2] == "orders" && r.Method == "PUT":
+		s.putTradeOrders(w, r, seg[1])
+	case route == "orders" && r.Method == "POST":
+		s.postOrder(w, r)
+	case (route == "orders" || route == "pendingOrders") && r.Method == "GET":
+		s.getOrders(w, r, route == "pendingOrders")
+	case len(seg) == 2 && seg[0] == "orders" && r.Method == "GET":
+		s.getOrder(w, r, seg[1])
+	case len(seg) == 2 && seg[0] == "orders" && r.Method == "PUT":
+		s.replaceOrder(w, r, seg[1])
+	case len(seg) == 3 && seg[0] == "orders" && seg[2] == "cancel" && r.Method == "PUT":
+		s.putCancelOrder(w, r, seg[1])
+	case len(seg) == 3 && seg[0] == "orders" && seg[2] == "clientExtensions" && r.Method == "PUT":
+		s.putOrderClientExtensions(w, r, seg[1])
+	case route == "transactions" && r.Method == "GET":
+		s.getTransactionPages(w, r)
+	case route == "transactions/idrange" && r.Method == "GET":
+		s.getTransactionRange(w, r)
+	case route == "transactions/sinceid" && r.Method == "GET":
+		s.getTransactionsSince(w, r)
+	case len(seg) == 2 && seg[0] == "transactions" && r.Method == "GET":
+		s.getTransaction(w, r, seg[1])
+	default:
+		notFound(w, r)
+	}
+}
+
+// /sim/... simulatorの操作用
+// GET  /sim/clock             -> {"time":..}
+// POST /sim/tick?seconds=300  -> 次の300秒の倍数の時刻まで進める。データが尽きたら410
+// POST /sim/tick?to=2024-01-01T02:00:00.000000000Z -> toの時刻まで進める。toは現在時刻より後
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request, seg []string) {
+	route := strings.Join(seg, "/")
+	switch {
+	case route == "clock" && r.Method == "GET":
+	case route == "tick" && r.Method == "POST":
+		q := r.URL.Query()
+		var to time.Time
+		if v := q.Get("to"); v != "" {
+			t, err := oanda.ParseTime(v)
+			if err != nil || !t.After(s.now) {
+				writeError(w, http.StatusBadRequest, "invalid to")
+				return
+			}
+			to = t
+		} else {
+			secs, err := strconv.Atoi(q.Get("seconds"))
+			if err != nil || secs <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid seconds")
+				return
+			}
+			itv := time.Duration(secs) * time.Second
+			to = s.now.Truncate(itv).Add(itv)
+		}
+		if !s.advanceTo(to) {
+			writeError(w, http.StatusGone, "no more candles")
+			return
+		}
+	default:
+		notFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, tx{"time": oanda.FormatTime(s.now)})
+}
+
+func (s *Server) getCandles(w http.ResponseWriter, r *http.Request, instrument string) {
+	if instrument != s.cfg.Instrument {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'instrument'")
+		return
+	}
+	q := r.URL.Query()
+	if g := q.Get("granularity"); g != "" && g != s.cfg.Granularity {
+		writeError(w, http.StatusBadRequest, "granularity not available in simulator:"+g)
+		return
+	}
+	count := 500
+	if c := q.Get("count"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 || n > 5000 {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for 'count'")
+			return
+		}
+		count = n
+	}
+	from, to := time.Time{}, s.now
+	if v := q.Get("from"); v != "" {
+		t, err := oanda.ParseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for 'from'")
+			return
+		}
+		from = t
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := oanda.ParseTime(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for 'to'")
+			return
+		}
+		if t.Before(to) {
+			to = t
+		}
+	}
+
+	price := q.Get("price")
+	if price == "" {
+		price = "M"
+	}
+	if strings.Trim(price, "MBA") != "" {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'price'")
+		return
+	}
+
+	// 現在時刻までの足。形成中の足は始値だけの未確定足として返す。
+	// bid,askはmidからspreadの半分ずつずらしたもの。
+	sticks := []tx{}
+	for _, c := range s.cfg.Candles {
+		if c.Time.Before(from) || c.Time.After(to) || !c.Time.Before(s.now) {
+			continue
+		}
+		complete := !c.Time.Add(s.gran).After(s.now)
+		hloc := func(d float64) tx {
+			if !complete {
+				return tx{"o": fstr(c.O + d), "h": fstr(c.O + d), "l": fstr(c.O + d), "c": fstr(c.O + d)}
+			}
+			return tx{"o": fstr(c.O + d), "h": fstr(c.H + d), "l": fstr(c.L + d), "c": fstr(c.C + d)}
+		}
+		stick := tx{
+			"complete": complete,
+			"time":     oanda.FormatTime(c.Time),
+			"volume":   c.Volume,
+		}
+		half := s.cfg.Spread / 2
+		for _, p := range []struct {
+			c   string
+			key string
+			d   float64
+		}{{"M", "mid", 0}, {"B", "bid", -half}, {"A", "ask", half}} {
+			if strings.Contains(price, p.c) {
+				stick[p.key] = hloc(p.d)
+			}
+		}
+		sticks = append(sticks, stick)
+	}
+	// oandaと同様、from,to両方指定で上限を超える場合はエラー
+	if !from.IsZero() && q.Get("to") != "" && len(sticks) > 5000 {
+		writeError(w, http.StatusBadRequest, "Maximum value for 'count' exceeded")
+		return
+	}
+	// fromの指定が無ければ直近count本
+	if from.IsZero() && len(sticks) > count {
+		sticks = sticks[len(sticks)-count:]
+	}
+	if !from.IsZero() && len(sticks) > count && q.Get("to") == "" {
+		sticks = sticks[:count]
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"instrument":  instrument,
+		"granularity": s.cfg.Granularity,
+		"candles":     sticks,
+	})
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, r *http.Request) {
+	marginUsed := s.marginUsed()
+	upl := s.unrealizedPL()
+	positions := []tx{}
+	if p := s.position(); len(s.trades) > 0 {
+		positions = append(positions, p)
+	}
+	openPositions := 0
+	if len(s.openTrades()) > 0 {
+		openPositions = 1
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"account": tx{
+			"id":                s.cfg.AccountID,
+			"currency":          quoteCurrency(s.cfg.Instrument),
+			"balance":           fstr(s.balance),
+			"pl":                fstr(s.pl),
+			"unrealizedPL":      fstr(upl),
+			"NAV":               fstr(s.balance + upl),
+			"marginRate":        fstr(s.cfg.MarginRate),
+			"marginUsed":        fstr(marginUsed),
+			"marginAvailable":   fstr(s.balance + upl - marginUsed),
+			"commission":        "0",
+			"openTradeCount":    len(s.openTrades()),
+			"openPositionCount": openPositions,
+			"pendingOrderCount": len(s.pendingOrders()),
+			"lastTransactionID": strconv.Itoa(s.lastTxID),
+			"positions":         positions,
+			"orders":            s.pendingOrders(),
+			"trades":            s.tradesJSON(s.openTrades()),
+		},
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// cfg.Instrumentの情報。JPYの通貨ペアは1pip=0.01、それ以外は0.0001とする
+func (s *Server) getInstruments(w http.ResponseWriter, r *http.Request) {
+	pip, precision := -4, 5
+	if quoteCurrency(s.cfg.Instrument) == "JPY" {
+		pip, precision = -2, 3
+	}
+	list := []tx{}
+	for _, inst := range strings.Split(r.URL.Query().Get("instruments"), ",") {
+		if inst != "" && inst != s.cfg.Instrument {
+			continue
+		}
+		list = append(list, tx{
+			"name":                        s.cfg.Instrument,
+			"type":                        "CURRENCY",
+			"displayName":                 strings.Replace(s.cfg.Instrument, "_", "/", 1),
+			"pipLocation":                 pip,
+			"displayPrecision":            precision,
+			"tradeUnitsPrecision":         0,
+			"minimumTradeSize":            "1",
+			"maximumTrailingStopDistance": fstr(math.Pow10(pip + 4)),
+			"minimumTrailingStopDistance": fstr(math.Pow10(pip + 1)),
+			"maximumPositionSize":         "0",
+			"maximumOrderUnits":           "100000000",
+			"marginRate":                  fstr(s.cfg.MarginRate),
+		})
+		break
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"instruments":       list,
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// 未約定の注文
+func (s *Server) pendingOrders() []tx {
+	list := []*simOrder{}
+	for _, o := range s.orders {
+		if o.State == "PENDING" {
+			list = append(list, o)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(list[i].ID)
+		b, _ := strconv.Atoi(list[j].ID)
+		return a < b
+	})
+	res := []tx{}
+	for _, o := range list {
+		res = append(res, orderJSON(o))
+	}
+	return res
+}
+
+// sinceTransactionIDより後のtransactionから、変化した注文・trade・ポジションを組み立てる。
+func (s *Server) getChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.Atoi(r.URL.Query().Get("sinceTransactionID"))
+	if err != nil || since > s.lastTxID {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'sinceTransactionID'")
+		return
+	}
+	changes := tx{}
+	add := func(key string, v tx) {
+		l, _ := changes[key].([]tx)
+		changes[key] = append(l, v)
+	}
+	seenOrders, seenTrades := map[string]bool{}, map[string]bool{}
+	order := func(id string) {
+		o, ok := s.orders[id]
+		if !ok || seenOrders[id+o.State] {
+			return
+		}
+		seenOrders[id+o.State] = true
+		switch o.State {
+		case "FILLED":
+			add("ordersFilled", orderJSON(o))
+		case "CANCELLED":
+			add("ordersCancelled", orderJSON(o))
+		}
+	}
+	trade := func(id string, opened bool) {
+		t := s.findTrade(id)
+		if t == nil || seenTrades[id] {
+			return
+		}
+		seenTrades[id] = true
+		switch {
+		case !t.open():
+			add("tradesClosed", s.tradeJSON(t))
+		case opened:
+			add("tradesOpened", s.tradeJSON(t))
+		default:
+			add("tradesReduced", s.tradeJSON(t))
+		}
+	}
+	txs := []tx{}
+	filled := false
+	for _, t := range s.transactions {
+		id, _ := strconv.Atoi(t["id"].(string))
+		if id <= since {
+			continue
+		}
+		txs = append(txs, t)
+		switch t["type"] {
+		case "ORDER_FILL":
+			filled = true
+			order(t["orderID"].(string))
+			if o, ok := t["tradeOpened"].(tx); ok {
+				trade(o["tradeID"].(string), true)
+			}
+			if o, ok := t["tradeReduced"].(tx); ok {
+				trade(o["tradeID"].(string), false)
+			}
+			if l, ok := t["tradesClosed"].([]tx); ok {
+				for _, o := range l {
+					trade(o["tradeID"].(string), false)
+				}
+			}
+		case "ORDER_CANCEL":
+			order(t["orderID"].(string))
+		default:
+			// 注文の作成。今の状態で返す
+			if o, ok := s.orders[t["id"].(string)]; ok {
+				add("ordersCreated", orderJSON(o))
+			}
+		}
+	}
+	if filled {
+		changes["positions"] = []tx{s.position()}
+	}
+	changes["transactions"] = txs
+
+	ask, bid := s.quote()
+	trades, positions := []tx{}, []tx{}
+	for _, t := range s.openTrades() {
+		trades = append(trades, tx{
+			"id":           t.ID,
+			"unrealizedPL": fstr(t.unrealizedPL(ask, bid)),
+			"marginUsed":   fstr(abs(float64(t.CurrentUnits)) * s.mid() * s.cfg.MarginRate),
+		})
+	}
+	if len(s.trades) > 0 {
+		p := s.position()
+		positions = append(positions, tx{
+			"instrument":        s.cfg.Instrument,
+			"netUnrealizedPL":   p["unrealizedPL"],
+			"longUnrealizedPL":  p["long"].(tx)["unrealizedPL"],
+			"shortUnrealizedPL": p["short"].(tx)["unrealizedPL"],
+			"marginUsed":        fstr(s.marginUsed()),
+		})
+	}
+	upl := s.unrealizedPL()
+	writeJSON(w, http.StatusOK, tx{
+		"changes": changes,
+		"state": tx{
+			"unrealizedPL":    fstr(upl),
+			"NAV":             fstr(s.balance + upl),
+			"marginUsed":      fstr(s.marginUsed()),
+			"marginAvailable": fstr(s.balance + upl - s.marginUsed()),
+			"balance":         fstr(s.balance),
+			"pl":              fstr(s.pl),
+			"orders":          []tx{},
+			"trades":          trades,
+			"positions":       positions,
+		},
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+func (s *Server) marginUsed() float64 {
+	m := 0.0
+	for _, t := range s.openTrades() {
+		m += abs(float64(t.CurrentUnits)) * s.mid() * s.cfg.MarginRate
+	}
+	return m
+}
+
+func (s *Server) getPricing(w http.ResponseWriter, r *http.Request) {
+	prices := []tx{}
+	for _, inst := range strings.Split(r.URL.Query().Get("instruments"), ",") {
+		if inst != s.cfg.Instrument {
+			continue
+		}
+		prices = append(prices, s.price())
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"time":   oanda.FormatTime(s.now),
+		"prices": prices,
+	})
+}
+
+// 現在価格をPrice形式で
+func (s *Server) price() tx {
+	ask, bid := s.quote()
+	return tx{
+		"type":        "PRICE",
+		"instrument":  s.cfg.Instrument,
+		"time":        oanda.FormatTime(s.now),
+		"tradeable":   true,
+		"bids":        []tx{{"price": fstr(bid), "liquidity": 10000000}},
+		"asks":        []tx{{"price": fstr(ask), "liquidity": 10000000}},
+		"closeoutBid": fstr(bid),
+		"closeoutAsk": fstr(ask),
+	}
+}
+
+func (s *Server) getPosition(w http.ResponseWriter, r *http.Request, instrument string) {
+	if instrument != s.cfg.Instrument {
+		writeError(w, http.StatusNotFound, "The specified position does not exist")
+		return
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"position":          s.position(),
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// positionを成行きでクローズする。longUnits,shortUnitsは"ALL","NONE"か数値。省略時は"ALL"
+func (s *Server) closePosition(w http.ResponseWriter, r *http.Request, instrument string) {
+	if instrument != s.cfg.Instrument {
+		writeError(w, http.StatusNotFound, "The specified position does not exist")
+		return
+	}
+	body := struct {
+		LongUnits  string `json:"longUnits"`
+		ShortUnits string `json:"shortUnits"`
+	}{"ALL", "ALL"}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON:"+err.Error())
+		return
+	}
+	long, short := 0, 0
+	for _, t := range s.openTrades() {
+		if t.CurrentUnits > 0 {
+			long += t.CurrentUnits
+		} else {
+			short -= t.CurrentUnits
+		}
+	}
+	// 先に両側をチェックしてから注文する
+	type closeout struct {
+		key      string
+		units    int
+		unitsStr string
+	}
+	closeouts := []closeout{}
+	for _, c := range []struct {
+		key, req string
+		held     int
+	}{{"long", body.LongUnits, long}, {"short", body.ShortUnits, short}} {
+		if c.req == "NONE" {
+			continue
+		}
+		n := c.held
+		if c.req != "ALL" {
+			v, err := strconv.Atoi(c.req)
+			if err != nil || v <= 0 {
+				writeError(w, http.StatusBadRequest, "Invalid value specified for '"+c.key+"Units'")
+				return
+			}
+			n = v
+		}
+		if c.held == 0 || n > c.held {
+			writeError(w, http.StatusBadRequest, "The Position requested to be closed out does not exist")
+			return
+		}
+		closeouts = append(closeouts, closeout{c.key, n, c.req})
+	}
+	if len(closeouts) == 0 {
+		writeError(w, http.StatusBadRequest, "longUnits or shortUnits must be specified")
+		return
+	}
+
+	res := tx{}
+	ids := []string{}
+	for _, c := range closeouts {
+		units := -c.units
+		if c.key == "short" {
+			units = c.units
+		}
+		extra := tx{c.key + "PositionCloseout": tx{"instrument": instrument, "units": c.unitsStr}}
+		create, fill, cancel := s.marketOrder(instrument, units, "FOK", "POSITION_CLOSEOUT", onFill{}, extra)
+		res[c.key+"OrderCreateTransaction"] = create
+		ids = append(ids, create["id"].(string))
+		if fill != nil {
+			res[c.key+"OrderFillTransaction"] = fill
+			ids = append(ids, fill["id"].(string))
+		}
+		if cancel != nil {
+			res[c.key+"OrderCancelTransaction"] = cancel
+			ids = append(ids, cancel["id"].(string))
+		}
+	}
+	res["relatedTransactionIDs"] = ids
+	res["lastTransactionID"] = strconv.Itoa(s.lastTxID)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) getPositions(w http.ResponseWriter, r *http.Request, openOnly bool) {
+	positions := []tx{}
+	if len(s.trades) > 0 && (!openOnly || len(s.openTrades()) > 0) {
+		positions = append(positions, s.position())
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"positions":         positions,
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// 保有tradeからposition情報を組み立てる
+func (s *Server) position() tx {
+	ask, bid := s.quote()
+	side := func(long bool) tx {
+		units, cost, upl, pl := 0, 0.0, 0.0, 0.0
+		ids := []string{}
+		for _, t := range s.trades {
+			if (t.InitialUnits > 0) != long {
+				continue
+			}
+			pl += t.RealizedPL
+			if !t.open() {
+				continue
+			}
+			units += t.CurrentUnits
+			cost += t.Price * float64(t.CurrentUnits)
+			upl += t.unrealizedPL(ask, bid)
+			ids = append(ids, t.ID)
+		}
+		st := tx{
+			"units":        strconv.Itoa(units),
+			"pl":           fstr(pl),
+			"unrealizedPL": fstr(upl),
+		}
+		if units != 0 {
+			st["averagePrice"] = fstr(cost / float64(units))
+			st["tradeIDs"] = ids
+		}
+		return st
+	}
+	long, short := side(true), side(false)
+	return tx{
+		"instrument":   s.cfg.Instrument,
+		"pl":           fstr(s.pl),
+		"unrealizedPL": fstr(s.unrealizedPL()),
+		"marginUsed":   "0",
+		"commission":   "0",
+		"long":         long,
+		"short":        short,
+	}
+}
+
+func (s *Server) getTrades(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	if state == "" {
+		state = "OPEN"
+	}
+	count := 50
+	if c := q.Get("count"); c != "" {
+		if n, err := strconv.Atoi(c); err == nil && n > 0 {
+			count = n
+		}
+	}
+	ids := map[string]bool{}
+	for _, id := range strings.Split(q.Get("ids"), ",") {
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	before, _ := strconv.Atoi(q.Get("beforeID"))
+	inst := q.Get("instrument")
+
+	ts := []*simTrade{}
+	for _, t := range s.trades {
+		if len(ids) > 0 && !ids[t.ID] {
+			continue
+		}
+		if state != "ALL" && t.state() != state {
+			continue
+		}
+		if inst != "" && t.Instrument != inst {
+			continue
+		}
+		if id, _ := strconv.Atoi(t.ID); before > 0 && id >= before {
+			continue
+		}
+		ts = append(ts, t)
+	}
+	// idの降順
+	sort.Slice(ts, func(i, j int) bool {
+		a, _ := strconv.Atoi(ts[i].ID)
+		b, _ := strconv.Atoi(ts[j].ID)
+		return a > b
+	})
+	if len(ts) > count {
+		ts = ts[:count]
+	}
+	s.writeTrades(w, ts)
+}
+
+func (s *Server) getTrade(w http.ResponseWriter, r *http.Request, id string) {
+	for _, t := range s.trades {
+		if t.ID == id {
+			writeJSON(w, http.StatusOK, tx{
+				"trade":             s.tradeJSON(t),
+				"lastTransactionID": strconv.Itoa(s.lastTxID),
+			})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "The Trade specified does not exist")
+}
+
+func (s *Server) writeTrades(w http.ResponseWriter, ts []*simTrade) {
+	writeJSON(w, http.StatusOK, tx{
+		"trades":            s.tradesJSON(ts),
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+func (s *Server) tradesJSON(ts []*simTrade) []tx {
+	res := []tx{}
+	for _, t := range ts {
+		res = append(res, s.tradeJSON(t))
+	}
+	return res
+}
+
+func (s *Server) tradeJSON(t *simTrade) tx {
+	ask, bid := s.quote()
+	d := tx{
+		"id":           t.ID,
+		"instrument":   t.Instrument,
+		"price":        fstr(t.Price),
+		"openTime":     oanda.FormatTime(t.OpenTime),
+		"state":        t.state(),
+		"initialUnits": strconv.Itoa(t.InitialUnits),
+		"currentUnits": strconv.Itoa(t.CurrentUnits),
+		"realizedPL":   fstr(t.RealizedPL),
+		"unrealizedPL": fstr(t.unrealizedPL(ask, bid)),
+		"financing":    "0",
+	}
+	if !t.open() {
+		d["closeTime"] = oanda.FormatTime(t.CloseTime)
+	}
+	if t.closedUnits > 0 {
+		d["averageClosePrice"] = fstr(t.AverageClose)
+		d["closingTransactionIDs"] = t.ClosingIDs
+	}
+	if t.open() {
+		margin := abs(float64(t.CurrentUnits)) * s.mid() * s.cfg.MarginRate
+		d["marginUsed"] = fstr(margin)
+		d["initialMarginRequired"] = fstr(abs(float64(t.InitialUnits)) * t.Price * s.cfg.MarginRate)
+	}
+	if o, ok := s.orders[t.TakeProfitID]; ok {
+		d["takeProfitOrder"] = orderJSON(o)
+	}
+	if o, ok := s.orders[t.StopLossID]; ok {
+		d["stopLossOrder"] = orderJSON(o)
+	}
+	return d
+}
+
+// tradeを成行きで決済する。unitsは"ALL"か数値。省略時は"ALL"
+func (s *Server) putCloseTrade(w http.ResponseWriter, r *http.Request, id string) {
+	t := s.findTrade(id)
+	if t == nil || !t.open() {
+		writeError(w, http.StatusNotFound, "The Trade specified does not exist")
+		return
+	}
+	body := struct {
+		Units string `json:"units"`
+	}{"ALL"}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON:"+err.Error())
+		return
+	}
+	held := t.CurrentUnits
+	if held < 0 {
+		held = -held
+	}
+	n := held
+	if body.Units != "ALL" {
+		v, err := strconv.Atoi(body.Units)
+		if err != nil || v <= 0 || v > held {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for 'units'")
+			return
+		}
+		n = v
+	}
+	create, fill := s.tradeCloseOrder(t, n, body.Units)
+	writeJSON(w, http.StatusOK, tx{
+		"orderCreateTransaction": create,
+		"orderFillTransaction":   fill,
+		"relatedTransactionIDs":  []string{create["id"].(string), fill["id"].(string)},
+		"lastTransactionID":      strconv.Itoa(s.lastTxID),
+	})
+}
+
+// tradeの利確・損切注文を作成(置き換え)する。nullを指定した場合はキャンセル。
+func (s *Server) putTradeOrders(w http.ResponseWriter, r *http.Request, id string) {
+	var t *simTrade
+	for _, tr := range s.trades {
+		if tr.ID == id && tr.open() {
+			t = tr
+		}
+	}
+	if t == nil {
+		writeError(w, http.StatusNotFound, "The Trade specified does not exist")
+		return
+	}
+	body := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON:"+err.Error())
+		return
+	}
+	if _, ok := body["trailingStopLoss"]; ok {
+		writeError(w, http.StatusBadRequest, "trailingStopLoss is not supported in simulator")
+		return
+	}
+
+	// 先に全てparseしてから注文を作る
+	type spec struct {
+		key, typ string
+		cancel   bool
+		price    float64
+	}
+	specs := []spec{}
+	ask, bid := s.quote()
+	for _, k := range [][2]string{{"takeProfit", "TAKE_PROFIT"}, {"stopLoss", "STOP_LOSS"}} {
+		raw, ok := body[k[0]]
+		if !ok {
+			continue
+		}
+		if string(raw) == "null" {
+			specs = append(specs, spec{key: k[0], typ: k[1], cancel: true})
+			continue
+		}
+		v := struct {
+			Price    json.Number `json:"price"`
+			Distance json.Number `json:"distance"`
+		}{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for '"+k[0]+"'")
+			return
+		}
+		price, _ := v.Price.Float64()
+		if d, _ := v.Distance.Float64(); d > 0 && k[1] == "STOP_LOSS" {
+			// distanceは現在の決済側価格から
+			if t.CurrentUnits > 0 {
+				price = bid - d
+			} else {
+				price = ask + d
+			}
+		}
+		if price <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for '"+k[0]+".price'")
+			return
+		}
+		specs = append(specs, spec{key: k[0], typ: k[1], price: price})
+	}
+
+	res := tx{}
+	ids := []string{}
+	for _, sp := range specs {
+		if sp.cancel {
+			if o, ok := s.orders[t.dependent(sp.typ)]; ok && o.State == "PENDING" {
+				c := s.cancelOrder(o, "CLIENT_REQUEST")
+				res[sp.key+"OrderCancelTransaction"] = c
+				ids = append(ids, c["id"].(string))
+			}
+			if sp.typ == "TAKE_PROFIT" {
+				t.TakeProfitID = ""
+			} else {
+				t.StopLossID = ""
+			}
+			continue
+		}
+		create, cancel := s.createDependent(sp.typ, t, sp.price, "CLIENT_ORDER", "")
+		res[sp.key+"OrderTransaction"] = create
+		ids = append(ids, create["id"].(string))
+		if cancel != nil {
+			res[sp.key+"OrderCancelTransaction"] = cancel
+			ids = append(ids, cancel["id"].(string))
+		}
+	}
+	res["relatedTransactionIDs"] = ids
+	res["lastTransactionID"] = strconv.Itoa(s.lastTxID)
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) postOrder(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Order struct {
+			Type        string      `json:"type"`
+			Instrument  string      `json:"instrument"`
+			Units       json.Number `json:"units"`
+			TimeInForce string      `json:"timeInForce"`
+			TakeProfit  *struct {
+				Price json.Number `json:"price"`
+			} `json:"takeProfitOnFill"`
+			StopLoss *struct {
+				Price    json.Number `json:"price"`
+				Distance json.Number `json:"distance"`
+			} `json:"stopLossOnFill"`
+			Trailing interface{} `json:"trailingStopLossOnFill"`
+		} `json:"order"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON:"+err.Error())
+		return
+	}
+	o := body.Order
+	if o.Type != "MARKET" {
+		writeError(w, http.StatusBadRequest, "order type not supported in simulator:"+o.Type)
+		return
+	}
+	units, err := strconv.Atoi(o.Units.String())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'units'")
+		return
+	}
+	if o.Trailing != nil {
+		writeError(w, http.StatusBadRequest, "trailingStopLossOnFill is not supported in simulator")
+		return
+	}
+	of := onFill{}
+	if o.TakeProfit != nil {
+		of.TakeProfit, _ = o.TakeProfit.Price.Float64()
+	}
+	if o.StopLoss != nil {
+		of.StopLoss, _ = o.StopLoss.Price.Float64()
+		of.StopLossDistance, _ = o.StopLoss.Distance.Float64()
+	}
+	create, fill, cancel := s.marketOrder(o.Instrument, units, o.TimeInForce, "CLIENT_ORDER", of, nil)
+	res := tx{
+		"orderCreateTransaction": create,
+		"lastTransactionID":      strconv.Itoa(s.lastTxID),
+	}
+	ids := []string{create["id"].(string)}
+	if fill != nil {
+		res["orderFillTransaction"] = fill
+		ids = append(ids, fill["id"].(string))
+	}
+	if cancel != nil {
+		res["orderCancelTransaction"] = cancel
+		ids = append(ids, cancel["id"].(string))
+	}
+	res["relatedTransactionIDs"] = ids
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request, id string) {
+	o := s.findOrder(id)
+	if o == nil {
+		writeError(w, http.StatusNotFound, "The Order specified does not exist")
+		return
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"order":             orderJSON(o),
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+func (s *Server) getOrders(w http.ResponseWriter, r *http.Request, pending bool) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	if state == "" || pending {
+		state = "PENDING"
+	}
+	count := 50
+	if c := q.Get("count"); c != "" && !pending {
+		if n, err := strconv.Atoi(c); err == nil && n > 0 {
+			count = n
+		}
+	}
+	ids := map[string]bool{}
+	for _, id := range strings.Split(q.Get("ids"), ",") {
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	before, _ := strconv.Atoi(q.Get("beforeID"))
+	inst := q.Get("instrument")
+
+	list := []*simOrder{}
+	for _, o := range s.orders {
+		if len(ids) > 0 && !ids[o.ID] {
+			continue
+		}
+		if state != "ALL" && o.State != state {
+			continue
+		}
+		if inst != "" && o.Instrument != inst {
+			continue
+		}
+		if id, _ := strconv.Atoi(o.ID); before > 0 && id >= before {
+			continue
+		}
+		list = append(list, o)
+	}
+	// idの降順
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(list[i].ID)
+		b, _ := strconv.Atoi(list[j].ID)
+		return a > b
+	})
+	if !pending && len(list) > count {
+		list = list[:count]
+	}
+	res := []tx{}
+	for _, o := range list {
+		res = append(res, orderJSON(o))
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"orders":            res,
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// 未約定の注文を置き換える。simulatorではTAKE_PROFIT,STOP_LOSSのみ対応。
+func (s *Server) replaceOrder(w http.ResponseWriter, r *http.Request, id string) {
+	o := s.findOrder(id)
+	if o == nil {
+		writeError(w, http.StatusNotFound, "The Order specified does not exist")
+		return
+	}
+	if o.State != "PENDING" {
+		writeError(w, http.StatusBadRequest, "The Order specified is not pending")
+		return
+	}
+	body := struct {
+		Order struct {
+			Type     string      `json:"type"`
+			TradeID  string      `json:"tradeID"`
+			Price    json.Number `json:"price"`
+			Distance json.Number `json:"distance"`
+		} `json:"order"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON:"+err.Error())
+		return
+	}
+	n := body.Order
+	if o.TradeID == "" || n.Type != o.Type {
+		writeError(w, http.StatusBadRequest, "replacing "+o.Type+" with "+n.Type+" is not supported in simulator")
+		return
+	}
+	t := s.findTrade(o.TradeID)
+	if t == nil || !t.open() {
+		writeError(w, http.StatusBadRequest, "The Trade specified does not exist")
+		return
+	}
+	price, _ := n.Price.Float64()
+	if d, _ := n.Distance.Float64(); d > 0 && n.Type == "STOP_LOSS" {
+		ask, bid := s.quote()
+		if t.CurrentUnits > 0 {
+			price = bid - d
+		} else {
+			price = ask + d
+		}
+	}
+	if price <= 0 {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'price'")
+		return
+	}
+	// 紐づけを置き換え対象にしてから作りなおす
+	if n.Type == "TAKE_PROFIT" {
+		t.TakeProfitID = o.ID
+	} else {
+		t.StopLossID = o.ID
+	}
+	create, cancel := s.createDependent(n.Type, t, price, "REPLACEMENT", "")
+	writeJSON(w, http.StatusCreated, tx{
+		"orderCancelTransaction": cancel,
+		"orderCreateTransaction": create,
+		"relatedTransactionIDs":  []string{create["id"].(string), cancel["id"].(string)},
+		"lastTransactionID":      strconv.Itoa(s.lastTxID),
+	})
+}
+
+func (s *Server) putCancelOrder(w http.ResponseWriter, r *http.Request, id string) {
+	o := s.findOrder(id)
+	if o == nil {
+		writeError(w, http.StatusNotFound, "The Order specified does not exist")
+		return
+	}
+	if o.State != "PENDING" {
+		writeError(w, http.StatusNotFound, "The Order specified is not pending")
+		return
+	}
+	cancel := s.cancelPending(o, "CLIENT_REQUEST")
+	writeJSON(w, http.StatusOK, tx{
+		"orderCancelTransaction": cancel,
+		"relatedTransactionIDs":  []string{cancel["id"].(string)},
+		"lastTransactionID":      strconv.Itoa(s.lastTxID),
+	})
+}
+
+func (s *Server) putOrderClientExtensions(w http.ResponseWriter, r *http.Request, id string) {
+	o := s.findOrder(id)
+	if o == nil {
+		writeError(w, http.StatusNotFound, "The Order specified does not exist")
+		return
+	}
+	body := struct {
+		Ext      tx `json:"clientExtensions"`
+		TradeExt tx `json:"tradeClientExtensions"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON:"+err.Error())
+		return
+	}
+	m := tx{"type": "ORDER_CLIENT_EXTENSIONS_MODIFY", "orderID": o.ID}
+	if o.Ext != nil {
+		m["clientOrderID"] = o.Ext["id"]
+	}
+	if body.Ext != nil {
+		o.Ext = body.Ext
+		m["clientExtensionsModify"] = body.Ext
+	}
+	if body.TradeExt != nil {
+		o.TradeExt = body.TradeExt
+		m["tradeClientExtensionsModify"] = body.TradeExt
+	}
+	s.record(m)
+	writeJSON(w, http.StatusOK, tx{
+		"orderClientExtensionsModifyTransaction": m,
+		"relatedTransactionIDs":                  []string{m["id"].(string)},
+		"lastTransactionID":                      strconv.Itoa(s.lastTxID),
+	})
+}
+
+func orderJSON(o *simOrder) tx {
+	d := tx{
+		"id":          o.ID,
+		"type":        o.Type,
+		"instrument":  o.Instrument,
+		"units":       strconv.Itoa(o.Units),
+		"timeInForce": o.Tif,
+		"createTime":  oanda.FormatTime(o.CreateTime),
+		"state":       o.State,
+	}
+	if o.TradeID != "" {
+		d["tradeID"] = o.TradeID
+		d["price"] = fstr(o.Price)
+		delete(d, "instrument")
+		delete(d, "units")
+	}
+	if o.FillTxID != "" {
+		d["fillingTransactionID"] = o.FillTxID
+	}
+	if o.CancelTxID != "" {
+		d["cancellingTransactionID"] = o.CancelTxID
+	}
+	if o.TradeOpened != "" {
+		d["tradeOpenedID"] = o.TradeOpened
+	}
+	if len(o.TradeClosed) > 0 {
+		d["tradeClosedIDs"] = o.TradeClosed
+	}
+	if o.ReplacesID != "" {
+		d["replacesOrderID"] = o.ReplacesID
+	}
+	if o.ReplacedByID != "" {
+		d["replacedByOrderID"] = o.ReplacedByID
+	}
+	if o.Ext != nil {
+		d["clientExtensions"] = o.Ext
+	}
+	if o.TradeExt != nil {
+		d["tradeClientExtensions"] = o.TradeExt
+	}
+	return d
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, tx{"errorMessage": msg})
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, fmt.Sprintf("%v %v is not supported in simulator", r.Method, r.URL.Path))
+}
+
+// "USD_JPY" -> "JPY"
+func quoteCurrency(instrument string) string {
+	if i := strings.Index(instrument, "_"); i >= 0 {
+		return instrument[i+1:]
+	}
+	return instrument
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,171 @@
+/*
+ * Oanda v20 REST APIの一部を再現するローカルsimulator。
+ * ロウソク足ファイルを再生し、MARKET注文をspread込みで約定させる。
+ * 利確・損切注文は、時刻を進めた時に確定したロウソク足の高値・安値で約定判定する。
+ * botの結合テストや長期間の動作確認用。口座通貨はInstrumentのquote通貨と同じと仮定する。
+ */
+
+package sim
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+type (
+	Config struct {
+		AccountID   string
+		Instrument  string  // "USD_JPY"等。1通貨のみ対応
+		Granularity string  // ロウソク足ファイルの足。"M5"等
+		Spread      float64 // ask-bid。midの上下に半分ずつ乗せる
+		Balance     float64 // 初期残高
+		MarginRate  float64 // 必要証拠金率。0なら0.04
+		Warmup      int     // 開始時点で確定済みとして扱う足の数。botのSpan分以上にしておく
+		Candles     []Candle
+	}
+
+	// simulator本体。http.Handlerとして/v3以下のendpointを提供する。
+	Server struct {
+		mu   sync.Mutex
+		cfg  Config
+		gran time.Duration
+		now  time.Time
+
+		balance  float64
+		pl       float64 // 累計実現損益
+		lastTxID int
+
+		trades       []*simTrade
+		orders       map[string]*simOrder
+		transactions []tx
+	}
+)
+
+// simulatorを生成する。時刻はcfg.Warmup本目のロウソク足が確定した時点から始まる。
+func New(cfg Config) (*Server, error) {
+	if len(cfg.Candles) == 0 {
+		return nil, errors.New("sim: no candles")
+	}
+	g, err := oanda.ParseGranularity(cfg.Granularity)
+	if err != nil {
+		return nil, errors.New("sim: unsupported granularity:" + cfg.Granularity)
+	}
+	gran := g.Duration()
+	if cfg.MarginRate == 0 {
+		cfg.MarginRate = 0.04
+	}
+	if cfg.Warmup < 1 {
+		cfg.Warmup = 1
+	}
+	if cfg.Warmup > len(cfg.Candles) {
+		return nil, errors.New("sim: warmup exceeds candles")
+	}
+	if cfg.AccountID == "" {
+		cfg.AccountID = "001-001-0000001-001"
+	}
+	return &Server{
+		cfg:     cfg,
+		gran:    gran,
+		now:     cfg.Candles[cfg.Warmup-1].Time.Add(gran),
+		balance: cfg.Balance,
+		orders:  map[string]*simOrder{},
+	}, nil
+}
+
+// simulator上の現在時刻
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// 口座残高
+func (s *Server) Balance() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.balance
+}
+
+// 時刻をdだけ進める。ロウソク足の終わりを超える場合はfalseを返し、時刻は進めない。
+func (s *Server) Advance(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.advanceTo(s.now.Add(d))
+}
+
+// 時刻を1足分進める。
+func (s *Server) Step() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.advanceTo(s.now.Add(s.gran))
+}
+
+// bot側のtick()と同様に、次のitvの倍数の時刻まで進める。
+func (s *Server) Tick(itv time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.now.Truncate(itv).Add(itv)
+	return s.advanceTo(next)
+}
+
+// 時刻をtまで進める。間に確定したロウソク足の値動きで利確・損切注文を約定させる。
+func (s *Server) advanceTo(t time.Time) bool {
+	last := s.cfg.Candles[len(s.cfg.Candles)-1].Time.Add(s.gran)
+	if t.After(last) {
+		return false
+	}
+	cs := s.cfg.Candles
+	for i := s.current(); i < len(cs) && cs[i].Time.Before(t); i++ {
+		c := cs[i]
+		end := c.Time.Add(s.gran)
+		if !end.After(s.now) || end.After(t) {
+			continue
+		}
+		// 約定時刻は足の確定時刻とする
+		s.now = end
+		s.triggerOrders(c)
+	}
+	s.now = t
+	return true
+}
+
+// 現在時刻時点で形成中のロウソク足のindex。
+// 形成中の足が無い（データの隙間、週末等）場合は直前の足。
+func (s *Server) current() int {
+	cs := s.cfg.Candles
+	// s.nowより後に始まる最初の足の1つ前
+	i := sort.Search(len(cs), func(i int) bool { return cs[i].Time.After(s.now) })
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// 現在のmid価格。形成中の足の始値、足が確定済みなら終値。
+func (s *Server) mid() float64 {
+	c := s.cfg.Candles[s.current()]
+	if !c.Time.Add(s.gran).After(s.now) {
+		return c.C
+	}
+	return c.O
+}
+
+// 現在のask,bid
+func (s *Server) quote() (float64, float64) {
+	m := s.mid()
+	return m + s.cfg.Spread/2, m - s.cfg.Spread/2
+}
+
+// 未実現損益の合計
+func (s *Server) unrealizedPL() float64 {
+	ask, bid := s.quote()
+	upl := 0.0
+	for _, t := range s.openTrades() {
+		upl += t.unrealizedPL(ask, bid)
+	}
+	return upl
+}
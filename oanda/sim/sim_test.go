@@ -0,0 +1,398 @@
+package sim
+
+import (
+	"context"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// n本のH1足。i本目はo=100+i,c=o+0.5
+func testCandles(n int) []Candle {
+	cs := make([]Candle, n)
+	for i := range cs {
+		o := 100 + float64(i)
+		cs[i] = Candle{Time: start.Add(time.Duration(i) * time.Hour), O: o, H: o + 1, L: o - 1, C: o + 0.5}
+	}
+	return cs
+}
+
+func newTestServer(t *testing.T, cs []Candle) *Server {
+	t.Helper()
+	s, err := New(Config{
+		Instrument:  "USD_JPY",
+		Granularity: "H1",
+		Spread:      0.02,
+		Balance:     1000000,
+		Warmup:      2,
+		Candles:     cs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Config{Granularity: "H1"}); err == nil {
+		t.Error("no candles: want error")
+	}
+	if _, err := New(Config{Granularity: "X1", Candles: testCandles(1)}); err == nil {
+		t.Error("bad granularity: want error")
+	}
+	if _, err := New(Config{Granularity: "H1", Warmup: 3, Candles: testCandles(2)}); err == nil {
+		t.Error("warmup > candles: want error")
+	}
+	s := newTestServer(t, testCandles(5))
+	// 2本目が確定した時点から始まる
+	if want := start.Add(2 * time.Hour); !s.Now().Equal(want) {
+		t.Errorf("now = %v, want %v", s.Now(), want)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	s := newTestServer(t, testCandles(4))
+	// 3本目が形成中。midは始値
+	if m := s.mid(); m != 102 {
+		t.Errorf("mid = %v, want 102", m)
+	}
+	if !s.Advance(30 * time.Minute) {
+		t.Fatal("Advance: want true")
+	}
+	if m := s.mid(); m != 102 {
+		t.Errorf("mid in the middle of candle = %v, want 102", m)
+	}
+	if !s.Tick(time.Hour) {
+		t.Fatal("Tick: want true")
+	}
+	if want := start.Add(3 * time.Hour); !s.Now().Equal(want) {
+		t.Errorf("Tick: now = %v, want %v", s.Now(), want)
+	}
+	// 最後の足が確定するまでは進める。確定後はclose
+	if !s.Step() {
+		t.Fatal("Step to the end: want true")
+	}
+	if m := s.mid(); m != 103.5 {
+		t.Errorf("mid after last candle = %v, want 103.5", m)
+	}
+	if s.Step() {
+		t.Error("Step past the end: want false")
+	}
+	if want := start.Add(4 * time.Hour); !s.Now().Equal(want) {
+		t.Errorf("now after failed Step = %v, want %v", s.Now(), want)
+	}
+}
+
+func TestMarketOrderFill(t *testing.T) {
+	s := newTestServer(t, testCandles(4))
+	ask, bid := s.quote()
+	if !near(ask, 102.01) || !near(bid, 101.99) {
+		t.Fatalf("quote = %v,%v", ask, bid)
+	}
+
+	_, fill, cancel := s.marketOrder("USD_JPY", 100, "", "CLIENT_ORDER", onFill{}, nil)
+	if fill == nil || cancel != nil {
+		t.Fatalf("buy: fill=%v cancel=%v", fill, cancel)
+	}
+	if fill["price"] != "102.01" {
+		t.Errorf("buy price = %v, want ask", fill["price"])
+	}
+	if fill["halfSpreadCost"] != "1" {
+		t.Errorf("halfSpreadCost = %v, want 1", fill["halfSpreadCost"])
+	}
+	if _, ok := fill["tradeOpened"]; !ok {
+		t.Error("buy: tradeOpened missing")
+	}
+
+	_, fill, _ = s.marketOrder("USD_JPY", -100, "", "CLIENT_ORDER", onFill{}, nil)
+	if fill["price"] != "101.99" {
+		t.Errorf("sell price = %v, want bid", fill["price"])
+	}
+	if _, ok := fill["tradeOpened"]; ok {
+		t.Error("sell: should only close the long trade")
+	}
+
+	// instrument違い、units0はcancel
+	for _, c := range []struct {
+		inst  string
+		units int
+	}{{"EUR_USD", 100}, {"USD_JPY", 0}} {
+		_, fill, cancel := s.marketOrder(c.inst, c.units, "", "CLIENT_ORDER", onFill{}, nil)
+		if fill != nil || cancel == nil {
+			t.Errorf("%v %v: want cancel", c.inst, c.units)
+		}
+	}
+}
+
+func TestMarketOrderNetting(t *testing.T) {
+	s := newTestServer(t, testCandles(6))
+	s.marketOrder("USD_JPY", 100, "", "CLIENT_ORDER", onFill{}, nil) // 102.01
+	s.Step()
+	s.marketOrder("USD_JPY", 50, "", "CLIENT_ORDER", onFill{}, nil) // 103.01
+	s.Step()
+
+	// 先に建てた100から決済し、次の50の内20を決済。
+	_, fill, _ := s.marketOrder("USD_JPY", -120, "", "CLIENT_ORDER", onFill{}, nil) // 103.99
+	closed := fill["tradesClosed"].([]tx)
+	if len(closed) != 2 {
+		t.Fatalf("tradesClosed = %v", closed)
+	}
+	if closed[0]["units"] != "-100" || closed[1]["units"] != "-20" {
+		t.Errorf("closed units = %v,%v", closed[0]["units"], closed[1]["units"])
+	}
+	open := s.openTrades()
+	if len(open) != 1 || open[0].CurrentUnits != 30 {
+		t.Fatalf("open trades = %+v", open)
+	}
+
+	// 残り30を超えて売ると、差分でshortを建てる
+	_, fill, _ = s.marketOrder("USD_JPY", -80, "", "CLIENT_ORDER", onFill{}, nil)
+	opened, ok := fill["tradeOpened"].(tx)
+	if !ok || opened["units"] != "-50" {
+		t.Errorf("tradeOpened = %v, want -50", fill["tradeOpened"])
+	}
+	open = s.openTrades()
+	if len(open) != 1 || open[0].CurrentUnits != -50 {
+		t.Errorf("open trades = %+v", open)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	s := newTestServer(t, testCandles(6))
+	s.marketOrder("USD_JPY", 1000, "", "CLIENT_ORDER", onFill{}, nil) // ask 102.01
+	s.Step()
+	// 現在mid 103。bidで評価
+	if upl := s.unrealizedPL(); !near(upl, (102.99-102.01)*1000) {
+		t.Errorf("unrealizedPL = %v", upl)
+	}
+
+	_, fill, _ := s.marketOrder("USD_JPY", -400, "", "CLIENT_ORDER", onFill{}, nil)
+	pl := (102.99 - 102.01) * 400
+	if !near(s.balance, 1000000+pl) || !near(s.pl, pl) {
+		t.Errorf("balance = %v, pl = %v, want pl %v", s.balance, s.pl, pl)
+	}
+	if fill["accountBalance"] != fstr(1000000+pl) {
+		t.Errorf("accountBalance = %v", fill["accountBalance"])
+	}
+
+	s.Step()
+	// 残りのlongもbidで決済
+	s.marketOrder("USD_JPY", -600, "", "CLIENT_ORDER", onFill{}, nil)
+	pl += (103.99 - 102.01) * 600
+	if !near(s.Balance(), 1000000+pl) {
+		t.Errorf("balance = %v, want %v", s.Balance(), 1000000+pl)
+	}
+	tr := s.trades[0]
+	if tr.open() || !near(tr.RealizedPL, pl) || !near(tr.AverageClose, (102.99*400+103.99*600)/1000) {
+		t.Errorf("trade = %+v", tr)
+	}
+	if upl := s.unrealizedPL(); upl != 0 {
+		t.Errorf("unrealizedPL after close = %v", upl)
+	}
+}
+
+func TestRemoteClock(t *testing.T) {
+	s := newTestServer(t, testCandles(4))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := NewRemoteClock(ts.URL + "/")
+	if now := c.Now(); !now.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("Now = %v", now)
+	}
+	ctx := context.Background()
+	if !c.Tick(ctx, "H1") || !c.Tick(ctx, "H1") {
+		t.Fatal("Tick: want true")
+	}
+	if now := c.Now(); !now.Equal(start.Add(4 * time.Hour)) {
+		t.Errorf("Now after Tick = %v", now)
+	}
+	// データが尽きたらfalse
+	if c.Tick(ctx, "H1") {
+		t.Error("Tick past the end: want false")
+	}
+}
+
+// H4の足はoandaの区切り(冬時間は22時UTC)で確定する
+func TestRemoteClockAlignment(t *testing.T) {
+	// 2024-01-01 22:00 UTCから4時間ごと
+	first := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC)
+	cs := []Candle{}
+	for i := 0; i < 4; i++ {
+		cs = append(cs, Candle{Time: first.Add(time.Duration(i) * 4 * time.Hour), O: 100, H: 101, L: 99, C: 100})
+	}
+	s, err := New(Config{Instrument: "USD_JPY", Granularity: "H4", Spread: 0.02, Balance: 1000000, Warmup: 1, Candles: cs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := NewRemoteClock(ts.URL)
+	ctx := context.Background()
+	// unix時間の区切りなら04:00,08:00になる
+	for _, want := range []time.Time{first.Add(8 * time.Hour), first.Add(12 * time.Hour)} {
+		if !c.Tick(ctx, "H4") {
+			t.Fatal("Tick: want true")
+		}
+		if now := c.Now(); !now.Equal(want) {
+			t.Errorf("Now = %v, want %v", now, want)
+		}
+	}
+}
+
+// 始値o,高値h,安値lの足を1時間ごとに並べる
+func ohlCandles(ohl ...[3]float64) []Candle {
+	cs := []Candle{}
+	for i, v := range ohl {
+		cs = append(cs, Candle{Time: start.Add(time.Duration(i) * time.Hour), O: v[0], H: v[1], L: v[2], C: v[0]})
+	}
+	return cs
+}
+
+func TestTakeProfitStopLoss(t *testing.T) {
+	tests := []struct {
+		name   string
+		units  int
+		of     onFill
+		next   [3]float64 // 約定後の足のo,h,l
+		reason string     // 決済したorderのtype。空なら決済されない
+		price  float64    // 決済価格
+	}{
+		// longは100.01で約定し、bid(mid-0.01)で判定
+		{"long tp", 100, onFill{TakeProfit: 101, StopLoss: 99}, [3]float64{100, 101.5, 99.5}, "TAKE_PROFIT_ORDER", 101},
+		{"long sl", 100, onFill{TakeProfit: 101, StopLoss: 99}, [3]float64{100, 100.5, 98.5}, "STOP_LOSS_ORDER", 99},
+		{"long both", 100, onFill{TakeProfit: 101, StopLoss: 99}, [3]float64{100, 102, 98}, "STOP_LOSS_ORDER", 99},
+		{"long gap", 100, onFill{TakeProfit: 101, StopLoss: 99}, [3]float64{97, 97.5, 96}, "STOP_LOSS_ORDER", 96.99},
+		{"long untouched", 100, onFill{TakeProfit: 101, StopLoss: 99}, [3]float64{100, 101, 99.02}, "", 0},
+		{"long distance", 100, onFill{StopLossDistance: 0.5}, [3]float64{100, 100.2, 99.5}, "STOP_LOSS_ORDER", 99.51},
+		// shortは99.99で約定し、ask(mid+0.01)で判定
+		{"short tp", -100, onFill{TakeProfit: 99, StopLoss: 101}, [3]float64{100, 100.5, 98.5}, "TAKE_PROFIT_ORDER", 99},
+		{"short sl", -100, onFill{TakeProfit: 99, StopLoss: 101}, [3]float64{100, 101, 99.5}, "STOP_LOSS_ORDER", 101},
+		{"short gap", -100, onFill{TakeProfit: 99, StopLoss: 101}, [3]float64{98, 98.5, 97.5}, "TAKE_PROFIT_ORDER", 98.01},
+	}
+	for _, tt := range tests {
+		flat := [3]float64{100, 100, 100}
+		s := newTestServer(t, ohlCandles(flat, flat, flat, tt.next))
+		_, fill, _ := s.marketOrder("USD_JPY", tt.units, "", "CLIENT_ORDER", tt.of, nil)
+		if fill == nil {
+			t.Fatalf("%v: not filled", tt.name)
+		}
+		tr := s.trades[0]
+		if tr.TakeProfitID == "" && tt.of.TakeProfit != 0 || tr.StopLossID == "" {
+			t.Fatalf("%v: dependent orders not created: %+v", tt.name, tr)
+		}
+		entry := tr.Price
+		s.Step()
+		s.Step()
+
+		if tt.reason == "" {
+			if !tr.open() {
+				t.Errorf("%v: closed at %v", tt.name, tr.AverageClose)
+			}
+			continue
+		}
+		if tr.open() || !near(tr.AverageClose, tt.price) {
+			t.Errorf("%v: trade = %+v, want closed at %v", tt.name, tr, tt.price)
+			continue
+		}
+		if want := (tt.price - entry) * float64(tt.units); !near(s.Balance()-1000000, want) {
+			t.Errorf("%v: pl = %v, want %v", tt.name, s.Balance()-1000000, want)
+		}
+		filled := false
+		for _, x := range s.transactions {
+			filled = filled || (x["type"] == "ORDER_FILL" && x["reason"] == tt.reason)
+		}
+		if !filled {
+			t.Errorf("%v: no %v fill", tt.name, tt.reason)
+		}
+		// 残った方の注文はキャンセルされる
+		for _, id := range []string{tr.TakeProfitID, tr.StopLossID} {
+			if id != "" {
+				t.Errorf("%v: dependent %v remains", tt.name, id)
+			}
+		}
+		pending := 0
+		for _, o := range s.orders {
+			if o.State == "PENDING" {
+				pending++
+			}
+		}
+		if pending != 0 {
+			t.Errorf("%v: %v pending orders after close", tt.name, pending)
+		}
+	}
+}
+
+// 約定価格に対して逆側の利確・損切は注文ごとキャンセル
+func TestOnFillLoss(t *testing.T) {
+	s := newTestServer(t, testCandles(4)) // ask 102.01
+	_, fill, cancel := s.marketOrder("USD_JPY", 100, "", "CLIENT_ORDER", onFill{TakeProfit: 102}, nil)
+	if fill != nil || cancel == nil || cancel["reason"] != "TAKE_PROFIT_ON_FILL_LOSS" {
+		t.Errorf("tp: fill=%v cancel=%v", fill, cancel)
+	}
+	_, fill, cancel = s.marketOrder("USD_JPY", -100, "", "CLIENT_ORDER", onFill{StopLoss: 101.9}, nil)
+	if fill != nil || cancel == nil || cancel["reason"] != "STOP_LOSS_ON_FILL_LOSS" {
+		t.Errorf("sl: fill=%v cancel=%v", fill, cancel)
+	}
+	if len(s.trades) != 0 || s.Balance() != 1000000 {
+		t.Errorf("trades = %v, balance = %v", len(s.trades), s.Balance())
+	}
+}
+
+// 成行きで決済した場合も紐づく注文はキャンセルされる
+func TestCloseCancelsDependents(t *testing.T) {
+	s := newTestServer(t, testCandles(4))
+	s.marketOrder("USD_JPY", 100, "", "CLIENT_ORDER", onFill{TakeProfit: 110, StopLoss: 90}, nil)
+	tr := s.trades[0]
+	tp, sl := s.orders[tr.TakeProfitID], s.orders[tr.StopLossID]
+	s.marketOrder("USD_JPY", -100, "", "CLIENT_ORDER", onFill{}, nil)
+	if tp.State != "CANCELLED" || sl.State != "CANCELLED" {
+		t.Errorf("tp = %v, sl = %v", tp.State, sl.State)
+	}
+}
+
+// bid,askはmidからspreadの半分ずつずらす。形成中の足は始値のみ
+func TestCandlesPrice(t *testing.T) {
+	srv := newTestServer(t, testCandles(4))
+	srv.Advance(30 * time.Minute)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey("acc", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := oanda.NewCandles(goq, 10, "H1", "USD_JPY", "", "", "MBA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sticks := res.Sticks()
+	if len(sticks) != 3 || sticks[2].Complete {
+		t.Fatalf("sticks = %+v", sticks)
+	}
+	for i, s := range sticks {
+		if !near(s.Bid.H, s.Mid.H-0.01) || !near(s.Ask.L, s.Mid.L+0.01) {
+			t.Errorf("%v: mid %+v bid %+v ask %+v", i, s.Mid, s.Bid, s.Ask)
+		}
+	}
+	if f := sticks[2].Ask; !near(f.O, 102.01) || !near(f.H, 102.01) || !near(f.C, 102.01) {
+		t.Errorf("forming ask = %+v", f)
+	}
+
+	res, err = oanda.NewCandles(goq, 10, "H1", "USD_JPY", "", "", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := res.Sticks(); s[0].Mid != nil || s[0].Ask != nil || s[0].Bid == nil {
+		t.Errorf("B only = %+v", s[0])
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * simulatorのstreaming endpoint
+ */
+
+package sim
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// streamの更新確認間隔とHEARTBEAT間隔(実時間)
+var (
+	streamPoll      = 100 * time.Millisecond
+	streamHeartbeat = 5 * time.Second
+)
+
+// GET /v3/accounts/{id}/pricing/stream
+// GET /v3/accounts/{id}/transactions/stream
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request, account, kind string) {
+	if account != s.cfg.AccountID {
+		s.mu.Lock()
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'accountID'")
+		s.mu.Unlock()
+		return
+	}
+	switch kind {
+	case "pricing":
+		s.streamPricing(w, r)
+	case "transactions":
+		s.streamTransactions(w, r)
+	default:
+		notFound(w, r)
+	}
+}
+
+// 時刻が進む度に価格を流す
+func (s *Server) streamPricing(w http.ResponseWriter, r *http.Request) {
+	insts := strings.Split(r.URL.Query().Get("instruments"), ",")
+	subscribed := false
+	for _, inst := range insts {
+		subscribed = subscribed || inst == s.cfg.Instrument
+	}
+	last := time.Time{}
+	s.streamLines(w, r, func() tx {
+		if !subscribed || !s.now.After(last) {
+			return nil
+		}
+		last = s.now
+		return s.price()
+	})
+}
+
+// 接続後に発生したtransactionを流す
+func (s *Server) streamTransactions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cursor := len(s.transactions)
+	s.mu.Unlock()
+	s.streamLines(w, r, func() tx {
+		if cursor >= len(s.transactions) {
+			return nil
+		}
+		t := s.transactions[cursor]
+		cursor++
+		return t
+	})
+}
+
+// 1行1jsonのstreamを返す。nextはlock中に呼ばれ、次に送るデータを返す。無ければnil。
+func (s *Server) streamLines(w http.ResponseWriter, r *http.Request, next func() tx) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	poll := time.NewTicker(streamPoll)
+	defer poll.Stop()
+	hb := time.NewTicker(streamHeartbeat)
+	defer hb.Stop()
+
+	heartbeat := func() bool {
+		s.mu.Lock()
+		line := tx{"type": "HEARTBEAT", "time": oanda.FormatTime(s.now), "lastTransactionID": strconv.Itoa(s.lastTxID)}
+		s.mu.Unlock()
+		if enc.Encode(line) != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	// 接続直後に1回送る
+	if !heartbeat() {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-hb.C:
+			if !heartbeat() {
+				return
+			}
+		case <-poll.C:
+			// 溜まっている分はまとめて流す
+			s.mu.Lock()
+			lines := []tx{}
+			for line := next(); line != nil; line = next() {
+				lines = append(lines, line)
+			}
+			s.mu.Unlock()
+			for _, line := range lines {
+				if enc.Encode(line) != nil {
+					return
+				}
+			}
+			if len(lines) > 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * transaction履歴のendpoint。typeのfilterは"ORDER_FILL"等の完全一致のみ対応。
+ */
+
+package sim
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// GET /v3/accounts/{id}/transactions
+func (s *Server) getTransactionPages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to := time.Time{}, s.now
+	for _, p := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.key); v != "" {
+			t, err := oanda.ParseTime(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid value specified for '%v'", p.key))
+				return
+			}
+			*p.t = t
+		}
+	}
+	size := 100
+	if v := q.Get("pageSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "Invalid value specified for 'pageSize'")
+			return
+		}
+		size = n
+	}
+	types := newTypeFilter(q.Get("type"))
+
+	ids := []string{}
+	for _, t := range s.transactions {
+		tm, _ := oanda.ParseTime(t["time"].(string))
+		if tm.Before(from) || tm.After(to) || !types.match(t) {
+			continue
+		}
+		ids = append(ids, t["id"].(string))
+	}
+	pages := []string{}
+	for i := 0; i < len(ids); i += size {
+		j := i + size
+		if j > len(ids) {
+			j = len(ids)
+		}
+		p := url.Values{"from": {ids[i]}, "to": {ids[j-1]}}
+		if v := q.Get("type"); v != "" {
+			p.Set("type", v)
+		}
+		pages = append(pages, fmt.Sprintf("http://%v/v3/accounts/%v/transactions/idrange?%v", r.Host, s.cfg.AccountID, p.Encode()))
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"from":              oanda.FormatTime(from),
+		"to":                oanda.FormatTime(to),
+		"pageSize":          size,
+		"type":              types.list(),
+		"count":             len(ids),
+		"pages":             pages,
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// GET /v3/accounts/{id}/transactions/idrange
+func (s *Server) getTransactionRange(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err1 := strconv.Atoi(q.Get("from"))
+	to, err2 := strconv.Atoi(q.Get("to"))
+	if err1 != nil || err2 != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'from' or 'to'")
+		return
+	}
+	s.writeTransactions(w, from, to, newTypeFilter(q.Get("type")))
+}
+
+// GET /v3/accounts/{id}/transactions/sinceid
+func (s *Server) getTransactionsSince(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid value specified for 'id'")
+		return
+	}
+	s.writeTransactions(w, id+1, s.lastTxID, nil)
+}
+
+// GET /v3/accounts/{id}/transactions/{transactionID}
+func (s *Server) getTransaction(w http.ResponseWriter, r *http.Request, id string) {
+	for _, t := range s.transactions {
+		if t["id"] == id {
+			writeJSON(w, http.StatusOK, tx{
+				"transaction":       t,
+				"lastTransactionID": strconv.Itoa(s.lastTxID),
+			})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "The Transaction specified does not exist")
+}
+
+// idがfromからtoまで(両端含む)のtransactionを返す
+func (s *Server) writeTransactions(w http.ResponseWriter, from, to int, types typeFilter) {
+	list := []tx{}
+	for _, t := range s.transactions {
+		id, _ := strconv.Atoi(t["id"].(string))
+		if id < from || id > to || !types.match(t) {
+			continue
+		}
+		list = append(list, t)
+	}
+	writeJSON(w, http.StatusOK, tx{
+		"transactions":      list,
+		"lastTransactionID": strconv.Itoa(s.lastTxID),
+	})
+}
+
+// "ORDER_FILL,ORDER_CANCEL" -> set。空なら全て一致
+type typeFilter map[string]bool
+
+func newTypeFilter(v string) typeFilter {
+	f := typeFilter{}
+	for _, t := range strings.Split(v, ",") {
+		if t != "" {
+			f[t] = true
+		}
+	}
+	return f
+}
+
+func (f typeFilter) match(t tx) bool {
+	if len(f) == 0 {
+		return true
+	}
+	typ, _ := t["type"].(string)
+	return f[typ]
+}
+
+func (f typeFilter) list() []string {
+	l := []string{}
+	for t := range f {
+		l = append(l, t)
+	}
+	sort.Strings(l)
+	return l
+}
@@ -0,0 +1,180 @@
+/*
+ * streaming endpointのclient。
+ * 1行1jsonで返ってくるchunked responseを読み、切断時はbackoffしながら再接続する。
+ */
+
+package oanda
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// この時間データ(HEARTBEAT含む)が来なければ切断されたとみなして再接続する。
+// Oandaは5秒ごとにHEARTBEATを送ってくる。
+var STREAM_TIMEOUT = 20 * time.Second
+
+type (
+	// PricingStreamで流れてくるHEARTBEAT
+	PricingHeartbeat struct {
+		Type string `json:"type"`
+		Time string `json:"time"`
+	}
+
+	// 価格のstream。
+	// GET: v3/accounts/{accountID}/pricing/stream
+	PricingStream struct {
+		// 価格。ctxがキャンセルされるとcloseされる。
+		C <-chan Price
+		// 接続エラー。再接続は自動で行うので、ログ用。読まなくても詰まらない。
+		Errors <-chan error
+	}
+)
+
+// 価格のstreamを開始する。instruments:"USD_JPY,EUR_USD"のように複数指定可能。
+// 切断された場合はgoq.Retryのbackoffで再接続し続ける。ctxをキャンセルすると終了する。
+func NewPricingStream(ctx context.Context, goq *Goquest, instruments string) *PricingStream {
+	prices := make(chan Price, 64)
+	errs := make(chan error, 8)
+	ep := "/accounts/" + goq.Auth.Id + "/pricing/stream"
+	param := strMap{"instruments": instruments}
+
+	go func() {
+		defer close(prices)
+		goq.streamLoop(ctx, ep, param, errs, func(b []byte) error {
+			head := struct {
+				Type string `json:"type"`
+			}{}
+			if err := json.Unmarshal(b, &head); err != nil {
+				return err
+			}
+			if head.Type == "HEARTBEAT" {
+				return nil
+			}
+			p := Price{}
+			if err := json.Unmarshal(b, &p); err != nil {
+				return err
+			}
+			select {
+			case prices <- p:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+	return &PricingStream{C: prices, Errors: errs}
+}
+
+// ctxがキャンセルされるまで、接続->読み込み->切断->backoff->再接続を繰り返す。
+// 接続エラーはerrsに送る(一杯なら捨てる)。
+func (goq *Goquest) streamLoop(ctx context.Context, ep string, param strMap, errs chan<- error, onLine func([]byte) error) {
+	policy := goq.Retry
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	attempt := 0
+	for {
+		received, err := goq.stream(ctx, ep, param, onLine)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+		// データを受信できていた場合はbackoffをリセット
+		if received {
+			attempt = 0
+		}
+		attempt++
+		if sleepContext(ctx, policy.backoff(attempt)) != nil {
+			return
+		}
+	}
+}
+
+// streamに1回接続し、切断されるまで1行ずつonLineに渡す。
+// 1行でも受信できたらreceived=true。
+func (goq *Goquest) stream(ctx context.Context, ep string, param strMap, onLine func([]byte) error) (bool, error) {
+	uri := goq.genStreamUrl(ep, param)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return false, err
+	}
+	goq.auth(req)
+	if err := goq.Limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+
+	res, err := goq.Client.Do(req)
+	if err != nil {
+		return false, &TransportError{Method: "GET", Url: uri, Err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b := make([]byte, 4096)
+		n, _ := res.Body.Read(b)
+		return false, newStatusError("GET", uri, res.StatusCode, res.Header, b[:n])
+	}
+
+	// STREAM_TIMEOUTの間何も来なければ切断
+	timeout := STREAM_TIMEOUT
+	alive := make(chan struct{}, 1)
+	go func() {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-alive:
+				if !t.Stop() {
+					<-t.C
+				}
+				t.Reset(timeout)
+			case <-t.C:
+				cancel()
+				return
+			}
+		}
+	}()
+
+	received := false
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		received = true
+		select {
+		case alive <- struct{}{}:
+		default:
+		}
+		if err := onLine(line); err != nil {
+			return received, &DecodeError{Url: uri, Body: append([]byte{}, line...), Err: err}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return received, &TransportError{Method: "GET", Url: uri, Err: err}
+	}
+	return received, &TransportError{Method: "GET", Url: uri, Err: errors.New("stream closed")}
+}
+
+// streaming用のフルurlを返す
+func (g *Goquest) genStreamUrl(ep string, param strMap) string {
+	u := g.genUrl(ep, param)
+	return fmt.Sprintf("%v%v", g.streamUrl, u[len(g.url):])
+}
@@ -0,0 +1,218 @@
+package oanda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPrice = `{"type":"PRICE","instrument":"USD_JPY","time":"2024-01-01T00:00:00.000000000Z","tradeable":true,` +
+	`"bids":[{"price":"149.99","liquidity":1000000}],"asks":[{"price":"150.01","liquidity":1000000}]}`
+
+const testHeartbeat = `{"type":"HEARTBEAT","time":"2024-01-01T00:00:00.000000000Z"}`
+
+// 接続毎にhandlersを順に使うstream server。使い切ったら最後のhandlerを使い続ける。
+type streamServer struct {
+	mu       sync.Mutex
+	handlers []func(w http.ResponseWriter, r *http.Request)
+	conns    []time.Time
+}
+
+func (s *streamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	i := len(s.conns)
+	s.conns = append(s.conns, time.Now())
+	if i >= len(s.handlers) {
+		i = len(s.handlers) - 1
+	}
+	h := s.handlers[i]
+	s.mu.Unlock()
+	h(w, r)
+}
+
+func (s *streamServer) connTimes() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time{}, s.conns...)
+}
+
+// linesを送った後、切断されるまで待つhandler
+func sendLines(lines ...string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}
+}
+
+func newStreamClient(t *testing.T, s *streamServer) *Goquest {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	goq, err := NewClient(
+		WithBaseURL(ts.URL),
+		WithKey("acc", "token"),
+		WithRetry(&RetryPolicy{BaseDelay: 20 * time.Millisecond, MaxDelay: 80 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goq
+}
+
+func setStreamTimeout(t *testing.T, d time.Duration) {
+	old := STREAM_TIMEOUT
+	STREAM_TIMEOUT = d
+	t.Cleanup(func() { STREAM_TIMEOUT = old })
+}
+
+// ctxをキャンセルし、streamが終了するまで待つ
+func closeStream(cancel context.CancelFunc, st *PricingStream) {
+	cancel()
+	for range st.C {
+	}
+}
+
+func recvPrice(t *testing.T, st *PricingStream) Price {
+	t.Helper()
+	select {
+	case p, ok := <-st.C:
+		if !ok {
+			t.Fatal("stream closed")
+		}
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("no price")
+	}
+	return Price{}
+}
+
+func recvErr(t *testing.T, st *PricingStream) error {
+	t.Helper()
+	select {
+	case err := <-st.Errors:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("no error")
+	}
+	return nil
+}
+
+func TestPricingStream(t *testing.T) {
+	s := &streamServer{handlers: []func(http.ResponseWriter, *http.Request){
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/accounts/acc/pricing/stream" || r.URL.Query().Get("instruments") != "USD_JPY" {
+				t.Errorf("url = %v", r.URL)
+			}
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("Authorization = %v", r.Header.Get("Authorization"))
+			}
+			sendLines(testHeartbeat, testPrice, "", testHeartbeat)(w, r)
+		},
+	}}
+	goq := newStreamClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	st := NewPricingStream(ctx, goq, "USD_JPY")
+
+	// HEARTBEATと空行は流れてこない
+	p := recvPrice(t, st)
+	if p.Type != "PRICE" || !p.Tradeable || p.Spread() < 0.019 || p.Spread() > 0.021 {
+		t.Errorf("price = %+v", p)
+	}
+
+	// キャンセルでCがcloseされる
+	closeStream(cancel, st)
+}
+
+func TestPricingStreamReconnect(t *testing.T) {
+	fail := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"errorMessage":"down"}`)
+	}
+	s := &streamServer{handlers: []func(http.ResponseWriter, *http.Request){
+		fail, fail, fail, sendLines(testPrice),
+	}}
+	goq := newStreamClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	st := NewPricingStream(ctx, goq, "USD_JPY")
+	defer closeStream(cancel, st)
+
+	for i := 0; i < 3; i++ {
+		var ae *APIError
+		if err := recvErr(t, st); !errors.As(err, &ae) || ae.StatusCode != 503 {
+			t.Errorf("error %v = %v, want 503 APIError", i, err)
+		}
+	}
+	recvPrice(t, st)
+
+	// 20ms,40ms,80msとbackoffして再接続
+	conns := s.connTimes()
+	if len(conns) != 4 {
+		t.Fatalf("connections = %v, want 4", len(conns))
+	}
+	for i, min := range []time.Duration{20, 40, 80} {
+		// jitter無し。多少の誤差は許容
+		if d := conns[i+1].Sub(conns[i]); d < min*time.Millisecond*9/10 {
+			t.Errorf("wait before connection %v = %v, want >= %vms", i+2, d, min)
+		}
+	}
+}
+
+func TestPricingStreamHeartbeatTimeout(t *testing.T) {
+	setStreamTimeout(t, 100*time.Millisecond)
+	// HEARTBEATが来ている間は切断しない
+	beats := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			fmt.Fprintln(w, testHeartbeat)
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+		// 以降は何も送らない
+		<-r.Context().Done()
+	}
+	s := &streamServer{handlers: []func(http.ResponseWriter, *http.Request){
+		beats, sendLines(testPrice),
+	}}
+	goq := newStreamClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	st := NewPricingStream(ctx, goq, "USD_JPY")
+	defer closeStream(cancel, st)
+
+	var te *TransportError
+	if err := recvErr(t, st); !errors.As(err, &te) {
+		t.Errorf("error = %v, want TransportError", err)
+	}
+	recvPrice(t, st)
+	conns := s.connTimes()
+	if len(conns) != 2 {
+		t.Fatalf("connections = %v, want 2", len(conns))
+	}
+	// 300ms分のHEARTBEAT + timeout待ち
+	if d := conns[1].Sub(conns[0]); d < 300*time.Millisecond {
+		t.Errorf("reconnected after %v, want after heartbeats stopped", d)
+	}
+}
+
+func TestPricingStreamDecodeError(t *testing.T) {
+	s := &streamServer{handlers: []func(http.ResponseWriter, *http.Request){
+		sendLines(`{"type":"PRICE","bids":`), sendLines(testPrice),
+	}}
+	goq := newStreamClient(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	st := NewPricingStream(ctx, goq, "USD_JPY")
+	defer closeStream(cancel, st)
+
+	var de *DecodeError
+	if err := recvErr(t, st); !errors.As(err, &de) {
+		t.Errorf("error = %v, want DecodeError", err)
+	}
+	// 壊れた行の後は再接続して続ける
+	recvPrice(t, st)
+}
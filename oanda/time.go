@@ -0,0 +1,34 @@
+/*
+ * oandaのtime形式とtime.Timeの変換。
+ * APIはAccept-Datetime-Formatにより RFC3339("2006-01-02T15:04:05.000000000Z")か
+ * unix秒("1700000000.000000000")で時刻を返すので、どちらもパースできるようにする。
+ */
+
+package oanda
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// time.FormatでYYYY-mm-ddTHH:MM:SS.000000000Z形式にするlayout
+const TimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// RFC3339形式かunix秒(小数部はナノ秒)をUTCのtime.Timeにする
+func ParseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse time:%v", s)
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC(), nil
+}
+
+// oandaのtime形式。YYYY-mm-ddTHH:MM:SS.000000000Z
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeLayout)
+}
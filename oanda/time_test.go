@@ -0,0 +1,26 @@
+package oanda
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2024, 1, 1, 0, 0, 0, 500000000, time.UTC)
+	for _, s := range []string{"2024-01-01T00:00:00.500000000Z", "2024-01-01T09:00:00.5+09:00", "1704067200.500000000"} {
+		got, err := ParseTime(s)
+		if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("%v: %v, %v", s, got, err)
+		}
+	}
+	if got, err := ParseTime("yesterday"); err == nil || !got.IsZero() {
+		t.Errorf("invalid: %v, %v", got, err)
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	tm := time.Date(2024, 1, 1, 9, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	if got := FormatTime(tm); got != "2024-01-01T00:00:00.000000000Z" {
+		t.Errorf("FormatTime = %v", got)
+	}
+}
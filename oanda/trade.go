@@ -0,0 +1,136 @@
+/*
+ * 保有trade(v3/accounts/{accountID}/trades/{tradeSpecifier})への操作
+ */
+
+package oanda
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+type (
+	// tradeに紐づく利確・損切注文の設定。nilの項目は変更しない。
+	// Cancel*をtrueにすると既存の注文をキャンセルする（設定とは同時に指定できない）。
+	TradeOrdersParam struct {
+		TakeProfit       *TakeProfitParam
+		StopLoss         *StopLossParam
+		Trailing         *TrailingStopLossParam
+		CancelTakeProfit bool
+		CancelStopLoss   bool
+		CancelTrailing   bool
+	}
+
+	// 利確・損切注文の設定時のレスポンス。各Transactionはレスポンスに無ければnil。
+	// 既存の注文は置き換えられるので、*CancelTransactionに旧注文のキャンセルが入る。
+	// PUT: v3/accounts/{accountID}/trades/{tradeSpecifier}/orders
+	TradeOrders struct {
+		base
+		TakeProfitCancelTransaction        *OrderCancelTransaction           `json:"takeProfitOrderCancelTransaction"`
+		TakeProfitTransaction              *TakeProfitOrderTransaction       `json:"takeProfitOrderTransaction"`
+		TakeProfitFillTransaction          *OrderFillTransaction             `json:"takeProfitOrderFillTransaction"`
+		TakeProfitCreatedCancelTransaction *OrderCancelTransaction           `json:"takeProfitOrderCreatedCancelTransaction"`
+		TakeProfitRejectTransaction        *OrderRejectTransaction           `json:"takeProfitOrderRejectTransaction"`
+		StopLossCancelTransaction          *OrderCancelTransaction           `json:"stopLossOrderCancelTransaction"`
+		StopLossTransaction                *StopLossOrderTransaction         `json:"stopLossOrderTransaction"`
+		StopLossFillTransaction            *OrderFillTransaction             `json:"stopLossOrderFillTransaction"`
+		StopLossCreatedCancelTransaction   *OrderCancelTransaction           `json:"stopLossOrderCreatedCancelTransaction"`
+		StopLossRejectTransaction          *OrderRejectTransaction           `json:"stopLossOrderRejectTransaction"`
+		TrailingCancelTransaction          *OrderCancelTransaction           `json:"trailingStopLossOrderCancelTransaction"`
+		TrailingTransaction                *TrailingStopLossOrderTransaction `json:"trailingStopLossOrderTransaction"`
+		TrailingRejectTransaction          *OrderRejectTransaction           `json:"trailingStopLossOrderRejectTransaction"`
+		RelatedIDs                         []string                          `json:"relatedTransactionIDs"`
+		LastID                             string                            `json:"lastTransactionID"`
+	}
+
+	// trade決済時のレスポンス。各Transactionはレスポンスに無ければnil。
+	// PUT: v3/accounts/{accountID}/trades/{tradeSpecifier}/close
+	TradeCloseOrders struct {
+		base
+		CreateTransaction *MarketOrderTransaction `json:"orderCreateTransaction"`
+		FillTransaction   *OrderFillTransaction   `json:"orderFillTransaction"`
+		CancelTransaction *OrderCancelTransaction `json:"orderCancelTransaction"`
+		RejectTransaction *OrderRejectTransaction `json:"orderRejectTransaction"`
+		RelatedIDs        []string                `json:"relatedTransactionIDs"`
+		LastID            string                  `json:"lastTransactionID"`
+	}
+)
+
+// NewMarketClose,CloseTradeで全unitsを決済する場合に指定する
+const CLOSE_ALL = -1
+
+// パラメタをチェックし、timeInForceが空ならdefaultを設定する。
+func (p *TradeOrdersParam) Validate() error {
+	if p.TakeProfit == nil && p.StopLoss == nil && p.Trailing == nil &&
+		!p.CancelTakeProfit && !p.CancelStopLoss && !p.CancelTrailing {
+		return &ParamError{Field: "orders", Msg: "nothing to set"}
+	}
+	if p.TakeProfit != nil && p.CancelTakeProfit {
+		return &ParamError{Field: "takeProfit", Msg: "cannot set and cancel at the same time"}
+	}
+	if p.StopLoss != nil && p.CancelStopLoss {
+		return &ParamError{Field: "stopLoss", Msg: "cannot set and cancel at the same time"}
+	}
+	if p.Trailing != nil && p.CancelTrailing {
+		return &ParamError{Field: "trailingStopLoss", Msg: "cannot set and cancel at the same time"}
+	}
+	return validateOnFill(p.TakeProfit, p.StopLoss, p.Trailing, "")
+}
+
+// tradeIDのtradeに利確・損切注文を設定する。既にある場合は置き換える。
+// 損切を建値に動かす、trailingにする等もこれで行う。
+func SetTradeOrders(goq *Goquest, tradeID string, p *TradeOrdersParam) (*TradeOrders, error) {
+	return SetTradeOrdersContext(context.Background(), goq, tradeID, p)
+}
+
+// SetTradeOrdersのcontext版。
+func SetTradeOrdersContext(ctx context.Context, goq *Goquest, tradeID string, p *TradeOrdersParam) (*TradeOrders, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	res := &TradeOrders{}
+	ep := fmt.Sprintf("/accounts/%v/trades/%v/orders", goq.Auth.Id, tradeID)
+	// キャンセルはnullを指定する。指定しない項目は変更されない。
+	param := iMap{}
+	if p.TakeProfit != nil || p.CancelTakeProfit {
+		param["takeProfit"] = p.TakeProfit
+	}
+	if p.StopLoss != nil || p.CancelStopLoss {
+		param["stopLoss"] = p.StopLoss
+	}
+	if p.Trailing != nil || p.CancelTrailing {
+		param["trailingStopLoss"] = p.Trailing
+	}
+	err := goq.Put(ctx, ep, param, res)
+	return res, err
+}
+
+// tradeIDのtradeを成行きで決済する。
+// units:決済するunits(正の値)。一部決済も可。全決済はCLOSE_ALL
+func CloseTrade(goq *Goquest, tradeID string, units int) (*TradeCloseOrders, error) {
+	return CloseTradeContext(context.Background(), goq, tradeID, units)
+}
+
+// CloseTradeのcontext版。
+func CloseTradeContext(ctx context.Context, goq *Goquest, tradeID string, units int) (*TradeCloseOrders, error) {
+	param := iMap{"units": "ALL"}
+	if units != CLOSE_ALL {
+		if units <= 0 {
+			return nil, &ParamError{Field: "units", Msg: "must be positive or CLOSE_ALL"}
+		}
+		param["units"] = strconv.Itoa(units)
+	}
+	res := &TradeCloseOrders{}
+	ep := fmt.Sprintf("/accounts/%v/trades/%v/close", goq.Auth.Id, tradeID)
+	err := goq.Put(ctx, ep, param, res)
+	return res, err
+}
+
+// 決済注文のorder ID
+func (t *TradeCloseOrders) Id() string {
+	if !t.Check() || t.CreateTransaction == nil {
+		return ""
+	}
+	return t.CreateTransaction.ID
+}
@@ -0,0 +1,267 @@
+package oanda_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/oanda/sim"
+)
+
+// USD_JPYのH1足を10本再生するsimulatorと、それに向けたclient
+func newSimClient(t *testing.T) (*sim.Server, *oanda.Goquest) {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cs := []sim.Candle{}
+	for i := 0; i < 10; i++ {
+		cs = append(cs, sim.Candle{Time: start.Add(time.Duration(i) * time.Hour), O: 150, H: 150.1, L: 149.9, C: 150})
+	}
+	srv, err := sim.New(sim.Config{AccountID: "acc", Instrument: "USD_JPY", Granularity: "H1", Spread: 0.01, Balance: 100000, Candles: cs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL+"/v3"), oanda.WithKey("acc", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, goq
+}
+
+func TestTradeOrdersParamValidate(t *testing.T) {
+	var pe *oanda.ParamError
+	if err := (&oanda.TradeOrdersParam{}).Validate(); !errors.As(err, &pe) || pe.Field != "orders" {
+		t.Errorf("empty: %v", err)
+	}
+	p := &oanda.TradeOrdersParam{StopLoss: &oanda.StopLossParam{Price: 149, Distance: 1}}
+	if err := p.Validate(); !errors.As(err, &pe) || pe.Field != "stopLoss" {
+		t.Errorf("sl both: %v", err)
+	}
+	p = &oanda.TradeOrdersParam{TakeProfit: &oanda.TakeProfitParam{Price: 151, Tif: "FOK"}}
+	if err := p.Validate(); !errors.As(err, &pe) || pe.Field != "takeProfit.timeInForce" {
+		t.Errorf("tp tif: %v", err)
+	}
+}
+
+func TestSetTradeOrders(t *testing.T) {
+	_, goq := newSimClient(t)
+	ctx := context.Background()
+
+	res, err := oanda.NewMarketOrderParamContext(ctx, goq, &oanda.OrderParam{
+		Instrument: "USD_JPY", Units: 100,
+		TakeProfit: &oanda.TakeProfitParam{Price: 151},
+		StopLoss:   &oanda.StopLossParam{Price: 149},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradeID := res.FillTransaction.TradeOpened.TradeID
+
+	trade, err := oanda.NewTradeContext(ctx, goq, tradeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp, sl := trade.TradeData.TakeProfitOrder, trade.TradeData.StopLossOrder; tp == nil || tp.Price != 151 || sl == nil || sl.Price != 149 {
+		t.Fatalf("on fill orders = %+v,%+v", tp, sl)
+	}
+	oldSL := trade.TradeData.StopLossOrder.Id
+
+	// 損切だけ置き換える
+	orders, err := oanda.SetTradeOrdersContext(ctx, goq, tradeID, &oanda.TradeOrdersParam{StopLoss: &oanda.StopLossParam{Price: 149.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orders.StopLossTransaction == nil || orders.StopLossTransaction.Price != 149.5 {
+		t.Errorf("stopLossOrderTransaction = %+v", orders.StopLossTransaction)
+	}
+	if c := orders.StopLossCancelTransaction; c == nil || c.OrderID != oldSL {
+		t.Errorf("stopLossOrderCancelTransaction = %+v", c)
+	}
+	if orders.TakeProfitTransaction != nil {
+		t.Errorf("takeProfit should not change: %+v", orders.TakeProfitTransaction)
+	}
+
+	trade, err = oanda.NewTradeContext(ctx, goq, tradeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp, sl := trade.TradeData.TakeProfitOrder, trade.TradeData.StopLossOrder; tp.Price != 151 || sl.Price != 149.5 {
+		t.Errorf("orders after replace = %+v,%+v", tp, sl)
+	}
+
+	// 存在しないtradeは404
+	_, err = oanda.SetTradeOrdersContext(ctx, goq, "999", &oanda.TradeOrdersParam{TakeProfit: &oanda.TakeProfitParam{Price: 151}})
+	var ae *oanda.APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 404 {
+		t.Errorf("unknown trade: %v", err)
+	}
+}
+
+func TestCloseTrade(t *testing.T) {
+	_, goq := newSimClient(t)
+	ctx := context.Background()
+	res, err := oanda.NewMarketOrderContext(ctx, goq, "USD_JPY", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradeID := res.FillTransaction.TradeOpened.TradeID
+
+	var pe *oanda.ParamError
+	if _, err := oanda.CloseTradeContext(ctx, goq, tradeID, 0); !errors.As(err, &pe) {
+		t.Errorf("units 0: %v", err)
+	}
+
+	// 一部決済はtradeReduced
+	part, err := oanda.CloseTradeContext(ctx, goq, tradeID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := part.FillTransaction; f == nil || f.TradeReduced == nil || f.TradeReduced.Units != -40 || len(f.TradesClosed) != 0 {
+		t.Errorf("partial fill = %+v", f)
+	}
+	if part.Id() == "" || part.CreateTransaction.TradeClose == nil || part.CreateTransaction.TradeClose.Units != "40" {
+		t.Errorf("partial create = %+v", part.CreateTransaction)
+	}
+
+	// 残りを全決済
+	all, err := oanda.CloseTradeContext(ctx, goq, tradeID, oanda.CLOSE_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := all.FillTransaction; f == nil || len(f.TradesClosed) != 1 || f.TradesClosed[0].Units != -60 {
+		t.Errorf("close all fill = %+v", f)
+	}
+	trade, err := oanda.NewTradeContext(ctx, goq, tradeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeData.State != "CLOSED" {
+		t.Errorf("state = %v", trade.TradeData.State)
+	}
+
+	_, err = oanda.CloseTradeContext(ctx, goq, tradeID, oanda.CLOSE_ALL)
+	var ae *oanda.APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 404 {
+		t.Errorf("closed trade: %v", err)
+	}
+}
+
+func TestNewMarketClose(t *testing.T) {
+	srv, goq := newSimClient(t)
+	ctx := context.Background()
+	var pe *oanda.ParamError
+	if _, err := oanda.NewMarketCloseContext(ctx, goq, "USD_JPY", 0, 0); !errors.As(err, &pe) {
+		t.Errorf("no units: %v", err)
+	}
+	if _, err := oanda.NewMarketOrderContext(ctx, goq, "USD_JPY", -100); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保有していないlong側を指定するとエラー
+	_, err := oanda.NewMarketCloseContext(ctx, goq, "USD_JPY", oanda.CLOSE_ALL, 0)
+	var ae *oanda.APIError
+	if !errors.As(err, &ae) || ae.StatusCode != 400 {
+		t.Errorf("close long: %v", err)
+	}
+
+	// 一部
+	res, err := oanda.NewMarketCloseContext(ctx, goq, "USD_JPY", 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Filled() || res.LongCreateTransaction != nil || res.ShortFillTransaction.Units != 30 {
+		t.Errorf("partial = %+v", res)
+	}
+	// 全て。long側は"NONE"で送るのでエラーにならない
+	res, err = oanda.NewMarketCloseContext(ctx, goq, "USD_JPY", 0, oanda.CLOSE_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Filled() || res.Id() != res.ShortCreateTransaction.ID || res.ShortFillTransaction.Units != 70 {
+		t.Errorf("all = %+v", res)
+	}
+	// 価格は動いていないので、spread分の損失のみ
+	if pl := res.PL(); pl >= 0 || pl < -0.01*70-1e-9 {
+		t.Errorf("PL = %v", pl)
+	}
+	if b := srv.Balance(); b > 100000 || b < 100000-0.01*100-1e-9 {
+		t.Errorf("balance = %v", b)
+	}
+	pos, err := oanda.NewPositionContext(ctx, goq, "USD_JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := pos.Extract(); p.Short.Units != 0 || p.Long.Units != 0 {
+		t.Errorf("position after close = %+v,%+v", p.Long, p.Short)
+	}
+}
+
+func TestCancelTradeOrders(t *testing.T) {
+	var pe *oanda.ParamError
+	p := &oanda.TradeOrdersParam{StopLoss: &oanda.StopLossParam{Price: 149}, CancelStopLoss: true}
+	if err := p.Validate(); !errors.As(err, &pe) || pe.Field != "stopLoss" {
+		t.Errorf("set and cancel: %v", err)
+	}
+
+	_, goq := newSimClient(t)
+	ctx := context.Background()
+	res, err := oanda.NewMarketOrderParamContext(ctx, goq, &oanda.OrderParam{
+		Instrument: "USD_JPY", Units: 100,
+		TakeProfit: &oanda.TakeProfitParam{Price: 151},
+		StopLoss:   &oanda.StopLossParam{Price: 149},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradeID := res.FillTransaction.TradeOpened.TradeID
+
+	// 損切だけ外す
+	orders, err := oanda.SetTradeOrdersContext(ctx, goq, tradeID, &oanda.TradeOrdersParam{CancelStopLoss: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orders.StopLossCancelTransaction == nil || orders.StopLossTransaction != nil || orders.TakeProfitCancelTransaction != nil {
+		t.Errorf("res = %+v", orders)
+	}
+	trade, err := oanda.NewTradeContext(ctx, goq, tradeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := trade.TradeData; d.StopLossOrder != nil || d.TakeProfitOrder == nil {
+		t.Errorf("orders after cancel = %+v,%+v", d.TakeProfitOrder, d.StopLossOrder)
+	}
+}
+
+func TestTradeData(t *testing.T) {
+	_, goq := newSimClient(t)
+	ctx := context.Background()
+	res, err := oanda.NewMarketOrderContext(ctx, goq, "USD_JPY", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradeID := res.FillTransaction.TradeOpened.TradeID
+	part, err := oanda.CloseTradeContext(ctx, goq, tradeID, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trade, err := oanda.NewTradeContext(ctx, goq, tradeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := trade.TradeData
+	if d.CurrentUnits != 60 || d.InitialUnits != 100 || d.AverageClosePrice != 149.995 {
+		t.Errorf("units,close = %v,%v,%v", d.CurrentUnits, d.InitialUnits, d.AverageClosePrice)
+	}
+	if len(d.ClosingTransactionIDs) != 1 || d.ClosingTransactionIDs[0] != part.FillTransaction.ID {
+		t.Errorf("closingTransactionIDs = %v", d.ClosingTransactionIDs)
+	}
+	// 証拠金率0.04
+	if d.MarginUsed != 60*150*0.04 || d.InitialMarginRequired != 100*150.005*0.04 {
+		t.Errorf("margin = %v,%v", d.MarginUsed, d.InitialMarginRequired)
+	}
+}
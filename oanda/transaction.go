@@ -0,0 +1,381 @@
+/*
+ * Oanda v20のtransactionの型を定める。
+ * transactions/streamやtransaction履歴のレスポンスを、typeに応じた型にdecodeする。
+ */
+
+package oanda
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+type (
+	// 全transaction共通の項目
+	TransactionHeader struct {
+		ID        string `json:"id"`
+		Time      string `json:"time"`
+		UserID    int    `json:"userID"`
+		AccountID string `json:"accountID"`
+		BatchID   string `json:"batchID"`
+		RequestID string `json:"requestID"`
+		// "ORDER_FILL","ORDER_CANCEL","STOP_LOSS_ORDER"等
+		Type string `json:"type"`
+	}
+
+	// 全transactionが満たすinterface
+	Transaction interface {
+		Header() *TransactionHeader
+	}
+
+	// 注文に付けるクライアント情報
+	ClientExtensions struct {
+		ID      string `json:"id,omitempty"`
+		Tag     string `json:"tag,omitempty"`
+		Comment string `json:"comment,omitempty"`
+	}
+
+	// ポジションのクローズ指定
+	PositionCloseout struct {
+		Instrument string `json:"instrument"`
+		Units      string `json:"units"`
+	}
+
+	// 約定で新規に建ったtrade
+	TradeOpen struct {
+		TradeID                string            `json:"tradeID"`
+		Units                  int               `json:"units,string"`
+		Price                  float64           `json:"price,string"`
+		GuaranteedExecutionFee float64           `json:"guaranteedExecutionFee,string"`
+		HalfSpreadCost         float64           `json:"halfSpreadCost,string"`
+		InitialMarginRequired  float64           `json:"initialMarginRequired,string"`
+		ClientExtensions       *ClientExtensions `json:"clientExtensions"`
+	}
+
+	// 約定で決済(一部決済)されたtrade
+	TradeReduce struct {
+		TradeID                string  `json:"tradeID"`
+		Units                  int     `json:"units,string"`
+		Price                  float64 `json:"price,string"`
+		RealizedPL             float64 `json:"realizedPL,string"`
+		Financing              float64 `json:"financing,string"`
+		GuaranteedExecutionFee float64 `json:"guaranteedExecutionFee,string"`
+		HalfSpreadCost         float64 `json:"halfSpreadCost,string"`
+	}
+
+	// 約定
+	OrderFillTransaction struct {
+		TransactionHeader
+		OrderID                string            `json:"orderID"`
+		ClientOrderID          string            `json:"clientOrderID"`
+		Instrument             string            `json:"instrument"`
+		Units                  int               `json:"units,string"`
+		Price                  float64           `json:"price,string"`
+		FullVWAP               float64           `json:"fullVWAP,string"`
+		Reason                 string            `json:"reason"`
+		PL                     float64           `json:"pl,string"`
+		Financing              float64           `json:"financing,string"`
+		Commission             float64           `json:"commission,string"`
+		GuaranteedExecutionFee float64           `json:"guaranteedExecutionFee,string"`
+		HalfSpreadCost         float64           `json:"halfSpreadCost,string"`
+		AccountBalance         float64           `json:"accountBalance,string"`
+		TradeOpened            *TradeOpen        `json:"tradeOpened"`
+		TradesClosed           []TradeReduce     `json:"tradesClosed"`
+		TradeReduced           *TradeReduce      `json:"tradeReduced"`
+		ClientExtensions       *ClientExtensions `json:"clientExtensions"`
+	}
+
+	// 注文のキャンセル
+	OrderCancelTransaction struct {
+		TransactionHeader
+		OrderID           string `json:"orderID"`
+		ClientOrderID     string `json:"clientOrderID"`
+		Reason            string `json:"reason"`
+		ReplacedByOrderID string `json:"replacedByOrderID"`
+	}
+
+	// 成行き注文の作成。
+	// 強制ロスカットもreason:"MARGIN_CLOSEOUT"のMARKET_ORDERとして流れてくる。
+	MarketOrderTransaction struct {
+		TransactionHeader
+		Instrument       string            `json:"instrument"`
+		Units            int               `json:"units,string"`
+		TimeInForce      string            `json:"timeInForce"`
+		PriceBound       float64           `json:"priceBound,string"`
+		PositionFill     string            `json:"positionFill"`
+		Reason           string            `json:"reason"`
+		ClientExtensions *ClientExtensions `json:"clientExtensions"`
+		TradeClose       *struct {
+			TradeID string `json:"tradeID"`
+			Units   string `json:"units"`
+		} `json:"tradeClose"`
+		// NewMarketCloseの場合。Unitsは"ALL"か数値
+		LongPositionCloseout  *PositionCloseout `json:"longPositionCloseout"`
+		ShortPositionCloseout *PositionCloseout `json:"shortPositionCloseout"`
+		MarginCloseout        *struct {
+			Reason string `json:"reason"`
+		} `json:"marginCloseout"`
+		TakeProfitOnFill       *TakeProfitParam       `json:"takeProfitOnFill"`
+		StopLossOnFill         *StopLossParam         `json:"stopLossOnFill"`
+		TrailingStopLossOnFill *TrailingStopLossParam `json:"trailingStopLossOnFill"`
+		TradeClientExtensions  *ClientExtensions      `json:"tradeClientExtensions"`
+	}
+
+	// 指値・逆指値・MIT注文(LIMIT_ORDER,STOP_ORDER,MARKET_IF_TOUCHED_ORDER)の作成
+	EntryOrderTransaction struct {
+		TransactionHeader
+		Instrument             string                 `json:"instrument"`
+		Units                  int                    `json:"units,string"`
+		Price                  float64                `json:"price,string"`
+		PriceBound             float64                `json:"priceBound,string"`
+		TimeInForce            string                 `json:"timeInForce"`
+		GtdTime                string                 `json:"gtdTime"`
+		PositionFill           string                 `json:"positionFill"`
+		TriggerCondition       string                 `json:"triggerCondition"`
+		Reason                 string                 `json:"reason"`
+		ClientExtensions       *ClientExtensions      `json:"clientExtensions"`
+		TakeProfitOnFill       *TakeProfitParam       `json:"takeProfitOnFill"`
+		StopLossOnFill         *StopLossParam         `json:"stopLossOnFill"`
+		TrailingStopLossOnFill *TrailingStopLossParam `json:"trailingStopLossOnFill"`
+		TradeClientExtensions  *ClientExtensions      `json:"tradeClientExtensions"`
+		ReplacesOrderID        string                 `json:"replacesOrderID"`
+	}
+
+	// 注文の却下。MARKET_ORDER_REJECT,LIMIT_ORDER_REJECT,ORDER_CANCEL_REJECT等、
+	// CLIENT_CONFIGURE_REJECT,TRANSFER_FUNDS_REJECT以外の"*_REJECT"のtype全て。
+	// 注文内容は共通の項目のみ保持する。
+	OrderRejectTransaction struct {
+		TransactionHeader
+		OrderID          string            `json:"orderID"`
+		ClientOrderID    string            `json:"clientOrderID"`
+		Instrument       string            `json:"instrument"`
+		Units            int               `json:"units,string"`
+		Price            float64           `json:"price,string"`
+		TradeID          string            `json:"tradeID"`
+		TimeInForce      string            `json:"timeInForce"`
+		Reason           string            `json:"reason"`
+		RejectReason     string            `json:"rejectReason"`
+		ClientExtensions *ClientExtensions `json:"clientExtensions"`
+	}
+
+	// tradeに紐づく決済注文(TAKE_PROFIT_ORDER,STOP_LOSS_ORDER,TRAILING_STOP_LOSS_ORDER)の作成
+	DependentOrderTransaction struct {
+		TransactionHeader
+		TradeID                 string            `json:"tradeID"`
+		ClientTradeID           string            `json:"clientTradeID"`
+		Price                   float64           `json:"price,string"`
+		Distance                float64           `json:"distance,string"`
+		TimeInForce             string            `json:"timeInForce"`
+		GtdTime                 string            `json:"gtdTime"`
+		TriggerCondition        string            `json:"triggerCondition"`
+		Reason                  string            `json:"reason"`
+		ClientExtensions        *ClientExtensions `json:"clientExtensions"`
+		OrderFillTransactionID  string            `json:"orderFillTransactionID"`
+		ReplacesOrderID         string            `json:"replacesOrderID"`
+		CancellingTransactionID string            `json:"cancellingTransactionID"`
+	}
+
+	// TAKE_PROFIT_ORDER
+	TakeProfitOrderTransaction struct {
+		DependentOrderTransaction
+	}
+
+	// STOP_LOSS_ORDER
+	StopLossOrderTransaction struct {
+		DependentOrderTransaction
+		Guaranteed bool `json:"guaranteed"`
+	}
+
+	// TRAILING_STOP_LOSS_ORDER
+	TrailingStopLossOrderTransaction struct {
+		DependentOrderTransaction
+	}
+
+	// 注文のclientExtensionsの変更
+	OrderClientExtensionsModifyTransaction struct {
+		TransactionHeader
+		OrderID                     string            `json:"orderID"`
+		ClientOrderID               string            `json:"clientOrderID"`
+		ClientExtensionsModify      *ClientExtensions `json:"clientExtensionsModify"`
+		TradeClientExtensionsModify *ClientExtensions `json:"tradeClientExtensionsModify"`
+	}
+
+	// 追証。MARGIN_CALL_ENTER,MARGIN_CALL_EXTEND,MARGIN_CALL_EXIT
+	MarginCallTransaction struct {
+		TransactionHeader
+		ExtensionNumber int `json:"extensionNumber"`
+	}
+
+	// 日次のスワップ
+	DailyFinancingTransaction struct {
+		TransactionHeader
+		Financing          float64 `json:"financing,string"`
+		AccountBalance     float64 `json:"accountBalance,string"`
+		PositionFinancings []struct {
+			Instrument string  `json:"instrument"`
+			Financing  float64 `json:"financing,string"`
+		} `json:"positionFinancings"`
+	}
+
+	// 口座の作成
+	CreateTransaction struct {
+		TransactionHeader
+		DivisionID    int    `json:"divisionID"`
+		SiteID        int    `json:"siteID"`
+		AccountUserID int    `json:"accountUserID"`
+		AccountNumber int    `json:"accountNumber"`
+		HomeCurrency  string `json:"homeCurrency"`
+	}
+
+	// 共通項目のみのtransaction。CLOSE,REOPEN,RESET_RESETTABLE_PL
+	AccountTransaction struct {
+		TransactionHeader
+	}
+
+	// 口座設定の変更。CLIENT_CONFIGURE,CLIENT_CONFIGURE_REJECT
+	ClientConfigureTransaction struct {
+		TransactionHeader
+		Alias        string  `json:"alias"`
+		MarginRate   float64 `json:"marginRate,string"`
+		RejectReason string  `json:"rejectReason"`
+	}
+
+	// 入出金。TRANSFER_FUNDS,TRANSFER_FUNDS_REJECT
+	TransferFundsTransaction struct {
+		TransactionHeader
+		Amount         float64 `json:"amount,string"`
+		FundingReason  string  `json:"fundingReason"`
+		Comment        string  `json:"comment"`
+		AccountBalance float64 `json:"accountBalance,string"`
+		RejectReason   string  `json:"rejectReason"`
+	}
+
+	// 価格固定の注文。口座移管等でoanda側が作る
+	FixedPriceOrderTransaction struct {
+		TransactionHeader
+		Instrument             string                 `json:"instrument"`
+		Units                  int                    `json:"units,string"`
+		Price                  float64                `json:"price,string"`
+		PositionFill           string                 `json:"positionFill"`
+		TradeState             string                 `json:"tradeState"`
+		Reason                 string                 `json:"reason"`
+		ClientExtensions       *ClientExtensions      `json:"clientExtensions"`
+		TakeProfitOnFill       *TakeProfitParam       `json:"takeProfitOnFill"`
+		StopLossOnFill         *StopLossParam         `json:"stopLossOnFill"`
+		TrailingStopLossOnFill *TrailingStopLossParam `json:"trailingStopLossOnFill"`
+		TradeClientExtensions  *ClientExtensions      `json:"tradeClientExtensions"`
+	}
+
+	// GUARANTEED_STOP_LOSS_ORDER
+	GuaranteedStopLossOrderTransaction struct {
+		DependentOrderTransaction
+		GuaranteedExecutionPremium float64 `json:"guaranteedExecutionPremium,string"`
+	}
+
+	// tradeのclientExtensionsの変更
+	TradeClientExtensionsModifyTransaction struct {
+		TransactionHeader
+		TradeID                     string            `json:"tradeID"`
+		ClientTradeID               string            `json:"clientTradeID"`
+		TradeClientExtensionsModify *ClientExtensions `json:"tradeClientExtensionsModify"`
+	}
+
+	// 市場が閉じている等で決済が遅延したtrade
+	DelayedTradeClosureTransaction struct {
+		TransactionHeader
+		Reason string `json:"reason"`
+		// "1,2,3"のようにカンマ区切り
+		TradeIDs string `json:"tradeIDs"`
+	}
+
+	// 配当調整(CFD)
+	DividendAdjustmentTransaction struct {
+		TransactionHeader
+		Instrument         string  `json:"instrument"`
+		DividendAdjustment float64 `json:"dividendAdjustment,string"`
+		AccountBalance     float64 `json:"accountBalance,string"`
+	}
+
+	// transactions/streamのHEARTBEAT
+	TransactionHeartbeat struct {
+		TransactionHeader
+		LastTransactionID string `json:"lastTransactionID"`
+	}
+
+	// 型を定義していないtransaction。元のjsonをRawに保持する。
+	OtherTransaction struct {
+		TransactionHeader
+		Raw json.RawMessage `json:"-"`
+	}
+)
+
+func (h *TransactionHeader) Header() *TransactionHeader {
+	return h
+}
+
+// 強制ロスカットの注文か
+func (t *MarketOrderTransaction) IsMarginCloseout() bool {
+	return t.Reason == "MARGIN_CLOSEOUT"
+}
+
+// transactionのjsonをtypeに応じた型にdecodeする。
+// v20の全typeに対応している。将来追加されたtype等、型を定義していないtypeはOtherTransactionになる。
+func DecodeTransaction(b []byte) (Transaction, error) {
+	h := TransactionHeader{}
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	var t Transaction
+	switch h.Type {
+	case "ORDER_FILL":
+		t = &OrderFillTransaction{}
+	case "ORDER_CANCEL":
+		t = &OrderCancelTransaction{}
+	case "MARKET_ORDER":
+		t = &MarketOrderTransaction{}
+	case "TAKE_PROFIT_ORDER":
+		t = &TakeProfitOrderTransaction{}
+	case "STOP_LOSS_ORDER":
+		t = &StopLossOrderTransaction{}
+	case "TRAILING_STOP_LOSS_ORDER":
+		t = &TrailingStopLossOrderTransaction{}
+	case "LIMIT_ORDER", "STOP_ORDER", "MARKET_IF_TOUCHED_ORDER":
+		t = &EntryOrderTransaction{}
+	case "ORDER_CLIENT_EXTENSIONS_MODIFY":
+		t = &OrderClientExtensionsModifyTransaction{}
+	case "GUARANTEED_STOP_LOSS_ORDER":
+		t = &GuaranteedStopLossOrderTransaction{}
+	case "FIXED_PRICE_ORDER":
+		t = &FixedPriceOrderTransaction{}
+	case "TRADE_CLIENT_EXTENSIONS_MODIFY":
+		t = &TradeClientExtensionsModifyTransaction{}
+	case "MARGIN_CALL_ENTER", "MARGIN_CALL_EXTEND", "MARGIN_CALL_EXIT":
+		t = &MarginCallTransaction{}
+	case "CREATE":
+		t = &CreateTransaction{}
+	case "CLOSE", "REOPEN", "RESET_RESETTABLE_PL":
+		t = &AccountTransaction{}
+	case "CLIENT_CONFIGURE", "CLIENT_CONFIGURE_REJECT":
+		t = &ClientConfigureTransaction{}
+	case "TRANSFER_FUNDS", "TRANSFER_FUNDS_REJECT":
+		t = &TransferFundsTransaction{}
+	case "DELAYED_TRADE_CLOSURE":
+		t = &DelayedTradeClosureTransaction{}
+	case "DIVIDEND_ADJUSTMENT":
+		t = &DividendAdjustmentTransaction{}
+	case "DAILY_FINANCING":
+		t = &DailyFinancingTransaction{}
+	case "HEARTBEAT":
+		t = &TransactionHeartbeat{}
+	default:
+		if strings.HasSuffix(h.Type, "_REJECT") {
+			t = &OrderRejectTransaction{}
+			break
+		}
+		return &OtherTransaction{TransactionHeader: h, Raw: append(json.RawMessage{}, b...)}, nil
+	}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,134 @@
+package oanda
+
+import (
+	"testing"
+)
+
+func TestDecodeTransaction(t *testing.T) {
+	tests := []struct {
+		json string
+		typ  string
+		want func(Transaction) bool
+	}{
+		{
+			`{"id":"10","type":"ORDER_FILL","orderID":"9","units":"-100","price":"150.005","pl":"12.5",` +
+				`"tradesClosed":[{"tradeID":"3","units":"-100","realizedPL":"12.5"}]}`,
+			"ORDER_FILL",
+			func(tr Transaction) bool {
+				f, ok := tr.(*OrderFillTransaction)
+				return ok && f.OrderID == "9" && f.Units == -100 && f.Price == 150.005 &&
+					len(f.TradesClosed) == 1 && f.TradesClosed[0].RealizedPL == 12.5 && f.TradeOpened == nil
+			},
+		},
+		{
+			`{"id":"11","type":"ORDER_CANCEL","orderID":"9","reason":"MARKET_HALTED"}`,
+			"ORDER_CANCEL",
+			func(tr Transaction) bool {
+				c, ok := tr.(*OrderCancelTransaction)
+				return ok && c.OrderID == "9" && c.Reason == "MARKET_HALTED"
+			},
+		},
+		{
+			`{"id":"12","type":"MARKET_ORDER","instrument":"USD_JPY","units":"100","reason":"MARGIN_CLOSEOUT"}`,
+			"MARKET_ORDER",
+			func(tr Transaction) bool {
+				m, ok := tr.(*MarketOrderTransaction)
+				return ok && m.Units == 100 && m.IsMarginCloseout()
+			},
+		},
+		{
+			`{"id":"13","type":"STOP_LOSS_ORDER","tradeID":"3","price":"149.5","guaranteed":true}`,
+			"STOP_LOSS_ORDER",
+			func(tr Transaction) bool {
+				s, ok := tr.(*StopLossOrderTransaction)
+				return ok && s.TradeID == "3" && s.Price == 149.5 && s.Guaranteed
+			},
+		},
+		{
+			`{"id":"14","type":"MARGIN_CALL_EXTEND","extensionNumber":2}`,
+			"MARGIN_CALL_EXTEND",
+			func(tr Transaction) bool {
+				m, ok := tr.(*MarginCallTransaction)
+				return ok && m.ExtensionNumber == 2
+			},
+		},
+		{
+			`{"type":"HEARTBEAT","lastTransactionID":"14"}`,
+			"HEARTBEAT",
+			func(tr Transaction) bool {
+				h, ok := tr.(*TransactionHeartbeat)
+				return ok && h.LastTransactionID == "14"
+			},
+		},
+		{
+			`{"id":"15","type":"TRANSFER_FUNDS","amount":"1000","fundingReason":"CLIENT_FUNDING","accountBalance":"251000"}`,
+			"TRANSFER_FUNDS",
+			func(tr Transaction) bool {
+				f, ok := tr.(*TransferFundsTransaction)
+				return ok && f.Amount == 1000 && f.FundingReason == "CLIENT_FUNDING" && f.AccountBalance == 251000
+			},
+		},
+		{
+			`{"id":"1","type":"CREATE","divisionID":4,"homeCurrency":"JPY"}`,
+			"CREATE",
+			func(tr Transaction) bool {
+				c, ok := tr.(*CreateTransaction)
+				return ok && c.DivisionID == 4 && c.HomeCurrency == "JPY"
+			},
+		},
+		// CLIENT_CONFIGURE_REJECTは注文の却下ではない
+		{
+			`{"id":"16","type":"CLIENT_CONFIGURE_REJECT","marginRate":"0.01","rejectReason":"MARGIN_RATE_INVALID"}`,
+			"CLIENT_CONFIGURE_REJECT",
+			func(tr Transaction) bool {
+				c, ok := tr.(*ClientConfigureTransaction)
+				return ok && c.MarginRate == 0.01 && c.RejectReason == "MARGIN_RATE_INVALID"
+			},
+		},
+		{
+			`{"id":"17","type":"ORDER_CANCEL_REJECT","orderID":"9","rejectReason":"ORDER_DOESNT_EXIST"}`,
+			"ORDER_CANCEL_REJECT",
+			func(tr Transaction) bool {
+				r, ok := tr.(*OrderRejectTransaction)
+				return ok && r.OrderID == "9" && r.RejectReason == "ORDER_DOESNT_EXIST"
+			},
+		},
+		{
+			`{"id":"18","type":"DELAYED_TRADE_CLOSURE","reason":"CLIENT_REQUEST","tradeIDs":"3,5"}`,
+			"DELAYED_TRADE_CLOSURE",
+			func(tr Transaction) bool {
+				d, ok := tr.(*DelayedTradeClosureTransaction)
+				return ok && d.TradeIDs == "3,5"
+			},
+		},
+		// 型を定義していないtypeは元のjsonを保持する
+		{
+			`{"id":"19","type":"NEW_TYPE","amount":"1"}`,
+			"NEW_TYPE",
+			func(tr Transaction) bool {
+				o, ok := tr.(*OtherTransaction)
+				return ok && o.ID == "19" && string(o.Raw) == `{"id":"19","type":"NEW_TYPE","amount":"1"}`
+			},
+		},
+	}
+	for _, tt := range tests {
+		tr, err := DecodeTransaction([]byte(tt.json))
+		if err != nil {
+			t.Errorf("%v: %v", tt.typ, err)
+			continue
+		}
+		if tr.Header().Type != tt.typ {
+			t.Errorf("%v: type = %v", tt.typ, tr.Header().Type)
+		}
+		if !tt.want(tr) {
+			t.Errorf("%v: unexpected %+v", tt.typ, tr)
+		}
+	}
+
+	// 壊れたjsonや型の合わない値はerror
+	for _, b := range []string{`{"type":`, `{"type":"ORDER_FILL","units":100}`} {
+		if _, err := DecodeTransaction([]byte(b)); err == nil {
+			t.Errorf("%v: want error", b)
+		}
+	}
+}
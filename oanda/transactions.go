@@ -0,0 +1,256 @@
+/*
+ * transaction履歴(v3/accounts/{accountID}/transactions)の取得
+ */
+
+package oanda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+type (
+	// typeに応じた型にdecodeされるtransactionのリスト
+	TransactionList []Transaction
+
+	// 期間内のtransactionのページ一覧。Pagesの各urlをNewTransactionIDRangeで取得する。
+	// GET: v3/accounts/{accountID}/transactions
+	TransactionPages struct {
+		base
+		From     string   `json:"from"`
+		To       string   `json:"to"`
+		PageSize int      `json:"pageSize"`
+		Type     []string `json:"type"`
+		Count    int      `json:"count"`
+		Pages    []string `json:"pages"`
+		LastID   string   `json:"lastTransactionID"`
+	}
+
+	// ID範囲、もしくは指定ID以降のtransaction
+	// GET: v3/accounts/{accountID}/transactions/idrange
+	// GET: v3/accounts/{accountID}/transactions/sinceid
+	TransactionRange struct {
+		base
+		Transactions TransactionList `json:"transactions"`
+		LastID       string          `json:"lastTransactionID"`
+	}
+
+	// 単一のtransaction
+	// GET: v3/accounts/{accountID}/transactions/{transactionID}
+	GetTransaction struct {
+		base
+		Transaction Transaction `json:"-"`
+		LastID      string      `json:"lastTransactionID"`
+	}
+
+	// 期間内のtransactionをページ毎に取得しながら1件ずつ返す。
+	//
+	//	it := NewTransactionIterator(goq, from, to, 0, "")
+	//	for it.Next(ctx) {
+	//		t := it.Transaction()
+	//	}
+	//	if err := it.Err(); err != nil {...}
+	TransactionIterator struct {
+		goq      *Goquest
+		from     string
+		to       string
+		pageSize int
+		types    string
+		pages    []string
+		started  bool
+		buf      TransactionList
+		cur      Transaction
+		err      error
+	}
+)
+
+func (l *TransactionList) UnmarshalJSON(b []byte) error {
+	raw := []json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	list := make(TransactionList, 0, len(raw))
+	for _, r := range raw {
+		t, err := DecodeTransaction(r)
+		if err != nil {
+			return err
+		}
+		list = append(list, t)
+	}
+	*l = list
+	return nil
+}
+
+func (g *GetTransaction) UnmarshalJSON(b []byte) error {
+	raw := struct {
+		Transaction json.RawMessage `json:"transaction"`
+		LastID      string          `json:"lastTransactionID"`
+	}{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	g.LastID = raw.LastID
+	if len(raw.Transaction) == 0 || string(raw.Transaction) == "null" {
+		return nil
+	}
+	t, err := DecodeTransaction(raw.Transaction)
+	if err != nil {
+		return err
+	}
+	g.Transaction = t
+	return nil
+}
+
+func (t *TransactionRange) Extract() TransactionList {
+	if !t.Check() {
+		return nil
+	}
+	return t.Transactions
+}
+
+// 期間内のtransactionのページ一覧を取得する。
+// from,to:RFC3339の時刻。空ならfromは口座作成時、toは現在。
+// pageSize:1ページの件数(最大1000)。0ならdefaultの100。
+// types:"ORDER_FILL,ORDER_CANCEL"のようにカンマ区切りのtypeのfilter。空なら全て。
+func NewTransactions(goq *Goquest, from, to string, pageSize int, types string) (*TransactionPages, error) {
+	return NewTransactionsContext(context.Background(), goq, from, to, pageSize, types)
+}
+
+// NewTransactionsのcontext版。
+func NewTransactionsContext(ctx context.Context, goq *Goquest, from, to string, pageSize int, types string) (*TransactionPages, error) {
+	if pageSize < 0 || pageSize > 1000 {
+		return nil, &ParamError{Field: "pageSize", Msg: "must be 1-1000, or 0 for default"}
+	}
+	res := &TransactionPages{}
+	ep := "/accounts/" + goq.Auth.Id + "/transactions"
+	p := strMap{}
+	if len(from) > 0 {
+		p["from"] = from
+	}
+	if len(to) > 0 {
+		p["to"] = to
+	}
+	if pageSize > 0 {
+		p["pageSize"] = strconv.Itoa(pageSize)
+	}
+	if len(types) > 0 {
+		p["type"] = types
+	}
+	err := goq.Get(ctx, ep, p, res)
+	return res, err
+}
+
+// fromからtoまで(両端含む)のIDのtransactionを取得する。
+// types:カンマ区切りのtypeのfilter。空なら全て。
+func NewTransactionIDRange(goq *Goquest, from, to, types string) (*TransactionRange, error) {
+	return NewTransactionIDRangeContext(context.Background(), goq, from, to, types)
+}
+
+// NewTransactionIDRangeのcontext版。
+func NewTransactionIDRangeContext(ctx context.Context, goq *Goquest, from, to, types string) (*TransactionRange, error) {
+	if len(from) == 0 || len(to) == 0 {
+		return nil, &ParamError{Field: "from,to", Msg: "required"}
+	}
+	res := &TransactionRange{}
+	ep := "/accounts/" + goq.Auth.Id + "/transactions/idrange"
+	p := strMap{"from": from, "to": to}
+	if len(types) > 0 {
+		p["type"] = types
+	}
+	err := goq.Get(ctx, ep, p, res)
+	return res, err
+}
+
+// idより後のtransactionを全て取得する。idは含まない。
+// 前回のLastIDを渡せば差分だけ取得できる。
+func NewTransactionsSinceID(goq *Goquest, id string) (*TransactionRange, error) {
+	return NewTransactionsSinceIDContext(context.Background(), goq, id)
+}
+
+// NewTransactionsSinceIDのcontext版。
+func NewTransactionsSinceIDContext(ctx context.Context, goq *Goquest, id string) (*TransactionRange, error) {
+	if len(id) == 0 {
+		return nil, &ParamError{Field: "id", Msg: "required"}
+	}
+	res := &TransactionRange{}
+	ep := "/accounts/" + goq.Auth.Id + "/transactions/sinceid"
+	err := goq.Get(ctx, ep, strMap{"id": id}, res)
+	return res, err
+}
+
+// idのtransactionを1件取得する。
+func NewTransaction(goq *Goquest, id string) (*GetTransaction, error) {
+	return NewTransactionContext(context.Background(), goq, id)
+}
+
+// NewTransactionのcontext版。
+func NewTransactionContext(ctx context.Context, goq *Goquest, id string) (*GetTransaction, error) {
+	res := &GetTransaction{}
+	ep := fmt.Sprintf("/accounts/%v/transactions/%v", goq.Auth.Id, id)
+	err := goq.Get(ctx, ep, nil, res)
+	return res, err
+}
+
+// 期間内のtransactionを順に返すiteratorを作る。引数はNewTransactionsと同じ。
+// リクエストはNextを呼んだ時に必要な分だけ行う。
+func NewTransactionIterator(goq *Goquest, from, to string, pageSize int, types string) *TransactionIterator {
+	return &TransactionIterator{goq: goq, from: from, to: to, pageSize: pageSize, types: types}
+}
+
+// 次のtransactionに進む。無くなるかエラーになったらfalse。
+func (it *TransactionIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		res, err := NewTransactionsContext(ctx, it.goq, it.from, it.to, it.pageSize, it.types)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.pages = res.Pages
+	}
+	for len(it.buf) == 0 {
+		if len(it.pages) == 0 {
+			it.cur = nil
+			return false
+		}
+		page := it.pages[0]
+		it.pages = it.pages[1:]
+		it.buf, it.err = it.fetch(ctx, page)
+		if it.err != nil {
+			return false
+		}
+	}
+	it.cur = it.buf[0]
+	it.buf = it.buf[1:]
+	return true
+}
+
+// ページのurlのfrom,to,typeでidrangeを取得する。
+func (it *TransactionIterator) fetch(ctx context.Context, page string) (TransactionList, error) {
+	u, err := url.Parse(page)
+	if err != nil {
+		return nil, &DecodeError{Url: page, Err: err}
+	}
+	q := u.Query()
+	res, err := NewTransactionIDRangeContext(ctx, it.goq, q.Get("from"), q.Get("to"), q.Get("type"))
+	if err != nil {
+		return nil, err
+	}
+	return res.Transactions, nil
+}
+
+// Nextで進んだ現在のtransaction
+func (it *TransactionIterator) Transaction() Transaction {
+	return it.cur
+}
+
+// Nextがfalseを返した原因のエラー。最後まで読んだ場合はnil。
+func (it *TransactionIterator) Err() error {
+	return it.err
+}
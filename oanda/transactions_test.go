@@ -0,0 +1,199 @@
+package oanda_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// pages[i]のidrangeでids[i]のtransactionを返すserver。idrangeのリクエスト回数を数える。
+// failPageのidrangeは500を返す(-1なら無し)。
+type pageServer struct {
+	mu       sync.Mutex
+	pages    [][]int
+	failPage int
+	fetched  []string
+}
+
+func (s *pageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/accounts/acc/transactions":
+		urls := ""
+		for i := range s.pages {
+			if i > 0 {
+				urls += ","
+			}
+			urls += fmt.Sprintf(`"http://%v/accounts/acc/transactions/idrange?from=p%v&to=p%v&type=ORDER_FILL"`, r.Host, i, i)
+		}
+		fmt.Fprintf(w, `{"pages":[%v],"lastTransactionID":"99"}`, urls)
+	case "/accounts/acc/transactions/idrange":
+		s.fetched = append(s.fetched, q.Get("from"))
+		if q.Get("type") != "ORDER_FILL" || q.Get("from") != q.Get("to") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errorMessage":"bad page"}`)
+			return
+		}
+		i, _ := strconv.Atoi(q.Get("from")[1:])
+		if i == s.failPage {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"errorMessage":"down"}`)
+			return
+		}
+		list := ""
+		for j, id := range s.pages[i] {
+			if j > 0 {
+				list += ","
+			}
+			list += fmt.Sprintf(`{"id":"%v","type":"ORDER_FILL"}`, id)
+		}
+		fmt.Fprintf(w, `{"transactions":[%v],"lastTransactionID":"99"}`, list)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newPageClient(t *testing.T, s *pageServer) *oanda.Goquest {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	goq, err := oanda.NewClient(oanda.WithBaseURL(ts.URL), oanda.WithKey("acc", "token"), oanda.WithRetry(&oanda.RetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goq
+}
+
+// iteratorが返したidと、Nextがfalseになった時のErr
+func collect(it *oanda.TransactionIterator) ([]string, error) {
+	ids := []string{}
+	for it.Next(context.Background()) {
+		ids = append(ids, it.Transaction().Header().ID)
+	}
+	return ids, it.Err()
+}
+
+func TestTransactionIterator(t *testing.T) {
+	tests := []struct {
+		name    string
+		pages   [][]int
+		want    string
+		fetched int
+	}{
+		{"no pages", nil, "[]", 0},
+		{"one page", [][]int{{1, 2, 3}}, "[1 2 3]", 1},
+		{"page boundary", [][]int{{1, 2}, {3, 4}, {5}}, "[1 2 3 4 5]", 3},
+		// 空のページは飛ばして次のページを取得する
+		{"empty pages", [][]int{{}, {1}, {}, {}, {2}}, "[1 2]", 5},
+		{"empty last page", [][]int{{1}, {}}, "[1]", 2},
+	}
+	for _, tt := range tests {
+		s := &pageServer{pages: tt.pages, failPage: -1}
+		it := oanda.NewTransactionIterator(newPageClient(t, s), "", "", 0, "ORDER_FILL")
+		ids, err := collect(it)
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		if fmt.Sprint(ids) != tt.want || len(s.fetched) != tt.fetched {
+			t.Errorf("%v: ids = %v, fetched = %v", tt.name, ids, s.fetched)
+		}
+		// 読み切った後はリクエストしない
+		if it.Next(context.Background()) || it.Transaction() != nil || len(s.fetched) != tt.fetched {
+			t.Errorf("%v: Next after end", tt.name)
+		}
+	}
+}
+
+func TestTransactionIteratorError(t *testing.T) {
+	s := &pageServer{pages: [][]int{{1, 2}, {3}, {4}}, failPage: 1}
+	it := oanda.NewTransactionIterator(newPageClient(t, s), "", "", 0, "ORDER_FILL")
+	ids, err := collect(it)
+	var ae *oanda.APIError
+	if fmt.Sprint(ids) != "[1 2]" || !errors.As(err, &ae) || ae.StatusCode != 500 {
+		t.Errorf("ids,err = %v,%v", ids, err)
+	}
+	// エラー後は止まったまま
+	if it.Next(context.Background()) || len(s.fetched) != 2 {
+		t.Errorf("fetched after error: %v", s.fetched)
+	}
+
+	// pageSizeが不正ならリクエストせずにParamError
+	for _, size := range []int{-1, 1001} {
+		s := &pageServer{failPage: -1}
+		it := oanda.NewTransactionIterator(newPageClient(t, s), "", "", size, "")
+		var pe *oanda.ParamError
+		if _, err := collect(it); !errors.As(err, &pe) || pe.Field != "pageSize" {
+			t.Errorf("pageSize %v: %v", size, err)
+		}
+	}
+}
+
+func TestTransactionsWithSim(t *testing.T) {
+	_, goq := newSimClient(t)
+	ctx := context.Background()
+	// MARKET_ORDER,ORDER_FILLが2件ずつで計4件
+	for _, units := range []int{100, -100} {
+		if _, err := oanda.NewMarketOrderContext(ctx, goq, "USD_JPY", units); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pageSize int
+		types    string
+		pages    int
+		want     string
+	}{
+		{0, "", 1, "[1 2 3 4]"},
+		{4, "", 1, "[1 2 3 4]"},
+		{3, "", 2, "[1 2 3 4]"},
+		{1, "", 4, "[1 2 3 4]"},
+		{1, "ORDER_FILL", 2, "[2 4]"},
+		{0, "DAILY_FINANCING", 0, "[]"},
+	}
+	for _, tt := range tests {
+		pages, err := oanda.NewTransactionsContext(ctx, goq, "", "", tt.pageSize, tt.types)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages.Pages) != tt.pages || pages.LastID != "4" {
+			t.Errorf("pageSize %v %v: pages = %v, lastID = %v", tt.pageSize, tt.types, pages.Pages, pages.LastID)
+		}
+		ids, err := collect(oanda.NewTransactionIterator(goq, "", "", tt.pageSize, tt.types))
+		if err != nil || fmt.Sprint(ids) != tt.want {
+			t.Errorf("pageSize %v %v: ids = %v, err = %v", tt.pageSize, tt.types, ids, err)
+		}
+	}
+
+	since, err := oanda.NewTransactionsSinceIDContext(ctx, goq, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := since.Extract(); len(l) != 2 || l[0].Header().ID != "3" {
+		t.Errorf("sinceid = %v", l)
+	}
+	one, err := oanda.NewTransactionContext(ctx, goq, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := one.Transaction.(*oanda.OrderFillTransaction); !ok || f.Units != 100 {
+		t.Errorf("transaction 2 = %+v", one.Transaction)
+	}
+	var ae *oanda.APIError
+	if _, err := oanda.NewTransactionContext(ctx, goq, "5"); !errors.As(err, &ae) || ae.StatusCode != 404 {
+		t.Errorf("missing transaction: %v", err)
+	}
+	var pe *oanda.ParamError
+	if _, err := oanda.NewTransactionIDRangeContext(ctx, goq, "1", "", ""); !errors.As(err, &pe) {
+		t.Errorf("idrange without to: %v", err)
+	}
+}
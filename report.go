@@ -0,0 +1,98 @@
+/*
+ * 結果の記録(reporting layer)。
+ * trade.json,balance.jsonへの書き出しと、tweet用Messageの組み立て・ツイート。
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/zenryokukun/gotweet"
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// graph用データの最大個数
+const historyLen = 5000
+
+type Reporter interface {
+	// 取引を記録する。x:ロウソク足のopenTime action:"OPEN","CLOSE"
+	Trade(x int64, price float64, side, action string)
+	// 評価額込みの総利益を記録する
+	Balance(x int64, price, upl float64)
+	// 口座全体の評価額込み残高を記録する。リスク管理のピーク・日次損失に使う
+	Equity(x int64, equity float64)
+}
+
+// trade.json,balance.jsonと、口座のequity.jsonに書き出すReporter
+type fileReporter struct {
+	tradeFile, balanceFile string
+	mlen                   int // 保持する最大個数
+	equity                 *equityLog
+}
+
+func newFileReporter(tradeFile, balanceFile string, equity *equityLog) *fileReporter {
+	return &fileReporter{tradeFile: tradeFile, balanceFile: balanceFile, mlen: historyLen, equity: equity}
+}
+
+func (r *fileReporter) Trade(x int64, price float64, side, action string) {
+	writeTrade(r.tradeFile, r.mlen, x, price, side, action)
+}
+
+func (r *fileReporter) Balance(x int64, price, upl float64) {
+	writeBalance(r.balanceFile, r.mlen, x, price, upl)
+}
+
+func (r *fileReporter) Equity(x int64, equity float64) {
+	r.equity.Add(x, equity)
+}
+
+// 実現損益をtweetメッセージに設定
+func addClosingMsg(ctx context.Context, data MarketData, ids string, m *Message) error {
+	realized, err := data.RealizedPL(ctx, ids)
+	if err != nil {
+		return err
+	}
+	m.realizedProf = realized
+	return nil
+}
+
+// 保有中ポジションの情報をメッセージにセット。tradesのうちidsに含まれるものを集計する。
+func addPositionMsg(trades []*oanda.TradeData, ids string, m *Message) {
+	unrealized, units := 0.0, 0 // 評価額,保有量
+	for _, t := range trades {
+		if !strings.Contains(","+ids, ","+t.ID+",") {
+			continue
+		}
+		unrealized += t.UnrealizedPL
+		units += t.CurrentUnits
+	}
+	if units > 0 {
+		m.side = "LONG"
+	} else {
+		m.side = "SHORT"
+	}
+	m.unrealizedProf = unrealized
+	m.units = units
+}
+
+func addTotalPLMsg(pl float64, m *Message) {
+	m.totalProf = pl
+}
+
+// グラフ画像を生成してmsgをツイートする
+func (b *bot) tweet(msg *Message) {
+	img := b.path(IMG_PATH)
+	cmd := exec.Command(genPyCommand(), IMG_PYSCRIPT, img, b.dir, b.prm.Inst)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		//err時は表示
+		fmt.Println(err)
+		fmt.Println(string(out))
+	}
+	twitter := gotweet.NewTwitter("./twitter.json")
+	twitter.Tweet(msg.String(), img)
+}
@@ -0,0 +1,103 @@
+/*
+ * 新規注文前のリスク確認。Executorが新規注文の前に呼ぶ。
+ * 判定自体はriskパッケージ。ここでは口座情報とequity.jsonから判定に使う値を集める。
+ */
+
+package main
+
+import (
+	"sync"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/risk"
+)
+
+type RiskChecker interface {
+	// instのunits(売りは負)の新規注文をしてよいか。制限に掛かる場合はerrorを返す。
+	// flat:この注文の前にinstの保有ポジを閉じている
+	Allow(inst string, units int, flat bool) error
+	// kill switchが入っているか。入っていたら保有ポジを閉じて停止する
+	Killed() bool
+}
+
+// param.jsonのRiskで判定するRiskChecker。
+// 口座情報はMarketData(同期済み)から、評価額込み残高の推移は口座のequity.jsonから取る。
+type limitRisk struct {
+	limits risk.Limits
+	data   MarketData
+	equity *equityLog
+}
+
+func newLimitRisk(limits risk.Limits, data MarketData, equity *equityLog) *limitRisk {
+	return &limitRisk{limits: limits, data: data, equity: equity}
+}
+
+// 口座全体の評価額込み残高の推移(equity.json)。口座の全botで共有し、各botのframeで記録する。
+// 通貨ペア毎のbalance.jsonは記録する時刻も基準の残高もbot毎に違うので、リスク管理にはこちらを使う。
+type equityLog struct {
+	mu   sync.Mutex
+	file string
+	mlen int // 保持する最大個数
+}
+
+func newEquityLog(file string) *equityLog {
+	return &equityLog{file: file, mlen: historyLen}
+}
+
+func (l *equityLog) Add(x int64, equity float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ed := NewEquityHistory()
+	load(l.file, ed)
+	ed.Add(x, equity)
+	ed.Slice(l.mlen)
+	dump(l.file, ed)
+}
+
+func (l *equityLog) Load() *EquityData {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ed := NewEquityHistory()
+	load(l.file, ed)
+	return ed
+}
+
+func (r *limitRisk) Allow(inst string, units int, flat bool) error {
+	acc := r.data.Account()
+	peak, dayStart := r.equityHistory(risk.Equity(&acc))
+	return r.limits.Check(&risk.State{
+		Account:    acc,
+		Instrument: inst,
+		Units:      units,
+		Flat:       flat,
+		DayStart:   dayStart,
+		Peak:       peak,
+	})
+}
+
+func (r *limitRisk) Killed() bool {
+	return r.limits.Killed()
+}
+
+// equity.jsonから評価額込み残高のピークと、その日の開始時点の値を求める。
+// その日の開始時点の値は、日足の区切りより前の最後の記録。無ければその日の最初の記録。
+// 記録が無ければcurrent(現在の評価額込み残高)を返す。
+func (r *limitRisk) equityHistory(current float64) (float64, float64) {
+	peak, start := current, current
+	if r.equity == nil {
+		return peak, start
+	}
+	ed := r.equity.Load()
+	dayStart := oanda.Granularity("D").Align(clock.Now(), candleAlign).Unix()
+
+	found := false
+	for i, eq := range ed.Equity {
+		if eq > peak {
+			peak = eq
+		}
+		if ed.X[i] < dayStart || !found {
+			start, found = eq, true
+		}
+	}
+	return peak, start
+}
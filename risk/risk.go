@@ -0,0 +1,126 @@
+/*
+ * 新規注文前のリスク管理。口座全体の保有量・損失・証拠金を見て、新規取引してよいか判定する。
+ * APIやファイルには依存させない。必要な値は呼び出し側が集めてStateに入れる。
+ * 決済はリスクを減らすので判定しない。
+ */
+
+package risk
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+type (
+	// param.jsonのRisk。いずれも0(空)なら制限しない。
+	Limits struct {
+		// 通貨ペア毎の保有量(絶対値)の上限。注文後の量で判定する
+		MaxUnits int
+		// 口座全体の保有量(通貨ペア毎の絶対値の合計)の上限。注文後の量で判定する
+		MaxTotalUnits int
+		// その日(oandaの日足の区切り)の評価額込み損失の上限。口座通貨で正の値
+		MaxDailyLoss float64
+		// 評価額込み残高のピークからの下落率の上限。0.1なら10%
+		MaxDrawdown float64
+		// 証拠金使用率(MarginUsed/評価額込み残高)の上限。0.5なら50%
+		MaxMarginUtil float64
+		// kill switch。このファイルが存在したら保有ポジを閉じて停止する
+		KillFile string
+	}
+
+	// 判定に使う口座の状態
+	State struct {
+		Account    oanda.AccountData // Positionsも入れること
+		Instrument string            // 注文する通貨ペア
+		Units      int               // 注文量。売りは負
+		// 注文の前にInstrumentの保有ポジを閉じている場合はtrue。保有量を0として判定する
+		Flat bool
+		// 評価額込み残高の、その日の開始時点の値とピーク。0なら判定しない
+		DayStart, Peak float64
+	}
+
+	// 制限に掛かった場合のerror
+	Violation struct {
+		Rule string // Limitsのfield名
+		Msg  string
+	}
+)
+
+func (v *Violation) Error() string {
+	return "risk: " + v.Rule + ": " + v.Msg
+}
+
+// sの状態で新規注文してよいか。制限に掛かる場合は*Violationを返す
+func (l *Limits) Check(s *State) error {
+	units, total := 0, 0 // 注文する通貨ペアの保有量,口座全体の保有量
+	for _, p := range s.Account.Positions {
+		u := netUnits(&p)
+		if p.Instrument == s.Instrument {
+			units = u
+			continue
+		}
+		total += abs(u)
+	}
+	if s.Flat {
+		units = 0
+	}
+	after := units + s.Units
+	total += abs(after)
+	if l.MaxUnits > 0 && abs(after) > l.MaxUnits {
+		return &Violation{"MaxUnits", fmt.Sprintf("%v units after order exceeds %v", abs(after), l.MaxUnits)}
+	}
+	if l.MaxTotalUnits > 0 && total > l.MaxTotalUnits {
+		return &Violation{"MaxTotalUnits", fmt.Sprintf("%v units after order exceeds %v", total, l.MaxTotalUnits)}
+	}
+
+	equity := Equity(&s.Account)
+	if l.MaxDailyLoss > 0 && s.DayStart > 0 && s.DayStart-equity >= l.MaxDailyLoss {
+		return &Violation{"MaxDailyLoss", fmt.Sprintf("lost %.2f today, limit %v", s.DayStart-equity, l.MaxDailyLoss)}
+	}
+	if l.MaxDrawdown > 0 && s.Peak > 0 {
+		if dd := (s.Peak - equity) / s.Peak; dd >= l.MaxDrawdown {
+			return &Violation{"MaxDrawdown", fmt.Sprintf("drawdown %.4f from peak %.2f, limit %v", dd, s.Peak, l.MaxDrawdown)}
+		}
+	}
+	if l.MaxMarginUtil > 0 && equity > 0 {
+		if u := s.Account.MarginUsed / equity; u >= l.MaxMarginUtil {
+			return &Violation{"MaxMarginUtil", fmt.Sprintf("margin utilization %.4f, limit %v", u, l.MaxMarginUtil)}
+		}
+	}
+	return nil
+}
+
+// kill switchが入っているか
+func (l *Limits) Killed() bool {
+	if len(l.KillFile) == 0 {
+		return false
+	}
+	_, err := os.Stat(l.KillFile)
+	return err == nil
+}
+
+// 評価額込みの残高
+func Equity(acc *oanda.AccountData) float64 {
+	return acc.Balance + acc.UnrealizedPL
+}
+
+// 保有量。shortなら負
+func netUnits(p *oanda.PositionData) int {
+	u := 0
+	if p.Long != nil {
+		u += p.Long.Units
+	}
+	if p.Short != nil {
+		u += p.Short.Units
+	}
+	return u
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,103 @@
+package risk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// long,shortの保有量(shortは負)のポジ
+func pos(inst string, long, short int) oanda.PositionData {
+	return oanda.PositionData{
+		Instrument: inst,
+		Long:       &oanda.PositionDataSide{Units: long},
+		Short:      &oanda.PositionDataSide{Units: short},
+	}
+}
+
+func account(balance, upl, margin float64, ps ...oanda.PositionData) oanda.AccountData {
+	return oanda.AccountData{Balance: balance, UnrealizedPL: upl, MarginUsed: margin, Positions: ps}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		state  State
+		rule   string // 掛かる制限。空なら通る
+	}{
+		{"no limits", Limits{}, State{Account: account(100000, 0, 0, pos("USD_JPY", 100000, 0)), Instrument: "USD_JPY", Units: 100000}, ""},
+
+		// MaxUnits。注文後の量で判定する
+		{"units within", Limits{MaxUnits: 1500}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: 500}, ""},
+		{"units exceed", Limits{MaxUnits: 1200}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: 500}, "MaxUnits"},
+		{"units reduce", Limits{MaxUnits: 1200}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: -1000}, ""},
+		{"units reverse", Limits{MaxUnits: 1200}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: -3000}, "MaxUnits"},
+		{"units other instrument", Limits{MaxUnits: 1200}, State{Account: account(100000, 0, 0, pos("EUR_USD", 5000, 0)), Instrument: "USD_JPY", Units: 1000}, ""},
+
+		// Flat。close-then-openの場合、閉じたポジは保有量に含めない
+		{"reopen not flat", Limits{MaxUnits: 500}, State{Account: account(100000, 0, 0, pos("USD_JPY", 0, -1000)), Instrument: "USD_JPY", Units: 1000}, ""},
+		{"reopen flat", Limits{MaxUnits: 500}, State{Account: account(100000, 0, 0, pos("USD_JPY", 0, -1000)), Instrument: "USD_JPY", Units: 1000, Flat: true}, "MaxUnits"},
+		{"same side flat", Limits{MaxUnits: 1500}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: 1000, Flat: true}, ""},
+
+		// longとshortは相殺した量で数える
+		{"netted within", Limits{MaxUnits: 1000}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, -600)), Instrument: "USD_JPY", Units: 500}, ""},
+		{"netted exceed", Limits{MaxUnits: 1000}, State{Account: account(100000, 0, 0, pos("USD_JPY", 1000, -400)), Instrument: "USD_JPY", Units: 500}, "MaxUnits"},
+
+		// MaxTotalUnits。通貨ペア毎の絶対値の合計
+		{"total within", Limits{MaxTotalUnits: 3000}, State{Account: account(100000, 0, 0, pos("EUR_USD", 0, -2000)), Instrument: "USD_JPY", Units: 1000}, ""},
+		{"total exceed", Limits{MaxTotalUnits: 2500}, State{Account: account(100000, 0, 0, pos("EUR_USD", 0, -2000)), Instrument: "USD_JPY", Units: 1000}, "MaxTotalUnits"},
+		{"total short counts", Limits{MaxTotalUnits: 2500}, State{Account: account(100000, 0, 0, pos("EUR_USD", 1000, 0)), Instrument: "USD_JPY", Units: -2000}, "MaxTotalUnits"},
+		{"total flat", Limits{MaxTotalUnits: 3000}, State{Account: account(100000, 0, 0, pos("EUR_USD", 0, -2000), pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: -1000, Flat: true}, ""},
+		{"total not flat", Limits{MaxTotalUnits: 2500}, State{Account: account(100000, 0, 0, pos("EUR_USD", 0, -2000), pos("USD_JPY", 1000, 0)), Instrument: "USD_JPY", Units: 1000}, "MaxTotalUnits"},
+
+		// MaxDailyLoss。評価額込み残高で判定する
+		{"daily loss hit", Limits{MaxDailyLoss: 1000}, State{Account: account(99500, -500, 0), Instrument: "USD_JPY", Units: 1000, DayStart: 100000}, "MaxDailyLoss"},
+		{"daily loss within", Limits{MaxDailyLoss: 1001}, State{Account: account(99500, -500, 0), Instrument: "USD_JPY", Units: 1000, DayStart: 100000}, ""},
+		{"daily loss no start", Limits{MaxDailyLoss: 1}, State{Account: account(99500, -500, 0), Instrument: "USD_JPY", Units: 1000}, ""},
+
+		// MaxDrawdown
+		{"drawdown hit", Limits{MaxDrawdown: 0.1}, State{Account: account(99000, 0, 0), Instrument: "USD_JPY", Units: 1000, Peak: 110000}, "MaxDrawdown"},
+		{"drawdown within", Limits{MaxDrawdown: 0.11}, State{Account: account(99000, 0, 0), Instrument: "USD_JPY", Units: 1000, Peak: 110000}, ""},
+		{"drawdown unrealized", Limits{MaxDrawdown: 0.1}, State{Account: account(110000, -11000, 0), Instrument: "USD_JPY", Units: 1000, Peak: 110000}, "MaxDrawdown"},
+		{"drawdown no peak", Limits{MaxDrawdown: 0.1}, State{Account: account(50000, 0, 0), Instrument: "USD_JPY", Units: 1000}, ""},
+
+		// MaxMarginUtil
+		{"margin hit", Limits{MaxMarginUtil: 0.5}, State{Account: account(90000, 10000, 50000), Instrument: "USD_JPY", Units: 1000}, "MaxMarginUtil"},
+		{"margin within", Limits{MaxMarginUtil: 0.6}, State{Account: account(90000, 10000, 50000), Instrument: "USD_JPY", Units: 1000}, ""},
+		{"margin no equity", Limits{MaxMarginUtil: 0.5}, State{Account: account(0, 0, 50000), Instrument: "USD_JPY", Units: 1000}, ""},
+	}
+	for _, tt := range tests {
+		err := tt.limits.Check(&tt.state)
+		if tt.rule == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		var v *Violation
+		if !errors.As(err, &v) || v.Rule != tt.rule {
+			t.Errorf("%v: err = %v, want %v", tt.name, err, tt.rule)
+		}
+	}
+}
+
+func TestKilled(t *testing.T) {
+	kill := filepath.Join(t.TempDir(), "KILL")
+	l := &Limits{KillFile: kill}
+	if l.Killed() {
+		t.Error("killed without file")
+	}
+	if err := os.WriteFile(kill, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Killed() {
+		t.Error("not killed with file")
+	}
+	if (&Limits{}).Killed() {
+		t.Error("killed without KillFile")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/risk"
+)
+
+type equityRecord struct {
+	x      time.Time
+	equity float64
+}
+
+func TestEquityHistory(t *testing.T) {
+	utc := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name        string
+		now         string
+		records     []equityRecord
+		current     float64
+		peak, start float64
+	}{
+		// 冬時間はNY17時=UTC22時で日が変わる
+		{"last record before day start", "2022-01-05 03:00", []equityRecord{
+			{utc("2022-01-04 21:50"), 100500},
+			{utc("2022-01-04 21:55"), 100300},
+			{utc("2022-01-04 22:00"), 100800},
+			{utc("2022-01-05 02:55"), 99800},
+		}, 99700, 100800, 100300},
+		{"no record before day start", "2022-01-05 03:00", []equityRecord{
+			{utc("2022-01-04 22:00"), 100100},
+			{utc("2022-01-04 23:00"), 100200},
+		}, 99900, 100200, 100100},
+		{"all records before day start", "2022-01-05 03:00", []equityRecord{
+			{utc("2022-01-03 12:00"), 100100},
+			{utc("2022-01-04 12:00"), 99900},
+		}, 99800, 100100, 99900},
+		{"current is peak", "2022-01-05 03:00", []equityRecord{
+			{utc("2022-01-04 21:55"), 100300},
+		}, 101000, 101000, 100300},
+		// 同じ時刻の記録は後から記録した値(別のbotが同じ足で記録した場合)
+		{"same time", "2022-01-05 03:00", []equityRecord{
+			{utc("2022-01-04 21:55"), 100900},
+			{utc("2022-01-04 21:55"), 100300},
+		}, 100000, 100300, 100300},
+		// 夏時間はNY17時=UTC21時。21:30は当日の記録になる
+		{"daylight saving", "2022-07-05 03:00", []equityRecord{
+			{utc("2022-07-04 20:55"), 100100},
+			{utc("2022-07-04 21:30"), 100900},
+		}, 100000, 100900, 100100},
+		{"no records", "2022-01-05 03:00", nil, 99000, 99000, 99000},
+	}
+	for _, tt := range tests {
+		setClock(t, utc(tt.now))
+		equity := newEquityLog(filepath.Join(t.TempDir(), "equity.json"))
+		for _, r := range tt.records {
+			equity.Add(r.x.Unix(), r.equity)
+		}
+		r := newLimitRisk(risk.Limits{}, nil, equity)
+		peak, start := r.equityHistory(tt.current)
+		if peak != tt.peak || start != tt.start {
+			t.Errorf("%v: peak,start = %v,%v, want %v,%v", tt.name, peak, start, tt.peak, tt.start)
+		}
+	}
+	// equity.jsonが無ければcurrent
+	if peak, start := newLimitRisk(risk.Limits{}, nil, nil).equityHistory(99000); peak != 99000 || start != 99000 {
+		t.Errorf("no equity log: %v,%v", peak, start)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * 売買判定(signal layer)。
+ * Snapshotを戦略の入力に変換して判定するだけで、APIは呼ばない。
+ * 判定ロジック自体はbacktestと共通のstrategyにある。
+ */
+
+package main
+
+import (
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/strategy"
+)
+
+// param.jsonのStrategyで選んだ戦略で、backtestと同じ判定をする。current:現在価格
+func decide(strat strategy.Strategy, snap *Snapshot, current float64) strategy.Decision {
+	return strat.Decide(strategyInput(snap, current))
+}
+
+// 戦略に渡す入力。保有ポジと口座はSnapshotから取る。
+func strategyInput(snap *Snapshot, current float64) *strategy.Input {
+	pos := snap.Position
+	in := &strategy.Input{Sticks: snap.Sticks, Current: current, Side: tradeSide(pos)}
+	switch in.Side {
+	case "BUY":
+		in.Units, in.Price = pos.Long.Units, pos.Long.Average
+	case "SELL":
+		in.Units, in.Price = pos.Short.Units, pos.Short.Average
+	}
+	in.Balance, in.UnrealizedPL = snap.Account.Balance, snap.Account.UnrealizedPL
+	if snap.Price != nil {
+		if ask, bid := snap.Price.Latest(); ask > 0 && bid > 0 {
+			in.Ask, in.Bid = ask, bid
+		}
+	}
+	return in
+}
+
+// Longポジを持っていいれば"BUY"、Shortなら"SELL"を返す
+// 両建て不可アカウントを想定しているため、両方は存在することは想定しない。
+// ポジ無しの時は空文字を返す
+func tradeSide(p *oanda.PositionData) string {
+	if !p.Has() {
+		return ""
+	}
+	if p.Long.Units > 0 {
+		return "BUY"
+	}
+	if p.Short.Units < 0 {
+		return "SELL"
+	}
+	return ""
+}
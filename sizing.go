@@ -0,0 +1,36 @@
+/*
+ * 新規取引の量。計算はsizingパッケージで、ここではSnapshotと換算レートから入力を作る。
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zenryokukun/oanda-bot/risk"
+	"github.com/zenryokukun/oanda-bot/sizing"
+)
+
+// param.jsonのSizingで新規取引の量を求める。current:現在価格
+// 換算レートが取得できない場合は量を計算できないので0(取引しない)にする。
+func (b *bot) orderUnits(ctx context.Context, snap *Snapshot, current float64) int {
+	in := &sizing.Input{
+		Units:     b.prm.Units,
+		LossRate:  b.prm.LossRate,
+		Price:     current,
+		Sticks:    snap.Sticks,
+		NAV:       risk.Equity(&snap.Account),
+		QuoteHome: 1,
+	}
+	// 固定量なら換算レートは使わないので取得しない
+	if _, fixed := b.sizer.(sizing.Fixed); !fixed {
+		rate, err := b.data.QuoteHome(ctx)
+		if err != nil {
+			fmt.Printf("%vframe:quoteHome:%v, skip opening\n", b.logPrefix(), err)
+			return 0
+		}
+		in.QuoteHome = rate
+	}
+	return b.sizer.Units(in)
+}
@@ -0,0 +1,241 @@
+/*
+ * 新規取引の量(position sizing)。param.jsonのSizing.Methodの名前で選ぶ。
+ * 量を計算するだけで、APIは呼ばない。換算レート等は呼び出し側が集めてInputに入れる。
+ * 新しい方法はRegisterで登録する。
+ */
+
+package sizing
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// Config.Methodが空の場合の方法
+const DefaultMethod = "fixed"
+
+type (
+	// param.jsonのSizing。使う項目は方法毎に違う。
+	Config struct {
+		// "fixed","fraction","risk","atr","kelly"。空なら"fixed"(Param.Units)
+		Method string
+		// fraction:評価額込み残高に対する想定元本の割合(1なら1倍)。
+		// kelly:Kelly比率に掛ける割合。0なら1(full Kelly)。half Kellyなら0.5
+		Fraction float64
+		// risk,atr:1取引の損切で失ってよい評価額込み残高の割合。0.01なら1%
+		Risk float64
+		// atr:ATRの期間。0なら14。確定足が足りない場合はある分で計算する
+		ATRPeriod int
+		// atr:損切幅とみなすATRの倍数。0なら1
+		ATRMult float64
+		// kelly:勝率と、平均利益/平均損失。backtestの結果から決める
+		WinRate float64
+		Payoff  float64
+	}
+
+	// 量の計算に使う値
+	Input struct {
+		Units    int     // Param.Units。fixedの量。計算できない場合もこれを使う
+		LossRate float64 // Param.LossRate。risk,kellyで損切幅に使う
+		Price    float64 // 約定見込み価格(quote通貨建て)
+		// 判定に使った確定足。atrで使う
+		Sticks oanda.CandleSticks
+		NAV    float64 // 評価額込み残高(口座通貨建て)
+		// quote通貨1単位の口座通貨での値。USD_JPYでJPY口座なら1、EUR_USDでJPY口座ならUSD_JPYの価格
+		QuoteHome float64
+	}
+
+	Sizer interface {
+		// 新規取引の量(正)。0なら取引しない。最小取引量・最大注文量への丸めは呼び出し側で行う
+		Units(in *Input) int
+	}
+
+	// Configから作る関数
+	Factory func(cfg Config) (Sizer, error)
+)
+
+var registry = map[string]Factory{}
+
+func init() {
+	Register("fixed", func(Config) (Sizer, error) { return Fixed{}, nil })
+	Register("fraction", NewFraction)
+	Register("risk", NewRiskPerTrade)
+	Register("atr", NewATR)
+	Register("kelly", NewKelly)
+}
+
+// nameで方法を登録する。同じ名前は上書きする。
+func Register(name string, f Factory) {
+	registry[name] = f
+}
+
+// cfg.Methodの名前のSizerを作る。空ならDefaultMethod。
+func New(cfg Config) (Sizer, error) {
+	name := cfg.Method
+	if len(name) == 0 {
+		name = DefaultMethod
+	}
+	f, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("sizing: unknown method:%v (available:%v)", name, Names())
+	}
+	return f(cfg)
+}
+
+// 登録済みの方法の名前
+func Names() []string {
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Param.Unitsをそのまま使うか。換算レート等が不要なので、呼び出し側で取得を省くのに使う
+func (c Config) Fixed() bool {
+	return len(c.Method) == 0 || c.Method == DefaultMethod
+}
+
+// Param.Unitsの固定量
+type Fixed struct{}
+
+func (Fixed) Units(in *Input) int {
+	return in.Units
+}
+
+// 評価額込み残高のFraction倍を想定元本とする。
+type Fraction struct {
+	cfg Config
+}
+
+func NewFraction(cfg Config) (Sizer, error) {
+	if cfg.Fraction <= 0 {
+		return nil, fmt.Errorf("sizing: fraction: Fraction must be positive:%v", cfg.Fraction)
+	}
+	return &Fraction{cfg: cfg}, nil
+}
+
+func (f *Fraction) Units(in *Input) int {
+	unit := in.Price * in.QuoteHome // 1単位の口座通貨での値
+	if !valid(in) || unit <= 0 {
+		return in.Units
+	}
+	return floor(in.NAV * f.cfg.Fraction / unit)
+}
+
+// 損切(LossRate)に掛かった時の損失が評価額込み残高のRiskになる量。
+type RiskPerTrade struct {
+	cfg Config
+}
+
+func NewRiskPerTrade(cfg Config) (Sizer, error) {
+	if cfg.Risk <= 0 {
+		return nil, fmt.Errorf("sizing: risk: Risk must be positive:%v", cfg.Risk)
+	}
+	return &RiskPerTrade{cfg: cfg}, nil
+}
+
+func (r *RiskPerTrade) Units(in *Input) int {
+	if !valid(in) {
+		return in.Units
+	}
+	return byStop(in.NAV*r.cfg.Risk, in.Price*math.Abs(in.LossRate), in)
+}
+
+// ATRのATRMult倍を損切幅とみなし、その損失が評価額込み残高のRiskになる量。
+// 値動きが大きいほど量が減る。
+type ATR struct {
+	cfg Config
+}
+
+func NewATR(cfg Config) (Sizer, error) {
+	if cfg.Risk <= 0 {
+		return nil, fmt.Errorf("sizing: atr: Risk must be positive:%v", cfg.Risk)
+	}
+	if cfg.ATRPeriod <= 0 {
+		cfg.ATRPeriod = 14
+	}
+	if cfg.ATRMult <= 0 {
+		cfg.ATRMult = 1
+	}
+	return &ATR{cfg: cfg}, nil
+}
+
+func (a *ATR) Units(in *Input) int {
+	if !valid(in) {
+		return in.Units
+	}
+	atr := AverageTrueRange(in.Sticks, a.cfg.ATRPeriod)
+	return byStop(in.NAV*a.cfg.Risk, atr*a.cfg.ATRMult, in)
+}
+
+// Kelly比率(勝率W、平均利益/平均損失R の時 W-(1-W)/R)にFractionを掛けた割合を、
+// 損切(LossRate)に掛かった時に失う量にする。Kelly比率が0以下なら取引しない。
+type Kelly struct {
+	cfg Config
+}
+
+func NewKelly(cfg Config) (Sizer, error) {
+	if cfg.WinRate <= 0 || cfg.WinRate >= 1 {
+		return nil, fmt.Errorf("sizing: kelly: WinRate must be between 0 and 1:%v", cfg.WinRate)
+	}
+	if cfg.Payoff <= 0 {
+		return nil, fmt.Errorf("sizing: kelly: Payoff must be positive:%v", cfg.Payoff)
+	}
+	if cfg.Fraction <= 0 {
+		cfg.Fraction = 1
+	}
+	return &Kelly{cfg: cfg}, nil
+}
+
+func (k *Kelly) Units(in *Input) int {
+	f := k.cfg.WinRate - (1-k.cfg.WinRate)/k.cfg.Payoff
+	if f <= 0 {
+		return 0
+	}
+	if !valid(in) {
+		return in.Units
+	}
+	return byStop(in.NAV*f*k.cfg.Fraction, in.Price*math.Abs(in.LossRate), in)
+}
+
+// 直近period本のATR(true rangeの単純平均)。足りない場合はある分で計算する。計算できなければ0
+func AverageTrueRange(cs oanda.CandleSticks, period int) float64 {
+	if len(cs) < 2 || period <= 0 {
+		return 0
+	}
+	st := len(cs) - period
+	if st < 1 {
+		st = 1
+	}
+	sum := 0.0
+	for i := st; i < len(cs); i++ {
+		h, l, pc := cs[i].Prices.H, cs[i].Prices.L, cs[i-1].Prices.C
+		sum += math.Max(h-l, math.Max(math.Abs(h-pc), math.Abs(l-pc)))
+	}
+	return sum / float64(len(cs)-st)
+}
+
+// 1単位あたりstop(quote通貨建ての価格幅)動いた時の損失がlossになる量。stopが0なら計算できないのでin.Units
+func byStop(loss, stop float64, in *Input) int {
+	if stop <= 0 {
+		return in.Units
+	}
+	return floor(loss / (stop * in.QuoteHome))
+}
+
+// 残高・価格・換算レートがそろっているか
+func valid(in *Input) bool {
+	return in.NAV > 0 && in.Price > 0 && in.QuoteHome > 0
+}
+
+func floor(f float64) int {
+	if f <= 0 {
+		return 0
+	}
+	return int(math.Floor(f))
+}
@@ -0,0 +1,150 @@
+package sizing
+
+import (
+	"math"
+	"testing"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+func sticks(hlc ...[3]float64) oanda.CandleSticks {
+	cs := oanda.CandleSticks{}
+	for _, p := range hlc {
+		cs = append(cs, oanda.CandleStick{Prices: &oanda.Hloc{H: p[0], L: p[1], C: p[2]}})
+	}
+	return cs
+}
+
+// true rangeは2,4(上に窓),6(下に窓)
+var atrSticks = sticks(
+	[3]float64{101, 99, 100},
+	[3]float64{102, 100, 101},
+	[3]float64{105, 103, 104},
+	[3]float64{100, 98, 99},
+)
+
+func TestAverageTrueRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		cs     oanda.CandleSticks
+		period int
+		want   float64
+	}{
+		{"all", atrSticks, 3, 4},
+		{"recent", atrSticks, 2, 5},
+		{"last", atrSticks, 1, 6},
+		{"short of period", atrSticks, 10, 4},
+		{"one stick", atrSticks[:1], 3, 0},
+		{"no sticks", nil, 3, 0},
+		{"zero period", atrSticks, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := AverageTrueRange(tt.cs, tt.period); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%v: ATR = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestByStop(t *testing.T) {
+	tests := []struct {
+		name       string
+		loss, stop float64
+		quoteHome  float64
+		want       int
+	}{
+		{"home quote", 1000, 0.5, 1, 2000},
+		{"converted", 1000, 0.5, 150, 13},
+		{"floor", 1000, 0.3, 1, 3333},
+		{"no stop", 1000, 0, 1, 500},
+		{"negative stop", 1000, -1, 1, 500},
+		{"no loss", 0, 0.5, 1, 0},
+		{"negative loss", -1000, 0.5, 1, 0},
+	}
+	for _, tt := range tests {
+		in := &Input{Units: 500, QuoteHome: tt.quoteHome}
+		if got := byStop(tt.loss, tt.stop, in); got != tt.want {
+			t.Errorf("%v: byStop = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func newSizer(t *testing.T, cfg Config) Sizer {
+	t.Helper()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUnits(t *testing.T) {
+	// 評価額込み残高100,000、価格100、損切1%(1.0)
+	in := func() *Input {
+		return &Input{Units: 500, LossRate: -0.01, Price: 100, Sticks: atrSticks, NAV: 100000, QuoteHome: 1}
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		mod  func(in *Input)
+		want int
+	}{
+		{"fixed", Config{}, nil, 500},
+		{"fraction", Config{Method: "fraction", Fraction: 2}, nil, 2000},
+		{"fraction converted", Config{Method: "fraction", Fraction: 2}, func(in *Input) { in.QuoteHome = 1.5 }, 1333},
+		{"risk", Config{Method: "risk", Risk: 0.01}, nil, 1000},
+		{"risk converted", Config{Method: "risk", Risk: 0.01}, func(in *Input) { in.QuoteHome = 150 }, 6},
+		{"atr", Config{Method: "atr", Risk: 0.01, ATRPeriod: 3}, nil, 250},
+		{"atr mult", Config{Method: "atr", Risk: 0.01, ATRPeriod: 3, ATRMult: 2}, nil, 125},
+		{"atr default period", Config{Method: "atr", Risk: 0.01}, nil, 250},
+
+		// Kelly比率 W-(1-W)/R。損切で失う額がNAV*比率*Fraction
+		{"kelly", Config{Method: "kelly", WinRate: 0.75, Payoff: 1}, nil, 50000},
+		{"kelly half", Config{Method: "kelly", WinRate: 0.75, Payoff: 1, Fraction: 0.5}, nil, 25000},
+		{"kelly payoff", Config{Method: "kelly", WinRate: 0.4, Payoff: 2}, nil, 10000},
+		{"kelly no edge", Config{Method: "kelly", WinRate: 0.5, Payoff: 1}, nil, 0},
+		{"kelly negative edge", Config{Method: "kelly", WinRate: 0.4, Payoff: 1}, nil, 0},
+		{"kelly negative edge invalid", Config{Method: "kelly", WinRate: 0.4, Payoff: 1}, func(in *Input) { in.NAV = 0 }, 0},
+
+		// 残高・価格・換算レートがそろっていない場合はParam.Units
+		{"fraction no nav", Config{Method: "fraction", Fraction: 1}, func(in *Input) { in.NAV = 0 }, 500},
+		{"fraction no price", Config{Method: "fraction", Fraction: 1}, func(in *Input) { in.Price = 0 }, 500},
+		{"risk no quote", Config{Method: "risk", Risk: 0.01}, func(in *Input) { in.QuoteHome = 0 }, 500},
+		{"risk negative nav", Config{Method: "risk", Risk: 0.01}, func(in *Input) { in.NAV = -1 }, 500},
+		{"atr no price", Config{Method: "atr", Risk: 0.01}, func(in *Input) { in.Price = 0 }, 500},
+		{"kelly no nav", Config{Method: "kelly", WinRate: 0.6, Payoff: 1}, func(in *Input) { in.NAV = 0 }, 500},
+		// 損切幅が0の場合もParam.Units
+		{"risk no loss rate", Config{Method: "risk", Risk: 0.01}, func(in *Input) { in.LossRate = 0 }, 500},
+		{"atr no sticks", Config{Method: "atr", Risk: 0.01}, func(in *Input) { in.Sticks = nil }, 500},
+	}
+	for _, tt := range tests {
+		i := in()
+		if tt.mod != nil {
+			tt.mod(i)
+		}
+		if got := newSizer(t, tt.cfg).Units(i); got != tt.want {
+			t.Errorf("%v: units = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"default", Config{}, true},
+		{"unknown", Config{Method: "martingale"}, false},
+		{"fraction zero", Config{Method: "fraction"}, false},
+		{"risk zero", Config{Method: "risk"}, false},
+		{"atr zero risk", Config{Method: "atr"}, false},
+		{"kelly win rate 1", Config{Method: "kelly", WinRate: 1, Payoff: 1}, false},
+		{"kelly win rate 0", Config{Method: "kelly", WinRate: 0, Payoff: 1}, false},
+		{"kelly no payoff", Config{Method: "kelly", WinRate: 0.5}, false},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.cfg); (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.name, err)
+		}
+	}
+}
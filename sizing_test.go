@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/oanda-bot/sizing"
+)
+
+func TestOrderUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      sizing.Config
+		quoteErr error
+		want     int
+	}{
+		{"fixed", sizing.Config{}, nil, 1000},
+		// 換算レートを使わないので取得に失敗しても影響しない
+		{"fixed quote error", sizing.Config{}, errors.New("no price"), 1000},
+		// 1,000,000 * 0.01 / (100 * 0.01 * 150) = 66.6
+		{"risk", sizing.Config{Method: "risk", Risk: 0.01}, nil, 66},
+		{"risk quote error", sizing.Config{Method: "risk", Risk: 0.01}, errors.New("no price"), 0},
+		{"fraction quote error", sizing.Config{Method: "fraction", Fraction: 1}, errors.New("no price"), 0},
+	}
+	for _, tt := range tests {
+		sizer, err := sizing.New(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &bot{
+			acct:  &account{},
+			prm:   &Param{Inst: "EUR_USD", Units: 1000, LossRate: -0.01},
+			data:  &fakeData{quoteErr: tt.quoteErr},
+			sizer: sizer,
+		}
+		snap := &Snapshot{Account: oanda.AccountData{Balance: 1000000}}
+		if got := b.orderUnits(context.Background(), snap, 100); got != tt.want {
+			t.Errorf("%v: units = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * 直近Span本の高値・安値をブレイクしたら取引するロジック。
+ * botのframeとbacktestの両方から呼ぶので、APIや口座には依存させないこと。
+ */
+
+package strategy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/zenryokukun/surfergopher/minmax"
+)
+
+func init() {
+	Register("breakout", NewBreakout)
+}
+
+// Donchian channel風のブレイクアウト。
+// 現在価格が直近Span本の高値を超えたら買い、安値を割ったら売り。
+// 逆向きポジを持っていて、かつ値幅(1-安値/高値)がThreshを超えていれば決済する。
+// 利確・損切は取得価格からProfRate,LossRateの率。
+type Breakout struct {
+	prm *Param
+	opt breakoutOptions
+}
+
+// breakoutのParam.Options
+type breakoutOptions struct {
+	// ブレイクの判定に使う価格。"M"(省略時):mid "BA":買いはask、売りはbidの高値・安値と現在価格で判定する。
+	// 値幅はいずれもmidで求める
+	Price string
+}
+
+func NewBreakout(prm *Param) (Strategy, error) {
+	if prm.Span <= 0 {
+		return nil, fmt.Errorf("strategy: breakout: Span must be positive:%v", prm.Span)
+	}
+	b := &Breakout{prm: prm}
+	if len(prm.Options) > 0 {
+		if err := json.Unmarshal(prm.Options, &b.opt); err != nil {
+			return nil, fmt.Errorf("strategy: breakout: Options:%w", err)
+		}
+	}
+	if p := b.opt.Price; p != "" && p != "M" && p != "BA" {
+		return nil, fmt.Errorf("strategy: breakout: Price must be \"M\" or \"BA\":%v", p)
+	}
+	return b, nil
+}
+
+func (b *Breakout) Span() int {
+	return b.prm.Span
+}
+
+func (b *Breakout) Decide(in *Input) Decision {
+	// 最大値と最小値をセット。AddWrapしてるが今のところ使う予定なし
+	highs, lows := in.Sticks.Extract("H"), in.Sticks.Extract("L")
+	inf := minmax.NewInf(highs, lows).AddWrap(in.Current)
+
+	d := Decision{}
+	// 値幅
+	vel := 1 - (inf.Minv / inf.Maxv)
+	// 新規取引判定 "BUY","SELL",""
+	if b.opt.Price == "BA" && hasBidAsk(in) {
+		d.Open, d.Reason = breakThroughBA(in)
+	} else {
+		d.Open = BreakThrough(in.Current, inf)
+		switch d.Open {
+		case "BUY":
+			d.Reason = fmt.Sprintf("breakout: %.8g > high %.8g", in.Current, inf.Maxv)
+		case "SELL":
+			d.Reason = fmt.Sprintf("breakout: %.8g < low %.8g", in.Current, inf.Minv)
+		}
+	}
+	if len(d.Open) > 0 && len(in.Side) > 0 && in.Side != d.Open && vel > b.prm.Thresh {
+		d.Close = true
+		d.Reason += fmt.Sprintf(", range %.4f > thresh %v", vel, b.prm.Thresh)
+	}
+	return d
+}
+
+// askが直近のaskの高値を超えたら買い、bidが直近のbidの安値を割ったら売り
+func breakThroughBA(in *Input) (string, string) {
+	ask, bid := in.Sticks.Side("A"), in.Sticks.Side("B")
+	askHigh := minmax.NewInf(ask.Extract("H"), ask.Extract("L")).Maxv
+	bidLow := minmax.NewInf(bid.Extract("H"), bid.Extract("L")).Minv
+	if in.Ask > askHigh {
+		return "BUY", fmt.Sprintf("breakout: ask %.8g > ask high %.8g", in.Ask, askHigh)
+	}
+	if in.Bid < bidLow {
+		return "SELL", fmt.Sprintf("breakout: bid %.8g < bid low %.8g", in.Bid, bidLow)
+	}
+	return "", ""
+}
+
+// 現在のbid,askと、全ての足のbid,askがあるか。無ければmidで判定する
+func hasBidAsk(in *Input) bool {
+	if in.Bid <= 0 || in.Ask <= 0 || len(in.Sticks) == 0 {
+		return false
+	}
+	for _, s := range in.Sticks {
+		if s.Bid == nil || s.Ask == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Breakout) Exits(p float64, side string) (float64, float64) {
+	return ExitPrices(b.prm, p, side)
+}
+
+// 売買判定ロジック
+func BreakThrough(v float64, inf *minmax.Inf) string {
+	if v > inf.Maxv {
+		return "BUY"
+	}
+	if v < inf.Minv {
+		return "SELL"
+	}
+	return ""
+}
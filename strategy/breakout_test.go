@@ -0,0 +1,189 @@
+package strategy
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+	"github.com/zenryokukun/surfergopher/minmax"
+)
+
+// 高値hs,安値lsの確定足
+func sticks(hs, ls []float64) oanda.CandleSticks {
+	cs := oanda.CandleSticks{}
+	for i := range hs {
+		cs = append(cs, oanda.CandleStick{Complete: true, Prices: &oanda.Hloc{H: hs[i], L: ls[i], O: ls[i], C: hs[i]}})
+	}
+	return cs
+}
+
+func breakout(t *testing.T, prm *Param) Strategy {
+	t.Helper()
+	s, err := New(prm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBreakoutDecide(t *testing.T) {
+	// 高値151、安値149。値幅は1-149/151=0.0132
+	cs := sticks([]float64{150, 151, 150.5}, []float64{149.5, 150, 149})
+	tests := []struct {
+		name    string
+		current float64
+		side    string
+		thresh  float64
+		open    string
+		close   bool
+	}{
+		{"range", 150, "", 0.01, "", false},
+		{"break up", 151.1, "", 0.01, "BUY", false},
+		{"break down", 148.9, "", 0.01, "SELL", false},
+		// 高値ちょうどはブレイクではない
+		{"touch high", 151, "", 0.01, "", false},
+		{"same side", 151.1, "BUY", 0.01, "BUY", false},
+		{"reverse", 148.9, "BUY", 0.01, "SELL", true},
+		{"reverse short", 151.1, "SELL", 0.01, "BUY", true},
+		// 値幅が閾値以下なら逆向きでも決済しない
+		{"reverse narrow", 148.9, "BUY", 0.02, "SELL", false},
+		{"hold in range", 150, "SELL", 0.01, "", false},
+	}
+	for _, tt := range tests {
+		s := breakout(t, &Param{Span: 3, Thresh: tt.thresh})
+		d := s.Decide(&Input{Sticks: cs, Current: tt.current, Side: tt.side})
+		if d.Open != tt.open || d.Close != tt.close {
+			t.Errorf("%v: open,close = %q,%v, want %q,%v", tt.name, d.Open, d.Close, tt.open, tt.close)
+		}
+		if (len(d.Open) > 0) != (len(d.Reason) > 0) {
+			t.Errorf("%v: reason = %q", tt.name, d.Reason)
+		}
+	}
+}
+
+// sticksにmidからhalfずつずらしたbid,askを付ける
+func withBidAsk(cs oanda.CandleSticks, half float64) oanda.CandleSticks {
+	out := oanda.CandleSticks{}
+	for _, c := range cs {
+		p := *c.Prices
+		c.Bid = &oanda.Hloc{H: p.H - half, L: p.L - half, O: p.O - half, C: p.C - half}
+		c.Ask = &oanda.Hloc{H: p.H + half, L: p.L + half, O: p.O + half, C: p.C + half}
+		out = append(out, c)
+	}
+	return out
+}
+
+func TestBreakoutBidAsk(t *testing.T) {
+	// mid 高値151、安値149。spread 0.2。askの高値151.1、bidの安値148.9
+	mid := sticks([]float64{150, 151, 150.5}, []float64{149.5, 150, 149})
+	ba := withBidAsk(mid, 0.1)
+	tests := []struct {
+		name    string
+		options string
+		cs      oanda.CandleSticks
+		current float64
+		half    float64
+		side    string
+		open    string
+		close   bool
+	}{
+		// midでは151.05は高値151を超えている
+		{"mid break up", "", ba, 151.05, 0.1, "", "BUY", false},
+		{"mid option", `{"Price":"M"}`, ba, 151.05, 0.1, "", "BUY", false},
+		// askの高値はmidより0.1高い。現在のspreadが狭いとaskは超えない
+		{"ask below ask high", `{"Price":"BA"}`, ba, 151.05, 0.01, "", "", false},
+		{"ask break up", `{"Price":"BA"}`, ba, 151.05, 0.1, "", "BUY", false},
+		{"bid above bid low", `{"Price":"BA"}`, ba, 148.95, 0.01, "", "", false},
+		{"bid break down", `{"Price":"BA"}`, ba, 148.95, 0.1, "", "SELL", false},
+		// 値幅はmidで求める(1-149/151=0.0132)
+		{"reverse", `{"Price":"BA"}`, ba, 148.95, 0.1, "BUY", "SELL", true},
+		// bid,askの無い足はmidで判定
+		{"no bid ask sticks", `{"Price":"BA"}`, mid, 151.05, 0.01, "", "BUY", false},
+		{"no current bid ask", `{"Price":"BA"}`, ba, 151.05, 0, "", "BUY", false},
+	}
+	for _, tt := range tests {
+		s := breakout(t, &Param{Span: 3, Thresh: 0.01, Options: []byte(tt.options)})
+		in := &Input{Sticks: tt.cs, Current: tt.current, Side: tt.side}
+		if tt.half > 0 {
+			in.Bid, in.Ask = tt.current-tt.half, tt.current+tt.half
+		}
+		d := s.Decide(in)
+		if d.Open != tt.open || d.Close != tt.close {
+			t.Errorf("%v: open,close = %q,%v, want %q,%v (%v)", tt.name, d.Open, d.Close, tt.open, tt.close, d.Reason)
+		}
+	}
+}
+
+func TestNewBreakoutOptions(t *testing.T) {
+	for _, o := range []string{`{"Price":"B"}`, `{"Price":1}`, `[`} {
+		if _, err := New(&Param{Span: 3, Options: []byte(o)}); err == nil {
+			t.Errorf("%v: no error", o)
+		}
+	}
+}
+
+// 戦略の切り出し前(strategy.Decide)の判定をそのまま残したもの
+func legacyDecide(prm *Param, sticks oanda.CandleSticks, current float64, side string) (string, bool) {
+	highs, lows := sticks.Extract("H"), sticks.Extract("L")
+	inf := minmax.NewInf(highs, lows).AddWrap(current)
+	vel := 1 - (inf.Minv / inf.Maxv)
+	dec := legacyBreakThrough(current, inf)
+	return dec, len(dec) > 0 && len(side) > 0 && side != dec && vel > prm.Thresh
+}
+
+func legacyBreakThrough(v float64, inf *minmax.Inf) string {
+	if v > inf.Maxv {
+		return "BUY"
+	}
+	if v < inf.Minv {
+		return "SELL"
+	}
+	return ""
+}
+
+// ランダムウォークの足で、breakoutが切り出し前と同じ判定をするか
+func TestBreakoutMatchesLegacy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	cs := oanda.CandleSticks{}
+	p := 150.0
+	for i := 0; i < 2000; i++ {
+		o := p
+		p += r.NormFloat64() * 0.05
+		h, l := math.Max(o, p)+r.Float64()*0.03, math.Min(o, p)-r.Float64()*0.03
+		cs = append(cs, oanda.CandleStick{Complete: true, Time: time.Unix(int64(i*300), 0), Prices: &oanda.Hloc{O: o, H: h, L: l, C: p}})
+	}
+	n, opens := 0, 0
+	for _, span := range []int{5, 20} {
+		for _, thresh := range []float64{0, 0.0005, 0.002} {
+			prm := &Param{Span: span, Thresh: thresh}
+			s := breakout(t, prm)
+			for i := span; i < len(cs); i++ {
+				for _, side := range []string{"", "BUY", "SELL"} {
+					sticks, current := cs[i-span:i], cs[i].Prices.C
+					open, close := legacyDecide(prm, sticks, current, side)
+					d := s.Decide(&Input{Sticks: sticks, Current: current, Side: side})
+					if d.Open != open || d.Close != close {
+						t.Fatalf("span %v thresh %v candle %v side %q: %q,%v, want %q,%v", span, thresh, i, side, d.Open, d.Close, open, close)
+					}
+					n++
+					if len(open) > 0 {
+						opens++
+					}
+				}
+			}
+		}
+	}
+	// 判定が偏っていないこと
+	if opens == 0 || opens == n {
+		t.Errorf("opens %v of %v", opens, n)
+	}
+}
+
+func TestBreakoutExits(t *testing.T) {
+	s := breakout(t, &Param{Span: 1, ProfRate: 0.01, LossRate: -0.005})
+	if tp, sl := s.Exits(150, "BUY"); !near(tp, 151.5) || !near(sl, 149.25) {
+		t.Errorf("BUY: %v,%v", tp, sl)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * 戦略によらない決済まわりの共通処理
+ */
+
+package strategy
+
+// 保有ポジと逆サイドを返す。決済の向きを指定するために使う
+func ClosingSide(side string) string {
+	if side == "BUY" {
+		return "SELL"
+	}
+	if side == "SELL" {
+		return "BUY"
+	}
+	return ""
+}
+
+// p:取得価格 side:"BUY"or"SELL"のtradeの、利確価格と損切価格を返す。
+// LossRateは負の値。ProfRate,LossRateが0の場合は0を返す（注文を付けない）。
+// 価格は丸めないので、注文時にInstrument.RoundPrice等で丸めること。
+func ExitPrices(prm *Param, p float64, side string) (float64, float64) {
+	sign := 1.0
+	if side == "SELL" {
+		sign = -1.0
+	}
+	tp, sl := 0.0, 0.0
+	if prm.ProfRate != 0 {
+		tp = p * (1 + prm.ProfRate*sign)
+	}
+	if prm.LossRate != 0 {
+		sl = p * (1 + prm.LossRate*sign)
+	}
+	return tp, sl
+}
+
+// 含み益がprm.Breakevenに達していれば建値(取得価格p)を、達していなければ0を返す。
+func BreakevenPrice(prm *Param, p, current float64, side string, round func(float64) float64) float64 {
+	if prm.Breakeven <= 0 {
+		return 0
+	}
+	gain := (current - p) / p
+	if side == "SELL" {
+		gain = -gain
+	}
+	if gain < prm.Breakeven {
+		return 0
+	}
+	return round(p)
+}
+
+// 損切価格aがbより有利か。longなら高い方、shortなら低い方が有利。
+func Tighter(side string, a, b float64) bool {
+	if side == "SELL" {
+		return a < b-1e-9
+	}
+	return a > b+1e-9
+}
@@ -0,0 +1,75 @@
+package strategy
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestClosingSide(t *testing.T) {
+	for side, want := range map[string]string{"BUY": "SELL", "SELL": "BUY", "": ""} {
+		if got := ClosingSide(side); got != want {
+			t.Errorf("ClosingSide(%q) = %q", side, got)
+		}
+	}
+}
+
+func TestExitPrices(t *testing.T) {
+	prm := &Param{ProfRate: 0.01, LossRate: -0.005}
+	if tp, sl := ExitPrices(prm, 150, "BUY"); !near(tp, 151.5) || !near(sl, 149.25) {
+		t.Errorf("BUY: %v,%v", tp, sl)
+	}
+	if tp, sl := ExitPrices(prm, 150, "SELL"); !near(tp, 148.5) || !near(sl, 150.75) {
+		t.Errorf("SELL: %v,%v", tp, sl)
+	}
+	// 0なら注文を付けない
+	if tp, sl := ExitPrices(&Param{ProfRate: 0.01}, 150, "BUY"); !near(tp, 151.5) || sl != 0 {
+		t.Errorf("no loss: %v,%v", tp, sl)
+	}
+}
+
+func TestBreakevenPrice(t *testing.T) {
+	round := func(p float64) float64 { return math.Round(p*1000) / 1000 }
+	prm := &Param{Breakeven: 0.01}
+	tests := []struct {
+		p, current float64
+		side       string
+		want       float64
+	}{
+		{150.0004, 151.6, "BUY", 150},
+		{150, 151.4, "BUY", 0},
+		{150, 148.4, "SELL", 150},
+		{150, 151.6, "SELL", 0},
+	}
+	for _, tt := range tests {
+		if got := BreakevenPrice(prm, tt.p, tt.current, tt.side, round); got != tt.want {
+			t.Errorf("%v %v %v = %v, want %v", tt.p, tt.current, tt.side, got, tt.want)
+		}
+	}
+	if got := BreakevenPrice(&Param{}, 150, 200, "BUY", round); got != 0 {
+		t.Errorf("disabled = %v", got)
+	}
+}
+
+func TestTighter(t *testing.T) {
+	tests := []struct {
+		side string
+		a, b float64
+		want bool
+	}{
+		{"BUY", 150, 149, true},
+		{"BUY", 149, 150, false},
+		{"BUY", 150, 150, false},
+		{"SELL", 149, 150, true},
+		{"SELL", 150, 149, false},
+		{"SELL", 150, 150, false},
+	}
+	for _, tt := range tests {
+		if got := Tighter(tt.side, tt.a, tt.b); got != tt.want {
+			t.Errorf("Tighter(%v,%v,%v) = %v", tt.side, tt.a, tt.b, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * 売買ロジックのパラメタ(param.json)
+ */
+
+package strategy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// ロジックに使うパラメタ。コンパイル面倒だからファイルから読み取る。
+// 取引量・リスク管理などbot側の設定は、同じparam.jsonに書いてLoadParamsAsで読み込む。
+type Param struct {
+	// 戦略の名前。空なら"breakout"
+	Strategy string
+	// 戦略固有のパラメタ。中身は戦略毎に決める
+	Options  json.RawMessage
+	Inst     string            // Instrument: "USD_JPY","EUR_USD"等
+	Gran     oanda.Granularity // granularity："M5","H4",等。足の長さもここから求める
+	Span     int               // Gran何個分で予測するか
+	Thresh   float64           // レンジ判定の閾値
+	ProfRate float64           // 利確ライン。取得価格からの率。oanda側に利確注文として置く
+	LossRate float64           // 損切ライン。負の値。oanda側に損切注文として置く
+	Spread   float64           // 許容スプレッド
+	Units    int               // 取引量。通貨ペアの最小取引量・最大注文量の範囲に収めて注文する
+	// 含み益が取得価格からこの率に達したら損切を建値に移動する。0なら移動しない
+	Breakeven float64
+	// 稼働時の残高。0ならINITIAL_BALANCE。口座毎に違う場合に指定する
+	InitialBalance float64
+}
+
+// ファイルからパラメタを読み取ってParam structを返す。
+// Instrumentsに複数書いてある場合は最初の通貨ペアのもの。
+func LoadParam(fpath string) (*Param, error) {
+	ps, err := LoadParams(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return ps[0], nil
+}
+
+// ファイルから通貨ペア毎のパラメタを読み取る。Instrumentsが無ければトップレベルの1つだけ返す。
+// 複数の通貨ペアを動かす場合はInstrumentsに書く。
+// Instrumentsの各要素はトップレベルの値を引き継ぎ、書いた項目だけ上書きする。
+//
+//	{"Strategy":"breakout","Spread":0.01,"Instruments":[{"Inst":"USD_JPY","Gran":"M5"},{"Inst":"EUR_USD","Gran":"M15"}]}
+func LoadParams(fpath string) ([]*Param, error) {
+	return LoadParamsAs(fpath, func(p *Param) *Param { return p })
+}
+
+// LoadParamsと同じ形式のファイルを、Paramに戦略以外の設定を加えたTとして読み込む。paramはTのParamを返す。
+// Instrumentsの各要素はトップレベルの値を引き継ぐ。structの項目は、書いた項目だけ上書きする。
+//
+//	type botParam struct {
+//		strategy.Param
+//		Risk risk.Limits
+//	}
+func LoadParamsAs[T any](fpath string, param func(*T) *Param) ([]*T, error) {
+	b, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	top := new(T)
+	if err := json.Unmarshal(b, top); err != nil {
+		return nil, err
+	}
+	f := struct{ Instruments []json.RawMessage }{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Instruments) == 0 {
+		if err := param(top).Gran.Validate(); err != nil {
+			return nil, err
+		}
+		return []*T{top}, nil
+	}
+	ps := []*T{}
+	seen := map[string]bool{}
+	for _, raw := range f.Instruments {
+		// コピーだとOptions等のsliceを共有して上書きしてしまうので、トップレベルから読み直す
+		p := new(T)
+		if err := json.Unmarshal(b, p); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, p); err != nil {
+			return nil, err
+		}
+		prm := param(p)
+		if len(prm.Inst) == 0 {
+			return nil, fmt.Errorf("strategy: Inst is empty:%s", raw)
+		}
+		if seen[prm.Inst] {
+			return nil, fmt.Errorf("strategy: duplicate Inst:%v", prm.Inst)
+		}
+		seen[prm.Inst] = true
+		if err := prm.Gran.Validate(); err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// psからinstのパラメタを返す。無ければnil
+func Find(ps []*Param, inst string) *Param {
+	for _, p := range ps {
+		if p.Inst == inst {
+			return p
+		}
+	}
+	return nil
+}
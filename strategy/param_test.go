@@ -0,0 +1,110 @@
+package strategy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+func TestLoadParam(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		fpath := filepath.Join(dir, name)
+		if err := os.WriteFile(fpath, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fpath
+	}
+
+	p, err := LoadParam(write("ok.json", `{"Inst":"USD_JPY","Gran":"M5","Span":12,"Thresh":0.001,"Units":1000}`))
+	if err != nil || p.Inst != "USD_JPY" || p.Gran != "M5" || p.Span != 12 || p.Units != 1000 {
+		t.Errorf("ok: %+v,%v", p, err)
+	}
+
+	if _, err := LoadParam(filepath.Join(dir, "none.json")); !os.IsNotExist(err) {
+		t.Errorf("missing: %v", err)
+	}
+	if _, err := LoadParam(write("broken.json", `{"Inst":`)); err == nil {
+		t.Error("broken: want error")
+	}
+	var pe *oanda.ParamError
+	if _, err := LoadParam(write("gran.json", `{"Inst":"USD_JPY","Gran":"M3"}`)); !errors.As(err, &pe) {
+		t.Errorf("bad granularity: %v", err)
+	}
+}
+
+func TestLoadParams(t *testing.T) {
+	dir := t.TempDir()
+	write := func(body string) string {
+		fpath := filepath.Join(dir, "param.json")
+		if err := os.WriteFile(fpath, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fpath
+	}
+
+	// Instrumentsはトップレベルを引き継いで上書きする
+	ps, err := LoadParams(write(`{"Gran":"M5","Span":12,"Units":1000,"Instruments":[{"Inst":"USD_JPY"},{"Inst":"EUR_USD","Gran":"M15","Units":10}]}`))
+	if err != nil || len(ps) != 2 {
+		t.Fatalf("%v,%v", ps, err)
+	}
+	if p := ps[0]; p.Inst != "USD_JPY" || p.Gran != "M5" || p.Span != 12 || p.Units != 1000 {
+		t.Errorf("USD_JPY = %+v", p)
+	}
+	if p := ps[1]; p.Inst != "EUR_USD" || p.Gran != "M15" || p.Span != 12 || p.Units != 10 {
+		t.Errorf("EUR_USD = %+v", p)
+	}
+	if Find(ps, "EUR_USD") != ps[1] || Find(ps, "GBP_USD") != nil {
+		t.Error("Find")
+	}
+	// LoadParamは最初の通貨ペア
+	if p, err := LoadParam(filepath.Join(dir, "param.json")); err != nil || p.Inst != "USD_JPY" {
+		t.Errorf("LoadParam = %+v,%v", p, err)
+	}
+
+	// Instrumentsが無ければトップレベルのみ
+	if ps, err := LoadParams(write(`{"Inst":"USD_JPY","Gran":"H1"}`)); err != nil || len(ps) != 1 || ps[0].Inst != "USD_JPY" {
+		t.Errorf("single = %v,%v", ps, err)
+	}
+
+	for _, body := range []string{
+		`{"Gran":"M5","Instruments":[{"Gran":"M5"}]}`,
+		`{"Gran":"M5","Instruments":[{"Inst":"USD_JPY"},{"Inst":"USD_JPY"}]}`,
+		`{"Gran":"M5","Instruments":[{"Inst":"USD_JPY","Gran":"M7"}]}`,
+		`{"Gran":"M5","Instruments":[{"Inst":1}]}`,
+	} {
+		if _, err := LoadParams(write(body)); err == nil {
+			t.Errorf("%v: want error", body)
+		}
+	}
+}
+
+// Paramに戦略以外の設定を加えて読み込む
+func TestLoadParamsAs(t *testing.T) {
+	type limits struct{ MaxUnits, MaxTotalUnits int }
+	type botParam struct {
+		Param
+		Risk limits
+	}
+	fpath := filepath.Join(t.TempDir(), "param.json")
+	body := `{"Gran":"M5","Options":{"Price":"M"},"Risk":{"MaxUnits":100,"MaxTotalUnits":300},
+		"Instruments":[{"Inst":"USD_JPY","Options":{"Price":"BA"},"Risk":{"MaxUnits":200}},{"Inst":"EUR_USD"}]}`
+	if err := os.WriteFile(fpath, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ps, err := LoadParamsAs(fpath, func(p *botParam) *Param { return &p.Param })
+	if err != nil || len(ps) != 2 {
+		t.Fatalf("%v,%v", ps, err)
+	}
+	// structは書いた項目だけ上書き
+	if p := ps[0]; p.Inst != "USD_JPY" || p.Gran != "M5" || p.Risk != (limits{200, 300}) || string(p.Options) != `{"Price":"BA"}` {
+		t.Errorf("USD_JPY = %+v %s", p, p.Options)
+	}
+	// 前の通貨ペアのOptionsに上書きされない
+	if p := ps[1]; p.Inst != "EUR_USD" || p.Risk != (limits{100, 300}) || string(p.Options) != `{"Price":"M"}` {
+		t.Errorf("EUR_USD = %+v %s", p, p.Options)
+	}
+}
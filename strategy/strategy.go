@@ -0,0 +1,85 @@
+/*
+ * 売買判定の戦略。param.jsonのStrategyの名前で選ぶ。
+ * 戦略は判定だけを行い、注文やAPIの呼び出しはbot(frame)やbacktestが行う。
+ * 新しい戦略はRegisterで登録する。
+ */
+
+package strategy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
+)
+
+// Param.Strategyが空の場合の戦略
+const DefaultStrategy = "breakout"
+
+type (
+	// 1フレーム分の判定の入力
+	Input struct {
+		// 判定に使う確定足。古い順にSpan本。現在価格を含む直近の確定足は含まない。
+		// PricesはmidでBid,Askも持つ(backtestではspreadから求めたもの)
+		Sticks  oanda.CandleSticks
+		Current float64 // 現在価格(mid)
+		// 現在のbid,ask。分からなければ0
+		Bid, Ask float64
+		// 保有ポジ。向きは"BUY","SELL",""。Unitsはshortなら負、Priceは平均取得価格
+		Side  string
+		Units int
+		Price float64
+		// 口座の残高と含み損益
+		Balance      float64
+		UnrealizedPL float64
+	}
+
+	// 1フレーム分の判定結果
+	Decision struct {
+		Open   string // 新規取引の向き。"BUY","SELL",""
+		Close  bool   // 保有ポジを閉じるか
+		Reason string // 判定理由。ログ用
+	}
+
+	Strategy interface {
+		// 判定に使う確定足の本数
+		Span() int
+		// 1フレーム分の判定
+		Decide(in *Input) Decision
+		// 取得価格pのtradeの利確価格と損切価格。0なら注文を付けない。丸めは呼び出し側で行う
+		Exits(p float64, side string) (float64, float64)
+	}
+
+	// Paramから戦略を作る関数
+	Factory func(prm *Param) (Strategy, error)
+)
+
+var registry = map[string]Factory{}
+
+// nameで戦略を登録する。同じ名前は上書きする。
+func Register(name string, f Factory) {
+	registry[name] = f
+}
+
+// prm.Strategyの名前の戦略を作る。空ならDefaultStrategy。
+func New(prm *Param) (Strategy, error) {
+	name := prm.Strategy
+	if len(name) == 0 {
+		name = DefaultStrategy
+	}
+	f, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("strategy: unknown strategy:%v (available:%v)", name, Names())
+	}
+	return f(prm)
+}
+
+// 登録済みの戦略の名前
+func Names() []string {
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
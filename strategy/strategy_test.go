@@ -0,0 +1,36 @@
+package strategy
+
+import (
+	"strings"
+	"testing"
+)
+
+type fixed struct{ span int }
+
+func (f *fixed) Span() int                                       { return f.span }
+func (f *fixed) Decide(in *Input) Decision                       { return Decision{Open: "BUY"} }
+func (f *fixed) Exits(p float64, side string) (float64, float64) { return 0, 0 }
+
+func TestNew(t *testing.T) {
+	// 空ならbreakout
+	if s, err := New(&Param{Span: 3}); err != nil || s.Span() != 3 {
+		t.Errorf("default: %v,%v", s, err)
+	} else if _, ok := s.(*Breakout); !ok {
+		t.Errorf("default = %T", s)
+	}
+	if _, err := New(&Param{Strategy: "breakout"}); err == nil || !strings.Contains(err.Error(), "Span") {
+		t.Errorf("zero span: %v", err)
+	}
+	if _, err := New(&Param{Strategy: "nope"}); err == nil || !strings.Contains(err.Error(), "unknown strategy:nope") {
+		t.Errorf("unknown: %v", err)
+	}
+
+	Register("fixed", func(prm *Param) (Strategy, error) { return &fixed{span: prm.Span}, nil })
+	defer delete(registry, "fixed")
+	if s, err := New(&Param{Strategy: "fixed", Span: 7}); err != nil || s.Span() != 7 {
+		t.Errorf("fixed: %v,%v", s, err)
+	}
+	if names := strings.Join(Names(), ","); names != "breakout,fixed" {
+		t.Errorf("names = %v", names)
+	}
+}
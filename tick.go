@@ -1,16 +1,51 @@
 package main
 
 import (
+	"context"
 	"time"
+
+	"github.com/zenryokukun/oanda-bot/oanda"
 )
 
-// itv秒分スリープする関数。itv -> 秒。5分なら300。
-func tick(itv int64) {
-	micro := itv * 1000000              // seconds -> microseconds
-	now := time.Now().UnixMicro()       // 現在時刻をmicro秒で。
-	rem := now % micro                  // 前回時刻からの経過秒。itv:300,12:06 -> 1分
-	prev := now - rem                   // 前回時刻
-	next := prev + micro                // 次回時刻
-	diff := time.Duration(next - now)   // 現在時刻から次回時刻までのmicro秒数。
-	time.Sleep(diff * time.Microsecond) // 次回時刻まで待つ。
+// 時刻の取得と次フレームまでの待機。
+// 通常はwallClock。simulatorで動かすときはsim.RemoteClockに差し替える。
+type Clock interface {
+	Now() time.Time
+	Tick(ctx context.Context, g oanda.Granularity) bool
+}
+
+// 実時間のClock
+type wallClock struct{}
+
+var clock Clock = wallClock{}
+
+// 足の区切り。oandaのcandlesのdefaultに合わせる
+var candleAlign = oanda.DefaultAlignment()
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Tick(ctx context.Context, g oanda.Granularity) bool {
+	return tick(ctx, g)
+}
+
+// 次のgの足が確定する時刻までスリープする関数。M5なら12:06 -> 12:10。
+// H4等もoandaの足の区切り(17時NY基準)に合わせる。
+// ctxがキャンセルされた場合はその時点でfalseを返す。
+func tick(ctx context.Context, g oanda.Granularity) bool {
+	next := g.Next(time.Now(), candleAlign) // 次回時刻
+	return sleep(ctx, time.Until(next))     // 次回時刻まで待つ。
+}
+
+// dだけスリープする。ctxがキャンセルされた場合はその時点でfalseを返す。
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
 }